@@ -0,0 +1,73 @@
+package usb
+
+// A Backend is what a Context uses to reach devices. libusb is the
+// default (see NewLibusbBackend); anything else implementing these
+// interfaces can be passed to NewContext, and everything built on
+// Context, DeviceHandle and EndpointHandle works the same on top of
+// it.
+type Backend interface {
+	// List the devices currently attached
+	GetDeviceList() ([]BackendDevice, *UsbError)
+	SetDebug(level int)
+	Close()
+}
+
+// A device as a Backend sees it. It doesn't have to be open.
+type BackendDevice interface {
+	GetBusNumber() int
+	GetAddress() int
+	GetSpeed() Speed
+
+	GetDeviceDescriptor() (DeviceDescriptor, *UsbError)
+	GetConfigDescriptor(config_index int) (ConfigDescriptor, *UsbError)
+	// The descriptor of the configuration currently selected
+	GetActiveConfigDescriptor() (ConfigDescriptor, *UsbError)
+
+	Open() (BackendHandle, *UsbError)
+}
+
+// An open device. Interfaces and endpoints are numbered as in the
+// descriptors.
+type BackendHandle interface {
+	Close()
+
+	GetConfiguration() (int, *UsbError)
+	SetConfiguration(config int) *UsbError
+
+	ClaimInterface(iface_no int) *UsbError
+	ReleaseInterface(iface_no int) *UsbError
+	SetInterfaceAltSetting(iface_no, alt int) *UsbError
+	KernelDriverActive(iface_no int) (bool, *UsbError)
+	AttachKernelDriver(iface_no int) *UsbError
+	DetachKernelDriver(iface_no int) *UsbError
+
+	ClearHalt(endpoint byte) *UsbError
+	Reset() *UsbError
+
+	// Start a transfer. Once a transfer has been accepted, the
+	// backend must call t.Complete exactly once, from any goroutine,
+	// however it ends: done, failed, timed out or cancelled.
+	SubmitTransfer(t *Transfer) *UsbError
+	// Ask for a submitted transfer to be cancelled. It still ends
+	// with t.Complete, with UsbErrorCancelled unless it finished
+	// first.
+	CancelTransfer(t *Transfer) *UsbError
+}
+
+// A Backend that can take over a device node opened elsewhere, for
+// Context.OpenFromFD. The device it returns is the open one; the
+// descriptor must be left open for the caller to close.
+type FDOpener interface {
+	OpenFD(fd uintptr) (BackendDevice, BackendHandle, *UsbError)
+}
+
+// A Backend that takes options, for Context.SetOption
+type OptionSetter interface {
+	SetOption(option, value int) *UsbError
+}
+
+// A Backend that can say what it can do, for Context.HasCapability
+type CapabilityReporter interface {
+	// Whether the backend has a capability, one of the CAP_* constants
+	HasCapability(capability int) bool
+}
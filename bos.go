@@ -0,0 +1,128 @@
+package usb
+
+// The Binary device Object Store, a list of device capabilities
+// hung off a single descriptor.
+
+type CapabilityType byte
+
+const (
+	DEVCAP_WIRELESS_USB      CapabilityType = 0x01
+	DEVCAP_USB_2_0_EXTENSION CapabilityType = 0x02
+	DEVCAP_SUPERSPEED_USB    CapabilityType = 0x03
+	DEVCAP_CONTAINER_ID      CapabilityType = 0x04
+	DEVCAP_PLATFORM          CapabilityType = 0x05
+)
+
+type (
+	BOSDescriptor struct {
+		BLength         byte
+		BDescriptorType DescriptorType
+		WTotalLength    uint16
+		Capabilities    []DeviceCapability
+	}
+
+	// Data is everything after bDevCapabilityType
+	DeviceCapability struct {
+		BLength            byte
+		BDescriptorType    DescriptorType
+		BDevCapabilityType CapabilityType
+		Data               []byte
+	}
+)
+
+func ParseBOSDescriptor(buf []byte) (BOSDescriptor, *UsbError) {
+	if len(buf) < 5 || buf[0] < 5 || DescriptorType(buf[1]) != DT_BOS {
+		return BOSDescriptor{}, UsbErrorBadDescriptor
+	}
+	total := int(le16(buf[2:]))
+	if total < int(buf[0]) || total > len(buf) {
+		return BOSDescriptor{}, UsbErrorBadDescriptor
+	}
+	ret := BOSDescriptor{
+		BLength:         buf[0],
+		BDescriptorType: DT_BOS,
+		WTotalLength:    uint16(total),
+		Capabilities:    make([]DeviceCapability, 0, int(buf[4])),
+	}
+	rest := buf[buf[0]:total]
+	for len(rest) > 0 {
+		if len(rest) < 3 || rest[0] < 3 || int(rest[0]) > len(rest) {
+			return BOSDescriptor{}, UsbErrorBadDescriptor
+		}
+		desc := rest[:rest[0]]
+		rest = rest[rest[0]:]
+		if DescriptorType(desc[1]) != DT_DEVICE_CAPABILITY {
+			continue
+		}
+		ret.Capabilities = append(ret.Capabilities, DeviceCapability{
+			BLength:            desc[0],
+			BDescriptorType:    DT_DEVICE_CAPABILITY,
+			BDevCapabilityType: CapabilityType(desc[2]),
+			Data:               append([]byte(nil), desc[3:]...),
+		})
+	}
+	return ret, nil
+}
+
+// Fetch and parse the BOS descriptor. Devices older than USB 2.01
+// usually don't have one and stall the request (UsbErrorPipe).
+func (h *DeviceHandle) GetBOSDescriptor() (BOSDescriptor, *UsbError) {
+	buf, err := h.getRawConfig(DT_BOS, 0)
+	if err != nil {
+		return BOSDescriptor{}, err
+	}
+	return ParseBOSDescriptor(buf)
+}
+
+// Build a platform capability: a bReserved byte, the 16 byte UUID in
+// wire order, then the platform-specific data.
+func NewPlatformCapability(uuid [16]byte, data []byte) DeviceCapability {
+	d := make([]byte, 0, 17+len(data))
+	d = append(d, 0)
+	d = append(d, uuid[:]...)
+	d = append(d, data...)
+	return DeviceCapability{
+		BLength:            byte(3 + len(d)),
+		BDescriptorType:    DT_DEVICE_CAPABILITY,
+		BDevCapabilityType: DEVCAP_PLATFORM,
+		Data:               d,
+	}
+}
+
+// If this is a platform capability, return its UUID (in wire order)
+// and the platform-specific data that follows it.
+func (c DeviceCapability) Platform() (uuid [16]byte, data []byte, ok bool) {
+	if c.BDevCapabilityType != DEVCAP_PLATFORM || len(c.Data) < 17 {
+		return uuid, nil, false
+	}
+	copy(uuid[:], c.Data[1:17])
+	return uuid, c.Data[17:], true
+}
+
+// Return the first platform capability with the given UUID
+func (bos *BOSDescriptor) FindPlatformCapability(uuid [16]byte) (data []byte, ok bool) {
+	for _, c := range bos.Capabilities {
+		if u, d, isPlatform := c.Platform(); isPlatform && u == uuid {
+			return d, true
+		}
+	}
+	return nil, false
+}
+
+// Serialize the capability, recomputing bLength
+func (c DeviceCapability) Bytes() []byte {
+	buf := []byte{byte(3 + len(c.Data)), byte(DT_DEVICE_CAPABILITY), byte(c.BDevCapabilityType)}
+	return append(buf, c.Data...)
+}
+
+// Serialize the BOS with all of its capabilities, recomputing the
+// lengths and the capability count.
+func (bos *BOSDescriptor) Bytes() []byte {
+	buf := []byte{5, byte(DT_BOS), 0, 0, byte(len(bos.Capabilities))}
+	for _, c := range bos.Capabilities {
+		buf = append(buf, c.Bytes()...)
+	}
+	buf[2] = byte(len(buf))
+	buf[3] = byte(len(buf) >> 8)
+	return buf
+}
@@ -0,0 +1,119 @@
+//go:build linux
+
+package broker
+
+import (
+	"bytes"
+	"encoding/json"
+	"net"
+	"os"
+	"syscall"
+
+	"gopkg.thequux.com/usb"
+)
+
+// Ask the broker listening at path for a device. On success the
+// returned file is the device's node, opened read-write, for the
+// caller to close.
+func RequestFD(path string, req Request) (*os.File, *Response, error) {
+	conn, err := net.DialUnix("unix", nil, &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		return nil, nil, err
+	}
+	defer conn.Close()
+	buf, _ := json.Marshal(req)
+	if _, err := conn.Write(append(buf, '\n')); err != nil {
+		return nil, nil, err
+	}
+
+	// The descriptor comes with the first byte of the response, which
+	// the broker sends in one piece; read until the end of the line in
+	// case it doesn't arrive in one
+	var (
+		data  []byte
+		files []*os.File
+	)
+	chunk := make([]byte, maxRequest)
+	oob := make([]byte, syscall.CmsgSpace(4))
+	for bytes.IndexByte(data, '\n') < 0 {
+		n, oobn, _, _, err := conn.ReadMsgUnix(chunk, oob)
+		if oobn > 0 {
+			files = append(files, receivedFiles(oob[:oobn])...)
+		}
+		data = append(data, chunk[:n]...)
+		if err != nil {
+			break
+		}
+	}
+	closeAll := func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}
+
+	var resp Response
+	if err := json.Unmarshal(data, &resp); err != nil {
+		closeAll()
+		return nil, nil, ErrProtocol
+	}
+	if resp.Error != "" {
+		closeAll()
+		if err, ok := responseErrors[resp.Error]; ok {
+			return nil, &resp, err
+		}
+		return nil, &resp, ErrProtocol
+	}
+	if len(files) != 1 {
+		closeAll()
+		return nil, &resp, ErrProtocol
+	}
+	return files[0], &resp, nil
+}
+
+// The descriptors passed in a control message, as files
+func receivedFiles(oob []byte) []*os.File {
+	msgs, err := syscall.ParseSocketControlMessage(oob)
+	if err != nil {
+		return nil
+	}
+	var ret []*os.File
+	for _, msg := range msgs {
+		fds, err := syscall.ParseUnixRights(&msg)
+		if err != nil {
+			continue
+		}
+		for _, fd := range fds {
+			syscall.CloseOnExec(fd)
+			ret = append(ret, os.NewFile(uintptr(fd), "usb device"))
+		}
+	}
+	return ret
+}
+
+// A device handle got from a broker, which keeps the descriptor it
+// came in open for as long as the handle is
+type Handle struct {
+	*usb.DeviceHandle
+	file *os.File
+}
+
+// Ask the broker listening at path for a device, and open it in ctx,
+// which needs a backend that can open descriptors (see usb.FDOpener)
+func Open(ctx *usb.Context, path string, req Request) (*Handle, error) {
+	file, _, err := RequestFD(path, req)
+	if err != nil {
+		return nil, err
+	}
+	h, uerr := ctx.OpenFromFD(file.Fd())
+	if uerr != nil {
+		file.Close()
+		return nil, uerr
+	}
+	return &Handle{h, file}, nil
+}
+
+// Close the handle, then the descriptor
+func (h *Handle) Close() {
+	h.DeviceHandle.Close()
+	h.file.Close()
+}
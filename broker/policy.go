@@ -0,0 +1,152 @@
+// Package broker lets unprivileged processes use USB devices that a
+// privileged one opens for them. The broker, run as root or as a user
+// udev lets at the device nodes, listens on a Unix socket; a client
+// names a device, and if the policy allows that client that device,
+// the broker opens its usbfs node and passes the descriptor back over
+// the socket. The client library turns the descriptor into a
+// DeviceHandle with Context.OpenFromFD.
+//
+// Clients are identified by the UID and GID the kernel reports for the
+// other end of the socket, so they can't claim to be anyone else. The
+// groups they are in are those the kernel reports, along with those
+// the user database lists for their UID.
+package broker
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"strconv"
+	"strings"
+)
+
+var (
+	ErrPolicy   = errors.New("broker: malformed policy")
+	ErrProtocol = errors.New("broker: malformed message")
+	ErrDenied   = errors.New("broker: device not allowed")
+	ErrNotFound = errors.New("broker: no such device")
+	ErrOpen     = errors.New("broker: device could not be opened")
+)
+
+// What a client asks the broker for. Device is "vid:pid" in hex, as
+// usblint takes it; Serial, if given, must match too. Bus and Address,
+// if given, pick one device out of several that match.
+type Request struct {
+	Device  string `json:"device"`
+	Serial  string `json:"serial,omitempty"`
+	Bus     int    `json:"bus,omitempty"`
+	Address int    `json:"address,omitempty"`
+}
+
+// The broker's answer. On success the descriptor comes with it, and
+// Bus and Address say which device it is for.
+type Response struct {
+	Error   string `json:"error,omitempty"`
+	Bus     int    `json:"bus,omitempty"`
+	Address int    `json:"address,omitempty"`
+}
+
+// The errors as they are sent in a Response
+var responseErrors = map[string]error{
+	"protocol":  ErrProtocol,
+	"denied":    ErrDenied,
+	"not found": ErrNotFound,
+	"open":      ErrOpen,
+}
+
+func responseError(err error) string {
+	for code, e := range responseErrors {
+		if e == err {
+			return code
+		}
+	}
+	return "protocol"
+}
+
+// Who may have which devices. A client gets a device if any rule
+// matches both; anything else is denied.
+type Policy struct {
+	Rules []Rule `json:"rules"`
+}
+
+// Devices are matched by Device, "vid:pid" in hex with either half
+// "*" for any, and by Serial if it is set. Clients are matched if
+// their UID is among UIDs or any of their groups among GIDs; a rule
+// with neither matches nobody.
+type Rule struct {
+	Device string `json:"device"`
+	Serial string `json:"serial,omitempty"`
+	UIDs   []int  `json:"uids,omitempty"`
+	GIDs   []int  `json:"gids,omitempty"`
+}
+
+// Read a policy in JSON, such as
+//
+//	{"rules": [
+//		{"device": "2047:0200", "uids": [1000]},
+//		{"device": "0483:*", "serial": "205F3784", "gids": [20]}
+//	]}
+func ReadPolicy(r io.Reader) (*Policy, error) {
+	var p Policy
+	if err := json.NewDecoder(r).Decode(&p); err != nil {
+		return nil, ErrPolicy
+	}
+	for _, rule := range p.Rules {
+		if _, _, ok := parseDevice(rule.Device, true); !ok {
+			return nil, ErrPolicy
+		}
+	}
+	return &p, nil
+}
+
+// Parse "vid:pid", allowing "*" for either half if wild
+func parseDevice(s string, wild bool) (vendor, product int, ok bool) {
+	parts := strings.Split(s, ":")
+	if len(parts) != 2 {
+		return 0, 0, false
+	}
+	ids := [2]int{}
+	for i, part := range parts {
+		if part == "*" && wild {
+			ids[i] = -1
+			continue
+		}
+		id, err := strconv.ParseUint(part, 16, 16)
+		if err != nil {
+			return 0, 0, false
+		}
+		ids[i] = int(id)
+	}
+	return ids[0], ids[1], true
+}
+
+func contains(list []int, v int) bool {
+	for _, x := range list {
+		if x == v {
+			return true
+		}
+	}
+	return false
+}
+
+// Whether the client with the given UID and groups may have the device
+func (p *Policy) Allows(uid int, gids []int, vendor, product int, serial string) bool {
+	for _, rule := range p.Rules {
+		rule_vendor, rule_product, ok := parseDevice(rule.Device, true)
+		if !ok ||
+			rule_vendor >= 0 && rule_vendor != vendor ||
+			rule_product >= 0 && rule_product != product ||
+			rule.Serial != "" && rule.Serial != serial {
+			continue
+		}
+		if contains(rule.UIDs, uid) {
+			return true
+		}
+		for _, gid := range gids {
+			if contains(rule.GIDs, gid) {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,72 @@
+package broker
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestReadPolicy(t *testing.T) {
+	p, err := ReadPolicy(strings.NewReader(`{"rules": [
+		{"device": "2047:0200", "uids": [1000]},
+		{"device": "0483:*", "serial": "205F3784", "gids": [20]}
+	]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(p.Rules) != 2 || p.Rules[1].Serial != "205F3784" || len(p.Rules[1].GIDs) != 1 {
+		t.Errorf("read %+v", p.Rules)
+	}
+
+	for _, bad := range []string{
+		`{"rules": [{"device": "2047"}]}`,
+		`{"rules": [{"device": "2047:0200:1"}]}`,
+		`{"rules": [{"device": "zz:0200"}]}`,
+		`{"rules": [{"device": "12345:0200"}]}`,
+		`{"rules": [{"device": ""}]}`,
+		`{"rules": [{"device": "2047:0200"}`,
+		`not json`,
+	} {
+		if _, err := ReadPolicy(strings.NewReader(bad)); err != ErrPolicy {
+			t.Errorf("%s: %v, want %v", bad, err, ErrPolicy)
+		}
+	}
+}
+
+func TestAllows(t *testing.T) {
+	p := &Policy{Rules: []Rule{
+		{Device: "2047:0200", UIDs: []int{1000}},
+		{Device: "0483:*", Serial: "205F3784", GIDs: []int{20}},
+		{Device: "*:5740", UIDs: []int{1001}, GIDs: []int{46}},
+		{Device: "*:*"}, // matches nobody
+	}}
+	tests := []struct {
+		name            string
+		uid             int
+		gids            []int
+		vendor, product int
+		serial          string
+		want            bool
+	}{
+		{"uid", 1000, []int{1000}, 0x2047, 0x0200, "", true},
+		{"other uid", 1002, []int{1002}, 0x2047, 0x0200, "", false},
+		{"other product", 1000, []int{1000}, 0x2047, 0x0201, "", false},
+		{"primary gid", 1002, []int{20}, 0x0483, 0x3748, "205F3784", true},
+		{"supplementary gid", 1002, []int{1002, 20}, 0x0483, 0x3748, "205F3784", true},
+		{"gid not uid", 20, []int{1002}, 0x0483, 0x3748, "205F3784", false},
+		{"wrong serial", 1002, []int{20}, 0x0483, 0x3748, "205F3785", false},
+		{"no serial", 1002, []int{20}, 0x0483, 0x3748, "", false},
+		{"other vendor", 1002, []int{20}, 0x0484, 0x3748, "205F3784", false},
+		{"wildcard vendor, uid", 1001, nil, 0x0483, 0x5740, "", true},
+		{"wildcard vendor, gid", 1002, []int{1002, 46}, 0x1234, 0x5740, "", true},
+		{"wildcard vendor, other product", 1001, nil, 0x0483, 0x5741, "", false},
+		{"rule without uids or gids", 0, []int{0}, 0x1234, 0x5678, "", false},
+	}
+	for _, test := range tests {
+		if got := p.Allows(test.uid, test.gids, test.vendor, test.product, test.serial); got != test.want {
+			t.Errorf("%s: allowed %v, want %v", test.name, got, test.want)
+		}
+	}
+	if (&Policy{}).Allows(0, []int{0}, 0x2047, 0x0200, "") {
+		t.Error("an empty policy allowed a device")
+	}
+}
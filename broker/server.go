@@ -0,0 +1,253 @@
+//go:build linux
+
+package broker
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"gopkg.thequux.com/usb"
+)
+
+// Where the broker opens device nodes
+const DEV_ROOT = "/dev/bus/usb"
+
+// How long a client has to ask, and the most it may send
+const (
+	requestTimeout = 10 * time.Second
+	maxRequest     = 4096
+)
+
+// A broker, handing out devices to clients on Unix sockets as its
+// policy allows:
+//
+//	s := broker.NewServer(policy)
+//	l, _ := net.ListenUnix("unix", &net.UnixAddr{Name: "/run/usbbroker.sock", Net: "unix"})
+//	s.Serve(l)
+//
+// Each connection carries one request. Devices are found through sysfs
+// and opened read-write at DEV_ROOT/BBB/DDD, so the broker needs no
+// libusb and doesn't keep anything open; once the client has the
+// descriptor, the device is the client's.
+type Server struct {
+	// Where devices are found and opened; usb.SYSFS_ROOT and DEV_ROOT
+	// unless changed before serving
+	Sysfs, DevRoot string
+	// If set, every request is logged here with what was done about it
+	Log *log.Logger
+
+	lock      sync.Mutex
+	policy    *Policy
+	listeners []net.Listener
+	closed    bool
+}
+
+func NewServer(policy *Policy) *Server {
+	return &Server{
+		Sysfs:   usb.SYSFS_ROOT,
+		DevRoot: DEV_ROOT,
+		policy:  policy,
+	}
+}
+
+// Replace the policy, such as when it has been edited. Requests already
+// granted are not revisited.
+func (s *Server) SetPolicy(policy *Policy) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.policy = policy
+}
+
+// Accept clients until the listener fails or the server is closed
+func (s *Server) Serve(l *net.UnixListener) error {
+	s.lock.Lock()
+	if s.closed {
+		s.lock.Unlock()
+		return net.ErrClosed
+	}
+	s.listeners = append(s.listeners, l)
+	s.lock.Unlock()
+	for {
+		conn, err := l.AcceptUnix()
+		if err != nil {
+			return err
+		}
+		go s.ServeConn(conn)
+	}
+}
+
+// Close the listeners. Clients already connected are still answered.
+func (s *Server) Close() {
+	s.lock.Lock()
+	s.closed = true
+	listeners := s.listeners
+	s.listeners = nil
+	s.lock.Unlock()
+	for _, l := range listeners {
+		l.Close()
+	}
+}
+
+func (s *Server) logf(format string, args ...interface{}) {
+	if s.Log != nil {
+		s.Log.Printf(format, args...)
+	}
+}
+
+// Answer the request on a connection, then close it
+func (s *Server) ServeConn(conn *net.UnixConn) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(requestTimeout))
+
+	cred, err := peerCred(conn)
+	if err != nil {
+		s.logf("connection without credentials: %v", err)
+		return
+	}
+	var req Request
+	if err := json.NewDecoder(io.LimitReader(conn, maxRequest)).Decode(&req); err != nil {
+		s.logf("uid %d pid %d: %v", cred.Uid, cred.Pid, ErrProtocol)
+		s.reply(conn, Response{Error: responseError(ErrProtocol)}, -1)
+		return
+	}
+
+	dev, err := s.find(int(cred.Uid), groups(cred), req)
+	if err != nil {
+		s.logf("uid %d pid %d: %s: %v", cred.Uid, cred.Pid, req.Device, err)
+		s.reply(conn, Response{Error: responseError(err)}, -1)
+		return
+	}
+	path := filepath.Join(s.DevRoot, fmt.Sprintf("%03d/%03d", dev.Bus, dev.Address))
+	fd, oerr := syscall.Open(path, syscall.O_RDWR|syscall.O_CLOEXEC, 0)
+	if oerr != nil {
+		s.logf("uid %d pid %d: %s: %v: %v", cred.Uid, cred.Pid, req.Device, ErrOpen, oerr)
+		s.reply(conn, Response{Error: responseError(ErrOpen)}, -1)
+		return
+	}
+	defer syscall.Close(fd)
+	if !isNode(fd, dev.Bus, dev.Address) {
+		// Unplugged since it was found, and something else, or
+		// nothing, is at its address now
+		s.logf("uid %d pid %d: %s: %s is no longer the device", cred.Uid, cred.Pid, req.Device, path)
+		s.reply(conn, Response{Error: responseError(ErrNotFound)}, -1)
+		return
+	}
+	s.logf("uid %d pid %d: %s: granted %s", cred.Uid, cred.Pid, req.Device, path)
+	s.reply(conn, Response{Bus: dev.Bus, Address: dev.Address}, fd)
+}
+
+// The credentials of the process at the other end, as the kernel
+// recorded them when it connected
+func peerCred(conn *net.UnixConn) (*syscall.Ucred, error) {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	var (
+		cred *syscall.Ucred
+		cerr error
+	)
+	if err := raw.Control(func(fd uintptr) {
+		cred, cerr = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	}); err != nil {
+		return nil, err
+	}
+	return cred, cerr
+}
+
+// The client's primary group, as the kernel recorded it, and the
+// supplementary groups its user is in
+func groups(cred *syscall.Ucred) []int {
+	gids := []int{int(cred.Gid)}
+	u, err := user.LookupId(strconv.Itoa(int(cred.Uid)))
+	if err != nil {
+		return gids
+	}
+	ids, _ := u.GroupIds()
+	for _, id := range ids {
+		if gid, err := strconv.Atoi(id); err == nil {
+			gids = append(gids, gid)
+		}
+	}
+	return gids
+}
+
+// usbfs device nodes are character devices of this major number,
+// with bus and address in the minor
+const usbfsMajor = 189
+
+// Whether fd is the usbfs node of the device at bus and address. Nodes
+// are named for them, but opening one by name races with the device
+// being unplugged and another taking its place.
+func isNode(fd, bus, address int) bool {
+	var st syscall.Stat_t
+	if err := syscall.Fstat(fd, &st); err != nil {
+		return false
+	}
+	return statIsNode(&st, bus, address)
+}
+
+func statIsNode(st *syscall.Stat_t, bus, address int) bool {
+	if st.Mode&syscall.S_IFMT != syscall.S_IFCHR {
+		return false
+	}
+	// As the kernel's new_encode_dev packs them
+	rdev := uint64(st.Rdev)
+	major := int(rdev>>8&0xfff | rdev>>32&^0xfff)
+	minor := int(rdev&0xff | rdev>>12&^0xff)
+	return major == usbfsMajor && minor == (bus-1)*128+address-1
+}
+
+// The first device that matches the request and that the policy lets
+// the client have. A device that matches but isn't allowed is reported
+// as such, so that clients can tell a policy problem from an unplugged
+// device.
+func (s *Server) find(uid int, gids []int, req Request) (*usb.SysfsDevice, error) {
+	vendor, product, ok := parseDevice(req.Device, false)
+	if !ok {
+		return nil, ErrProtocol
+	}
+	s.lock.Lock()
+	policy := s.policy
+	s.lock.Unlock()
+
+	devs, _ := usb.ListSysfsDevices(s.Sysfs)
+	err := ErrNotFound
+	for _, dev := range devs {
+		desc, derr := dev.GetDeviceDescriptor()
+		if derr != nil ||
+			int(desc.IdVendor) != vendor || int(desc.IdProduct) != product ||
+			req.Serial != "" && dev.Serial != req.Serial ||
+			req.Bus != 0 && dev.Bus != req.Bus ||
+			req.Address != 0 && dev.Address != req.Address {
+			continue
+		}
+		if policy == nil || !policy.Allows(uid, gids, vendor, product, dev.Serial) {
+			err = ErrDenied
+			continue
+		}
+		return dev, nil
+	}
+	return nil, err
+}
+
+// Send the response, with the descriptor if there is one
+func (s *Server) reply(conn *net.UnixConn, resp Response, fd int) {
+	buf, _ := json.Marshal(resp)
+	var oob []byte
+	if fd >= 0 {
+		oob = syscall.UnixRights(fd)
+	}
+	if _, _, err := conn.WriteMsgUnix(append(buf, '\n'), oob, nil); err != nil {
+		s.logf("replying: %v", err)
+	}
+}
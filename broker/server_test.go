@@ -0,0 +1,74 @@
+package broker
+
+import (
+	"reflect"
+	"syscall"
+	"testing"
+)
+
+// Pack a device number as the kernel's new_encode_dev does for stat
+func newEncodeDev(major, minor uint32) uint32 {
+	return minor&0xff | major<<8 | (minor&^0xff)<<12
+}
+
+func TestStatIsNode(t *testing.T) {
+	tests := []struct {
+		name         string
+		mode         uint32
+		major, minor uint32
+		bus, address int
+		want         bool
+	}{
+		{"first device", syscall.S_IFCHR | 0664, 189, 0, 1, 1, true},
+		{"bus 1", syscall.S_IFCHR | 0664, 189, 6, 1, 7, true},
+		{"bus 3, past minor 255", syscall.S_IFCHR | 0664, 189, 2*128 + 4, 3, 5, true},
+		{"high bus", syscall.S_IFCHR | 0664, 189, 20*128 + 126, 21, 127, true},
+		{"other address", syscall.S_IFCHR | 0664, 189, 6, 1, 8, false},
+		{"other bus", syscall.S_IFCHR | 0664, 189, 6, 2, 7, false},
+		{"usbmisc major", syscall.S_IFCHR | 0664, 180, 6, 1, 7, false},
+		{"large major", syscall.S_IFCHR | 0664, 189 + 0x100, 6, 1, 7, false},
+		{"block device", syscall.S_IFBLK | 0664, 189, 6, 1, 7, false},
+		{"regular file", syscall.S_IFREG | 0664, 189, 6, 1, 7, false},
+	}
+	for _, test := range tests {
+		st := &syscall.Stat_t{Mode: test.mode}
+		// Rdev is 32 or 64 bits, depending on the architecture
+		reflect.ValueOf(&st.Rdev).Elem().SetUint(uint64(newEncodeDev(test.major, test.minor)))
+		if got := statIsNode(st, test.bus, test.address); got != test.want {
+			t.Errorf("%s: %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+// The usb package's testdata/sysfs has 2047:0200, serial ABC123, at
+// 1:5
+func TestFind(t *testing.T) {
+	s := NewServer(&Policy{Rules: []Rule{
+		{Device: "2047:0200", Serial: "ABC123", UIDs: []int{1000}},
+	}})
+	s.Sysfs = "../testdata/sysfs"
+	tests := []struct {
+		name string
+		uid  int
+		req  Request
+		want error
+	}{
+		{"allowed", 1000, Request{Device: "2047:0200"}, nil},
+		{"by serial", 1000, Request{Device: "2047:0200", Serial: "ABC123"}, nil},
+		{"by bus and address", 1000, Request{Device: "2047:0200", Bus: 1, Address: 5}, nil},
+		{"other uid", 1001, Request{Device: "2047:0200"}, ErrDenied},
+		{"other serial", 1000, Request{Device: "2047:0200", Serial: "ABC124"}, ErrNotFound},
+		{"other address", 1000, Request{Device: "2047:0200", Bus: 1, Address: 6}, ErrNotFound},
+		{"not attached", 1000, Request{Device: "2047:0201"}, ErrNotFound},
+		{"wildcard", 1000, Request{Device: "2047:*"}, ErrProtocol},
+		{"malformed", 1000, Request{Device: "2047"}, ErrProtocol},
+	}
+	for _, test := range tests {
+		dev, err := s.find(test.uid, []int{test.uid}, test.req)
+		if err != test.want {
+			t.Errorf("%s: %v, want %v", test.name, err, test.want)
+		} else if err == nil && dev.Name != "1-1.2" {
+			t.Errorf("%s: found %s, want 1-1.2", test.name, dev.Name)
+		}
+	}
+}
@@ -0,0 +1,78 @@
+//go:build linux
+
+// Hand out USB devices to unprivileged processes as a policy allows.
+//
+//	usbbroker -policy /etc/usbbroker.json -socket /run/usbbroker.sock
+//
+// Run as root, or as a user udev gives the devices to. The socket is
+// made accessible to everyone, since the policy decides who gets what;
+// send SIGHUP to reread the policy.
+package main
+
+import (
+	"errors"
+	"flag"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"gopkg.thequux.com/usb/broker"
+)
+
+func readPolicy(path string) (*broker.Policy, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return broker.ReadPolicy(f)
+}
+
+func main() {
+	policy_path := flag.String("policy", "/etc/usbbroker.json", "the `file` with the policy")
+	socket := flag.String("socket", "/run/usbbroker.sock", "listen on this `path`")
+	quiet := flag.Bool("q", false, "don't log requests")
+	flag.Parse()
+
+	policy, err := readPolicy(*policy_path)
+	if err != nil {
+		log.Fatal("reading policy: ", err)
+	}
+	s := broker.NewServer(policy)
+	if !*quiet {
+		s.Log = log.New(os.Stderr, "", log.LstdFlags)
+	}
+
+	// A socket left from a previous run would make the listen fail
+	os.Remove(*socket)
+	l, err := net.ListenUnix("unix", &net.UnixAddr{Name: *socket, Net: "unix"})
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := os.Chmod(*socket, 0666); err != nil {
+		log.Fatal(err)
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		for sig := range signals {
+			if sig != syscall.SIGHUP {
+				s.Close()
+				return
+			}
+			if policy, err := readPolicy(*policy_path); err != nil {
+				log.Print("rereading policy: ", err)
+			} else {
+				s.SetPolicy(policy)
+				log.Print("policy reread")
+			}
+		}
+	}()
+
+	if err := s.Serve(l); err != nil && !errors.Is(err, net.ErrClosed) {
+		log.Fatal(err)
+	}
+}
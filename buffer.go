@@ -0,0 +1,208 @@
+package usb
+
+import (
+	"sync"
+	"unsafe"
+)
+
+// Memory for transfers that the backend can hand to the device as it
+// is, rather than copying each transfer's data in and out of memory of
+// its own. With libusb it comes from libusb_dev_mem_alloc where the
+// platform has that (on Linux, memory mapped from usbfs, which the
+// kernel moves data to and from directly), and from malloc otherwise;
+// with usbfs, it is mapped from the device node. Backends that can't
+// allocate memory get Go memory, which works, but is copied as any
+// other buffer is.
+//
+// To transfer to or from a Buffer, set Transfer.Mem to it and
+// Transfer.Buffer to the part of it to use, or leave Buffer nil to use
+// all of it. The memory is freed when the Buffer is released, or when
+// its DeviceHandle is closed, whichever comes first; closing the handle
+// cancels the transfers still using it, but a Buffer must not be
+// released while a transfer is.
+type Buffer struct {
+	mem    []byte
+	owner  BackendHandle // nil for Go memory
+	free   func()
+	handle *DeviceHandle
+	pool   *BufferPool
+}
+
+// A BackendHandle that can allocate memory for transfers, outside the
+// Go heap, that it can use without copying (see Buffer).
+type BufferAllocator interface {
+	// At least size bytes, and how to free them
+	AllocBuffer(size int) (mem []byte, free func(), err *UsbError)
+}
+
+// Allocate a Buffer of size bytes
+func (h *DeviceHandle) AllocBuffer(size int) (*Buffer, *UsbError) {
+	if h.handle == nil {
+		return nil, UsbErrorNoDevice
+	}
+	if size < 0 {
+		return nil, UsbErrorInvalidParam
+	}
+	b := &Buffer{handle: h}
+	if a, ok := h.handle.(BufferAllocator); ok {
+		mem, free, err := a.AllocBuffer(size)
+		if err != nil {
+			return nil, err
+		}
+		b.mem, b.owner, b.free = mem[:size], h.handle, free
+	} else {
+		b.mem = make([]byte, size)
+	}
+	h.buffer_lock.Lock()
+	h.buffers[b] = true
+	h.buffer_lock.Unlock()
+	return b, nil
+}
+
+// Note a transfer using one of the handle's buffers as in flight, or
+// as over
+func (h *DeviceHandle) bufferInUse(t *Transfer, in_use bool) {
+	h.buffer_lock.Lock()
+	defer h.buffer_lock.Unlock()
+	if in_use {
+		h.buffer_transfers[t] = true
+	} else {
+		delete(h.buffer_transfers, t)
+	}
+}
+
+// Cancel the transfers still using the handle's buffers and wait for
+// them to end, so that their memory isn't freed while the backend or
+// the kernel is still using it
+func (h *DeviceHandle) cancelBufferTransfers() {
+	h.buffer_lock.Lock()
+	transfers := make([]*Transfer, 0, len(h.buffer_transfers))
+	for t := range h.buffer_transfers {
+		transfers = append(transfers, t)
+	}
+	h.buffer_lock.Unlock()
+	for _, t := range transfers {
+		t.Cancel()
+	}
+	for _, t := range transfers {
+		t.Wait()
+	}
+}
+
+// Free every Buffer of the handle, as it is closed
+func (h *DeviceHandle) freeBuffers() {
+	h.buffer_lock.Lock()
+	buffers := h.buffers
+	h.buffers = make(map[*Buffer]bool)
+	h.buffer_lock.Unlock()
+	for b := range buffers {
+		b.release()
+	}
+}
+
+// The buffer's memory; nil once it has been freed
+func (b *Buffer) Bytes() []byte {
+	return b.mem
+}
+
+func (b *Buffer) Len() int {
+	return len(b.mem)
+}
+
+// Give the buffer back to its pool, or free it if it has none. It must
+// not be used afterwards.
+func (b *Buffer) Release() {
+	if b.pool != nil && b.pool.put(b) {
+		return
+	}
+	b.handle.buffer_lock.Lock()
+	delete(b.handle.buffers, b)
+	b.handle.buffer_lock.Unlock()
+	b.release()
+}
+
+func (b *Buffer) release() {
+	if b.free != nil {
+		b.free()
+	}
+	b.mem, b.free = nil, nil
+}
+
+// Whether buf lies within the buffer's memory
+func (b *Buffer) contains(buf []byte) bool {
+	if len(buf) == 0 {
+		return true
+	}
+	if len(b.mem) == 0 {
+		return false
+	}
+	start := uintptr(unsafe.Pointer(&b.mem[0]))
+	p := uintptr(unsafe.Pointer(&buf[0]))
+	return p >= start && p+uintptr(len(buf)) <= start+uintptr(len(b.mem))
+}
+
+// Whether t is to use memory that h allocated, which it can then give
+// the device as it is. Control transfers still need the setup packet
+// put in front, so they are always copied.
+func (t *Transfer) inPlace(h BackendHandle) bool {
+	return t.Mem != nil && t.Mem.owner != nil && t.Mem.owner == h && t.Type != TRANSFER_TYPE_CONTROL
+}
+
+// Buffers of one size, kept for reuse rather than freed, so that a
+// stream of transfers needs no allocation once it is going
+type BufferPool struct {
+	handle *DeviceHandle
+	size   int
+
+	lock   sync.Mutex
+	idle   []*Buffer
+	closed bool
+}
+
+// Make a pool of buffers of size bytes
+func (h *DeviceHandle) NewBufferPool(size int) *BufferPool {
+	return &BufferPool{handle: h, size: size}
+}
+
+// A buffer from the pool, allocated if there is none to reuse. Its
+// contents are whatever they were when it was last released.
+func (p *BufferPool) Get() (*Buffer, *UsbError) {
+	p.lock.Lock()
+	if n := len(p.idle); n > 0 {
+		b := p.idle[n-1]
+		p.idle = p.idle[:n-1]
+		p.lock.Unlock()
+		return b, nil
+	}
+	p.lock.Unlock()
+	b, err := p.handle.AllocBuffer(p.size)
+	if err != nil {
+		return nil, err
+	}
+	b.pool = p
+	return b, nil
+}
+
+// Keep a released buffer, unless the pool or the buffer is done with
+func (p *BufferPool) put(b *Buffer) bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.closed || b.mem == nil {
+		return false
+	}
+	p.idle = append(p.idle, b)
+	return true
+}
+
+// Free the buffers in the pool. Those still in use are freed when they
+// are released.
+func (p *BufferPool) Close() {
+	p.lock.Lock()
+	idle := p.idle
+	p.idle, p.closed = nil, true
+	p.lock.Unlock()
+	for _, b := range idle {
+		b.pool = nil
+		b.Release()
+	}
+}
@@ -0,0 +1,96 @@
+package usb
+
+import (
+	"fmt"
+	"os"
+)
+
+// What the libusb linked in can do, as libusb_has_capability reports
+const (
+	CAP_HAS_CAPABILITY                = 0x0000
+	CAP_HAS_HOTPLUG                   = 0x0001
+	CAP_HAS_HID_ACCESS                = 0x0100
+	CAP_SUPPORTS_DETACH_KERNEL_DRIVER = 0x0101
+
+	// Not libusb's: whether devices' descriptors can be read without
+	// opening them, through sysfs (see ListSysfsDevices)
+	CAP_DESCRIPTORS_WITHOUT_OPEN = 0x10000
+)
+
+// Options for Context.SetOption, numbered as libusb's are
+const (
+	// The value is a DEBUG_* level
+	OPTION_LOG_LEVEL = 0
+	// Use the UsbDk driver rather than WinUSB; Windows only, and only
+	// before any devices are listed
+	OPTION_USE_USBDK = 1
+	// Don't look for devices (see LibusbOptions.NoDeviceDiscovery).
+	// Android calls this weak authority.
+	OPTION_NO_DEVICE_DISCOVERY = 2
+	OPTION_WEAK_AUTHORITY      = OPTION_NO_DEVICE_DISCOVERY
+)
+
+// The version of libusb linked in
+type LibusbVersion struct {
+	Major, Minor, Micro, Nano int
+	// A release candidate suffix, such as "-rc1"; empty for releases
+	RC string
+}
+
+func (v LibusbVersion) String() string {
+	return fmt.Sprintf("%d.%d.%d.%d%s", v.Major, v.Minor, v.Micro, v.Nano, v.RC)
+}
+
+// Whether v is the given version or later
+func (v LibusbVersion) AtLeast(major, minor, micro int) bool {
+	if v.Major != major {
+		return v.Major > major
+	}
+	if v.Minor != minor {
+		return v.Minor > minor
+	}
+	return v.Micro >= micro
+}
+
+// Whether DefaultContext's backend has a capability, one of the CAP_*
+// constants
+func HasCapability(capability int) bool {
+	return DefaultContext.HasCapability(capability)
+}
+
+// Whether the context's backend has a capability, one of the CAP_*
+// constants: libusb's if it is libusb, what usbfs itself can do if it
+// is usbfs. A backend that isn't a CapabilityReporter has none but
+// CAP_HAS_CAPABILITY, and one that can't be started has none at all.
+func (ctx *Context) HasCapability(capability int) bool {
+	if capability == CAP_DESCRIPTORS_WITHOUT_OPEN {
+		_, err := os.Stat(SYSFS_ROOT)
+		return err == nil
+	}
+	if ctx.doinit() != nil {
+		return false
+	}
+	if b, ok := ctx.backend.(CapabilityReporter); ok {
+		return b.HasCapability(capability)
+	}
+	return capability == CAP_HAS_CAPABILITY
+}
+
+// Set one of the OPTION_* options. value is the level for
+// OPTION_LOG_LEVEL, which every backend takes, and ignored otherwise.
+// The others need a backend that is an OptionSetter, and a libusb
+// recent enough to have them; some only work before any devices are
+// listed, so are better set with LibusbOptions.
+func (ctx *Context) SetOption(option, value int) *UsbError {
+	if err := ctx.doinit(); err != nil {
+		return err
+	}
+	if b, ok := ctx.backend.(OptionSetter); ok {
+		return b.SetOption(option, value)
+	}
+	if option == OPTION_LOG_LEVEL {
+		ctx.backend.SetDebug(value)
+		return nil
+	}
+	return UsbErrorNotSupported
+}
@@ -1,13 +1,6 @@
 package usb
 
-// #cgo CFLAGS: -I/usr/include/libusb-1.0
-// #cgo LDFLAGS: -lusb-1.0
-// #include <libusb.h>
-// #include <malloc.h>
-import "C"
-import "reflect"
-import "unsafe"
-import "unicode/utf16"
+import "time"
 
 type (
 	DescriptorType int
@@ -21,16 +14,28 @@ const (
 	DT_INTERFACE
 	DT_ENDPOINT
 
-	// These don't actually show up in libusb, but are in the spec
+	// These don't actually show up in libusb, but are in the spec.
+	// See DeviceHandle.GetDeviceQualifier and GetOtherSpeedConfigDescriptor.
 	DT_DEVICE_QUALIFIER
 	DT_OTHER_SPEED_CONFIG
 	DT_INTERFACE_POWER
 
+	// Defined by the Interface Association ECN; libusb leaves these in Extra
+	DT_INTERFACE_ASSOCIATION DescriptorType = 0x0B
+
+	// Binary device Object Store, USB 2.0 LPM ECN and USB 3.x
+	DT_BOS               DescriptorType = 0x0F
+	DT_DEVICE_CAPABILITY DescriptorType = 0x10
+
 	// These are in the spec, but not libusb
 	DT_HID          DescriptorType = 0x21
 	DT_HID_REPORT   DescriptorType = 0x22
 	DT_HID_PHYSICAL DescriptorType = 0x23
 	DT_HUB          DescriptorType = 0x29
+	DT_SS_HUB       DescriptorType = 0x2A
+
+	// Follows each endpoint descriptor at SuperSpeed
+	DT_SS_ENDPOINT_COMPANION DescriptorType = 0x30
 )
 
 const (
@@ -101,9 +106,24 @@ type (
 		BmAttributes        byte
 		MaxPower            byte
 		Interfaces          [][]InterfaceDescriptor
+		Functions           []Function
 		Extra               []byte
 	}
 
+	// A Function is a group of consecutive interfaces tied together
+	// by an Interface Association Descriptor, e.g. the control and
+	// data interfaces of a CDC-ACM port.
+	Function struct {
+		BLength           byte
+		BDescriptorType   DescriptorType
+		BFirstInterface   byte
+		BInterfaceCount   byte
+		BFunctionClass    ClassCode
+		BFunctionSubClass byte
+		BFunctionProtocol byte
+		IFunction         byte
+	}
+
 	EndpointDescriptor struct {
 		BLength          byte
 		BDescriptorType  DescriptorType
@@ -130,190 +150,178 @@ type (
 	}
 )
 
-// Usage:
-// given: foo_array *Foo := native array of Foo
-//        foo_len   int  := Number of Foos in foo_array
-// 
-// res := sliceify(foo_array, []Foo(nil), foo_len).([]Foo)
-func sliceify(arg interface{}, sample interface{}, length int) interface{} {
-	val := reflect.ValueOf(arg)
-	target := unsafe.Pointer(&reflect.SliceHeader{
-		Data: val.Pointer(),
-		Len:  length,
-		Cap:  length,
-	})
-	return unsafe.Unreflect(reflect.TypeOf(sample), target)
-}
-
-func cloneSlice(arg interface{}) interface{} {
-	oldval := reflect.ValueOf(arg)
-	val := reflect.MakeSlice(oldval.Type(), oldval.Len(), oldval.Len())
-	reflect.Copy(val, oldval)
-	return val.Interface()
+// Calls fn for each descriptor in a blob of concatenated
+// descriptors. Stops at the first malformed header.
+func walkDescriptors(buf []byte, fn func(dtype DescriptorType, desc []byte)) {
+	for len(buf) >= 2 {
+		length := int(buf[0])
+		if length < 2 || length > len(buf) {
+			return
+		}
+		fn(DescriptorType(buf[1]), buf[:length])
+		buf = buf[length:]
+	}
 }
 
-func parseDeviceDescriptor(desc *C.struct_libusb_device_descriptor) DeviceDescriptor {
-	return DeviceDescriptor{
-		BLength:            byte(desc.bLength),
-		BDescriptorType:    DescriptorType(desc.bDescriptorType),
-		BcdUSB:             uint16(desc.bcdUSB),
-		BDeviceClass:       ClassCode(desc.bDeviceClass),
-		BDeviceSubClass:    byte(desc.bDeviceSubClass),
-		BDeviceProtocol:    byte(desc.bDeviceProtocol),
-		BMaxPacketSize0:    byte(desc.bMaxPacketSize0),
-		IdVendor:           uint16(desc.idVendor),
-		IdProduct:          uint16(desc.idProduct),
-		BcdDevice:          uint16(desc.bcdDevice),
-		IManufacturer:      byte(desc.iManufacturer),
-		IProduct:           byte(desc.iProduct),
-		ISerialNumber:      byte(desc.iSerialNumber),
-		BNumConfigurations: byte(desc.bNumConfigurations),
+func parseFunction(desc []byte) (Function, bool) {
+	if len(desc) < 8 {
+		return Function{}, false
 	}
+	return Function{
+		BLength:           desc[0],
+		BDescriptorType:   DescriptorType(desc[1]),
+		BFirstInterface:   desc[2],
+		BInterfaceCount:   desc[3],
+		BFunctionClass:    ClassCode(desc[4]),
+		BFunctionSubClass: desc[5],
+		BFunctionProtocol: desc[6],
+		IFunction:         desc[7],
+	}, true
 }
 
-func parseConfigDescriptor(desc *C.struct_libusb_config_descriptor) ConfigDescriptor {
-	ret := ConfigDescriptor{
-		BLength:             byte(desc.bLength),
-		BDescriptorType:     DescriptorType(desc.bDescriptorType),
-		WTotalLength:        uint16(desc.wTotalLength),
-		BConfigurationValue: int(desc.bConfigurationValue),
-		IConfiguration:      byte(desc.iConfiguration),
-		BmAttributes:        byte(desc.bmAttributes),
-		MaxPower:            byte(desc.MaxPower),
-		Interfaces:          make([][]InterfaceDescriptor, int(desc.bNumInterfaces)),
-		Extra:               cloneSlice(sliceify(desc.extra, []byte{}, int(desc.extra_length))).([]byte),
+// libusb files an IAD under whatever precedes it: the configuration
+// for the first function, otherwise the previous interface or one of
+// its endpoints. Walk the extras in descriptor order to collect them.
+func findFunctions(cfg *ConfigDescriptor) []Function {
+	var funcs []Function
+	collect := func(dtype DescriptorType, desc []byte) {
+		if dtype != DT_INTERFACE_ASSOCIATION {
+			return
+		}
+		if f, ok := parseFunction(desc); ok {
+			funcs = append(funcs, f)
+		}
 	}
-
-	iface_list := sliceify(desc._interface, []C.struct_libusb_interface(nil), int(desc.bNumInterfaces)).([]C.struct_libusb_interface)
-	for i := 0; i < int(desc.bNumInterfaces); i++ {
-		iface := iface_list[i]
-		alts := sliceify(iface.altsetting, []C.struct_libusb_interface_descriptor{}, int(iface.num_altsetting)).([]C.struct_libusb_interface_descriptor)
-		parsed := make([]InterfaceDescriptor, len(alts), len(alts))
-		ret.Interfaces[i] = parsed
-		for j := range alts {
-			parsed[j] = parseInterfaceDescriptor(&alts[j])
+	walkDescriptors(cfg.Extra, collect)
+	for _, alts := range cfg.Interfaces {
+		for _, alt := range alts {
+			walkDescriptors(alt.Extra, collect)
+			for _, ep := range alt.Endpoints {
+				walkDescriptors(ep.Extra, collect)
+			}
 		}
 	}
-	return ret
+	return funcs
 }
 
-func parseEndpointDescriptor(desc *C.struct_libusb_endpoint_descriptor) EndpointDescriptor {
-	return EndpointDescriptor{
-		BLength:          byte(desc.bLength),
-		BDescriptorType:  DescriptorType(desc.bDescriptorType),
-		BEndpointAddress: byte(desc.bEndpointAddress),
-		BmAttributes:     byte(desc.bmAttributes),
-		WMaxPacketSize:   uint16(desc.wMaxPacketSize),
-		BInterval:        byte(desc.bInterval),
-		BRefresh:         byte(desc.bRefresh),
-		BSynchAddress:    byte(desc.bSynchAddress),
-		Extra:            cloneSlice(sliceify(desc.extra, []byte{}, int(desc.extra_length))).([]byte),
-	}
+// Reports whether the given interface number belongs to this function
+func (f Function) Contains(iface_no byte) bool {
+	return iface_no >= f.BFirstInterface && int(iface_no) < int(f.BFirstInterface)+int(f.BInterfaceCount)
 }
 
-func parseInterfaceDescriptor(desc *C.struct_libusb_interface_descriptor) InterfaceDescriptor {
-	ret := InterfaceDescriptor{
-		BLength:            byte(desc.bLength),
-		BDescriptorType:    DescriptorType(desc.bDescriptorType),
-		BInterfaceNumber:   byte(desc.bInterfaceNumber),
-		BAlternateSetting:  byte(desc.bAlternateSetting),
-		BInterfaceClass:    ClassCode(desc.bInterfaceClass),
-		BInterfaceSubClass: byte(desc.bInterfaceSubClass),
-		BInterfaceProtocol: byte(desc.bInterfaceProtocol),
-		IInterface:         byte(desc.iInterface),
-		Endpoints:          make([]EndpointDescriptor, int(desc.bNumEndpoints)),
-		Extra:              cloneSlice(sliceify(desc.extra, []byte{}, int(desc.extra_length))).([]byte),
+// Return the function that the given interface belongs to, if any
+func (cfg *ConfigDescriptor) GetFunction(iface_no byte) (Function, bool) {
+	for _, f := range cfg.Functions {
+		if f.Contains(iface_no) {
+			return f, true
+		}
 	}
+	return Function{}, false
+}
 
-	ep_list := sliceify(desc.endpoint, []C.struct_libusb_endpoint_descriptor(nil), int(desc.bNumEndpoints)).([]C.struct_libusb_endpoint_descriptor)
-	for i := 0; i < int(desc.bNumEndpoints); i++ {
-		ret.Endpoints[i] = parseEndpointDescriptor(&ep_list[i])
+// Return the alternate settings of each interface in the function
+func (cfg *ConfigDescriptor) FunctionInterfaces(f Function) [][]InterfaceDescriptor {
+	var ret [][]InterfaceDescriptor
+	for _, alts := range cfg.Interfaces {
+		if len(alts) > 0 && f.Contains(alts[0].BInterfaceNumber) {
+			ret = append(ret, alts)
+		}
 	}
 	return ret
 }
 
 func (dev *Device) GetDeviceDescriptor() (DeviceDescriptor, *UsbError) {
-	//var desc = (*C.struct_libusb_device_descriptor)(&C.devdesc)
-	var desc C.struct_libusb_device_descriptor
-	//println(desc)
-	err := returnUsbError(C.libusb_get_device_descriptor(dev.device, &desc))
-	if err != nil {
-		return DeviceDescriptor{}, err
-	}
-	return parseDeviceDescriptor(&desc), err
+	return dev.dev.GetDeviceDescriptor()
 }
 
 func (dev *Device) GetActiveConfigDescriptor() (ConfigDescriptor, *UsbError) {
-	var desc *C.struct_libusb_config_descriptor
-	err := returnUsbError(C.libusb_get_active_config_descriptor(dev.device, &desc))
-	if err != nil {
-		return ConfigDescriptor{}, err
-	}
-	ret := parseConfigDescriptor(desc)
-	C.libusb_free_config_descriptor(desc)
-	return ret, nil
+	return dev.dev.GetActiveConfigDescriptor()
 }
 
 func (dev *Device) GetConfigDescriptor(config_index int) (ConfigDescriptor, *UsbError) {
-	var desc *C.struct_libusb_config_descriptor
-	err := returnUsbError(C.libusb_get_config_descriptor(dev.device, C.uint8_t(config_index), &desc))
-	if err != nil {
-		return ConfigDescriptor{}, err
-	}
-	ret := parseConfigDescriptor(desc)
-	C.libusb_free_config_descriptor(desc)
-	return ret, nil
+	return dev.dev.GetConfigDescriptor(config_index)
 }
 
 func (dev *Device) GetConfigByValue(bConfigurationValue byte) (ConfigDescriptor, *UsbError) {
-	var desc *C.struct_libusb_config_descriptor
-	err := returnUsbError(C.libusb_get_config_descriptor_by_value(dev.device, C.uint8_t(bConfigurationValue), &desc))
+	desc, err := dev.GetDeviceDescriptor()
 	if err != nil {
 		return ConfigDescriptor{}, err
 	}
-	ret := parseConfigDescriptor(desc)
-	C.libusb_free_config_descriptor(desc)
-	return ret, nil
+	for i := 0; i < int(desc.BNumConfigurations); i++ {
+		cfg, err := dev.GetConfigDescriptor(i)
+		if err != nil {
+			return ConfigDescriptor{}, err
+		}
+		if cfg.BConfigurationValue == int(bConfigurationValue) {
+			return cfg, nil
+		}
+	}
+	return ConfigDescriptor{}, UsbErrorNotFound
 }
 
-func (h *DeviceHandle) GetStringDescriptor(index byte, langid uint16) (string, *UsbError) {
-	buf := make([]uint16, 128)
-
-	rlen, err := decodeUsbError(C.libusb_get_string_descriptor(h.handle, C.uint8_t(index), C.uint16_t(langid), (*C.uchar)(unsafe.Pointer(&buf[0])), 256))
+// Timeout used for descriptor requests; matches what libusb uses
+// internally for its own descriptor reads.
+const descriptorTimeout = time.Second
+
+// Fetch a descriptor with a standard GET_DESCRIPTOR request,
+// reading at most length bytes. langid is only meaningful for
+// string descriptors.
+func (h *DeviceHandle) GetRawDescriptor(dtype DescriptorType, index byte, langid uint16, length int) ([]byte, *UsbError) {
+	buf := make([]byte, length)
+	n, err := h.ControlTransfer(DIR_IN|REQUEST_TYPE_STANDARD|RECIPIENT_DEVICE, REQUEST_GET_DESCRIPTOR,
+		uint16(dtype)<<8|uint16(index), langid, buf, descriptorTimeout)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
-	return string(utf16.Decode(buf[1 : rlen/2])), nil
+	return buf[:n], nil
 }
 
-func (h *DeviceHandle) GetDefaultStringDescriptor(index byte) (string, *UsbError) {
-	if h.default_langid == 0 {
-		langs, err := h.GetLangIds()
-		if err != nil {
-			return "", err
-		} else if len(langs) > 0 {
-			h.default_langid = langs[0]
-		} else {
-			return "", UsbErrorNotSupported
-		}
+// Fetch a descriptor that carries wTotalLength at offset 2
+// (configurations and the BOS) in full: read the header to learn
+// the length, then read the whole thing.
+func (h *DeviceHandle) getRawConfig(dtype DescriptorType, index byte) ([]byte, *UsbError) {
+	hdr, err := h.GetRawDescriptor(dtype, index, 0, 9)
+	if err != nil {
+		return nil, err
 	}
-
-	return h.GetStringDescriptor(index, h.default_langid)
+	if len(hdr) < 4 {
+		return nil, UsbErrorBadDescriptor
+	}
+	return h.GetRawDescriptor(dtype, index, 0, int(le16(hdr[2:])))
 }
 
-func (h *DeviceHandle) GetLangIds() ([]uint16, *UsbError) {
-	var buf [256]C.uchar
-	u16buf := (*[128]C.uint16_t)(unsafe.Pointer(&buf[0]))
+// Fetch the device descriptor as the device sends it
+func (h *DeviceHandle) GetRawDeviceDescriptor() ([]byte, *UsbError) {
+	return h.GetRawDescriptor(DT_DEVICE, 0, 0, 18)
+}
 
-	rlen, err := decodeUsbError(C.libusb_get_string_descriptor(h.handle, 0, 0, &buf[0], 256))
+// Fetch a configuration descriptor with all of its interfaces,
+// endpoints and class descriptors, as the device sends it.
+func (h *DeviceHandle) GetRawConfigDescriptor(config_index int) ([]byte, *UsbError) {
+	return h.getRawConfig(DT_CONFIG, byte(config_index))
+}
 
+// Return the device qualifier, which describes how a high-speed
+// capable device would look when operating at the other speed. The
+// result is laid out as a DeviceDescriptor with BDescriptorType set
+// to DT_DEVICE_QUALIFIER; the vendor, product and string fields are
+// not part of the qualifier and are left zero. Devices that only do
+// full speed answer with a stall (UsbErrorPipe).
+func (h *DeviceHandle) GetDeviceQualifier() (DeviceDescriptor, *UsbError) {
+	buf, err := h.GetRawDescriptor(DT_DEVICE_QUALIFIER, 0, 0, 10)
 	if err != nil {
-		return nil, err
+		return DeviceDescriptor{}, err
 	}
-	// I'm explicitly ignoring the first two bytes, which are length and descriptor type, respectively.
-	ret := make([]uint16, rlen/2-1)
-	for i := 1; i < rlen/2; i++ {
-		ret[i-1] = uint16(u16buf[i])
+	return parseRawDeviceQualifier(buf)
+}
+
+// Return the configuration the device would have when operating at
+// the other speed. BDescriptorType is DT_OTHER_SPEED_CONFIG; the
+// index is the same as for GetConfigDescriptor.
+func (h *DeviceHandle) GetOtherSpeedConfigDescriptor(config_index int) (ConfigDescriptor, *UsbError) {
+	buf, err := h.getRawConfig(DT_OTHER_SPEED_CONFIG, byte(config_index))
+	if err != nil {
+		return ConfigDescriptor{}, err
 	}
-	return ret, nil
+	return ParseConfigDescriptor(buf)
 }
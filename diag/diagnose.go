@@ -0,0 +1,411 @@
+//go:build linux
+
+package diag
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"gopkg.thequux.com/usb"
+)
+
+var ErrNoDevice = errors.New("diag: device not found in sysfs")
+
+// Where device nodes are
+const DEV_ROOT = "/dev/bus/usb"
+
+// Where udev reads rules from. A file in an earlier directory hides
+// one of the same name in a later one.
+var RULE_DIRS = []string{"/etc/udev/rules.d", "/run/udev/rules.d", "/usr/lib/udev/rules.d", "/lib/udev/rules.d"}
+
+// Looks at devices; the zero Checker won't do, see NewChecker
+type Checker struct {
+	// Where devices, their nodes and udev rules are looked for;
+	// usb.SYSFS_ROOT, DEV_ROOT and RULE_DIRS unless changed
+	Sysfs, DevRoot string
+	RuleDirs       []string
+}
+
+func NewChecker() *Checker {
+	return &Checker{Sysfs: usb.SYSFS_ROOT, DevRoot: DEV_ROOT, RuleDirs: RULE_DIRS}
+}
+
+// An entry of a device node's ACL naming a user or group
+type ACLEntry struct {
+	Group bool // else a user
+	ID    int
+	Name  string
+	Perm  os.FileMode // of 07: read, write, execute
+}
+
+// A line of a udev rules file that matches the device
+type RuleMatch struct {
+	File string
+	Line int
+	Text string
+}
+
+// What was found out about a device, and what it means
+type Report struct {
+	Device *usb.SysfsDevice
+	Path   string // of the device node
+	Exists bool
+
+	// The node's owner, group and mode, and its ACL entries, if it has
+	// an ACL
+	UID, GID           int
+	Owner, GroupName   string
+	Mode               os.FileMode
+	ACL                []ACLEntry
+	ACLMask            os.FileMode
+	Readable, Writable bool // by this process
+
+	// Who this process is, and the groups it is in
+	User   string
+	Groups []string
+	// Groups the user is in that this process isn't, since the user
+	// was added to them after logging in
+	StaleGroups []string
+
+	Rules []RuleMatch
+
+	// What is wrong, in plain language; empty if nothing is
+	Problems []string
+	// A rule that would give access, if one is needed
+	Suggested *Rule
+}
+
+// Diagnose a device found through usb, with the default Checker
+func Diagnose(dev *usb.Device) (*Report, error) {
+	bus, addr := dev.GetDeviceAddress()
+	return NewChecker().Check(bus, addr)
+}
+
+// Find out why the device at bus and address can or can't be opened
+func (c *Checker) Check(bus, address int) (*Report, error) {
+	devs, uerr := usb.ListSysfsDevices(c.Sysfs)
+	if uerr != nil {
+		return nil, uerr
+	}
+	r := &Report{}
+	for _, dev := range devs {
+		if dev.Bus == bus && dev.Address == address {
+			r.Device = dev
+		}
+	}
+	if r.Device == nil {
+		return nil, ErrNoDevice
+	}
+	r.Path = filepath.Join(c.DevRoot, fmt.Sprintf("%03d/%03d", bus, address))
+	r.checkNode()
+	r.checkUser()
+	desc, derr := r.Device.GetDeviceDescriptor()
+	if derr == nil {
+		r.Rules = c.findRules(desc.IdVendor, desc.IdProduct)
+	}
+	r.explain(desc, derr == nil)
+	return r, nil
+}
+
+func userName(uid int) string {
+	if u, err := user.LookupId(strconv.Itoa(uid)); err == nil {
+		return u.Username
+	}
+	return strconv.Itoa(uid)
+}
+
+func groupName(gid int) string {
+	if g, err := user.LookupGroupId(strconv.Itoa(gid)); err == nil {
+		return g.Name
+	}
+	return strconv.Itoa(gid)
+}
+
+func (r *Report) checkNode() {
+	var st syscall.Stat_t
+	if err := syscall.Stat(r.Path, &st); err != nil {
+		return
+	}
+	r.Exists = true
+	r.UID, r.GID = int(st.Uid), int(st.Gid)
+	r.Owner, r.GroupName = userName(r.UID), groupName(r.GID)
+	r.Mode = os.FileMode(st.Mode & 0777)
+	r.Readable = syscall.Access(r.Path, 4) == nil
+	r.Writable = syscall.Access(r.Path, 2) == nil
+	r.readACL()
+}
+
+// ACL tags and the layout of the system.posix_acl_access attribute
+const (
+	aclVersion  = 2
+	aclUser     = 0x02
+	aclGroup    = 0x08
+	aclMask     = 0x10
+	aclEntryLen = 8
+)
+
+func (r *Report) readACL() {
+	buf := make([]byte, 1024)
+	n, err := syscall.Getxattr(r.Path, "system.posix_acl_access", buf)
+	if err != nil || n < 4 || binary.LittleEndian.Uint32(buf) != aclVersion {
+		return
+	}
+	for entry := buf[4:n]; len(entry) >= aclEntryLen; entry = entry[aclEntryLen:] {
+		tag := binary.LittleEndian.Uint16(entry)
+		perm := os.FileMode(binary.LittleEndian.Uint16(entry[2:]) & 7)
+		id := int(binary.LittleEndian.Uint32(entry[4:]))
+		switch tag {
+		case aclUser:
+			r.ACL = append(r.ACL, ACLEntry{ID: id, Name: userName(id), Perm: perm})
+		case aclGroup:
+			r.ACL = append(r.ACL, ACLEntry{Group: true, ID: id, Name: groupName(id), Perm: perm})
+		case aclMask:
+			r.ACLMask = perm
+		}
+	}
+}
+
+func (r *Report) checkUser() {
+	r.User = userName(os.Getuid())
+	have := map[string]bool{}
+	gids, _ := os.Getgroups()
+	gids = append(gids, os.Getgid())
+	for _, gid := range gids {
+		name := groupName(gid)
+		if !have[name] {
+			have[name] = true
+			r.Groups = append(r.Groups, name)
+		}
+	}
+	sort.Strings(r.Groups)
+	if u, err := user.LookupId(strconv.Itoa(os.Getuid())); err == nil {
+		ids, _ := u.GroupIds()
+		for _, id := range ids {
+			gid, _ := strconv.Atoi(id)
+			if name := groupName(gid); !have[name] {
+				r.StaleGroups = append(r.StaleGroups, name)
+			}
+		}
+	}
+}
+
+func (r *Report) inGroup(name string) bool {
+	for _, g := range r.Groups {
+		if g == name {
+			return true
+		}
+	}
+	return false
+}
+
+var (
+	ruleVendor  = regexp.MustCompile(`idVendor}=="([^"]*)"`)
+	ruleProduct = regexp.MustCompile(`idProduct}=="([^"]*)"`)
+)
+
+// The lines of rules files that match the device by ID. Lines that
+// don't mention a product match any of the vendor's.
+func (c *Checker) findRules(vendor, product uint16) []RuleMatch {
+	vid, pid := fmt.Sprintf("%04x", vendor), fmt.Sprintf("%04x", product)
+	seen := map[string]bool{}
+	var files []string
+	for _, dir := range c.RuleDirs {
+		names, _ := filepath.Glob(filepath.Join(dir, "*.rules"))
+		for _, name := range names {
+			if !seen[filepath.Base(name)] {
+				seen[filepath.Base(name)] = true
+				files = append(files, name)
+			}
+		}
+	}
+	// udev reads them in order of name, whatever the directory
+	sort.Slice(files, func(i, j int) bool { return filepath.Base(files[i]) < filepath.Base(files[j]) })
+
+	var ret []RuleMatch
+	for _, name := range files {
+		f, err := os.Open(name)
+		if err != nil {
+			continue
+		}
+		scanner := bufio.NewScanner(f)
+		for line := 1; scanner.Scan(); line++ {
+			text := strings.TrimSpace(scanner.Text())
+			if strings.HasPrefix(text, "#") {
+				continue
+			}
+			m := ruleVendor.FindStringSubmatch(text)
+			if m == nil || !globMatch(m[1], vid) {
+				continue
+			}
+			if m := ruleProduct.FindStringSubmatch(text); m != nil && !globMatch(m[1], pid) {
+				continue
+			}
+			ret = append(ret, RuleMatch{File: name, Line: line, Text: text})
+		}
+		f.Close()
+	}
+	return ret
+}
+
+// udev matches with shell patterns, and alternatives split by |
+func globMatch(pattern, s string) bool {
+	for _, alt := range strings.Split(strings.ToLower(pattern), "|") {
+		if ok, _ := filepath.Match(alt, s); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Which of the owner, group and other bits, or which ACL entry,
+// decides this process's access, and what it allows
+func (r *Report) governing() (string, os.FileMode) {
+	if os.Getuid() == r.UID {
+		return fmt.Sprintf("you own it (%s)", r.Owner), r.Mode >> 6 & 7
+	}
+	mask := os.FileMode(7)
+	if len(r.ACL) > 0 {
+		mask = r.ACLMask
+	}
+	for _, e := range r.ACL {
+		if !e.Group && e.ID == os.Getuid() {
+			return "its ACL names you", e.Perm & mask
+		}
+	}
+	// Any group that matches may grant access
+	var why []string
+	var perm os.FileMode
+	matched := false
+	if r.inGroup(r.GroupName) {
+		why = append(why, "group "+r.GroupName)
+		perm |= r.Mode >> 3 & 7 & mask
+		matched = true
+	}
+	for _, e := range r.ACL {
+		if e.Group && r.inGroup(e.Name) {
+			why = append(why, "group "+e.Name+" (from its ACL)")
+			perm |= e.Perm & mask
+			matched = true
+		}
+	}
+	if matched {
+		return "you are in " + strings.Join(why, " and "), perm
+	}
+	return "you are neither its owner nor in its group", r.Mode & 7
+}
+
+func permWords(perm os.FileMode) string {
+	switch perm & 6 {
+	case 6:
+		return "read and write"
+	case 4:
+		return "only read"
+	case 2:
+		return "only write"
+	}
+	return "do nothing with"
+}
+
+func (r *Report) problem(format string, args ...interface{}) {
+	r.Problems = append(r.Problems, fmt.Sprintf(format, args...))
+}
+
+func (r *Report) explain(desc usb.DeviceDescriptor, have_desc bool) {
+	if !r.Exists {
+		r.problem("There is no device node at %s. Either the device has just been unplugged, or /dev/bus/usb isn't there, as in a container that hasn't been given it.", r.Path)
+		return
+	}
+
+	if !r.Writable {
+		if os.Getuid() == 0 {
+			r.problem("%s can't be opened even though you are root, so something other than its permissions stops it: a security module such as SELinux or AppArmor, or a container's device rules.", r.Path)
+			return
+		}
+		if have_desc {
+			r.Suggested = &Rule{Vendor: desc.IdVendor, Product: desc.IdProduct, Uaccess: true}
+		}
+		why, perm := r.governing()
+		r.problem("%s is owned by %s, group %s, with mode %04o, and %s, so you may %s it; opening a device needs both.", r.Path, r.Owner, r.GroupName, r.Mode, why, permWords(perm))
+		for _, e := range r.ACL {
+			if !e.Group && e.ID != os.Getuid() {
+				r.problem("Its ACL gives %s access, most likely because they are logged in at the local seat and a udev rule tags the device with uaccess. Access follows whoever is logged in there, not whoever runs the program.", e.Name)
+			}
+		}
+		for _, g := range r.StaleGroups {
+			if g == r.GroupName {
+				r.problem("You are in group %s, but this process isn't, because you were added to it after logging in. Log out and back in (or use newgrp) and try again.", g)
+			}
+		}
+		if len(r.Rules) == 0 {
+			r.problem("No udev rule mentions the device, so it has the default permissions. A rule like the suggested one, in /etc/udev/rules.d, would give you access once the device is plugged in again.")
+		} else {
+			r.problem("%d udev rule(s) mention the device (listed above), but none gives you access; a later rule may override them, or they may have been added after the device was plugged in.", len(r.Rules))
+		}
+		return
+	}
+
+	// It can be opened, but its interfaces may be held
+	var held []string
+	ifaces := make([]int, 0, len(r.Device.Drivers))
+	for n := range r.Device.Drivers {
+		ifaces = append(ifaces, int(n))
+	}
+	sort.Ints(ifaces)
+	for _, n := range ifaces {
+		if driver := r.Device.Drivers[byte(n)]; driver != "usbfs" {
+			held = append(held, fmt.Sprintf("%d (%s)", n, driver))
+		}
+	}
+	if len(held) > 0 {
+		r.problem("The device can be opened, but kernel drivers hold interface(s) %s; claiming them fails as busy until the driver is detached, such as with Interface.DetachKernelDriver.", strings.Join(held, ", "))
+	}
+	for n, driver := range r.Device.Drivers {
+		if driver == "usbfs" {
+			r.problem("Interface %d is claimed by another program using the device directly.", n)
+		}
+	}
+}
+
+// The report, as it would be shown to whoever has to fix things
+func (r *Report) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Device %s (bus %d, address %d)", r.Device.Name, r.Device.Bus, r.Device.Address)
+	if r.Device.Product != "" {
+		fmt.Fprintf(&b, ": %s", r.Device.Product)
+	}
+	b.WriteString("\n")
+	if r.Exists {
+		fmt.Fprintf(&b, "  node:    %s, %s:%s, mode %04o\n", r.Path, r.Owner, r.GroupName, r.Mode)
+		for _, e := range r.ACL {
+			kind := "user"
+			if e.Group {
+				kind = "group"
+			}
+			fmt.Fprintf(&b, "  acl:     %s %s may %s it\n", kind, e.Name, permWords(e.Perm))
+		}
+	}
+	fmt.Fprintf(&b, "  you:     %s, in %s\n", r.User, strings.Join(r.Groups, ", "))
+	for _, rule := range r.Rules {
+		fmt.Fprintf(&b, "  rule:    %s:%d: %s\n", rule.File, rule.Line, rule.Text)
+	}
+	if len(r.Problems) == 0 {
+		b.WriteString("Nothing stands in the way of opening it.\n")
+	}
+	for _, p := range r.Problems {
+		fmt.Fprintf(&b, "* %s\n", p)
+	}
+	if r.Suggested != nil {
+		fmt.Fprintf(&b, "Suggested rule, for /etc/udev/rules.d/%s:\n  %s\n", r.Suggested.FileName(), r.Suggested)
+	}
+	return b.String()
+}
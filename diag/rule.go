@@ -0,0 +1,65 @@
+// Package diag explains why a device can't be opened, and writes the
+// udev rule that would let it be.
+//
+// A Report looks at what decides whether a device node may be opened
+// on Linux: its owner, group, mode and ACL, the groups the process is
+// in, and the udev rules that mention the device; and also at which
+// kernel drivers hold its interfaces, which is what stops them being
+// claimed.
+//
+//	if err == usb.UsbErrorAccess {
+//		if r, err := diag.Diagnose(dev); err == nil {
+//			fmt.Print(r)
+//		}
+//	}
+package diag
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// A udev rule giving access to a device
+type Rule struct {
+	Vendor, Product uint16
+	// If set, only the device with this serial number
+	Serial string
+
+	// Give the user logged in at the local seat access, with an ACL
+	// that follows them as they log in and out
+	Uaccess bool
+	// If set, the device node's group and mode
+	Group string
+	Mode  os.FileMode
+}
+
+// Characters that udev would take as a pattern, or that would end the
+// string; they are matched with ? instead
+var udevEscaper = strings.NewReplacer(`*`, `?`, `?`, `?`, `[`, `?`, `\`, `?`, `"`, `?`)
+
+// The rule, as a line for a rules file
+func (r Rule) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, `SUBSYSTEM=="usb", ENV{DEVTYPE}=="usb_device", ATTR{idVendor}=="%04x", ATTR{idProduct}=="%04x"`, r.Vendor, r.Product)
+	if r.Serial != "" {
+		fmt.Fprintf(&b, `, ATTR{serial}=="%s"`, udevEscaper.Replace(r.Serial))
+	}
+	if r.Group != "" {
+		fmt.Fprintf(&b, `, GROUP="%s"`, r.Group)
+	}
+	if r.Mode != 0 {
+		fmt.Fprintf(&b, `, MODE="%04o"`, r.Mode.Perm())
+	}
+	if r.Uaccess {
+		b.WriteString(`, TAG+="uaccess"`)
+	}
+	return b.String()
+}
+
+// A name for the file to put the rule in, under /etc/udev/rules.d.
+// The uaccess tag only works in rules read before 73-seat-late.rules,
+// so the name sorts before it.
+func (r Rule) FileName() string {
+	return fmt.Sprintf("70-usb-%04x-%04x.rules", r.Vendor, r.Product)
+}
@@ -0,0 +1,93 @@
+//go:build linux
+
+// Explain why a device can't be opened, or write a udev rule so that it
+// can be.
+//
+//	usbdiag -d 2047:0200                         # what stands in the way
+//	usbdiag -serial 1234 -rule -group plugdev    # a rule for the device
+//
+// With -rule, the rule is printed, along with the name of the file in
+// /etc/udev/rules.d to put it in.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+
+	"gopkg.thequux.com/usb"
+	"gopkg.thequux.com/usb/diag"
+)
+
+func main() {
+	device := flag.String("d", "", "the device with this `vid:pid`")
+	serial := flag.String("serial", "", "the device with this serial `number`")
+	rule := flag.Bool("rule", false, "print a udev rule for the device rather than diagnosing it")
+	uaccess := flag.Bool("uaccess", true, "with -rule, give the user at the local seat access")
+	group := flag.String("group", "", "with -rule, the `group` to give the device node")
+	mode := flag.String("mode", "", "with -rule, the `mode` to give the device node, in octal, such as 660")
+	flag.Parse()
+
+	if (*device == "" && *serial == "") || flag.NArg() != 0 {
+		fmt.Fprintln(os.Stderr, "usage: usbdiag [-d vid:pid] [-serial serial] [-rule [-uaccess=false] [-group group] [-mode mode]]")
+		os.Exit(2)
+	}
+	var perm uint64
+	if *mode != "" {
+		var err error
+		if perm, err = strconv.ParseUint(*mode, 8, 32); err != nil || perm > 0777 {
+			log.Fatal("bad mode ", *mode, ", should be octal, like 660")
+		}
+	}
+	vid, pid := -1, -1
+	if *device != "" {
+		if _, err := fmt.Sscanf(*device, "%x:%x", &vid, &pid); err != nil {
+			log.Fatal("bad device ", *device, ": ", err)
+		}
+	}
+
+	c := diag.NewChecker()
+	devs, uerr := usb.ListSysfsDevices(c.Sysfs)
+	if uerr != nil {
+		log.Fatal("listing devices: ", uerr)
+	}
+	var found *usb.SysfsDevice
+	var desc usb.DeviceDescriptor
+	for _, dev := range devs {
+		d, err := dev.GetDeviceDescriptor()
+		if err != nil {
+			continue
+		}
+		if (vid >= 0 && (int(d.IdVendor) != vid || int(d.IdProduct) != pid)) ||
+			(*serial != "" && dev.Serial != *serial) {
+			continue
+		}
+		if found != nil {
+			log.Fatal("more than one device matches; use -serial to pick one")
+		}
+		found, desc = dev, d
+	}
+	if found == nil {
+		log.Fatal("no such device")
+	}
+
+	if *rule {
+		r := diag.Rule{
+			Vendor:  desc.IdVendor,
+			Product: desc.IdProduct,
+			Serial:  *serial,
+			Uaccess: *uaccess,
+			Group:   *group,
+			Mode:    os.FileMode(perm),
+		}
+		fmt.Printf("# /etc/udev/rules.d/%s\n%s\n", r.FileName(), r)
+		return
+	}
+	report, err := c.Check(found.Bus, found.Address)
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Print(report)
+}
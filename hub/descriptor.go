@@ -0,0 +1,125 @@
+package hub
+
+import (
+	"encoding/binary"
+	"time"
+
+	"gopkg.thequux.com/usb"
+)
+
+// Power switching modes, from wHubCharacteristics
+const (
+	POWER_SWITCHING_GANGED     = 0
+	POWER_SWITCHING_INDIVIDUAL = 1
+	POWER_SWITCHING_NONE       = 2
+)
+
+// Over-current protection modes, from wHubCharacteristics
+const (
+	OVER_CURRENT_GLOBAL     = 0
+	OVER_CURRENT_INDIVIDUAL = 1
+	OVER_CURRENT_NONE       = 2
+)
+
+// The hub class descriptor. USB 2 hubs use DT_HUB, SuperSpeed hubs
+// DT_SS_HUB; fields only present in one of them are zero in the other.
+type Descriptor struct {
+	BDescLength         byte
+	BDescriptorType     usb.DescriptorType
+	BNbrPorts           byte
+	WHubCharacteristics uint16
+	BPwrOn2PwrGood      byte   // in units of 2ms
+	BHubContrCurrent    byte   // mA
+	BHubHdrDecLat       byte   // SuperSpeed only
+	WHubDelay           uint16 // ns, SuperSpeed only
+
+	// Bitmap indexed by port number; bit 0 is reserved
+	DeviceRemovable []byte
+	// USB 2 only, and unused since USB 1.1
+	PortPwrCtrlMask []byte
+}
+
+func ParseDescriptor(buf []byte) (Descriptor, error) {
+	if len(buf) < 7 || buf[0] < 7 || int(buf[0]) > len(buf) {
+		return Descriptor{}, ErrMalformed
+	}
+	buf = buf[:buf[0]]
+	d := Descriptor{
+		BDescLength:         buf[0],
+		BDescriptorType:     usb.DescriptorType(buf[1]),
+		BNbrPorts:           buf[2],
+		WHubCharacteristics: binary.LittleEndian.Uint16(buf[3:]),
+		BPwrOn2PwrGood:      buf[5],
+		BHubContrCurrent:    buf[6],
+	}
+	switch d.BDescriptorType {
+	case usb.DT_HUB:
+		// DeviceRemovable and PortPwrCtrlMask are one bit per port
+		// plus the reserved bit 0, rounded up to whole bytes
+		n := (int(d.BNbrPorts) + 8) / 8
+		if len(buf) < 7+n {
+			return Descriptor{}, ErrMalformed
+		}
+		d.DeviceRemovable = append([]byte(nil), buf[7:7+n]...)
+		// Some hubs leave off the legacy mask
+		if len(buf) >= 7+2*n {
+			d.PortPwrCtrlMask = append([]byte(nil), buf[7+n:7+2*n]...)
+		}
+	case usb.DT_SS_HUB:
+		if len(buf) < 12 {
+			return Descriptor{}, ErrMalformed
+		}
+		d.BHubHdrDecLat = buf[7]
+		d.WHubDelay = binary.LittleEndian.Uint16(buf[8:])
+		d.DeviceRemovable = append([]byte(nil), buf[10:12]...)
+	default:
+		return Descriptor{}, ErrMalformed
+	}
+	return d, nil
+}
+
+// One of the POWER_SWITCHING_* constants
+func (d *Descriptor) PowerSwitching() int {
+	if d.WHubCharacteristics&0x02 != 0 {
+		return POWER_SWITCHING_NONE
+	}
+	return int(d.WHubCharacteristics & 0x01)
+}
+
+// Whether the hub is part of a compound device
+func (d *Descriptor) IsCompound() bool {
+	return d.WHubCharacteristics&0x04 != 0
+}
+
+// One of the OVER_CURRENT_* constants
+func (d *Descriptor) OverCurrentProtection() int {
+	if d.WHubCharacteristics&0x10 != 0 {
+		return OVER_CURRENT_NONE
+	}
+	return int(d.WHubCharacteristics>>3) & 0x01
+}
+
+// Transaction translator think time in FS bit times (8 to 32); only
+// meaningful for high-speed hubs.
+func (d *Descriptor) TTThinkTime() int {
+	return 8 * (int(d.WHubCharacteristics>>5)&0x03 + 1)
+}
+
+// Whether the hub has per-port indicator LEDs. SuperSpeed hubs never do.
+func (d *Descriptor) HasPortIndicators() bool {
+	return d.BDescriptorType == usb.DT_HUB && d.WHubCharacteristics&0x80 != 0
+}
+
+// How long to wait after powering a port before its power is good
+func (d *Descriptor) PowerOnDelay() time.Duration {
+	return time.Duration(d.BPwrOn2PwrGood) * 2 * time.Millisecond
+}
+
+// Whether the device on the given port (counting from 1) can be
+// unplugged. Ports with a soldered-down device report false.
+func (d *Descriptor) Removable(port int) bool {
+	if port < 1 || port > int(d.BNbrPorts) || port/8 >= len(d.DeviceRemovable) {
+		return true
+	}
+	return d.DeviceRemovable[port/8]&(1<<uint(port%8)) == 0
+}
@@ -0,0 +1,349 @@
+// A driver for the hub class: reading the hub descriptor and port
+// status, and switching port features such as power, which is enough
+// to power-cycle individual devices on hubs that support it.
+//
+// The kernel's hub driver can stay bound; these are plain class
+// requests on the control endpoint. It may however notice a port
+// going away and react to it.
+package hub
+
+import (
+	"encoding/binary"
+	"errors"
+	"time"
+
+	"gopkg.thequux.com/usb"
+)
+
+var (
+	ErrMalformed  = errors.New("hub: malformed descriptor")
+	ErrNotHub     = errors.New("hub: device is not a hub")
+	ErrNoSuchPort = errors.New("hub: no such port")
+)
+
+// Feature selectors for SetPortFeature and ClearPortFeature
+const (
+	PORT_CONNECTION     = 0
+	PORT_ENABLE         = 1
+	PORT_SUSPEND        = 2
+	PORT_OVER_CURRENT   = 3
+	PORT_RESET          = 4
+	PORT_LINK_STATE     = 5
+	PORT_POWER          = 8
+	PORT_LOW_SPEED      = 9
+	C_PORT_CONNECTION   = 16
+	C_PORT_ENABLE       = 17
+	C_PORT_SUSPEND      = 18
+	C_PORT_OVER_CURRENT = 19
+	C_PORT_RESET        = 20
+	PORT_TEST           = 21
+	PORT_INDICATOR      = 22
+
+	// SuperSpeed only
+	PORT_U1_TIMEOUT       = 23
+	PORT_U2_TIMEOUT       = 24
+	C_PORT_LINK_STATE     = 25
+	C_PORT_CONFIG_ERROR   = 26
+	PORT_REMOTE_WAKE_MASK = 27
+	BH_PORT_RESET         = 28
+	C_BH_PORT_RESET       = 29
+	FORCE_LINKPM_ACCEPT   = 30
+)
+
+// Port indicator selectors for SetIndicator
+const (
+	INDICATOR_AUTO  = 0
+	INDICATOR_AMBER = 1
+	INDICATOR_GREEN = 2
+	INDICATOR_OFF   = 3
+)
+
+// Bits of wPortStatus. Where USB 2 and SuperSpeed hubs disagree, the
+// SuperSpeed variant is prefixed SS_.
+const (
+	PORT_STAT_CONNECTION   = 0x0001
+	PORT_STAT_ENABLE       = 0x0002
+	PORT_STAT_SUSPEND      = 0x0004
+	PORT_STAT_OVER_CURRENT = 0x0008
+	PORT_STAT_RESET        = 0x0010
+	PORT_STAT_L1           = 0x0020
+	PORT_STAT_POWER        = 0x0100
+	PORT_STAT_LOW_SPEED    = 0x0200
+	PORT_STAT_HIGH_SPEED   = 0x0400
+	PORT_STAT_TEST         = 0x0800
+	PORT_STAT_INDICATOR    = 0x1000
+
+	SS_PORT_STAT_LINK_STATE = 0x01e0
+	SS_PORT_STAT_POWER      = 0x0200
+	SS_PORT_STAT_SPEED      = 0x1c00
+)
+
+// Bits of wPortChange
+const (
+	PORT_STAT_C_CONNECTION   = 0x0001
+	PORT_STAT_C_ENABLE       = 0x0002
+	PORT_STAT_C_SUSPEND      = 0x0004
+	PORT_STAT_C_OVER_CURRENT = 0x0008
+	PORT_STAT_C_RESET        = 0x0010
+	PORT_STAT_C_L1           = 0x0020
+
+	SS_PORT_STAT_C_BH_RESET     = 0x0020
+	SS_PORT_STAT_C_LINK_STATE   = 0x0040
+	SS_PORT_STAT_C_CONFIG_ERROR = 0x0080
+)
+
+// SuperSpeed link states, from PortStatus.LinkState
+const (
+	LINK_STATE_U0          = 0x0
+	LINK_STATE_U1          = 0x1
+	LINK_STATE_U2          = 0x2
+	LINK_STATE_U3          = 0x3
+	LINK_STATE_SS_DISABLED = 0x4
+	LINK_STATE_RX_DETECT   = 0x5
+	LINK_STATE_SS_INACTIVE = 0x6
+	LINK_STATE_POLLING     = 0x7
+	LINK_STATE_RECOVERY    = 0x8
+	LINK_STATE_HOT_RESET   = 0x9
+	LINK_STATE_COMPLIANCE  = 0xa
+	LINK_STATE_LOOPBACK    = 0xb
+)
+
+const requestTimeout = time.Second
+
+// Status and change bits of a port, or of the hub itself
+type PortStatus struct {
+	Status     uint16
+	Change     uint16
+	SuperSpeed bool
+}
+
+func (s PortStatus) Connected() bool   { return s.Status&PORT_STAT_CONNECTION != 0 }
+func (s PortStatus) Enabled() bool     { return s.Status&PORT_STAT_ENABLE != 0 }
+func (s PortStatus) OverCurrent() bool { return s.Status&PORT_STAT_OVER_CURRENT != 0 }
+func (s PortStatus) Resetting() bool   { return s.Status&PORT_STAT_RESET != 0 }
+
+// SuperSpeed ports have no suspend bit; U3 is their suspend.
+func (s PortStatus) Suspended() bool {
+	if s.SuperSpeed {
+		return s.LinkState() == LINK_STATE_U3
+	}
+	return s.Status&PORT_STAT_SUSPEND != 0
+}
+
+func (s PortStatus) Powered() bool {
+	if s.SuperSpeed {
+		return s.Status&SS_PORT_STAT_POWER != 0
+	}
+	return s.Status&PORT_STAT_POWER != 0
+}
+
+// One of the LINK_STATE_* constants; zero for USB 2 ports
+func (s PortStatus) LinkState() int {
+	if !s.SuperSpeed {
+		return 0
+	}
+	return int(s.Status&SS_PORT_STAT_LINK_STATE) >> 5
+}
+
+// "low", "full", "high" or "super" for a connected device
+func (s PortStatus) Speed() string {
+	switch {
+	case !s.Connected():
+		return ""
+	case s.SuperSpeed:
+		return "super"
+	case s.Status&PORT_STAT_LOW_SPEED != 0:
+		return "low"
+	case s.Status&PORT_STAT_HIGH_SPEED != 0:
+		return "high"
+	}
+	return "full"
+}
+
+type Hub struct {
+	Handle     *usb.DeviceHandle
+	Descriptor Descriptor
+	SuperSpeed bool
+}
+
+// Wrap an open hub, reading its hub descriptor. SuperSpeed hubs
+// (USB 3 hubs have a separate SuperSpeed half that shows up as its
+// own device) are told apart by their device protocol.
+func Open(h *usb.DeviceHandle) (*Hub, error) {
+	dd, err := h.GetDevice().GetDeviceDescriptor()
+	if err != nil {
+		return nil, err
+	}
+	if dd.BDeviceClass != usb.CLASS_HUB {
+		return nil, ErrNotHub
+	}
+	hub := &Hub{Handle: h, SuperSpeed: dd.BcdUSB >= 0x0300 && dd.BDeviceProtocol == 3}
+	dtype := usb.DT_HUB
+	if hub.SuperSpeed {
+		dtype = usb.DT_SS_HUB
+	}
+	buf := make([]byte, 71) // enough for 255 ports
+	n, err := h.ControlTransfer(usb.DIR_IN|usb.REQUEST_TYPE_CLASS|usb.RECIPIENT_DEVICE,
+		usb.REQUEST_GET_DESCRIPTOR, uint16(dtype)<<8, 0, buf, requestTimeout)
+	if err != nil {
+		return nil, err
+	}
+	desc, perr := ParseDescriptor(buf[:n])
+	if perr != nil {
+		return nil, perr
+	}
+	hub.Descriptor = desc
+	return hub, nil
+}
+
+func (hub *Hub) NumPorts() int {
+	return int(hub.Descriptor.BNbrPorts)
+}
+
+func (hub *Hub) checkPort(port int) error {
+	if port < 1 || port > hub.NumPorts() {
+		return ErrNoSuchPort
+	}
+	return nil
+}
+
+func (hub *Hub) getStatus(recipient byte, port int) (PortStatus, error) {
+	buf := make([]byte, 4)
+	n, err := hub.Handle.ControlTransfer(usb.DIR_IN|usb.REQUEST_TYPE_CLASS|recipient,
+		usb.REQUEST_GET_STATUS, 0, uint16(port), buf, requestTimeout)
+	if err != nil {
+		return PortStatus{}, err
+	}
+	if n < 4 {
+		return PortStatus{}, ErrMalformed
+	}
+	return PortStatus{
+		Status:     binary.LittleEndian.Uint16(buf),
+		Change:     binary.LittleEndian.Uint16(buf[2:]),
+		SuperSpeed: hub.SuperSpeed,
+	}, nil
+}
+
+// Status of the hub as a whole: local power and over-current bits
+func (hub *Hub) GetHubStatus() (PortStatus, error) {
+	return hub.getStatus(usb.RECIPIENT_DEVICE, 0)
+}
+
+// Status of a port, counting from 1
+func (hub *Hub) GetPortStatus(port int) (PortStatus, error) {
+	if err := hub.checkPort(port); err != nil {
+		return PortStatus{}, err
+	}
+	return hub.getStatus(usb.RECIPIENT_OTHER, port)
+}
+
+func (hub *Hub) portFeature(request byte, port int, feature uint16, selector byte) error {
+	if err := hub.checkPort(port); err != nil {
+		return err
+	}
+	_, err := hub.Handle.ControlTransfer(usb.DIR_OUT|usb.REQUEST_TYPE_CLASS|usb.RECIPIENT_OTHER,
+		request, feature, uint16(selector)<<8|uint16(port), nil, requestTimeout)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+func (hub *Hub) SetPortFeature(port int, feature uint16) error {
+	return hub.portFeature(usb.REQUEST_SET_FEATURE, port, feature, 0)
+}
+
+func (hub *Hub) ClearPortFeature(port int, feature uint16) error {
+	return hub.portFeature(usb.REQUEST_CLEAR_FEATURE, port, feature, 0)
+}
+
+// Switch port power. On hubs with ganged power switching this affects
+// every port, and on hubs without power switching it has no effect
+// at all; check Descriptor.PowerSwitching.
+func (hub *Hub) SetPower(port int, on bool) error {
+	if on {
+		return hub.SetPortFeature(port, PORT_POWER)
+	}
+	return hub.ClearPortFeature(port, PORT_POWER)
+}
+
+// Turn a port off, wait, and turn it back on, waiting for power to
+// become good before returning.
+func (hub *Hub) PowerCycle(port int, off time.Duration) error {
+	if err := hub.SetPower(port, false); err != nil {
+		return err
+	}
+	time.Sleep(off)
+	if err := hub.SetPower(port, true); err != nil {
+		return err
+	}
+	time.Sleep(hub.Descriptor.PowerOnDelay())
+	return nil
+}
+
+// Start a port reset. The reset completes asynchronously; the
+// PORT_STAT_C_RESET change bit is set when it's done.
+func (hub *Hub) Reset(port int) error {
+	return hub.SetPortFeature(port, PORT_RESET)
+}
+
+// Suspend or resume a port. On SuperSpeed hubs this moves the link
+// to U3 or back to U0 instead.
+func (hub *Hub) SetSuspend(port int, suspend bool) error {
+	if hub.SuperSpeed {
+		state := byte(LINK_STATE_U0)
+		if suspend {
+			state = LINK_STATE_U3
+		}
+		return hub.portFeature(usb.REQUEST_SET_FEATURE, port, PORT_LINK_STATE, state)
+	}
+	if suspend {
+		return hub.SetPortFeature(port, PORT_SUSPEND)
+	}
+	return hub.ClearPortFeature(port, PORT_SUSPEND)
+}
+
+// Set the port indicator LED to one of the INDICATOR_* selectors.
+// Needs Descriptor.HasPortIndicators.
+func (hub *Hub) SetIndicator(port int, selector byte) error {
+	return hub.portFeature(usb.REQUEST_SET_FEATURE, port, PORT_INDICATOR, selector)
+}
+
+// Which feature acknowledges which change bit
+type changeFeature struct {
+	bit     uint16
+	feature uint16
+}
+
+var changeFeatures = []changeFeature{
+	{PORT_STAT_C_CONNECTION, C_PORT_CONNECTION},
+	{PORT_STAT_C_ENABLE, C_PORT_ENABLE},
+	{PORT_STAT_C_SUSPEND, C_PORT_SUSPEND},
+	{PORT_STAT_C_OVER_CURRENT, C_PORT_OVER_CURRENT},
+	{PORT_STAT_C_RESET, C_PORT_RESET},
+}
+
+var ssChangeFeatures = []changeFeature{
+	{PORT_STAT_C_CONNECTION, C_PORT_CONNECTION},
+	{PORT_STAT_C_OVER_CURRENT, C_PORT_OVER_CURRENT},
+	{PORT_STAT_C_RESET, C_PORT_RESET},
+	{SS_PORT_STAT_C_BH_RESET, C_BH_PORT_RESET},
+	{SS_PORT_STAT_C_LINK_STATE, C_PORT_LINK_STATE},
+	{SS_PORT_STAT_C_CONFIG_ERROR, C_PORT_CONFIG_ERROR},
+}
+
+// Acknowledge every change bit set in status
+func (hub *Hub) ClearChanges(port int, status PortStatus) error {
+	features := changeFeatures
+	if hub.SuperSpeed {
+		features = ssChangeFeatures
+	}
+	for _, f := range features {
+		if status.Change&f.bit != 0 {
+			if err := hub.ClearPortFeature(port, f.feature); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -1,14 +1,9 @@
 package usb
 
-// #cgo CFLAGS: -I/usr/include/libusb-1.0
-// #cgo LDFLAGS: -lusb-1.0
-// #include <libusb.h>
-// #include <malloc.h>
-import "C"
 import (
 	"io"
 	"syscall"
-	"unsafe"
+	"time"
 )
 
 type Endpoint interface {
@@ -34,9 +29,15 @@ type EndpointHandle struct {
 	descriptor *EndpointDescriptor
 	readable   bool
 	ep         byte // endpoint number
+	timeout    time.Duration
 	transfer   func(ep *EndpointHandle, p []byte, for_read bool) (n int, err error)
 }
 
+// Set how long Read and Write wait. The default, 0, waits forever.
+func (ep *EndpointHandle) SetTimeout(timeout time.Duration) {
+	ep.timeout = timeout
+}
+
 func (ep *EndpointHandle) Write(p []byte) (n int, err error) {
 	if ep.readable {
 		return 0, syscall.EBADF
@@ -78,32 +79,119 @@ func (s TwoWayStream) Write(p []byte) (n int, err error) {
 }
 
 func interruptTransfer(ep *EndpointHandle, p []byte, _ bool) (n int, err error) {
-	var transferred C.int
-	err0 := returnUsbError(C.libusb_interrupt_transfer(
-		ep.handle.handle,
-		C.uchar(ep.ep),
-		(*C.uchar)(unsafe.Pointer(&p[0])),
-		C.int(len(p)),
-		&transferred,
-		0))
+	n, err0 := ep.handle.do(&Transfer{
+		Type:     TRANSFER_TYPE_INTERRUPT,
+		Endpoint: ep.ep,
+		Buffer:   p,
+		Timeout:  ep.timeout,
+	})
 	if err0 != nil {
 		err = err0
 	}
-	return int(transferred), err
+	return n, err
 }
 
 func bulkTransfer(ep *EndpointHandle, p []byte, _ bool) (n int, err error) {
-	var transferred C.int
-	err0 := returnUsbError(C.libusb_bulk_transfer(
-		ep.handle.handle,
-		C.uchar(ep.ep),
-		(*C.uchar)(unsafe.Pointer(&p[0])),
-		C.int(len(p)),
-		&transferred,
-		0))
+	n, err0 := ep.handle.do(&Transfer{
+		Type:     TRANSFER_TYPE_BULK,
+		Endpoint: ep.ep,
+		Buffer:   p,
+		Timeout:  ep.timeout,
+	})
 	if err0 != nil {
 		err = err0
 	}
 
-	return int(transferred), err
+	return n, err
+}
+
+// Split p into as many packets as it takes. Reads return the data
+// of all packets packed together; the error is only reported if no
+// packet got through.
+func isoTransfer(ep *EndpointHandle, p []byte, for_read bool) (n int, err error) {
+	size, err0 := ep.handle.GetDevice().GetMaxIsoPacketSize(int(ep.ep))
+	if err0 != nil {
+		return 0, err0
+	}
+	if size == 0 {
+		return 0, UsbErrorInvalidParam
+	}
+	t := &Transfer{
+		Type:     TRANSFER_TYPE_ISOCHRONOUS,
+		Endpoint: ep.ep,
+		Buffer:   p,
+		Timeout:  ep.timeout,
+	}
+	for left := len(p); left > 0; left -= size {
+		length := size
+		if left < size {
+			length = left
+		}
+		t.IsoPackets = append(t.IsoPackets, IsoPacket{Length: length})
+	}
+	if _, err0 = ep.handle.do(t); err0 != nil {
+		return 0, err0
+	}
+
+	var first *UsbError
+	for i, pkt := range t.IsoPackets {
+		if pkt.Status != nil && first == nil {
+			first = pkt.Status
+		}
+		if for_read {
+			copy(p[n:], p[i*size:i*size+pkt.Actual])
+		}
+		n += pkt.Actual
+	}
+	if n == 0 && first != nil {
+		err = first
+	}
+	return n, err
+}
+
+// Fields of bmRequestType in a control setup packet
+const (
+	REQUEST_TYPE_STANDARD = 0x00 << 5
+	REQUEST_TYPE_CLASS    = 0x01 << 5
+	REQUEST_TYPE_VENDOR   = 0x02 << 5
+	REQUEST_TYPE_MASK     = 0x03 << 5
+
+	RECIPIENT_DEVICE    = 0x00
+	RECIPIENT_INTERFACE = 0x01
+	RECIPIENT_ENDPOINT  = 0x02
+	RECIPIENT_OTHER     = 0x03
+	RECIPIENT_MASK      = 0x1f
+)
+
+// Standard requests, chapter 9 of the USB 2.0 spec
+const (
+	REQUEST_GET_STATUS        = 0x00
+	REQUEST_CLEAR_FEATURE     = 0x01
+	REQUEST_SET_FEATURE       = 0x03
+	REQUEST_SET_ADDRESS       = 0x05
+	REQUEST_GET_DESCRIPTOR    = 0x06
+	REQUEST_SET_DESCRIPTOR    = 0x07
+	REQUEST_GET_CONFIGURATION = 0x08
+	REQUEST_SET_CONFIGURATION = 0x09
+	REQUEST_GET_INTERFACE     = 0x0A
+	REQUEST_SET_INTERFACE     = 0x0B
+	REQUEST_SYNCH_FRAME       = 0x0C
+)
+
+// Perform a control transfer on endpoint 0. The direction bit of
+// bmRequestType decides whether data is read or written; wLength is
+// len(data). A timeout of 0 waits forever. Returns the number of
+// bytes actually transferred.
+func (h *DeviceHandle) ControlTransfer(bmRequestType, bRequest byte, wValue, wIndex uint16, data []byte, timeout time.Duration) (int, *UsbError) {
+	return h.do(&Transfer{
+		Type: TRANSFER_TYPE_CONTROL,
+		Setup: SetupPacket{
+			BmRequestType: bmRequestType,
+			BRequest:      bRequest,
+			WValue:        wValue,
+			WIndex:        wIndex,
+		},
+		Buffer:  data,
+		Timeout: timeout,
+	})
 }
@@ -0,0 +1,208 @@
+package usb
+
+import "fmt"
+
+// The LANGIDs most devices use. The full list is in the USB-IF's
+// "Language Identifiers" document; LangIdName knows most of it.
+const (
+	LANGID_ENGLISH_US = 0x0409
+	LANGID_ENGLISH_UK = 0x0809
+	LANGID_GERMAN     = 0x0407
+	LANGID_FRENCH     = 0x040c
+	LANGID_SPANISH    = 0x0c0a
+	LANGID_JAPANESE   = 0x0411
+	LANGID_CHINESE    = 0x0804
+	LANGID_KOREAN     = 0x0412
+	LANGID_HID        = 0x04ff
+)
+
+// Names of full LANGIDs, where the sublanguage matters
+var langIdNames = map[uint16]string{
+	0x0401: "Arabic (Saudi Arabia)",
+	0x0801: "Arabic (Iraq)",
+	0x0c01: "Arabic (Egypt)",
+	0x1001: "Arabic (Libya)",
+	0x1401: "Arabic (Algeria)",
+	0x1801: "Arabic (Morocco)",
+	0x1c01: "Arabic (Tunisia)",
+	0x2001: "Arabic (Oman)",
+	0x2401: "Arabic (Yemen)",
+	0x2801: "Arabic (Syria)",
+	0x2c01: "Arabic (Jordan)",
+	0x3001: "Arabic (Lebanon)",
+	0x3401: "Arabic (Kuwait)",
+	0x3801: "Arabic (U.A.E.)",
+	0x3c01: "Arabic (Bahrain)",
+	0x4001: "Arabic (Qatar)",
+	0x0404: "Chinese (Taiwan)",
+	0x0804: "Chinese (PRC)",
+	0x0c04: "Chinese (Hong Kong SAR, PRC)",
+	0x1004: "Chinese (Singapore)",
+	0x1404: "Chinese (Macau SAR)",
+	0x0407: "German (Standard)",
+	0x0807: "German (Switzerland)",
+	0x0c07: "German (Austria)",
+	0x1007: "German (Luxembourg)",
+	0x1407: "German (Liechtenstein)",
+	0x0409: "English (United States)",
+	0x0809: "English (United Kingdom)",
+	0x0c09: "English (Australian)",
+	0x1009: "English (Canadian)",
+	0x1409: "English (New Zealand)",
+	0x1809: "English (Ireland)",
+	0x1c09: "English (South Africa)",
+	0x2009: "English (Jamaica)",
+	0x2409: "English (Caribbean)",
+	0x2809: "English (Belize)",
+	0x2c09: "English (Trinidad)",
+	0x3009: "English (Zimbabwe)",
+	0x3409: "English (Philippines)",
+	0x040a: "Spanish (Traditional Sort)",
+	0x080a: "Spanish (Mexican)",
+	0x0c0a: "Spanish (Modern Sort)",
+	0x100a: "Spanish (Guatemala)",
+	0x140a: "Spanish (Costa Rica)",
+	0x180a: "Spanish (Panama)",
+	0x1c0a: "Spanish (Dominican Republic)",
+	0x200a: "Spanish (Venezuela)",
+	0x240a: "Spanish (Colombia)",
+	0x280a: "Spanish (Peru)",
+	0x2c0a: "Spanish (Argentina)",
+	0x300a: "Spanish (Ecuador)",
+	0x340a: "Spanish (Chile)",
+	0x380a: "Spanish (Uruguay)",
+	0x3c0a: "Spanish (Paraguay)",
+	0x400a: "Spanish (Bolivia)",
+	0x440a: "Spanish (El Salvador)",
+	0x480a: "Spanish (Honduras)",
+	0x4c0a: "Spanish (Nicaragua)",
+	0x500a: "Spanish (Puerto Rico)",
+	0x040c: "French (Standard)",
+	0x080c: "French (Belgian)",
+	0x0c0c: "French (Canadian)",
+	0x100c: "French (Switzerland)",
+	0x140c: "French (Luxembourg)",
+	0x180c: "French (Monaco)",
+	0x0410: "Italian (Standard)",
+	0x0810: "Italian (Switzerland)",
+	0x0412: "Korean",
+	0x0812: "Korean (Johab)",
+	0x0413: "Dutch (Netherlands)",
+	0x0813: "Dutch (Belgium)",
+	0x0414: "Norwegian (Bokmal)",
+	0x0814: "Norwegian (Nynorsk)",
+	0x0416: "Portuguese (Brazil)",
+	0x0816: "Portuguese (Standard)",
+	0x041a: "Croatian",
+	0x081a: "Serbian (Latin)",
+	0x0c1a: "Serbian (Cyrillic)",
+	0x041d: "Swedish",
+	0x081d: "Swedish (Finland)",
+	0x0420: "Urdu (Pakistan)",
+	0x0820: "Urdu (India)",
+	0x082c: "Azeri (Cyrillic)",
+	0x042c: "Azeri (Latin)",
+	0x043e: "Malay (Malaysian)",
+	0x083e: "Malay (Brunei Darussalam)",
+	0x0443: "Uzbek (Latin)",
+	0x0843: "Uzbek (Cyrillic)",
+	0x0860: "Kashmiri (India)",
+	0x0861: "Nepali (India)",
+	0x04ff: "HID (Usage Data Descriptor)",
+	0xf0ff: "HID (Vendor Defined 1)",
+	0xf4ff: "HID (Vendor Defined 2)",
+	0xf8ff: "HID (Vendor Defined 3)",
+	0xfcff: "HID (Vendor Defined 4)",
+}
+
+// Names of primary languages, the low 10 bits of a LANGID
+var primaryLangNames = map[uint16]string{
+	0x01: "Arabic",
+	0x02: "Bulgarian",
+	0x03: "Catalan",
+	0x04: "Chinese",
+	0x05: "Czech",
+	0x06: "Danish",
+	0x07: "German",
+	0x08: "Greek",
+	0x09: "English",
+	0x0a: "Spanish",
+	0x0b: "Finnish",
+	0x0c: "French",
+	0x0d: "Hebrew",
+	0x0e: "Hungarian",
+	0x0f: "Icelandic",
+	0x10: "Italian",
+	0x11: "Japanese",
+	0x12: "Korean",
+	0x13: "Dutch",
+	0x14: "Norwegian",
+	0x15: "Polish",
+	0x16: "Portuguese",
+	0x18: "Romanian",
+	0x19: "Russian",
+	0x1a: "Croatian",
+	0x1b: "Slovak",
+	0x1c: "Albanian",
+	0x1d: "Swedish",
+	0x1e: "Thai",
+	0x1f: "Turkish",
+	0x20: "Urdu",
+	0x21: "Indonesian",
+	0x22: "Ukrainian",
+	0x23: "Belarusian",
+	0x24: "Slovenian",
+	0x25: "Estonian",
+	0x26: "Latvian",
+	0x27: "Lithuanian",
+	0x29: "Farsi",
+	0x2a: "Vietnamese",
+	0x2b: "Armenian",
+	0x2c: "Azeri",
+	0x2d: "Basque",
+	0x2f: "Macedonian",
+	0x36: "Afrikaans",
+	0x37: "Georgian",
+	0x38: "Faeroese",
+	0x39: "Hindi",
+	0x3e: "Malay",
+	0x3f: "Kazak",
+	0x41: "Swahili",
+	0x43: "Uzbek",
+	0x44: "Tatar",
+	0x45: "Bengali",
+	0x46: "Punjabi",
+	0x47: "Gujarati",
+	0x48: "Oriya",
+	0x49: "Tamil",
+	0x4a: "Telugu",
+	0x4b: "Kannada",
+	0x4c: "Malayalam",
+	0x4d: "Assamese",
+	0x4e: "Marathi",
+	0x4f: "Sanskrit",
+	0x57: "Konkani",
+	0x58: "Manipuri",
+	0x59: "Sindhi",
+	0x60: "Kashmiri",
+	0x61: "Nepali",
+	0xff: "HID",
+}
+
+// Return a human-readable name for a LANGID, e.g. "English (United
+// States)" for 0x0409. Unlisted sublanguages fall back to the name of
+// the primary language; unknown languages to the hex value.
+func LangIdName(langid uint16) string {
+	if name, ok := langIdNames[langid]; ok {
+		return name
+	}
+	primary, sub := langid&0x3ff, langid>>10
+	name, ok := primaryLangNames[primary]
+	switch {
+	case !ok:
+		return fmt.Sprintf("Unknown (0x%04x)", langid)
+	case sub == 1:
+		return name
+	}
+	return fmt.Sprintf("%s (sublanguage %d)", name, sub)
+}
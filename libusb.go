@@ -0,0 +1,779 @@
+//go:build cgo
+
+package usb
+
+/*
+#cgo CFLAGS: -I/usr/include/libusb-1.0
+#cgo LDFLAGS: -lusb-1.0
+#include <libusb.h>
+#include <stdlib.h>
+#include <string.h>
+
+void goTransferCallback(struct libusb_transfer *);
+void goLogCallback(libusb_context *, int, char *);
+
+static void LIBUSB_CALL gousb_callback(struct libusb_transfer *t) {
+	goTransferCallback(t);
+}
+
+static struct libusb_transfer *gousb_alloc_transfer(libusb_device_handle *h,
+	int iso_packets, unsigned char type, unsigned char endpoint,
+	unsigned char *buf, int length, unsigned int timeout) {
+	struct libusb_transfer *t = libusb_alloc_transfer(iso_packets);
+	if (t == NULL)
+		return NULL;
+	t->dev_handle = h;
+	t->type = type;
+	t->endpoint = endpoint;
+	t->buffer = buf;
+	t->length = length;
+	t->timeout = timeout;
+	t->num_iso_packets = iso_packets;
+	t->callback = gousb_callback;
+	return t;
+}
+
+// iso_packet_desc is a flexible array member, which cgo can't index
+static void gousb_set_iso_length(struct libusb_transfer *t, int i, unsigned int length) {
+	t->iso_packet_desc[i].length = length;
+}
+
+static unsigned int gousb_iso_actual(struct libusb_transfer *t, int i) {
+	return t->iso_packet_desc[i].actual_length;
+}
+
+static int gousb_iso_status(struct libusb_transfer *t, int i) {
+	return t->iso_packet_desc[i].status;
+}
+
+// Turning device discovery off came in with 1.0.24, as
+// LIBUSB_OPTION_WEAK_AUTHORITY, and could only be done for every
+// context at once until 1.0.27. UsbDk (1.0.22) has to be asked for
+// before the context is used for anything else.
+static int gousb_init(libusb_context **ctx, int no_discovery, int use_usbdk) {
+#if defined(LIBUSB_API_VERSION) && LIBUSB_API_VERSION >= 0x0100010A
+	struct libusb_init_option opts[2];
+	int n = 0;
+	memset(opts, 0, sizeof(opts));
+	if (no_discovery)
+		opts[n++].option = LIBUSB_OPTION_NO_DEVICE_DISCOVERY;
+	if (use_usbdk)
+		opts[n++].option = LIBUSB_OPTION_USE_USBDK;
+	return libusb_init_context(ctx, opts, n);
+#else
+	int err;
+	if (no_discovery) {
+#if defined(LIBUSB_API_VERSION) && LIBUSB_API_VERSION >= 0x01000108
+		err = libusb_set_option(NULL, LIBUSB_OPTION_WEAK_AUTHORITY);
+		if (err < 0)
+			return err;
+#else
+		return LIBUSB_ERROR_NOT_SUPPORTED;
+#endif
+	}
+	err = libusb_init(ctx);
+	if (err < 0 || !use_usbdk)
+		return err;
+#if defined(LIBUSB_API_VERSION) && LIBUSB_API_VERSION >= 0x01000106
+	err = libusb_set_option(*ctx, LIBUSB_OPTION_USE_USBDK);
+#else
+	err = LIBUSB_ERROR_NOT_SUPPORTED;
+#endif
+	if (err < 0)
+		libusb_exit(*ctx);
+	return err;
+#endif
+}
+
+// libusb_wrap_sys_device is 1.0.23 and later
+static int gousb_wrap_sys_device(libusb_context *ctx, intptr_t fd, libusb_device_handle **h) {
+#if defined(LIBUSB_API_VERSION) && LIBUSB_API_VERSION >= 0x01000107
+	return libusb_wrap_sys_device(ctx, fd, h);
+#else
+	return LIBUSB_ERROR_NOT_SUPPORTED;
+#endif
+}
+
+// libusb_dev_mem_alloc is 1.0.21 and later, and returns NULL where
+// the platform can't do it
+static unsigned char *gousb_dev_mem_alloc(libusb_device_handle *h, size_t length) {
+#if defined(LIBUSB_API_VERSION) && LIBUSB_API_VERSION >= 0x01000105
+	return libusb_dev_mem_alloc(h, length);
+#else
+	return NULL;
+#endif
+}
+
+static void gousb_dev_mem_free(libusb_device_handle *h, unsigned char *buf, size_t length) {
+#if defined(LIBUSB_API_VERSION) && LIBUSB_API_VERSION >= 0x01000105
+	libusb_dev_mem_free(h, buf, length);
+#endif
+}
+
+// libusb_set_option is 1.0.22 and later, and variadic, which cgo
+// can't call. Only the options that take an int or nothing are let
+// through; before 1.0.22, only the log level can be set, with the
+// deprecated libusb_set_debug.
+static int gousb_set_option(libusb_context *ctx, int option, int value) {
+#if defined(LIBUSB_API_VERSION) && LIBUSB_API_VERSION >= 0x01000106
+	switch (option) {
+	case LIBUSB_OPTION_LOG_LEVEL:
+		return libusb_set_option(ctx, LIBUSB_OPTION_LOG_LEVEL, value);
+	case LIBUSB_OPTION_USE_USBDK:
+		return libusb_set_option(ctx, LIBUSB_OPTION_USE_USBDK);
+#if LIBUSB_API_VERSION >= 0x01000108
+	case LIBUSB_OPTION_WEAK_AUTHORITY:
+		return libusb_set_option(ctx, LIBUSB_OPTION_WEAK_AUTHORITY);
+#endif
+	}
+#else
+	if (option == 0) {
+		libusb_set_debug(ctx, value);
+		return 0;
+	}
+#endif
+	return LIBUSB_ERROR_NOT_SUPPORTED;
+}
+
+// Log callbacks are 1.0.23 and later; before that, libusb can only
+// write to stderr
+#if defined(LIBUSB_API_VERSION) && LIBUSB_API_VERSION >= 0x01000107
+static void LIBUSB_CALL gousb_log_callback(libusb_context *ctx, enum libusb_log_level level, const char *str) {
+	goLogCallback(ctx, level, (char *)str);
+}
+#endif
+
+static int gousb_set_log_cb(libusb_context *ctx, int enable) {
+#if defined(LIBUSB_API_VERSION) && LIBUSB_API_VERSION >= 0x01000107
+	libusb_set_log_cb(ctx, enable ? gousb_log_callback : NULL, LIBUSB_LOG_CB_CONTEXT);
+	return 0;
+#else
+	return LIBUSB_ERROR_NOT_SUPPORTED;
+#endif
+}
+*/
+import "C"
+import (
+	"context"
+	"log/slog"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+	"unsafe"
+)
+
+func decodeUsbError(errno C.int) (int, *UsbError) {
+	if errno >= 0 {
+		return int(errno), nil
+	}
+	err, ok := UsbErrorMap[int(errno)]
+	if !ok {
+		err = UsbErrorMisc
+	}
+	return int(errno), err
+}
+
+func returnUsbError(errno C.int) *UsbError {
+	_, err := decodeUsbError(errno)
+	return err
+}
+
+func parseDeviceDescriptor(desc *C.struct_libusb_device_descriptor) DeviceDescriptor {
+	return DeviceDescriptor{
+		BLength:            byte(desc.bLength),
+		BDescriptorType:    DescriptorType(desc.bDescriptorType),
+		BcdUSB:             uint16(desc.bcdUSB),
+		BDeviceClass:       ClassCode(desc.bDeviceClass),
+		BDeviceSubClass:    byte(desc.bDeviceSubClass),
+		BDeviceProtocol:    byte(desc.bDeviceProtocol),
+		BMaxPacketSize0:    byte(desc.bMaxPacketSize0),
+		IdVendor:           uint16(desc.idVendor),
+		IdProduct:          uint16(desc.idProduct),
+		BcdDevice:          uint16(desc.bcdDevice),
+		IManufacturer:      byte(desc.iManufacturer),
+		IProduct:           byte(desc.iProduct),
+		ISerialNumber:      byte(desc.iSerialNumber),
+		BNumConfigurations: byte(desc.bNumConfigurations),
+	}
+}
+
+func parseConfigDescriptor(desc *C.struct_libusb_config_descriptor) ConfigDescriptor {
+	ret := ConfigDescriptor{
+		BLength:             byte(desc.bLength),
+		BDescriptorType:     DescriptorType(desc.bDescriptorType),
+		WTotalLength:        uint16(desc.wTotalLength),
+		BConfigurationValue: int(desc.bConfigurationValue),
+		IConfiguration:      byte(desc.iConfiguration),
+		BmAttributes:        byte(desc.bmAttributes),
+		MaxPower:            byte(desc.MaxPower),
+		Interfaces:          make([][]InterfaceDescriptor, int(desc.bNumInterfaces)),
+		Extra:               C.GoBytes(unsafe.Pointer(desc.extra), C.int(desc.extra_length)),
+	}
+
+	iface_list := unsafe.Slice(desc._interface, int(desc.bNumInterfaces))
+	for i := 0; i < int(desc.bNumInterfaces); i++ {
+		iface := iface_list[i]
+		alts := unsafe.Slice(iface.altsetting, int(iface.num_altsetting))
+		parsed := make([]InterfaceDescriptor, len(alts), len(alts))
+		ret.Interfaces[i] = parsed
+		for j := range alts {
+			parsed[j] = parseInterfaceDescriptor(&alts[j])
+		}
+	}
+	ret.Functions = findFunctions(&ret)
+	return ret
+}
+
+func parseEndpointDescriptor(desc *C.struct_libusb_endpoint_descriptor) EndpointDescriptor {
+	return EndpointDescriptor{
+		BLength:          byte(desc.bLength),
+		BDescriptorType:  DescriptorType(desc.bDescriptorType),
+		BEndpointAddress: byte(desc.bEndpointAddress),
+		BmAttributes:     byte(desc.bmAttributes),
+		WMaxPacketSize:   uint16(desc.wMaxPacketSize),
+		BInterval:        byte(desc.bInterval),
+		BRefresh:         byte(desc.bRefresh),
+		BSynchAddress:    byte(desc.bSynchAddress),
+		Extra:            C.GoBytes(unsafe.Pointer(desc.extra), C.int(desc.extra_length)),
+	}
+}
+
+func parseInterfaceDescriptor(desc *C.struct_libusb_interface_descriptor) InterfaceDescriptor {
+	ret := InterfaceDescriptor{
+		BLength:            byte(desc.bLength),
+		BDescriptorType:    DescriptorType(desc.bDescriptorType),
+		BInterfaceNumber:   byte(desc.bInterfaceNumber),
+		BAlternateSetting:  byte(desc.bAlternateSetting),
+		BInterfaceClass:    ClassCode(desc.bInterfaceClass),
+		BInterfaceSubClass: byte(desc.bInterfaceSubClass),
+		BInterfaceProtocol: byte(desc.bInterfaceProtocol),
+		IInterface:         byte(desc.iInterface),
+		Endpoints:          make([]EndpointDescriptor, int(desc.bNumEndpoints)),
+		Extra:              C.GoBytes(unsafe.Pointer(desc.extra), C.int(desc.extra_length)),
+	}
+
+	ep_list := unsafe.Slice(desc.endpoint, int(desc.bNumEndpoints))
+	for i := 0; i < int(desc.bNumEndpoints); i++ {
+		ret.Endpoints[i] = parseEndpointDescriptor(&ep_list[i])
+	}
+	return ret
+}
+
+//////////////////////// The backend
+
+// libusb transfers are all asynchronous underneath; a goroutine per
+// context runs libusb's event loop so that they complete.
+type libusbBackend struct {
+	ctx     *C.struct_libusb_context
+	stop    chan struct{}
+	stopped chan struct{}
+
+	// The references held by libusbDevices, which libusb_exit needs
+	// dropped first. Their finalizers do nothing once it has run.
+	ref_lock sync.Mutex
+	refs     map[*C.struct_libusb_device]int
+	exited   bool
+}
+
+// Settings for a libusb context that can only be made as it is
+// created
+type LibusbOptions struct {
+	// Don't look for devices, so that none are listed and they can
+	// only be reached with Context.OpenFromFD. This is for systems,
+	// like Android, where the device nodes can't be opened or even
+	// listed. It needs libusb 1.0.24; before 1.0.27 it applies to
+	// every libusb context made afterwards.
+	NoDeviceDiscovery bool
+	// Use the UsbDk driver rather than WinUSB. Windows only.
+	UseUsbDK bool
+}
+
+// Make a backend on a new libusb context
+func NewLibusbBackend() (Backend, *UsbError) {
+	return NewLibusbBackendWithOptions(LibusbOptions{})
+}
+
+func NewLibusbBackendWithOptions(opts LibusbOptions) (Backend, *UsbError) {
+	b := &libusbBackend{
+		stop:    make(chan struct{}),
+		stopped: make(chan struct{}),
+		refs:    make(map[*C.struct_libusb_device]int),
+	}
+	no_discovery, use_usbdk := C.int(0), C.int(0)
+	if opts.NoDeviceDiscovery {
+		no_discovery = 1
+	}
+	if opts.UseUsbDK {
+		use_usbdk = 1
+	}
+	if err := returnUsbError(C.gousb_init(&b.ctx, no_discovery, use_usbdk)); err != nil {
+		return nil, err
+	}
+	go b.handleEvents()
+	return b, nil
+}
+
+func newDefaultBackend() (Backend, *UsbError) {
+	return NewLibusbBackend()
+}
+
+func (b *libusbBackend) handleEvents() {
+	defer close(b.stopped)
+	// Wake up now and then to notice Close
+	tv := C.struct_timeval{tv_usec: 100000}
+	for {
+		select {
+		case <-b.stop:
+			return
+		default:
+		}
+		C.libusb_handle_events_timeout_completed(b.ctx, &tv, nil)
+	}
+}
+
+func (b *libusbBackend) SetDebug(level int) {
+	C.gousb_set_option(b.ctx, OPTION_LOG_LEVEL, C.int(level))
+}
+
+func (b *libusbBackend) SetOption(option, value int) *UsbError {
+	return returnUsbError(C.gousb_set_option(b.ctx, C.int(option), C.int(value)))
+}
+
+// The version of libusb linked in
+func Version() LibusbVersion {
+	v := C.libusb_get_version()
+	return LibusbVersion{
+		Major: int(v.major),
+		Minor: int(v.minor),
+		Micro: int(v.micro),
+		Nano:  int(v.nano),
+		RC:    C.GoString(v.rc),
+	}
+}
+
+func libusbHasCapability(capability int) bool {
+	return C.libusb_has_capability(C.uint32_t(capability)) != 0
+}
+
+func (b *libusbBackend) HasCapability(capability int) bool {
+	return libusbHasCapability(capability)
+}
+
+// The loggers of the contexts that have one, for goLogCallback
+var libusbLoggers = struct {
+	sync.Mutex
+	byCtx map[*C.struct_libusb_context]*slog.Logger
+}{byCtx: make(map[*C.struct_libusb_context]*slog.Logger)}
+
+// Have libusb's messages logged to l, at as fine a level as l takes.
+// With libusb before 1.0.23, they still go to stderr.
+func (b *libusbBackend) SetLogger(l *slog.Logger) {
+	libusbLoggers.Lock()
+	if l != nil {
+		libusbLoggers.byCtx[b.ctx] = l
+	} else {
+		delete(libusbLoggers.byCtx, b.ctx)
+	}
+	libusbLoggers.Unlock()
+	if l == nil {
+		C.gousb_set_log_cb(b.ctx, 0)
+		return
+	}
+	if C.gousb_set_log_cb(b.ctx, 1) == 0 {
+		b.SetDebug(debugLevelFor(l))
+	}
+}
+
+// libusb formats its messages for stderr, as "libusb: level [function]
+// message\n", with a timestamp and thread in front at debug level. The
+// level is known already, so only the function is kept, as an
+// attribute.
+func logLibusbMessage(l *slog.Logger, level int, str string) {
+	msg := strings.TrimRight(str, "\n")
+	var attrs []interface{}
+	if i := strings.Index(msg, "libusb: "); i >= 0 {
+		msg = msg[i+len("libusb: "):]
+		if start, end := strings.Index(msg, " ["), strings.Index(msg, "] "); start >= 0 && end > start {
+			attrs = append(attrs, slog.String("function", msg[start+2:end]))
+			msg = msg[end+2:]
+		}
+	}
+	slog_level, ok := debugLevels[level]
+	if !ok {
+		slog_level = slog.LevelDebug
+	}
+	attrs = append(attrs, slog.String("source", "libusb"))
+	l.Log(context.Background(), slog_level, msg, attrs...)
+}
+
+func (b *libusbBackend) Close() {
+	close(b.stop)
+	<-b.stopped
+	libusbLoggers.Lock()
+	delete(libusbLoggers.byCtx, b.ctx)
+	libusbLoggers.Unlock()
+	b.ref_lock.Lock()
+	for dev, n := range b.refs {
+		for ; n > 0; n-- {
+			C.libusb_unref_device(dev)
+		}
+	}
+	b.refs, b.exited = nil, true
+	b.ref_lock.Unlock()
+	C.libusb_exit(b.ctx)
+	b.ctx = nil
+}
+
+func (b *libusbBackend) GetDeviceList() ([]BackendDevice, *UsbError) {
+	var baseptr **C.struct_libusb_device
+	count, err := decodeUsbError(C.int(C.libusb_get_device_list(b.ctx, &baseptr)))
+	if err != nil {
+		return nil, err
+	}
+	devlist := unsafe.Slice(baseptr, count)
+	ret := make([]BackendDevice, count)
+	for i := range devlist {
+		ret[i] = b.wrapDevice(devlist[i])
+	}
+	C.libusb_free_device_list(baseptr, 1)
+	return ret, nil
+}
+
+// Wrap a device node opened elsewhere. libusb reads the descriptors
+// through it, and leaves it open when the handle is closed.
+func (b *libusbBackend) OpenFD(fd uintptr) (BackendDevice, BackendHandle, *UsbError) {
+	h := &libusbHandle{}
+	if err := returnUsbError(C.gousb_wrap_sys_device(b.ctx, C.intptr_t(fd), &h.handle)); err != nil {
+		return nil, nil, err
+	}
+	return b.wrapDevice(C.libusb_get_device(h.handle)), h, nil
+}
+
+//////////////////////// Devices
+
+type libusbDevice struct {
+	device  *C.struct_libusb_device
+	backend *libusbBackend
+}
+
+// Hold a reference for as long as Go does, or until the backend is
+// closed
+func (b *libusbBackend) wrapDevice(dev *C.struct_libusb_device) *libusbDevice {
+	b.ref_lock.Lock()
+	C.libusb_ref_device(dev)
+	b.refs[dev]++
+	b.ref_lock.Unlock()
+	d := &libusbDevice{device: dev, backend: b}
+	runtime.SetFinalizer(d, (*libusbDevice).unref)
+	return d
+}
+
+func (d *libusbDevice) unref() {
+	b := d.backend
+	b.ref_lock.Lock()
+	defer b.ref_lock.Unlock()
+	if b.exited {
+		return
+	}
+	C.libusb_unref_device(d.device)
+	if b.refs[d.device]--; b.refs[d.device] == 0 {
+		delete(b.refs, d.device)
+	}
+}
+
+func (d *libusbDevice) GetBusNumber() int {
+	return int(C.libusb_get_bus_number(d.device))
+}
+
+func (d *libusbDevice) GetAddress() int {
+	return int(C.libusb_get_device_address(d.device))
+}
+
+func (d *libusbDevice) GetSpeed() Speed {
+	return Speed(C.libusb_get_device_speed(d.device))
+}
+
+func (d *libusbDevice) GetDeviceDescriptor() (DeviceDescriptor, *UsbError) {
+	var desc C.struct_libusb_device_descriptor
+	err := returnUsbError(C.libusb_get_device_descriptor(d.device, &desc))
+	if err != nil {
+		return DeviceDescriptor{}, err
+	}
+	return parseDeviceDescriptor(&desc), nil
+}
+
+func (d *libusbDevice) GetActiveConfigDescriptor() (ConfigDescriptor, *UsbError) {
+	var desc *C.struct_libusb_config_descriptor
+	err := returnUsbError(C.libusb_get_active_config_descriptor(d.device, &desc))
+	if err != nil {
+		return ConfigDescriptor{}, err
+	}
+	ret := parseConfigDescriptor(desc)
+	C.libusb_free_config_descriptor(desc)
+	return ret, nil
+}
+
+func (d *libusbDevice) GetConfigDescriptor(config_index int) (ConfigDescriptor, *UsbError) {
+	var desc *C.struct_libusb_config_descriptor
+	err := returnUsbError(C.libusb_get_config_descriptor(d.device, C.uint8_t(config_index), &desc))
+	if err != nil {
+		return ConfigDescriptor{}, err
+	}
+	ret := parseConfigDescriptor(desc)
+	C.libusb_free_config_descriptor(desc)
+	return ret, nil
+}
+
+func (d *libusbDevice) Open() (BackendHandle, *UsbError) {
+	h := &libusbHandle{}
+	if err := returnUsbError(C.libusb_open(d.device, &h.handle)); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+//////////////////////// Handles
+
+type libusbHandle struct {
+	handle *C.struct_libusb_device_handle
+}
+
+func (h *libusbHandle) Close() {
+	C.libusb_close(h.handle)
+	h.handle = nil
+}
+
+func (h *libusbHandle) GetConfiguration() (int, *UsbError) {
+	var res C.int
+	if err := returnUsbError(C.libusb_get_configuration(h.handle, &res)); err != nil {
+		return 0, err
+	}
+	return int(res), nil
+}
+
+func (h *libusbHandle) SetConfiguration(config int) *UsbError {
+	return returnUsbError(C.libusb_set_configuration(h.handle, C.int(config)))
+}
+
+func (h *libusbHandle) ClaimInterface(iface_no int) *UsbError {
+	return returnUsbError(C.libusb_claim_interface(h.handle, C.int(iface_no)))
+}
+
+func (h *libusbHandle) ReleaseInterface(iface_no int) *UsbError {
+	return returnUsbError(C.libusb_release_interface(h.handle, C.int(iface_no)))
+}
+
+func (h *libusbHandle) SetInterfaceAltSetting(iface_no, alt int) *UsbError {
+	return returnUsbError(C.libusb_set_interface_alt_setting(h.handle, C.int(iface_no), C.int(alt)))
+}
+
+// Where libusb can't detach kernel drivers (anywhere but Linux), it
+// is better not to ask
+func (h *libusbHandle) KernelDriverActive(iface_no int) (bool, *UsbError) {
+	if !libusbHasCapability(CAP_SUPPORTS_DETACH_KERNEL_DRIVER) {
+		return false, UsbErrorNotSupported
+	}
+	v, err := decodeUsbError(C.libusb_kernel_driver_active(h.handle, C.int(iface_no)))
+	if err != nil {
+		return false, err
+	}
+	return (v == 1), nil
+}
+
+func (h *libusbHandle) AttachKernelDriver(iface_no int) *UsbError {
+	if !libusbHasCapability(CAP_SUPPORTS_DETACH_KERNEL_DRIVER) {
+		return UsbErrorNotSupported
+	}
+	return returnUsbError(C.libusb_attach_kernel_driver(h.handle, C.int(iface_no)))
+}
+
+func (h *libusbHandle) DetachKernelDriver(iface_no int) *UsbError {
+	if !libusbHasCapability(CAP_SUPPORTS_DETACH_KERNEL_DRIVER) {
+		return UsbErrorNotSupported
+	}
+	return returnUsbError(C.libusb_detach_kernel_driver(h.handle, C.int(iface_no)))
+}
+
+func (h *libusbHandle) ClearHalt(endpoint byte) *UsbError {
+	return returnUsbError(C.libusb_clear_halt(h.handle, C.uchar(endpoint)))
+}
+
+func (h *libusbHandle) Reset() *UsbError {
+	return returnUsbError(C.libusb_reset_device(h.handle))
+}
+
+//////////////////////// Transfers
+
+// A transfer in flight. libusb keeps the buffer past the call that
+// submits it, so it has to be C memory; data is copied in on submit
+// and out on completion.
+type libusbTransfer struct {
+	t      *Transfer
+	xfer   *C.struct_libusb_transfer
+	buf    unsafe.Pointer
+	length int  // of buf, including the setup packet of a control transfer
+	shared bool // buf is the transfer's own Buffer, not a copy
+}
+
+var libusbTransfers = struct {
+	sync.Mutex
+	byXfer     map[*C.struct_libusb_transfer]*libusbTransfer
+	byTransfer map[*Transfer]*libusbTransfer
+}{
+	byXfer:     make(map[*C.struct_libusb_transfer]*libusbTransfer),
+	byTransfer: make(map[*Transfer]*libusbTransfer),
+}
+
+// Matches enum libusb_transfer_status
+var libusbTransferStatus = []*UsbError{
+	nil,               // LIBUSB_TRANSFER_COMPLETED
+	UsbErrorIO,        // LIBUSB_TRANSFER_ERROR
+	UsbErrorTimeout,   // LIBUSB_TRANSFER_TIMED_OUT
+	UsbErrorCancelled, // LIBUSB_TRANSFER_CANCELLED
+	UsbErrorPipe,      // LIBUSB_TRANSFER_STALL
+	UsbErrorNoDevice,  // LIBUSB_TRANSFER_NO_DEVICE
+	UsbErrorOverflow,  // LIBUSB_TRANSFER_OVERFLOW
+}
+
+func decodeTransferStatus(status int) *UsbError {
+	if status < 0 || status >= len(libusbTransferStatus) {
+		return UsbErrorMisc
+	}
+	return libusbTransferStatus[status]
+}
+
+// libusb takes 0 to mean no timeout, so don't round a short one down to it
+func libusbTimeout(d time.Duration) C.uint {
+	ms := d / time.Millisecond
+	if ms == 0 && d > 0 {
+		ms = 1
+	}
+	return C.uint(ms)
+}
+
+// Memory that transfers can use as it is: mapped from the device
+// where libusb can do that, malloc'd otherwise
+func (h *libusbHandle) AllocBuffer(size int) ([]byte, func(), *UsbError) {
+	length := C.size_t(size)
+	if p := C.gousb_dev_mem_alloc(h.handle, length); p != nil {
+		handle := h.handle
+		return unsafe.Slice((*byte)(p), size), func() { C.gousb_dev_mem_free(handle, p, length) }, nil
+	}
+	p := C.malloc(length + 1)
+	if p == nil {
+		return nil, nil, UsbErrorNoMem
+	}
+	return unsafe.Slice((*byte)(p), size), func() { C.free(p) }, nil
+}
+
+func (lt *libusbTransfer) bytes() []byte {
+	return unsafe.Slice((*byte)(lt.buf), lt.length)
+}
+
+func (h *libusbHandle) SubmitTransfer(t *Transfer) *UsbError {
+	offset := 0
+	if t.Type == TRANSFER_TYPE_CONTROL {
+		offset = 8
+	}
+	lt := &libusbTransfer{t: t, length: offset + len(t.Buffer)}
+	if t.inPlace(h) {
+		// Memory from AllocBuffer, which libusb can have as it is
+		lt.shared = true
+		if len(t.Buffer) > 0 {
+			lt.buf = unsafe.Pointer(&t.Buffer[0])
+		}
+	} else {
+		// malloc(0) may well return NULL
+		lt.buf = C.malloc(C.size_t(lt.length + 1))
+		if lt.buf == nil {
+			return UsbErrorNoMem
+		}
+		buf := lt.bytes()
+		if t.Type == TRANSFER_TYPE_CONTROL {
+			buf[0] = t.Setup.BmRequestType
+			buf[1] = t.Setup.BRequest
+			putLe16(buf[2:], t.Setup.WValue)
+			putLe16(buf[4:], t.Setup.WIndex)
+			putLe16(buf[6:], t.Setup.WLength)
+		}
+		if !t.In() {
+			copy(buf[offset:], t.Buffer)
+		}
+	}
+
+	lt.xfer = C.gousb_alloc_transfer(h.handle, C.int(len(t.IsoPackets)), C.uchar(t.Type), C.uchar(t.Endpoint),
+		(*C.uchar)(lt.buf), C.int(lt.length), libusbTimeout(t.Timeout))
+	if lt.xfer == nil {
+		if !lt.shared {
+			C.free(lt.buf)
+		}
+		return UsbErrorNoMem
+	}
+	for i, p := range t.IsoPackets {
+		C.gousb_set_iso_length(lt.xfer, C.int(i), C.uint(p.Length))
+	}
+
+	// The callback can run before libusb_submit_transfer returns
+	libusbTransfers.Lock()
+	libusbTransfers.byXfer[lt.xfer] = lt
+	libusbTransfers.byTransfer[t] = lt
+	libusbTransfers.Unlock()
+	if err := returnUsbError(C.libusb_submit_transfer(lt.xfer)); err != nil {
+		libusbTransfers.Lock()
+		delete(libusbTransfers.byXfer, lt.xfer)
+		delete(libusbTransfers.byTransfer, t)
+		libusbTransfers.Unlock()
+		lt.free()
+		return err
+	}
+	return nil
+}
+
+func (h *libusbHandle) CancelTransfer(t *Transfer) *UsbError {
+	// Hold the lock so that the transfer can't complete and be freed
+	// under us; the callback only ever runs on the event goroutine.
+	libusbTransfers.Lock()
+	defer libusbTransfers.Unlock()
+	lt, ok := libusbTransfers.byTransfer[t]
+	if !ok {
+		return UsbErrorNotFound
+	}
+	return returnUsbError(C.libusb_cancel_transfer(lt.xfer))
+}
+
+func (lt *libusbTransfer) free() {
+	C.libusb_free_transfer(lt.xfer)
+	if !lt.shared {
+		C.free(lt.buf)
+	}
+	lt.xfer, lt.buf = nil, nil
+}
+
+// Called from goTransferCallback once libusb is done with a transfer
+func (lt *libusbTransfer) complete() {
+	t := lt.t
+	buf := lt.bytes()
+	actual := int(lt.xfer.actual_length)
+	status := decodeTransferStatus(int(lt.xfer.status))
+	switch t.Type {
+	case TRANSFER_TYPE_CONTROL:
+		buf = buf[8 : 8+actual]
+	case TRANSFER_TYPE_ISOCHRONOUS:
+		// Each packet's data stays at its own offset, so copy it all
+		actual = 0
+		for i := range t.IsoPackets {
+			p := &t.IsoPackets[i]
+			p.Actual = int(C.gousb_iso_actual(lt.xfer, C.int(i)))
+			p.Status = decodeTransferStatus(int(C.gousb_iso_status(lt.xfer, C.int(i))))
+			actual += p.Actual
+		}
+	default:
+		buf = buf[:actual]
+	}
+	if t.In() && !lt.shared {
+		copy(t.Buffer, buf)
+	}
+	lt.free()
+	t.Complete(actual, status)
+}
@@ -0,0 +1,33 @@
+//go:build cgo
+
+package usb
+
+// Exported functions can't share a file with C definitions, so the
+// transfer callback lives here.
+
+// #include <libusb.h>
+import "C"
+
+//export goTransferCallback
+func goTransferCallback(xfer *C.struct_libusb_transfer) {
+	libusbTransfers.Lock()
+	lt, ok := libusbTransfers.byXfer[xfer]
+	delete(libusbTransfers.byXfer, xfer)
+	if ok {
+		delete(libusbTransfers.byTransfer, lt.t)
+	}
+	libusbTransfers.Unlock()
+	if ok {
+		lt.complete()
+	}
+}
+
+//export goLogCallback
+func goLogCallback(ctx *C.struct_libusb_context, level C.int, str *C.char) {
+	libusbLoggers.Lock()
+	l := libusbLoggers.byCtx[ctx]
+	libusbLoggers.Unlock()
+	if l != nil {
+		logLibusbMessage(l, int(level), C.GoString(str))
+	}
+}
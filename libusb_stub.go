@@ -0,0 +1,10 @@
+//go:build !cgo
+
+package usb
+
+// Without cgo, there is no libusb to ask
+
+// The version of libusb linked in; all zeroes if there is none
+func Version() LibusbVersion {
+	return LibusbVersion{}
+}
@@ -0,0 +1,190 @@
+// A checker for device descriptors against the rules of chapter 9 of
+// the USB 2.0 and 3.x specifications. It works on descriptors as they
+// come off the wire, so that lengths can be checked too, and can be
+// fed either from a live device or from a dump.
+package lint
+
+import (
+	"errors"
+	"fmt"
+
+	"gopkg.thequux.com/usb"
+)
+
+var ErrMalformedBlob = errors.New("lint: can't split descriptor blob")
+
+type Severity int
+
+const (
+	WARNING Severity = iota
+	ERROR
+)
+
+func (s Severity) String() string {
+	if s == ERROR {
+		return "error"
+	}
+	return "warning"
+}
+
+type Problem struct {
+	Severity Severity
+	Where    string // e.g. "config 0 interface 1 alt 0 endpoint 0x81"
+	Message  string
+}
+
+func (p Problem) String() string {
+	return fmt.Sprintf("%s: %s: %s", p.Severity, p.Where, p.Message)
+}
+
+// The descriptors to check.
+type Input struct {
+	// The speed the device runs at. With SPEED_UNKNOWN the checks
+	// that depend on speed are skipped.
+	Speed usb.Speed
+
+	Device  []byte   // the device descriptor
+	Configs [][]byte // each configuration with everything under it
+
+	// The strings that could be read, by index, and the language
+	// table. With Strings nil, string indices aren't checked.
+	Strings map[byte]string
+	LangIds []uint16
+}
+
+// Read everything Check needs from an open device. Strings that
+// can't be read are simply missing from Input.Strings, which is what
+// Check then complains about.
+func FromDevice(h *usb.DeviceHandle) (*Input, error) {
+	in := &Input{Speed: h.GetDevice().GetSpeed()}
+	raw, err := h.GetRawDeviceDescriptor()
+	if err != nil {
+		return nil, err
+	}
+	in.Device = raw
+	dd, err := usb.ParseDeviceDescriptor(raw)
+	if err != nil {
+		// Nothing more can be found out; Check will say why
+		return in, nil
+	}
+	for i := 0; i < int(dd.BNumConfigurations); i++ {
+		raw, err := h.GetRawConfigDescriptor(i)
+		if err != nil {
+			return nil, err
+		}
+		in.Configs = append(in.Configs, raw)
+	}
+
+	in.Strings = make(map[byte]string)
+	in.LangIds, _ = h.GetLangIds()
+	if len(in.LangIds) == 0 {
+		return in, nil
+	}
+	for index := range stringIndices(in) {
+		if s, err := h.GetDefaultStringDescriptor(index); err == nil {
+			in.Strings[index] = s
+		}
+	}
+	return in, nil
+}
+
+// Split a dump of a device descriptor followed by its configuration
+// descriptors, the layout of the "descriptors" file in sysfs, into an
+// Input. The strings are unknown, so they aren't checked.
+func FromBlob(speed usb.Speed, blob []byte) (*Input, error) {
+	if len(blob) < 2 || int(blob[0]) > len(blob) || blob[0] < 2 {
+		return nil, ErrMalformedBlob
+	}
+	in := &Input{Speed: speed, Device: blob[:blob[0]]}
+	rest := blob[blob[0]:]
+	for len(rest) > 0 {
+		if len(rest) < 4 {
+			return nil, ErrMalformedBlob
+		}
+		total := int(rest[2]) | int(rest[3])<<8
+		if total < 4 {
+			return nil, ErrMalformedBlob
+		}
+		if total > len(rest) {
+			// Let Check complain about wTotalLength
+			total = len(rest)
+		}
+		in.Configs = append(in.Configs, rest[:total])
+		rest = rest[total:]
+	}
+	return in, nil
+}
+
+// Every string index the descriptors refer to, and where from
+func stringIndices(in *Input) map[byte]string {
+	ret := make(map[byte]string)
+	add := func(index byte, where string) {
+		if _, seen := ret[index]; index != 0 && !seen {
+			ret[index] = where
+		}
+	}
+	if dd, err := usb.ParseDeviceDescriptor(in.Device); err == nil {
+		add(dd.IManufacturer, "device iManufacturer")
+		add(dd.IProduct, "device iProduct")
+		add(dd.ISerialNumber, "device iSerialNumber")
+	}
+	for i, raw := range in.Configs {
+		cfg, err := usb.ParseConfigDescriptor(raw)
+		if err != nil {
+			continue
+		}
+		add(cfg.IConfiguration, fmt.Sprintf("config %d iConfiguration", i))
+		for _, f := range cfg.Functions {
+			add(f.IFunction, fmt.Sprintf("config %d function %d iFunction", i, f.BFirstInterface))
+		}
+		for _, alts := range cfg.Interfaces {
+			for _, alt := range alts {
+				add(alt.IInterface, fmt.Sprintf("%s iInterface", altWhere(i, alt)))
+			}
+		}
+	}
+	return ret
+}
+
+func altWhere(config int, alt usb.InterfaceDescriptor) string {
+	return fmt.Sprintf("config %d interface %d alt %d", config, alt.BInterfaceNumber, alt.BAlternateSetting)
+}
+
+type checker struct {
+	in       *Input
+	problems []Problem
+}
+
+func (c *checker) report(sev Severity, where, format string, args ...interface{}) {
+	c.problems = append(c.problems, Problem{sev, where, fmt.Sprintf(format, args...)})
+}
+
+func (c *checker) errorf(where, format string, args ...interface{}) {
+	c.report(ERROR, where, format, args...)
+}
+
+func (c *checker) warnf(where, format string, args ...interface{}) {
+	c.report(WARNING, where, format, args...)
+}
+
+// Check the descriptors and return every problem found, in the
+// order the descriptors appear.
+func Check(in *Input) []Problem {
+	c := &checker{in: in}
+	dd, ok := c.checkDevice()
+	for i, raw := range in.Configs {
+		c.checkConfig(i, raw, dd, ok)
+	}
+	c.checkStrings()
+	return c.problems
+}
+
+// Reports whether any of the problems is an error
+func HasErrors(problems []Problem) bool {
+	for _, p := range problems {
+		if p.Severity == ERROR {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,85 @@
+package lint_test
+
+import (
+	"strings"
+	"testing"
+
+	"gopkg.thequux.com/usb"
+	"gopkg.thequux.com/usb/lint"
+)
+
+// A high-speed composite device: an interface association over a CDC
+// control interface with an interrupt endpoint and a data interface
+// with two bulk endpoints
+func fixture() *lint.Input {
+	return &lint.Input{
+		Speed:  usb.SPEED_HIGH,
+		Device: []byte{18, 1, 0x00, 0x02, 0xef, 0x02, 0x01, 64, 0x47, 0x20, 0x00, 0x02, 0x00, 0x01, 1, 2, 3, 1},
+		Configs: [][]byte{{
+			9, 2, 61, 0, 2, 1, 0, 0x80, 50, // 0: configuration
+			8, 0x0b, 0, 2, 2, 2, 1, 0, // 9: interface association
+			9, 4, 0, 0, 1, 2, 2, 1, 0, // 17: interface 0
+			5, 0x24, 0, 0x10, 1, // 26: CDC header
+			7, 5, 0x81, 3, 8, 0, 4, // 31: interrupt IN
+			9, 4, 1, 0, 2, 0x0a, 0, 0, 0, // 38: interface 1
+			7, 5, 0x82, 2, 0x00, 0x02, 0, // 47: bulk IN
+			7, 5, 0x02, 2, 0x00, 0x02, 0, // 54: bulk OUT
+		}},
+		Strings: map[byte]string{1: "Texas Instruments", 2: "MSP430", 3: "ABC123"},
+		LangIds: []uint16{0x0409},
+	}
+}
+
+func TestClean(t *testing.T) {
+	if problems := lint.Check(fixture()); len(problems) != 0 {
+		t.Errorf("found %v", problems)
+	}
+
+	// The same descriptors as sysfs has them
+	in := fixture()
+	in, err := lint.FromBlob(in.Speed, append(append([]byte(nil), in.Device...), in.Configs[0]...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if problems := lint.Check(in); len(problems) != 0 {
+		t.Errorf("from a blob, found %v", problems)
+	}
+}
+
+// Each change to the fixture breaks exactly one rule
+func TestRules(t *testing.T) {
+	tests := []struct {
+		name   string
+		change func(in *lint.Input)
+		where  string
+		want   string
+	}{
+		{"device bLength", func(in *lint.Input) { in.Device[0] = 19 },
+			"device", "bLength is 19, should be 18"},
+		{"wTotalLength", func(in *lint.Input) { in.Configs[0][2] = 62 },
+			"config 0", "wTotalLength is 62 but the configuration is 61 bytes long"},
+		{"high-speed bulk wMaxPacketSize", func(in *lint.Input) { in.Configs[0][51], in.Configs[0][52] = 64, 0 },
+			"config 0 interface 1 alt 0 endpoint 0x82", "64 bytes is not a valid bulk packet size at high speed"},
+		{"endpoint address in two interfaces", func(in *lint.Input) { in.Configs[0][49] = 0x81 },
+			"config 0 interface 1 alt 0 endpoint 0x81", "endpoint address is also used by interface 0"},
+		{"interrupt bInterval", func(in *lint.Input) { in.Configs[0][37] = 17 },
+			"config 0 interface 0 alt 0 endpoint 0x81", "bInterval 17 is out of range"},
+		{"interface association overrun", func(in *lint.Input) { in.Configs[0][12] = 3 },
+			"config 0 function 0", "covers interface 2, which doesn't exist"},
+		{"dangling string index", func(in *lint.Input) { in.Configs[0][6] = 4 },
+			"config 0 iConfiguration", "string index 4 can't be read"},
+	}
+	for _, test := range tests {
+		in := fixture()
+		test.change(in)
+		problems := lint.Check(in)
+		if len(problems) != 1 {
+			t.Errorf("%s: found %v, want one problem", test.name, problems)
+			continue
+		}
+		p := problems[0]
+		if p.Severity != lint.ERROR || p.Where != test.where || !strings.HasPrefix(p.Message, test.want) {
+			t.Errorf("%s: found %q, want error at %s: %s", test.name, p, test.where, test.want)
+		}
+	}
+}
@@ -0,0 +1,430 @@
+package lint
+
+import (
+	"fmt"
+
+	"gopkg.thequux.com/usb"
+)
+
+// Descriptor types that only show up in lint
+const (
+	dtSSPIsoEndpointCompanion usb.DescriptorType = 0x31
+)
+
+var knownBcdUSB = map[uint16]bool{
+	0x0100: true, 0x0110: true,
+	0x0200: true, 0x0201: true, 0x0210: true,
+	0x0300: true, 0x0310: true, 0x0320: true,
+}
+
+func isSuperSpeed(speed usb.Speed) bool {
+	return speed >= usb.SPEED_SUPER
+}
+
+func (c *checker) checkDevice() (dd usb.DeviceDescriptor, ok bool) {
+	const where = "device"
+	raw := c.in.Device
+	if len(raw) < 2 {
+		c.errorf(where, "device descriptor is missing")
+		return dd, false
+	}
+	if raw[0] != 18 {
+		c.errorf(where, "bLength is %d, should be 18", raw[0])
+	}
+	if usb.DescriptorType(raw[1]) != usb.DT_DEVICE {
+		c.errorf(where, "bDescriptorType is 0x%02x, should be 0x%02x", raw[1], usb.DT_DEVICE)
+	}
+	if len(raw) < 18 {
+		c.errorf(where, "only %d bytes long", len(raw))
+		return dd, false
+	}
+	// Check the contents even if the header is wrong
+	fixed := append([]byte{18, byte(usb.DT_DEVICE)}, raw[2:18]...)
+	dd, _ = usb.ParseDeviceDescriptor(fixed)
+
+	if !knownBcdUSB[dd.BcdUSB] {
+		c.warnf(where, "bcdUSB 0x%04x is not a released USB version", dd.BcdUSB)
+	}
+	speed := c.in.Speed
+	if isSuperSpeed(speed) && dd.BcdUSB < 0x0300 {
+		c.errorf(where, "running at %s speed with bcdUSB 0x%04x", speed, dd.BcdUSB)
+	}
+
+	mps := int(dd.BMaxPacketSize0)
+	switch {
+	case speed == usb.SPEED_LOW && mps != 8:
+		c.errorf(where, "bMaxPacketSize0 is %d, must be 8 at low speed", mps)
+	case speed == usb.SPEED_FULL && mps != 8 && mps != 16 && mps != 32 && mps != 64:
+		c.errorf(where, "bMaxPacketSize0 is %d, must be 8, 16, 32 or 64 at full speed", mps)
+	case speed == usb.SPEED_HIGH && mps != 64:
+		c.errorf(where, "bMaxPacketSize0 is %d, must be 64 at high speed", mps)
+	case isSuperSpeed(speed) && mps != 9:
+		c.errorf(where, "bMaxPacketSize0 is %d, must be 9 (512 bytes) at SuperSpeed", mps)
+	}
+
+	if dd.BNumConfigurations == 0 {
+		c.errorf(where, "bNumConfigurations is 0")
+	} else if c.in.Configs != nil && int(dd.BNumConfigurations) != len(c.in.Configs) {
+		c.errorf(where, "bNumConfigurations is %d but %d configurations were found", dd.BNumConfigurations, len(c.in.Configs))
+	}
+	return dd, true
+}
+
+func (c *checker) checkStrings() {
+	if c.in.Strings == nil {
+		return
+	}
+	indices := stringIndices(c.in)
+	if len(indices) > 0 && len(c.in.LangIds) == 0 {
+		c.errorf("string 0", "strings are referenced but there is no LANGID table")
+		return
+	}
+	for index, where := range indices {
+		if _, ok := c.in.Strings[index]; !ok {
+			c.errorf(where, "string index %d can't be read", index)
+		}
+	}
+}
+
+// State carried along the walk of a configuration's raw descriptors
+type walkState struct {
+	where          string
+	iface          int // bInterfaceNumber of the current interface, or -1
+	iface_class    usb.ClassCode
+	num_eps        int // bNumEndpoints of the current interface
+	seen_eps       int
+	want_companion bool
+	iad_offsets    map[byte]int // by bFirstInterface
+	iface_offsets  map[byte]int // first appearance, by bInterfaceNumber
+}
+
+func (c *checker) checkConfig(index int, raw []byte, dd usb.DeviceDescriptor, have_dd bool) {
+	where := fmt.Sprintf("config %d", index)
+	if len(raw) < 9 {
+		c.errorf(where, "only %d bytes long", len(raw))
+		return
+	}
+	if raw[0] != 9 {
+		c.errorf(where, "bLength is %d, should be 9", raw[0])
+	}
+	if usb.DescriptorType(raw[1]) != usb.DT_CONFIG {
+		c.errorf(where, "bDescriptorType is 0x%02x, should be 0x%02x", raw[1], usb.DT_CONFIG)
+	}
+	total := int(raw[2]) | int(raw[3])<<8
+	if total != len(raw) {
+		c.errorf(where, "wTotalLength is %d but the configuration is %d bytes long", total, len(raw))
+		if total > len(raw) {
+			total = len(raw)
+		}
+	}
+	attrs := raw[7]
+	if attrs&0x80 == 0 {
+		c.errorf(where, "bmAttributes bit 7 must be set")
+	}
+	if attrs&0x1f != 0 {
+		c.warnf(where, "bmAttributes reserved bits 0x%02x are set", attrs&0x1f)
+	}
+	if isSuperSpeed(c.in.Speed) {
+		if int(raw[8])*8 > 900 {
+			c.errorf(where, "bMaxPower is %dmA, more than the 900mA SuperSpeed allows", int(raw[8])*8)
+		}
+	} else if int(raw[8])*2 > 500 {
+		c.errorf(where, "bMaxPower is %dmA, more than the 500mA USB 2 allows", int(raw[8])*2)
+	}
+
+	st := &walkState{
+		where:         where,
+		iface:         -1,
+		iad_offsets:   make(map[byte]int),
+		iface_offsets: make(map[byte]int),
+	}
+	// With a bad bLength, assume the header is the usual 9 bytes
+	start := int(raw[0])
+	if start < 9 {
+		start = 9
+	}
+	if start > total {
+		c.errorf(where, "bLength %d runs past wTotalLength", start)
+		return
+	}
+	walked := c.walkConfig(st, raw[:total], start)
+
+	// Parse whatever was well-formed, with the header patched up
+	fixed := append([]byte(nil), raw[:walked]...)
+	fixed[0], fixed[1] = byte(start), byte(usb.DT_CONFIG)
+	fixed[2], fixed[3] = byte(walked), byte(walked>>8)
+	cfg, err := usb.ParseConfigDescriptor(fixed)
+	if err != nil {
+		c.errorf(where, "can't be parsed any further")
+		return
+	}
+	if int(raw[4]) != len(cfg.Interfaces) {
+		c.errorf(where, "bNumInterfaces is %d but %d interfaces were found", raw[4], len(cfg.Interfaces))
+	}
+	c.checkInterfaces(index, &cfg)
+	c.checkFunctions(index, &cfg, st, dd, have_dd)
+}
+
+// Walk the descriptors, checking their lengths and placement. Returns
+// how many bytes could be walked, so that parsing can go on with the
+// well-formed prefix.
+func (c *checker) walkConfig(st *walkState, raw []byte, pos int) int {
+	for pos < len(raw) {
+		length := int(raw[pos])
+		if pos+2 > len(raw) || length < 2 {
+			c.errorf(st.where, "descriptor at offset %d has bLength %d", pos, length)
+			return pos
+		}
+		if pos+length > len(raw) {
+			c.errorf(st.where, "descriptor at offset %d runs past wTotalLength", pos)
+			return pos
+		}
+		desc := raw[pos : pos+length]
+		dtype := usb.DescriptorType(desc[1])
+
+		if st.want_companion && dtype != usb.DT_SS_ENDPOINT_COMPANION {
+			c.errorf(st.where, "SuperSpeed endpoint at offset %d is not followed by an endpoint companion", pos)
+		}
+		st.want_companion = false
+
+		switch dtype {
+		case usb.DT_DEVICE, usb.DT_CONFIG:
+			c.errorf(st.where, "descriptor type 0x%02x at offset %d doesn't belong in a configuration", dtype, pos)
+		case usb.DT_INTERFACE:
+			c.endInterface(st)
+			if length != 9 {
+				c.errorf(st.where, "interface descriptor at offset %d has bLength %d, should be 9", pos, length)
+			}
+			if length >= 9 {
+				st.iface = int(desc[2])
+				st.num_eps = int(desc[4])
+				st.iface_class = usb.ClassCode(desc[5])
+				st.seen_eps = 0
+				if _, seen := st.iface_offsets[desc[2]]; !seen {
+					st.iface_offsets[desc[2]] = pos
+				}
+			}
+		case usb.DT_ENDPOINT:
+			st.seen_eps++
+			if st.iface < 0 {
+				c.errorf(st.where, "endpoint at offset %d comes before any interface", pos)
+			}
+			switch {
+			case length == 9 && st.iface_class == usb.CLASS_AUDIO:
+			case length == 9:
+				c.warnf(st.where, "endpoint at offset %d has the audio class bLength 9 outside an audio interface", pos)
+			case length != 7:
+				c.errorf(st.where, "endpoint at offset %d has bLength %d, should be 7", pos, length)
+			}
+			st.want_companion = isSuperSpeed(c.in.Speed)
+		case usb.DT_INTERFACE_ASSOCIATION:
+			if length != 8 {
+				c.errorf(st.where, "interface association at offset %d has bLength %d, should be 8", pos, length)
+			}
+			if length >= 3 {
+				st.iad_offsets[desc[2]] = pos
+			}
+		case usb.DT_SS_ENDPOINT_COMPANION:
+			if length != 6 {
+				c.errorf(st.where, "endpoint companion at offset %d has bLength %d, should be 6", pos, length)
+			}
+		case dtSSPIsoEndpointCompanion:
+			if length != 8 {
+				c.errorf(st.where, "isochronous endpoint companion at offset %d has bLength %d, should be 8", pos, length)
+			}
+		}
+		pos += length
+	}
+	if st.want_companion {
+		c.errorf(st.where, "last SuperSpeed endpoint is not followed by an endpoint companion")
+	}
+	c.endInterface(st)
+	return pos
+}
+
+func (c *checker) endInterface(st *walkState) {
+	if st.iface >= 0 && st.seen_eps != st.num_eps {
+		c.errorf(st.where, "interface %d has bNumEndpoints %d but %d endpoints follow", st.iface, st.num_eps, st.seen_eps)
+	}
+	st.iface = -1
+}
+
+func (c *checker) checkInterfaces(index int, cfg *usb.ConfigDescriptor) {
+	where := fmt.Sprintf("config %d", index)
+	// Which interface each endpoint address belongs to
+	owners := make(map[byte]byte)
+
+	numbers := make(map[byte]bool)
+	for _, alts := range cfg.Interfaces {
+		numbers[alts[0].BInterfaceNumber] = true
+		for i, alt := range alts {
+			if int(alt.BAlternateSetting) != i {
+				c.warnf(altWhere(index, alt), "alternate settings aren't numbered consecutively from 0")
+			}
+			seen := make(map[byte]bool)
+			for _, ep := range alt.Endpoints {
+				ep_where := fmt.Sprintf("%s endpoint 0x%02x", altWhere(index, alt), ep.BEndpointAddress)
+				c.checkEndpoint(ep_where, &ep)
+				addr := ep.BEndpointAddress
+				if seen[addr] {
+					c.errorf(ep_where, "endpoint address appears twice in the same alternate setting")
+				}
+				seen[addr] = true
+				if owner, ok := owners[addr]; ok && owner != alt.BInterfaceNumber {
+					c.errorf(ep_where, "endpoint address is also used by interface %d", owner)
+				}
+				owners[addr] = alt.BInterfaceNumber
+			}
+		}
+	}
+	for n := 0; n < len(numbers); n++ {
+		if !numbers[byte(n)] {
+			c.warnf(where, "interfaces aren't numbered consecutively from 0; %d is missing", n)
+			break
+		}
+	}
+}
+
+func (c *checker) checkEndpoint(where string, ep *usb.EndpointDescriptor) {
+	addr := ep.BEndpointAddress
+	if addr&0x0f == 0 {
+		c.errorf(where, "endpoint 0 can't be described by an endpoint descriptor")
+	}
+	if addr&0x70 != 0 {
+		c.errorf(where, "reserved bits of bEndpointAddress are set")
+	}
+
+	ttype := int(ep.BmAttributes & usb.TRANSFER_TYPE_MASK)
+	if ttype != usb.TRANSFER_TYPE_ISOCHRONOUS && ep.BmAttributes&0x3c != 0 && !isSuperSpeed(c.in.Speed) {
+		c.warnf(where, "synchronization and usage bits are set on a non-isochronous endpoint")
+	}
+	if msg := checkMaxPacket(c.in.Speed, ttype, ep.WMaxPacketSize); msg != "" {
+		c.errorf(where, "%s", msg)
+	}
+	if sev, msg := checkInterval(c.in.Speed, ttype, ep.BInterval); msg != "" {
+		c.report(sev, where, "%s", msg)
+	}
+}
+
+var transferTypeNames = []string{"control", "isochronous", "bulk", "interrupt"}
+
+// Returns a description of what's wrong with wMaxPacketSize, or ""
+func checkMaxPacket(speed usb.Speed, ttype int, w uint16) string {
+	size, mult := int(w&0x7ff), int(w>>11)&3
+	name := transferTypeNames[ttype]
+	if w>>13 != 0 {
+		return fmt.Sprintf("reserved bits of wMaxPacketSize 0x%04x are set", w)
+	}
+	if mult != 0 {
+		switch {
+		case mult == 3:
+			return "additional transactions per microframe is the reserved value 3"
+		case ttype == usb.TRANSFER_TYPE_CONTROL || ttype == usb.TRANSFER_TYPE_BULK:
+			return "additional transactions per microframe are only allowed on periodic endpoints"
+		case speed != usb.SPEED_HIGH && speed != usb.SPEED_UNKNOWN:
+			return fmt.Sprintf("additional transactions per microframe aren't allowed at %s speed", speed)
+		}
+	}
+	switch ttype {
+	case usb.TRANSFER_TYPE_CONTROL:
+		switch {
+		case speed == usb.SPEED_LOW && size != 8,
+			speed == usb.SPEED_FULL && size != 8 && size != 16 && size != 32 && size != 64,
+			speed == usb.SPEED_HIGH && size != 64,
+			isSuperSpeed(speed) && size != 512:
+			return fmt.Sprintf("%d bytes is not a valid %s packet size at %s speed", size, name, speed)
+		}
+	case usb.TRANSFER_TYPE_BULK:
+		switch {
+		case speed == usb.SPEED_LOW:
+			return "bulk endpoints aren't allowed at low speed"
+		case speed == usb.SPEED_FULL && size != 8 && size != 16 && size != 32 && size != 64,
+			speed == usb.SPEED_HIGH && size != 512,
+			isSuperSpeed(speed) && size != 1024:
+			return fmt.Sprintf("%d bytes is not a valid %s packet size at %s speed", size, name, speed)
+		}
+	case usb.TRANSFER_TYPE_INTERRUPT, usb.TRANSFER_TYPE_ISOCHRONOUS:
+		limit := 1024
+		switch {
+		case speed == usb.SPEED_LOW && ttype == usb.TRANSFER_TYPE_ISOCHRONOUS:
+			return "isochronous endpoints aren't allowed at low speed"
+		case speed == usb.SPEED_LOW:
+			limit = 8
+		case speed == usb.SPEED_FULL && ttype == usb.TRANSFER_TYPE_INTERRUPT:
+			limit = 64
+		case speed == usb.SPEED_FULL:
+			limit = 1023
+		}
+		if size > limit {
+			return fmt.Sprintf("%d bytes is more than the %d allowed for %s endpoints at %s speed", size, limit, name, speed)
+		}
+		if size == 0 && ttype == usb.TRANSFER_TYPE_INTERRUPT {
+			return "interrupt endpoint with a maximum packet size of 0"
+		}
+		// USB 2.0 table 9-14: the size has to justify the extra transactions
+		if mult == 1 && size < 513 || mult == 2 && size < 683 {
+			return fmt.Sprintf("%d bytes is too small for %d additional transactions per microframe", size, mult)
+		}
+	}
+	return ""
+}
+
+// Returns what's wrong with bInterval and how bad it is, or ""
+func checkInterval(speed usb.Speed, ttype int, interval byte) (Severity, string) {
+	switch ttype {
+	case usb.TRANSFER_TYPE_INTERRUPT:
+		switch {
+		case speed == usb.SPEED_UNKNOWN:
+		case interval == 0:
+			return ERROR, "bInterval is 0 on an interrupt endpoint"
+		case speed == usb.SPEED_LOW && interval < 10:
+			return WARNING, fmt.Sprintf("bInterval %d is below the 10ms minimum for low-speed interrupt endpoints", interval)
+		case speed >= usb.SPEED_HIGH && interval > 16:
+			return ERROR, fmt.Sprintf("bInterval %d is out of range; at %s speed it must be 1 to 16", interval, speed)
+		}
+	case usb.TRANSFER_TYPE_ISOCHRONOUS:
+		if interval < 1 || interval > 16 {
+			return ERROR, fmt.Sprintf("bInterval %d is out of range; isochronous endpoints must use 1 to 16", interval)
+		}
+	case usb.TRANSFER_TYPE_BULK:
+		if isSuperSpeed(speed) && interval != 0 {
+			return WARNING, fmt.Sprintf("bInterval %d is set on a SuperSpeed bulk endpoint", interval)
+		}
+	}
+	return WARNING, ""
+}
+
+func (c *checker) checkFunctions(index int, cfg *usb.ConfigDescriptor, st *walkState, dd usb.DeviceDescriptor, have_dd bool) {
+	if len(cfg.Functions) == 0 {
+		return
+	}
+	if have_dd && (dd.BDeviceClass != 0xef || dd.BDeviceSubClass != 0x02 || dd.BDeviceProtocol != 0x01) {
+		c.warnf("device", "has interface associations but the device class triple isn't EF/02/01")
+	}
+	owner := make(map[byte]byte)
+	for _, f := range cfg.Functions {
+		where := fmt.Sprintf("config %d function %d", index, f.BFirstInterface)
+		switch {
+		case f.BInterfaceCount == 0:
+			c.errorf(where, "bInterfaceCount is 0")
+		case f.BInterfaceCount == 1:
+			c.warnf(where, "an interface association should group at least two interfaces")
+		}
+		for n := int(f.BFirstInterface); n < int(f.BFirstInterface)+int(f.BInterfaceCount); n++ {
+			if n > 0xff {
+				break
+			}
+			iface := byte(n)
+			if _, ok := st.iface_offsets[iface]; !ok {
+				c.errorf(where, "covers interface %d, which doesn't exist", n)
+			}
+			if other, ok := owner[iface]; ok {
+				c.errorf(where, "interface %d is also part of function %d", n, other)
+			}
+			owner[iface] = f.BFirstInterface
+		}
+		if first, ok := st.iface_offsets[f.BFirstInterface]; ok && st.iad_offsets[f.BFirstInterface] > first {
+			c.errorf(where, "interface association comes after its first interface")
+		}
+	}
+}
@@ -0,0 +1,76 @@
+// Check a device's descriptors against the USB specification.
+//
+//	usblint -d 2047:0200                 # a connected device
+//	usblint -speed high descriptors.bin  # a dump, e.g. from sysfs
+//
+// Exits with status 1 if any errors were found.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+
+	"gopkg.thequux.com/usb"
+	"gopkg.thequux.com/usb/lint"
+)
+
+var speeds = map[string]usb.Speed{
+	"low":    usb.SPEED_LOW,
+	"full":   usb.SPEED_FULL,
+	"high":   usb.SPEED_HIGH,
+	"super":  usb.SPEED_SUPER,
+	"super+": usb.SPEED_SUPER_PLUS,
+}
+
+func main() {
+	device := flag.String("d", "", "check the connected device with this `vid:pid`")
+	speed_name := flag.String("speed", "", "speed a dump was taken at: low, full, high, super or super+")
+	warnings := flag.Bool("w", true, "report warnings as well as errors")
+	flag.Parse()
+
+	var (
+		in  *lint.Input
+		err error
+	)
+	switch {
+	case *device != "" && flag.NArg() == 0:
+		var vid, pid int
+		if _, err := fmt.Sscanf(*device, "%x:%x", &vid, &pid); err != nil {
+			log.Fatal("bad device ", *device, ": ", err)
+		}
+		h, uerr := usb.DefaultContext.Open(vid, pid)
+		if uerr != nil {
+			log.Fatal("opening device: ", uerr)
+		}
+		in, err = lint.FromDevice(h)
+	case *device == "" && flag.NArg() == 1:
+		speed, ok := speeds[*speed_name]
+		if !ok && *speed_name != "" {
+			log.Fatal("unknown speed ", *speed_name)
+		}
+		blob, rerr := ioutil.ReadFile(flag.Arg(0))
+		if rerr != nil {
+			log.Fatal(rerr)
+		}
+		in, err = lint.FromBlob(speed, blob)
+	default:
+		fmt.Fprintln(os.Stderr, "usage: usblint [-w=false] -d vid:pid | [-speed speed] file")
+		os.Exit(2)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	problems := lint.Check(in)
+	for _, p := range problems {
+		if p.Severity == lint.ERROR || *warnings {
+			fmt.Println(p)
+		}
+	}
+	if lint.HasErrors(problems) {
+		os.Exit(1)
+	}
+}
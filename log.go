@@ -0,0 +1,101 @@
+package usb
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sync"
+)
+
+// A Backend that can send what it has to say to a logger rather than
+// to stderr, for Context.SetLogger. Messages are logged at the
+// slog level matching their DEBUG_* level.
+type LoggingBackend interface {
+	// nil goes back to whatever the backend did before
+	SetLogger(l *slog.Logger)
+}
+
+// The slog level of each DEBUG_* level
+var debugLevels = map[int]slog.Level{
+	DEBUG_ERROR: slog.LevelError,
+	DEBUG_WARN:  slog.LevelWarn,
+	DEBUG_INFO:  slog.LevelInfo,
+	DEBUG_DEBUG: slog.LevelDebug,
+}
+
+// The most verbose DEBUG_* level that l would log anything at
+func debugLevelFor(l *slog.Logger) int {
+	for level := DEBUG_DEBUG; level > DEBUG_SILENT; level-- {
+		if l.Enabled(context.Background(), debugLevels[level]) {
+			return level
+		}
+	}
+	return DEBUG_SILENT
+}
+
+type loggerSlot struct {
+	lock   sync.Mutex
+	logger *slog.Logger
+}
+
+func (s *loggerSlot) get() *slog.Logger {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.logger
+}
+
+func (s *loggerSlot) set(l *slog.Logger) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.logger = l
+}
+
+// Log what happens in this context to l: devices being opened,
+// interfaces claimed and transfers failing, and, if the backend is a
+// LoggingBackend, the backend's own messages. Attributes added with
+// l.With tell contexts apart. nil stops logging.
+//
+// libusb is told to say as much as l would log; SetDebug afterwards
+// still changes that.
+func (ctx *Context) SetLogger(l *slog.Logger) {
+	ctx.init_lock.Lock()
+	defer ctx.init_lock.Unlock()
+	ctx.logger.set(l)
+	if ctx.initialized {
+		ctx.applyLogger(l)
+	}
+}
+
+// Pass the logger on to the backend, if it takes one
+func (ctx *Context) applyLogger(l *slog.Logger) {
+	if b, ok := ctx.backend.(LoggingBackend); ok {
+		b.SetLogger(l)
+	}
+}
+
+func (ctx *Context) log(level slog.Level, msg string, args ...interface{}) {
+	if l := ctx.logger.get(); l != nil {
+		l.Log(context.Background(), level, msg, args...)
+	}
+}
+
+// The attributes that say which device a message is about
+func (dev *Device) logAttrs() slog.Attr {
+	return slog.Group("device",
+		slog.Int("bus", dev.dev.GetBusNumber()),
+		slog.Int("address", dev.dev.GetAddress()))
+}
+
+// Log a failed transfer. Cancellations are asked for and timeouts are
+// often expected, so they are only worth a debug message.
+func (h *DeviceHandle) logTransfer(t *Transfer, err *UsbError) {
+	level := slog.LevelWarn
+	if err == UsbErrorCancelled || err == UsbErrorTimeout {
+		level = slog.LevelDebug
+	}
+	h.ctx.log(level, "transfer failed", h.dev.logAttrs(),
+		slog.Int("type", t.Type),
+		slog.String("endpoint", fmt.Sprintf("0x%02x", t.Endpoint)),
+		slog.Int("length", len(t.Buffer)),
+		slog.String("error", err.Text))
+}
@@ -0,0 +1,260 @@
+// Package metrics exposes USB devices to Prometheus, or anything else
+// that scrapes the OpenMetrics text format: the devices attached, as
+// sysfs lists them, and the transfer statistics of device handles
+// open in this process.
+//
+//	e := metrics.NewExporter()
+//	e.Watch("programmer", h)
+//	http.Handle("/metrics", e)
+//
+// Devices are labelled with their bus, address, port, IDs and serial
+// number, so that an alert can watch for a particular device dropping
+// off or its transfers failing.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"gopkg.thequux.com/usb"
+)
+
+// The content type of the OpenMetrics text format
+const CONTENT_TYPE = "application/openmetrics-text; version=1.0.0; charset=utf-8"
+
+// Gathers the metrics afresh each time they are asked for
+type Exporter struct {
+	// Where devices are listed from; usb.SYSFS_ROOT unless changed
+	Sysfs string
+
+	lock    sync.Mutex
+	handles map[string]*usb.DeviceHandle
+}
+
+func NewExporter() *Exporter {
+	return &Exporter{
+		Sysfs:   usb.SYSFS_ROOT,
+		handles: make(map[string]*usb.DeviceHandle),
+	}
+}
+
+// Export the transfer statistics of a handle, labelled with name
+func (e *Exporter) Watch(name string, h *usb.DeviceHandle) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	e.handles[name] = h
+}
+
+// Stop exporting the statistics of the handle watched as name
+func (e *Exporter) Unwatch(name string) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	delete(e.handles, name)
+}
+
+// Serve the metrics, such as to a scrape
+func (e *Exporter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", CONTENT_TYPE)
+	e.WriteTo(w)
+}
+
+// Write the metrics in the OpenMetrics text format
+func (e *Exporter) WriteTo(w io.Writer) (int64, error) {
+	mw := &metricWriter{w: bufio.NewWriter(w)}
+	e.writeInventory(mw)
+	e.writeStats(mw)
+	mw.printf("# EOF\n")
+	if err := mw.w.Flush(); err != nil && mw.err == nil {
+		mw.err = err
+	}
+	return mw.n, mw.err
+}
+
+type metricWriter struct {
+	w   *bufio.Writer
+	n   int64
+	err error
+}
+
+func (mw *metricWriter) printf(format string, args ...interface{}) {
+	n, err := fmt.Fprintf(mw.w, format, args...)
+	mw.n += int64(n)
+	if err != nil && mw.err == nil {
+		mw.err = err
+	}
+}
+
+func (mw *metricWriter) family(name, kind, help string) {
+	mw.printf("# TYPE %s %s\n# HELP %s %s\n", name, kind, name, help)
+}
+
+// A sample, with its labels as name and value pairs
+func (mw *metricWriter) sample(name string, value interface{}, labels ...string) {
+	mw.printf("%s", name)
+	if len(labels) > 0 {
+		mw.printf("{")
+		for i := 0; i+1 < len(labels); i += 2 {
+			if i > 0 {
+				mw.printf(",")
+			}
+			mw.printf("%s=\"%s\"", labels[i], escapeLabel(labels[i+1]))
+		}
+		mw.printf("}")
+	}
+	switch v := value.(type) {
+	case float64:
+		mw.printf(" %s\n", strconv.FormatFloat(v, 'g', -1, 64))
+	default:
+		mw.printf(" %d\n", v)
+	}
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabel(s string) string {
+	return labelEscaper.Replace(s)
+}
+
+// The labels that identify an attached device
+func deviceLabels(dev *usb.SysfsDevice) []string {
+	var vendor, product string
+	if desc, err := dev.GetDeviceDescriptor(); err == nil {
+		vendor = fmt.Sprintf("%04x", desc.IdVendor)
+		product = fmt.Sprintf("%04x", desc.IdProduct)
+	}
+	return []string{
+		"bus", strconv.Itoa(dev.Bus),
+		"address", strconv.Itoa(dev.Address),
+		"port", dev.Name,
+		"vendor", vendor,
+		"product", product,
+		"serial", dev.Serial,
+	}
+}
+
+func (e *Exporter) writeInventory(mw *metricWriter) {
+	devs, err := usb.ListSysfsDevices(e.Sysfs)
+	mw.family("usb_sysfs_up", "gauge", "Whether the devices could be listed from sysfs")
+	if err != nil {
+		mw.sample("usb_sysfs_up", 0)
+		return
+	}
+	mw.sample("usb_sysfs_up", 1)
+	sort.Slice(devs, func(i, j int) bool {
+		if devs[i].Bus != devs[j].Bus {
+			return devs[i].Bus < devs[j].Bus
+		}
+		return devs[i].Address < devs[j].Address
+	})
+
+	mw.family("usb_device", "info", "A device attached")
+	for _, dev := range devs {
+		labels := append(deviceLabels(dev),
+			"speed", dev.Speed.String(),
+			"manufacturer", dev.Manufacturer,
+			"product_name", dev.Product)
+		mw.sample("usb_device_info", 1, labels...)
+	}
+
+	mw.family("usb_device_configuration", "gauge", "The bConfigurationValue of the active configuration, 0 if unconfigured")
+	for _, dev := range devs {
+		if value, err := dev.GetConfiguration(); err == nil {
+			mw.sample("usb_device_configuration", value, deviceLabels(dev)...)
+		}
+	}
+
+	mw.family("usb_interface_claimed", "gauge", "An interface of the active configuration that a driver has claimed; usbfs is a program using the device directly")
+	for _, dev := range devs {
+		ifaces := make([]int, 0, len(dev.Drivers))
+		for n := range dev.Drivers {
+			ifaces = append(ifaces, int(n))
+		}
+		sort.Ints(ifaces)
+		for _, n := range ifaces {
+			labels := append(deviceLabels(dev),
+				"interface", strconv.Itoa(n),
+				"driver", dev.Drivers[byte(n)])
+			mw.sample("usb_interface_claimed", 1, labels...)
+		}
+	}
+}
+
+type endpointSample struct {
+	labels []string
+	stats  usb.EndpointStats
+}
+
+// Histogram bounds are written as floats even when they are whole
+func formatBound(v float64) string {
+	s := strconv.FormatFloat(v, 'g', -1, 64)
+	if !strings.ContainsAny(s, ".e") {
+		s += ".0"
+	}
+	return s
+}
+
+func (e *Exporter) writeStats(mw *metricWriter) {
+	e.lock.Lock()
+	names := make([]string, 0, len(e.handles))
+	for name := range e.handles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var samples []endpointSample
+	for _, name := range names {
+		all := e.handles[name].GetAllEndpointStats()
+		endpoints := make([]int, 0, len(all))
+		for endpoint := range all {
+			endpoints = append(endpoints, int(endpoint))
+		}
+		sort.Ints(endpoints)
+		for _, endpoint := range endpoints {
+			samples = append(samples, endpointSample{
+				labels: []string{"device", name, "endpoint", fmt.Sprintf("0x%02x", endpoint)},
+				stats:  all[byte(endpoint)],
+			})
+		}
+	}
+	e.lock.Unlock()
+
+	mw.family("usb_transfers", "counter", "Transfers that have ended, however they did")
+	for _, s := range samples {
+		mw.sample("usb_transfers_total", s.stats.Transfers, s.labels...)
+	}
+	mw.family("usb_transfer_bytes", "counter", "Bytes moved by transfers")
+	for _, s := range samples {
+		mw.sample("usb_transfer_bytes_total", s.stats.Bytes, s.labels...)
+	}
+	mw.family("usb_transfer_errors", "counter", "Transfers that failed, by error")
+	for _, s := range samples {
+		errs := make([]*usb.UsbError, 0, len(s.stats.Errors))
+		for err := range s.stats.Errors {
+			errs = append(errs, err)
+		}
+		sort.Slice(errs, func(i, j int) bool { return errs[i].Text < errs[j].Text })
+		for _, err := range errs {
+			labels := append(append([]string(nil), s.labels...), "error", err.Text)
+			mw.sample("usb_transfer_errors_total", s.stats.Errors[err], labels...)
+		}
+	}
+	mw.family("usb_transfer_duration_seconds", "histogram", "How long transfers took from submission to completion")
+	for _, s := range samples {
+		var count int64
+		for i, bound := range usb.LatencyBuckets {
+			count += s.stats.Latency[i]
+			labels := append(append([]string(nil), s.labels...), "le", formatBound(bound.Seconds()))
+			mw.sample("usb_transfer_duration_seconds_bucket", count, labels...)
+		}
+		count += s.stats.Latency[len(usb.LatencyBuckets)]
+		labels := append(append([]string(nil), s.labels...), "le", "+Inf")
+		mw.sample("usb_transfer_duration_seconds_bucket", count, labels...)
+		mw.sample("usb_transfer_duration_seconds_sum", s.stats.TotalLatency.Seconds(), s.labels...)
+		mw.sample("usb_transfer_duration_seconds_count", count, s.labels...)
+	}
+}
@@ -0,0 +1,190 @@
+package metrics_test
+
+import (
+	"bufio"
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"gopkg.thequux.com/usb"
+	"gopkg.thequux.com/usb/metrics"
+	"gopkg.thequux.com/usb/usbtest"
+)
+
+// A handle on the usbtest echo device, whose IN endpoint has answered
+// once and stalled once
+func watched(t *testing.T) *usb.DeviceHandle {
+	stall := false
+	dev := usbtest.NewEchoDevice()
+	dev.Endpoints[0x81] = func(req *usbtest.Request) ([]byte, *usb.UsbError) {
+		if stall {
+			return nil, usb.UsbErrorPipe
+		}
+		stall = true
+		return []byte("data"), nil
+	}
+	h, err := usbtest.OpenEcho(usbtest.NewContext(dev))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(h.Close)
+	for _, want := range []*usb.UsbError{nil, usb.UsbErrorPipe} {
+		tr := &usb.Transfer{Type: usb.TRANSFER_TYPE_BULK, Endpoint: 0x81, Buffer: make([]byte, 64), Timeout: time.Second}
+		if err := h.Submit(tr); err != nil {
+			t.Fatal(err)
+		}
+		if err := tr.Wait(); err != want {
+			t.Fatalf("transfer ended with %v, want %v", err, want)
+		}
+	}
+	return h.DeviceHandle
+}
+
+// One line of the exposition, split at the last space
+type sample struct {
+	name, labels, value string
+}
+
+func parseSample(line string) (sample, bool) {
+	sp := strings.LastIndexByte(line, ' ')
+	if sp < 0 {
+		return sample{}, false
+	}
+	s := sample{name: line[:sp], value: line[sp+1:]}
+	if brace := strings.IndexByte(s.name, '{'); brace >= 0 {
+		s.name, s.labels = s.name[:brace], s.name[brace:]
+	}
+	return s, true
+}
+
+// A label set without le, to match a histogram's buckets with its
+// count
+func withoutLe(labels string) string {
+	if i := strings.Index(labels, `,le="`); i >= 0 {
+		return labels[:i] + "}"
+	}
+	return labels
+}
+
+// Scrape an exporter listing the usb package's testdata/sysfs and
+// watching a handle
+func TestExporter(t *testing.T) {
+	e := metrics.NewExporter()
+	e.Sysfs = "../testdata/sysfs"
+	e.Watch("launchpad", watched(t))
+	srv := httptest.NewServer(e)
+	defer srv.Close()
+	resp, err := srv.Client().Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != metrics.CONTENT_TYPE {
+		t.Errorf("content type %q, want %q", ct, metrics.CONTENT_TYPE)
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasSuffix(string(body), "\n# EOF\n") {
+		t.Errorf("exposition doesn't end with # EOF:\n%s", body)
+	}
+
+	// Every sample belongs to the family declared before it, with the
+	// suffix its type calls for
+	suffixes := map[string][]string{
+		"gauge":     {""},
+		"info":      {"_info"},
+		"counter":   {"_total"},
+		"histogram": {"_bucket", "_sum", "_count"},
+	}
+	var family, kind string
+	values := make(map[string]string) // by name and labels
+	inf := make(map[string]string)    // +Inf buckets, by labels without le
+	scanner := bufio.NewScanner(strings.NewReader(string(body)))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if fields := strings.Fields(line); len(fields) == 4 && fields[0] == "#" && fields[1] == "TYPE" {
+			family, kind = fields[2], fields[3]
+			continue
+		}
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		s, ok := parseSample(line)
+		if !ok {
+			t.Errorf("malformed line %q", line)
+			continue
+		}
+		belongs := false
+		for _, suffix := range suffixes[kind] {
+			if s.name == family+suffix {
+				belongs = true
+			}
+		}
+		if !belongs {
+			t.Errorf("%s in %s family %s", s.name, kind, family)
+		}
+		values[s.name+s.labels] = s.value
+		if s.name == "usb_transfer_duration_seconds_bucket" && strings.HasSuffix(s.labels, `,le="+Inf"}`) {
+			inf[withoutLe(s.labels)] = s.value
+		}
+	}
+
+	for _, want := range []string{
+		`usb_sysfs_up`,
+		`usb_device_info{bus="1",address="1",port="usb1",vendor="1d6b",product="0002",serial="0000:00:1a.0",speed="high",manufacturer="Linux 6.1.0 ehci_hcd",product_name="EHCI Host Controller"}`,
+		`usb_interface_claimed{bus="1",address="1",port="usb1",vendor="1d6b",product="0002",serial="0000:00:1a.0",interface="0",driver="hub"}`,
+		`usb_interface_claimed{bus="1",address="5",port="1-1.2",vendor="2047",product="0200",serial="ABC123",interface="0",driver="cdc_acm"}`,
+		`usb_device_configuration{bus="1",address="5",port="1-1.2",vendor="2047",product="0200",serial="ABC123"}`,
+		`usb_transfers_total{device="launchpad",endpoint="0x81"}`,
+		`usb_transfer_bytes_total{device="launchpad",endpoint="0x81"}`,
+		`usb_transfer_errors_total{device="launchpad",endpoint="0x81",error="` + usb.UsbErrorPipe.Text + `"}`,
+		`usb_transfer_duration_seconds_count{device="launchpad",endpoint="0x81"}`,
+	} {
+		if _, ok := values[want]; !ok {
+			t.Errorf("no sample %s", want)
+		}
+	}
+	for name, want := range map[string]string{
+		`usb_sysfs_up`: "1",
+		`usb_transfers_total{device="launchpad",endpoint="0x81"}`:      "2",
+		`usb_transfer_bytes_total{device="launchpad",endpoint="0x81"}`: "4",
+	} {
+		if got, ok := values[name]; ok && got != want {
+			t.Errorf("%s is %s, want %s", name, got, want)
+		}
+	}
+
+	if len(inf) == 0 {
+		t.Error("no +Inf buckets")
+	}
+	for labels, bucket := range inf {
+		if count := values["usb_transfer_duration_seconds_count"+labels]; bucket != count {
+			t.Errorf("+Inf bucket %s but count %s for %s", bucket, count, labels)
+		}
+	}
+}
+
+// Without sysfs, the devices are left out but transfer statistics are
+// still exported
+func TestExporterWithoutSysfs(t *testing.T) {
+	e := metrics.NewExporter()
+	e.Sysfs = "testdata/nonexistent"
+	e.Watch("launchpad", watched(t))
+	var out strings.Builder
+	if _, err := e.WriteTo(&out); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "\nusb_sysfs_up 0\n") {
+		t.Errorf("usb_sysfs_up isn't 0:\n%s", out.String())
+	}
+	if strings.Contains(out.String(), "usb_device_info") {
+		t.Errorf("devices listed without sysfs:\n%s", out.String())
+	}
+	if !strings.Contains(out.String(), `usb_transfers_total{device="launchpad",endpoint="0x81"} 2`) {
+		t.Errorf("no transfer statistics:\n%s", out.String())
+	}
+}
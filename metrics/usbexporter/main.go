@@ -0,0 +1,26 @@
+// Serve the USB devices attached to this machine as metrics.
+//
+//	usbexporter -listen localhost:9436
+//
+// The metrics are at /metrics, in the OpenMetrics text format.
+package main
+
+import (
+	"flag"
+	"log"
+	"net/http"
+
+	"gopkg.thequux.com/usb"
+	"gopkg.thequux.com/usb/metrics"
+)
+
+func main() {
+	listen := flag.String("listen", "localhost:9436", "serve on this `address`")
+	sysfs := flag.String("sysfs", usb.SYSFS_ROOT, "list devices from this `directory`")
+	flag.Parse()
+
+	e := metrics.NewExporter()
+	e.Sysfs = *sysfs
+	http.Handle("/metrics", e)
+	log.Fatal(http.ListenAndServe(*listen, nil))
+}
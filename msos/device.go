@@ -0,0 +1,60 @@
+package msos
+
+import "gopkg.thequux.com/usb"
+
+// The Microsoft OS descriptors a device advertises, for devices that
+// are emulated in software. Fill in whichever versions the device
+// should support; the BOS itself belongs to the device, so
+// PlatformCapability has to be added to it by the caller.
+type Descriptors struct {
+	VendorCode byte
+
+	// Version 1.0
+	CompatIDs  []CompatFunction
+	Properties map[byte][]Property // by interface number
+
+	// Version 2.0
+	Set *DescriptorSet
+}
+
+// The version 2.0 platform capability pointing at Set
+func (d *Descriptors) PlatformCapability() usb.DeviceCapability {
+	return PlatformCapability(PlatformInfo{
+		WindowsVersion: d.Set.WindowsVersion,
+		TotalLength:    uint16(len(d.Set.Bytes())),
+		VendorCode:     d.VendorCode,
+	})
+}
+
+// Answer a control request if it is one for Microsoft OS
+// descriptors, returning the response truncated to wLength. ok is
+// false for requests that aren't ours, which the caller should
+// handle itself (or stall).
+func (d *Descriptors) HandleControl(bmRequestType, bRequest byte, wValue, wIndex, wLength uint16) (resp []byte, ok bool) {
+	switch {
+	case bmRequestType == usb.DIR_IN|usb.REQUEST_TYPE_STANDARD|usb.RECIPIENT_DEVICE &&
+		bRequest == usb.REQUEST_GET_DESCRIPTOR &&
+		wValue == uint16(usb.DT_STRING)<<8|OS_STRING_INDEX &&
+		(d.CompatIDs != nil || d.Properties != nil):
+		resp = OSStringDescriptor(d.VendorCode)
+	case bmRequestType&(usb.DIR_MASK|usb.REQUEST_TYPE_MASK) != usb.DIR_IN|usb.REQUEST_TYPE_VENDOR ||
+		bRequest != d.VendorCode:
+		return nil, false
+	case wIndex == EXTENDED_COMPAT_ID && d.CompatIDs != nil:
+		resp = ExtendedCompatID(d.CompatIDs)
+	case wIndex == EXTENDED_PROPERTIES && d.Properties != nil:
+		props, found := d.Properties[byte(wValue)]
+		if !found {
+			return nil, false
+		}
+		resp = ExtendedProperties(props)
+	case wIndex == DESCRIPTOR_INDEX && d.Set != nil:
+		resp = d.Set.Bytes()
+	default:
+		return nil, false
+	}
+	if len(resp) > int(wLength) {
+		resp = resp[:wLength]
+	}
+	return resp, true
+}
@@ -0,0 +1,338 @@
+// Microsoft OS descriptors, which let Windows bind a driver (usually
+// WinUSB) to a device without an INF file.
+//
+// Version 1.0 is found through the 0xEE string descriptor, which
+// names a vendor request code; the Extended Compat ID and Extended
+// Properties feature descriptors are then read with that request.
+// Version 2.0 is advertised by a platform capability in the BOS and
+// is read as a single descriptor set.
+//
+// Everything here can be both read from a device and built, so that
+// an emulated device can serve the same bytes.
+package msos
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"time"
+	"unicode/utf16"
+
+	"gopkg.thequux.com/usb"
+)
+
+var ErrMalformed = errors.New("msos: malformed descriptor")
+
+const (
+	// String descriptor index of the OS string descriptor
+	OS_STRING_INDEX = 0xEE
+
+	// wIndex values of the feature descriptors
+	EXTENDED_COMPAT_ID  = 0x0004
+	EXTENDED_PROPERTIES = 0x0005
+)
+
+// Property data types, shared by version 1.0 and 2.0
+const (
+	REG_SZ                  = 1
+	REG_EXPAND_SZ           = 2
+	REG_BINARY              = 3
+	REG_DWORD_LITTLE_ENDIAN = 4
+	REG_DWORD_BIG_ENDIAN    = 5
+	REG_LINK                = 6
+	REG_MULTI_SZ            = 7
+)
+
+const requestTimeout = time.Second
+
+var osStringSignature = []byte{'M', 0, 'S', 0, 'F', 0, 'T', 0, '1', 0, '0', 0, '0', 0}
+
+var le = binary.LittleEndian
+
+// Encode a string as null-terminated UTF-16LE
+func encodeUTF16(s string) []byte {
+	units := utf16.Encode([]rune(s))
+	buf := make([]byte, 2*len(units)+2)
+	for i, u := range units {
+		le.PutUint16(buf[2*i:], u)
+	}
+	return buf
+}
+
+// Decode UTF-16LE, stopping at the first null
+func decodeUTF16(buf []byte) string {
+	units := make([]uint16, 0, len(buf)/2)
+	for i := 0; i+1 < len(buf); i += 2 {
+		u := le.Uint16(buf[i:])
+		if u == 0 {
+			break
+		}
+		units = append(units, u)
+	}
+	return string(utf16.Decode(units))
+}
+
+// Compatible and sub-compatible IDs are 8 bytes of ASCII, null padded
+func encodeID(id string) []byte {
+	buf := make([]byte, 8)
+	copy(buf, id)
+	return buf
+}
+
+func decodeID(buf []byte) string {
+	if i := bytes.IndexByte(buf, 0); i >= 0 {
+		buf = buf[:i]
+	}
+	return string(buf)
+}
+
+/////////////////// OS string descriptor
+
+// Build the 0xEE string descriptor advertising the given vendor code
+func OSStringDescriptor(vendor_code byte) []byte {
+	buf := []byte{18, byte(usb.DT_STRING)}
+	buf = append(buf, osStringSignature...)
+	return append(buf, vendor_code, 0)
+}
+
+// Parse the 0xEE string descriptor and return the vendor request
+// code used for the feature descriptors.
+func ParseOSStringDescriptor(buf []byte) (vendor_code byte, err error) {
+	if len(buf) < 18 || buf[0] < 18 || usb.DescriptorType(buf[1]) != usb.DT_STRING {
+		return 0, ErrMalformed
+	}
+	if !bytes.Equal(buf[2:16], osStringSignature) {
+		return 0, ErrMalformed
+	}
+	return buf[16], nil
+}
+
+// Read the 0xEE string descriptor. Devices without OS descriptors
+// usually stall, which comes back as usb.UsbErrorPipe.
+func GetVendorCode(h *usb.DeviceHandle) (byte, error) {
+	buf, err := h.GetRawDescriptor(usb.DT_STRING, OS_STRING_INDEX, 0, 18)
+	if err != nil {
+		return 0, err
+	}
+	return ParseOSStringDescriptor(buf)
+}
+
+// Read a feature descriptor whose total length is in the first four
+// bytes: fetch the header, then the whole thing.
+func getFeature(h *usb.DeviceHandle, recipient byte, vendor_code byte, wValue, wIndex uint16, header_len int) ([]byte, error) {
+	reqtype := byte(usb.DIR_IN | usb.REQUEST_TYPE_VENDOR | recipient)
+	buf := make([]byte, header_len)
+	n, err := h.ControlTransfer(reqtype, vendor_code, wValue, wIndex, buf, requestTimeout)
+	if err != nil {
+		return nil, err
+	}
+	if n < 4 {
+		return nil, ErrMalformed
+	}
+	total := int(le.Uint32(buf))
+	if total < header_len || total > 0xffff {
+		return nil, ErrMalformed
+	}
+	buf = make([]byte, total)
+	n, err = h.ControlTransfer(reqtype, vendor_code, wValue, wIndex, buf, requestTimeout)
+	if err != nil {
+		return nil, err
+	}
+	return buf[:n], nil
+}
+
+/////////////////// Extended Compat ID
+
+// One function section of the Extended Compat ID descriptor
+type CompatFunction struct {
+	FirstInterface  byte
+	CompatibleID    string // e.g. "WINUSB"
+	SubCompatibleID string
+}
+
+func ParseExtendedCompatID(buf []byte) ([]CompatFunction, error) {
+	if len(buf) < 16 || le.Uint16(buf[6:]) != EXTENDED_COMPAT_ID {
+		return nil, ErrMalformed
+	}
+	total := int(le.Uint32(buf))
+	count := int(buf[8])
+	if total > len(buf) || total != 16+24*count {
+		return nil, ErrMalformed
+	}
+	ret := make([]CompatFunction, count)
+	for i := range ret {
+		f := buf[16+24*i:]
+		ret[i] = CompatFunction{
+			FirstInterface:  f[0],
+			CompatibleID:    decodeID(f[2:10]),
+			SubCompatibleID: decodeID(f[10:18]),
+		}
+	}
+	return ret, nil
+}
+
+func ExtendedCompatID(funcs []CompatFunction) []byte {
+	buf := make([]byte, 16, 16+24*len(funcs))
+	le.PutUint32(buf, uint32(16+24*len(funcs)))
+	le.PutUint16(buf[4:], 0x0100)
+	le.PutUint16(buf[6:], EXTENDED_COMPAT_ID)
+	buf[8] = byte(len(funcs))
+	for _, f := range funcs {
+		buf = append(buf, f.FirstInterface, 0x01)
+		buf = append(buf, encodeID(f.CompatibleID)...)
+		buf = append(buf, encodeID(f.SubCompatibleID)...)
+		buf = append(buf, make([]byte, 6)...)
+	}
+	return buf
+}
+
+func GetExtendedCompatID(h *usb.DeviceHandle, vendor_code byte) ([]CompatFunction, error) {
+	buf, err := getFeature(h, usb.RECIPIENT_DEVICE, vendor_code, 0, EXTENDED_COMPAT_ID, 16)
+	if err != nil {
+		return nil, err
+	}
+	return ParseExtendedCompatID(buf)
+}
+
+/////////////////// Extended Properties
+
+// A registry property. In version 1.0 the type is 32 bits wide, in
+// 2.0 only 16; the same struct serves both.
+type Property struct {
+	Type uint32
+	Name string
+	Data []byte
+}
+
+func StringProperty(name, value string) Property {
+	return Property{REG_SZ, name, encodeUTF16(value)}
+}
+
+// The usual way to hand WinUSB its DeviceInterfaceGUIDs
+func MultiStringProperty(name string, values ...string) Property {
+	var data []byte
+	for _, v := range values {
+		data = append(data, encodeUTF16(v)...)
+	}
+	return Property{REG_MULTI_SZ, name, append(data, 0, 0)}
+}
+
+func DWordProperty(name string, value uint32) Property {
+	data := make([]byte, 4)
+	le.PutUint32(data, value)
+	return Property{REG_DWORD_LITTLE_ENDIAN, name, data}
+}
+
+// Decode string-typed data. REG_MULTI_SZ yields every string, the
+// other string types a single one.
+func (p Property) Strings() []string {
+	switch p.Type {
+	case REG_SZ, REG_EXPAND_SZ, REG_LINK:
+		return []string{decodeUTF16(p.Data)}
+	case REG_MULTI_SZ:
+		// Strings are split by nulls, and the list ends with an empty
+		// one, or with the data if the device left the nulls off
+		var ret []string
+		var units []uint16
+		for i := 0; i+1 < len(p.Data); i += 2 {
+			u := le.Uint16(p.Data[i:])
+			if u != 0 {
+				units = append(units, u)
+				continue
+			}
+			if len(units) == 0 {
+				return ret
+			}
+			ret = append(ret, string(utf16.Decode(units)))
+			units = units[:0]
+		}
+		if len(units) > 0 {
+			ret = append(ret, string(utf16.Decode(units)))
+		}
+		return ret
+	}
+	return nil
+}
+
+// Decode DWORD-typed data
+func (p Property) DWord() (uint32, bool) {
+	if len(p.Data) < 4 {
+		return 0, false
+	}
+	switch p.Type {
+	case REG_DWORD_LITTLE_ENDIAN:
+		return le.Uint32(p.Data), true
+	case REG_DWORD_BIG_ENDIAN:
+		return binary.BigEndian.Uint32(p.Data), true
+	}
+	return 0, false
+}
+
+func ParseExtendedProperties(buf []byte) ([]Property, error) {
+	if len(buf) < 10 || le.Uint16(buf[6:]) != EXTENDED_PROPERTIES {
+		return nil, ErrMalformed
+	}
+	total := int(le.Uint32(buf))
+	if total > len(buf) || total < 10 {
+		return nil, ErrMalformed
+	}
+	count := int(le.Uint16(buf[8:]))
+	rest := buf[10:total]
+	ret := make([]Property, 0, count)
+	for i := 0; i < count; i++ {
+		if len(rest) < 14 {
+			return nil, ErrMalformed
+		}
+		size := int(le.Uint32(rest))
+		if size < 14 || size > len(rest) {
+			return nil, ErrMalformed
+		}
+		prop := rest[:size]
+		rest = rest[size:]
+		name_len := int(le.Uint16(prop[8:]))
+		if 10+name_len+4 > size {
+			return nil, ErrMalformed
+		}
+		data_len := int(le.Uint32(prop[10+name_len:]))
+		if 14+name_len+data_len > size {
+			return nil, ErrMalformed
+		}
+		ret = append(ret, Property{
+			Type: le.Uint32(prop[4:]),
+			Name: decodeUTF16(prop[10 : 10+name_len]),
+			Data: append([]byte(nil), prop[14+name_len:14+name_len+data_len]...),
+		})
+	}
+	return ret, nil
+}
+
+func ExtendedProperties(props []Property) []byte {
+	buf := make([]byte, 10)
+	le.PutUint16(buf[4:], 0x0100)
+	le.PutUint16(buf[6:], EXTENDED_PROPERTIES)
+	le.PutUint16(buf[8:], uint16(len(props)))
+	for _, p := range props {
+		name := encodeUTF16(p.Name)
+		sect := make([]byte, 14+len(name)+len(p.Data))
+		le.PutUint32(sect, uint32(len(sect)))
+		le.PutUint32(sect[4:], p.Type)
+		le.PutUint16(sect[8:], uint16(len(name)))
+		copy(sect[10:], name)
+		le.PutUint32(sect[10+len(name):], uint32(len(p.Data)))
+		copy(sect[14+len(name):], p.Data)
+		buf = append(buf, sect...)
+	}
+	le.PutUint32(buf, uint32(len(buf)))
+	return buf
+}
+
+// Read the extended properties of an interface. The interface number
+// goes in the low byte of wValue, which is what Windows actually
+// sends (and what the Linux gadget framework expects).
+func GetExtendedProperties(h *usb.DeviceHandle, vendor_code byte, iface byte) ([]Property, error) {
+	buf, err := getFeature(h, usb.RECIPIENT_INTERFACE, vendor_code, uint16(iface), EXTENDED_PROPERTIES, 10)
+	if err != nil {
+		return nil, err
+	}
+	return ParseExtendedProperties(buf)
+}
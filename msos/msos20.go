@@ -0,0 +1,332 @@
+package msos
+
+import "gopkg.thequux.com/usb"
+
+// {D8DD60DF-4589-4CC7-9CD2-659D9E648A9F}, in wire order
+var PlatformUUID = [16]byte{
+	0xDF, 0x60, 0xDD, 0xD8, 0x89, 0x45, 0xC7, 0x4C,
+	0x9C, 0xD2, 0x65, 0x9D, 0x9E, 0x64, 0x8A, 0x9F,
+}
+
+// wIndex of the request that fetches the descriptor set
+const DESCRIPTOR_INDEX = 0x07
+
+// Windows version the descriptor set applies to, for
+// PlatformInfo.WindowsVersion and DescriptorSet.WindowsVersion
+const WINDOWS_VERSION_8_1 = 0x06030000
+
+// wDescriptorType values inside an MS OS 2.0 descriptor set
+const (
+	MS_OS_20_SET_HEADER_DESCRIPTOR       = 0x00
+	MS_OS_20_SUBSET_HEADER_CONFIGURATION = 0x01
+	MS_OS_20_SUBSET_HEADER_FUNCTION      = 0x02
+	MS_OS_20_FEATURE_COMPATBLE_ID        = 0x03
+	MS_OS_20_FEATURE_REG_PROPERTY        = 0x04
+	MS_OS_20_FEATURE_MIN_RESUME_TIME     = 0x05
+	MS_OS_20_FEATURE_MODEL_ID            = 0x06
+	MS_OS_20_FEATURE_CCGP_DEVICE         = 0x07
+	MS_OS_20_FEATURE_VENDOR_REVISION     = 0x08
+)
+
+// One descriptor set information entry from the platform capability
+type PlatformInfo struct {
+	WindowsVersion uint32
+	TotalLength    uint16
+	VendorCode     byte
+	AltEnumCode    byte
+}
+
+// Parse the data of the MS OS 2.0 platform capability, which holds
+// one or more descriptor set information entries.
+func ParsePlatformCapability(data []byte) ([]PlatformInfo, error) {
+	if len(data) == 0 || len(data)%8 != 0 {
+		return nil, ErrMalformed
+	}
+	ret := make([]PlatformInfo, len(data)/8)
+	for i := range ret {
+		d := data[8*i:]
+		ret[i] = PlatformInfo{
+			WindowsVersion: le.Uint32(d),
+			TotalLength:    le.Uint16(d[4:]),
+			VendorCode:     d[6],
+			AltEnumCode:    d[7],
+		}
+	}
+	return ret, nil
+}
+
+// Build the MS OS 2.0 platform capability for inclusion in a BOS
+func PlatformCapability(infos ...PlatformInfo) usb.DeviceCapability {
+	data := make([]byte, 8*len(infos))
+	for i, info := range infos {
+		d := data[8*i:]
+		le.PutUint32(d, info.WindowsVersion)
+		le.PutUint16(d[4:], info.TotalLength)
+		d[6] = info.VendorCode
+		d[7] = info.AltEnumCode
+	}
+	return usb.NewPlatformCapability(PlatformUUID, data)
+}
+
+// Look for the MS OS 2.0 platform capability in a BOS
+func FindPlatformInfo(bos *usb.BOSDescriptor) ([]PlatformInfo, bool) {
+	data, ok := bos.FindPlatformCapability(PlatformUUID)
+	if !ok {
+		return nil, false
+	}
+	infos, err := ParsePlatformCapability(data)
+	return infos, err == nil
+}
+
+/////////////////// Descriptor set
+
+// A feature descriptor within a descriptor set
+type Feature interface {
+	FeatureType() uint16
+	// The body of the descriptor, after wLength and wDescriptorType
+	payload() []byte
+}
+
+type (
+	CompatibleID struct {
+		CompatibleID    string
+		SubCompatibleID string
+	}
+
+	RegistryProperty Property
+
+	MinResumeTime struct {
+		ResumeRecoveryTime  byte // ms
+		ResumeSignalingTime byte // ms
+	}
+
+	ModelID [16]byte
+
+	CCGPDevice struct{}
+
+	VendorRevision uint16
+
+	// Anything this package doesn't know about
+	UnknownFeature struct {
+		Type uint16
+		Data []byte
+	}
+)
+
+func (CompatibleID) FeatureType() uint16     { return MS_OS_20_FEATURE_COMPATBLE_ID }
+func (RegistryProperty) FeatureType() uint16 { return MS_OS_20_FEATURE_REG_PROPERTY }
+func (MinResumeTime) FeatureType() uint16    { return MS_OS_20_FEATURE_MIN_RESUME_TIME }
+func (ModelID) FeatureType() uint16          { return MS_OS_20_FEATURE_MODEL_ID }
+func (CCGPDevice) FeatureType() uint16       { return MS_OS_20_FEATURE_CCGP_DEVICE }
+func (VendorRevision) FeatureType() uint16   { return MS_OS_20_FEATURE_VENDOR_REVISION }
+func (f UnknownFeature) FeatureType() uint16 { return f.Type }
+
+func (f CompatibleID) payload() []byte {
+	return append(encodeID(f.CompatibleID), encodeID(f.SubCompatibleID)...)
+}
+
+func (f RegistryProperty) payload() []byte {
+	name := encodeUTF16(f.Name)
+	buf := make([]byte, 6+len(name)+len(f.Data))
+	le.PutUint16(buf, uint16(f.Type))
+	le.PutUint16(buf[2:], uint16(len(name)))
+	copy(buf[4:], name)
+	le.PutUint16(buf[4+len(name):], uint16(len(f.Data)))
+	copy(buf[6+len(name):], f.Data)
+	return buf
+}
+
+func (f MinResumeTime) payload() []byte { return []byte{f.ResumeRecoveryTime, f.ResumeSignalingTime} }
+func (f ModelID) payload() []byte       { return f[:] }
+func (CCGPDevice) payload() []byte      { return nil }
+
+func (f VendorRevision) payload() []byte {
+	buf := make([]byte, 2)
+	le.PutUint16(buf, uint16(f))
+	return buf
+}
+
+func (f UnknownFeature) payload() []byte { return f.Data }
+
+func parseFeature(wtype uint16, body []byte) (Feature, error) {
+	switch wtype {
+	case MS_OS_20_FEATURE_COMPATBLE_ID:
+		if len(body) < 16 {
+			return nil, ErrMalformed
+		}
+		return CompatibleID{decodeID(body[:8]), decodeID(body[8:16])}, nil
+	case MS_OS_20_FEATURE_REG_PROPERTY:
+		if len(body) < 4 {
+			return nil, ErrMalformed
+		}
+		name_len := int(le.Uint16(body[2:]))
+		if 4+name_len+2 > len(body) {
+			return nil, ErrMalformed
+		}
+		data_len := int(le.Uint16(body[4+name_len:]))
+		if 6+name_len+data_len > len(body) {
+			return nil, ErrMalformed
+		}
+		return RegistryProperty{
+			Type: uint32(le.Uint16(body)),
+			Name: decodeUTF16(body[4 : 4+name_len]),
+			Data: append([]byte(nil), body[6+name_len:6+name_len+data_len]...),
+		}, nil
+	case MS_OS_20_FEATURE_MIN_RESUME_TIME:
+		if len(body) < 2 {
+			return nil, ErrMalformed
+		}
+		return MinResumeTime{body[0], body[1]}, nil
+	case MS_OS_20_FEATURE_MODEL_ID:
+		var id ModelID
+		if len(body) < 16 {
+			return nil, ErrMalformed
+		}
+		copy(id[:], body)
+		return id, nil
+	case MS_OS_20_FEATURE_CCGP_DEVICE:
+		return CCGPDevice{}, nil
+	case MS_OS_20_FEATURE_VENDOR_REVISION:
+		if len(body) < 2 {
+			return nil, ErrMalformed
+		}
+		return VendorRevision(le.Uint16(body)), nil
+	}
+	return UnknownFeature{wtype, append([]byte(nil), body...)}, nil
+}
+
+type (
+	FunctionSubset struct {
+		FirstInterface byte
+		Features       []Feature
+	}
+
+	// Despite the name of the field in the spec, Windows treats the
+	// configuration byte as an index rather than a bConfigurationValue.
+	ConfigurationSubset struct {
+		ConfigurationIndex byte
+		Features           []Feature
+		Functions          []FunctionSubset
+	}
+
+	// A whole MS OS 2.0 descriptor set. Devices with a single
+	// function usually only have device-wide Features; composite
+	// devices put theirs under Configurations.
+	DescriptorSet struct {
+		WindowsVersion uint32
+		Features       []Feature
+		Configurations []ConfigurationSubset
+	}
+)
+
+func ParseDescriptorSet(buf []byte) (*DescriptorSet, error) {
+	if len(buf) < 10 || le.Uint16(buf) != 10 || le.Uint16(buf[2:]) != MS_OS_20_SET_HEADER_DESCRIPTOR {
+		return nil, ErrMalformed
+	}
+	total := int(le.Uint16(buf[8:]))
+	if total < 10 || total > len(buf) {
+		return nil, ErrMalformed
+	}
+	set := &DescriptorSet{WindowsVersion: le.Uint32(buf[4:])}
+
+	// Subsets nest by length; remember where the current ones end
+	var (
+		cfg, fn         *[]Feature
+		cfg_end, fn_end int
+	)
+	for pos := 10; pos < total; {
+		if pos+4 > total {
+			return nil, ErrMalformed
+		}
+		length := int(le.Uint16(buf[pos:]))
+		wtype := le.Uint16(buf[pos+2:])
+		if length < 4 || pos+length > total {
+			return nil, ErrMalformed
+		}
+		if fn != nil && pos >= fn_end {
+			fn = nil
+		}
+		if cfg != nil && pos >= cfg_end {
+			cfg = nil
+		}
+		body := buf[pos+4 : pos+length]
+		switch wtype {
+		case MS_OS_20_SUBSET_HEADER_CONFIGURATION:
+			if length < 8 {
+				return nil, ErrMalformed
+			}
+			set.Configurations = append(set.Configurations, ConfigurationSubset{ConfigurationIndex: body[0]})
+			c := &set.Configurations[len(set.Configurations)-1]
+			cfg, cfg_end = &c.Features, pos+int(le.Uint16(body[2:]))
+			fn = nil
+		case MS_OS_20_SUBSET_HEADER_FUNCTION:
+			if length < 8 || cfg == nil {
+				return nil, ErrMalformed
+			}
+			c := &set.Configurations[len(set.Configurations)-1]
+			c.Functions = append(c.Functions, FunctionSubset{FirstInterface: body[0]})
+			fn, fn_end = &c.Functions[len(c.Functions)-1].Features, pos+int(le.Uint16(body[2:]))
+		default:
+			f, err := parseFeature(wtype, body)
+			if err != nil {
+				return nil, err
+			}
+			switch {
+			case fn != nil:
+				*fn = append(*fn, f)
+			case cfg != nil:
+				*cfg = append(*cfg, f)
+			default:
+				set.Features = append(set.Features, f)
+			}
+		}
+		pos += length
+	}
+	return set, nil
+}
+
+func appendFeatures(buf []byte, features []Feature) []byte {
+	for _, f := range features {
+		body := f.payload()
+		hdr := make([]byte, 4)
+		le.PutUint16(hdr, uint16(4+len(body)))
+		le.PutUint16(hdr[2:], f.FeatureType())
+		buf = append(buf, hdr...)
+		buf = append(buf, body...)
+	}
+	return buf
+}
+
+// Serialize the descriptor set, computing all of the lengths
+func (set *DescriptorSet) Bytes() []byte {
+	buf := make([]byte, 10)
+	le.PutUint16(buf, 10)
+	le.PutUint16(buf[2:], MS_OS_20_SET_HEADER_DESCRIPTOR)
+	le.PutUint32(buf[4:], set.WindowsVersion)
+	buf = appendFeatures(buf, set.Features)
+	for _, c := range set.Configurations {
+		cstart := len(buf)
+		buf = append(buf, 8, 0, MS_OS_20_SUBSET_HEADER_CONFIGURATION, 0, c.ConfigurationIndex, 0, 0, 0)
+		buf = appendFeatures(buf, c.Features)
+		for _, f := range c.Functions {
+			fstart := len(buf)
+			buf = append(buf, 8, 0, MS_OS_20_SUBSET_HEADER_FUNCTION, 0, f.FirstInterface, 0, 0, 0)
+			buf = appendFeatures(buf, f.Features)
+			le.PutUint16(buf[fstart+6:], uint16(len(buf)-fstart))
+		}
+		le.PutUint16(buf[cstart+6:], uint16(len(buf)-cstart))
+	}
+	le.PutUint16(buf[8:], uint16(len(buf)))
+	return buf
+}
+
+// Fetch the descriptor set described by a platform capability entry
+func GetDescriptorSet(h *usb.DeviceHandle, info PlatformInfo) (*DescriptorSet, error) {
+	buf := make([]byte, info.TotalLength)
+	n, err := h.ControlTransfer(usb.DIR_IN|usb.REQUEST_TYPE_VENDOR|usb.RECIPIENT_DEVICE,
+		info.VendorCode, 0, DESCRIPTOR_INDEX, buf, requestTimeout)
+	if err != nil {
+		return nil, err
+	}
+	return ParseDescriptorSet(buf[:n])
+}
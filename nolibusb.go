@@ -0,0 +1,9 @@
+//go:build !cgo && !linux
+
+package usb
+
+// Without cgo there is no libusb; a Backend has to be given to
+// NewContext.
+func newDefaultBackend() (Backend, *UsbError) {
+	return nil, UsbErrorNotSupported
+}
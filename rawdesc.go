@@ -0,0 +1,265 @@
+package usb
+
+// Parsing of descriptors straight off the wire, for the descriptors
+// that libusb doesn't parse for us and for descriptors that didn't
+// come from a device at all; and building them again, for devices
+// that don't exist.
+
+import "encoding/binary"
+
+func le16(b []byte) uint16 {
+	return binary.LittleEndian.Uint16(b)
+}
+
+func putLe16(b []byte, v uint16) {
+	binary.LittleEndian.PutUint16(b, v)
+}
+
+// Parse an 18 byte device descriptor
+func ParseDeviceDescriptor(buf []byte) (DeviceDescriptor, *UsbError) {
+	if len(buf) < 18 || buf[0] < 18 || DescriptorType(buf[1]) != DT_DEVICE {
+		return DeviceDescriptor{}, UsbErrorBadDescriptor
+	}
+	return DeviceDescriptor{
+		BLength:            buf[0],
+		BDescriptorType:    DescriptorType(buf[1]),
+		BcdUSB:             le16(buf[2:]),
+		BDeviceClass:       ClassCode(buf[4]),
+		BDeviceSubClass:    buf[5],
+		BDeviceProtocol:    buf[6],
+		BMaxPacketSize0:    buf[7],
+		IdVendor:           le16(buf[8:]),
+		IdProduct:          le16(buf[10:]),
+		BcdDevice:          le16(buf[12:]),
+		IManufacturer:      buf[14],
+		IProduct:           buf[15],
+		ISerialNumber:      buf[16],
+		BNumConfigurations: buf[17],
+	}, nil
+}
+
+// A device qualifier carries the subset of the device descriptor
+// that changes with speed. The identification fields are left zero.
+func parseRawDeviceQualifier(buf []byte) (DeviceDescriptor, *UsbError) {
+	if len(buf) < 10 || buf[0] < 10 || DescriptorType(buf[1]) != DT_DEVICE_QUALIFIER {
+		return DeviceDescriptor{}, UsbErrorBadDescriptor
+	}
+	return DeviceDescriptor{
+		BLength:            buf[0],
+		BDescriptorType:    DescriptorType(buf[1]),
+		BcdUSB:             le16(buf[2:]),
+		BDeviceClass:       ClassCode(buf[4]),
+		BDeviceSubClass:    buf[5],
+		BDeviceProtocol:    buf[6],
+		BMaxPacketSize0:    buf[7],
+		BNumConfigurations: buf[8],
+	}, nil
+}
+
+func parseRawInterfaceDescriptor(desc []byte) (InterfaceDescriptor, *UsbError) {
+	if len(desc) < 9 {
+		return InterfaceDescriptor{}, UsbErrorBadDescriptor
+	}
+	return InterfaceDescriptor{
+		BLength:            desc[0],
+		BDescriptorType:    DescriptorType(desc[1]),
+		BInterfaceNumber:   desc[2],
+		BAlternateSetting:  desc[3],
+		BInterfaceClass:    ClassCode(desc[5]),
+		BInterfaceSubClass: desc[6],
+		BInterfaceProtocol: desc[7],
+		IInterface:         desc[8],
+		Endpoints:          make([]EndpointDescriptor, 0, int(desc[4])),
+	}, nil
+}
+
+func parseRawEndpointDescriptor(desc []byte) (EndpointDescriptor, *UsbError) {
+	if len(desc) < 7 {
+		return EndpointDescriptor{}, UsbErrorBadDescriptor
+	}
+	ret := EndpointDescriptor{
+		BLength:          desc[0],
+		BDescriptorType:  DescriptorType(desc[1]),
+		BEndpointAddress: desc[2],
+		BmAttributes:     desc[3],
+		WMaxPacketSize:   le16(desc[4:]),
+		BInterval:        desc[6],
+	}
+	// Audio class endpoints carry two extra bytes
+	if len(desc) >= 9 {
+		ret.BRefresh = desc[7]
+		ret.BSynchAddress = desc[8]
+	}
+	return ret, nil
+}
+
+// Parse a complete configuration (or other-speed configuration)
+// descriptor, including its interfaces and endpoints, the same way
+// libusb does: anything that isn't an interface or endpoint ends up
+// in the Extra of whatever precedes it.
+func ParseConfigDescriptor(buf []byte) (ConfigDescriptor, *UsbError) {
+	if len(buf) < 9 || buf[0] < 9 {
+		return ConfigDescriptor{}, UsbErrorBadDescriptor
+	}
+	dtype := DescriptorType(buf[1])
+	if dtype != DT_CONFIG && dtype != DT_OTHER_SPEED_CONFIG {
+		return ConfigDescriptor{}, UsbErrorBadDescriptor
+	}
+	total := int(le16(buf[2:]))
+	if total < int(buf[0]) || total > len(buf) {
+		return ConfigDescriptor{}, UsbErrorBadDescriptor
+	}
+	buf = buf[:total]
+
+	cfg := ConfigDescriptor{
+		BLength:             buf[0],
+		BDescriptorType:     dtype,
+		WTotalLength:        uint16(total),
+		BConfigurationValue: int(buf[5]),
+		IConfiguration:      buf[6],
+		BmAttributes:        buf[7],
+		MaxPower:            buf[8],
+		Interfaces:          make([][]InterfaceDescriptor, 0, int(buf[4])),
+	}
+
+	// Indices of the interface/altsetting/endpoint most recently seen;
+	// -1 when there isn't one yet.
+	cur_iface, cur_alt, cur_ep := -1, -1, -1
+	rest := buf[buf[0]:]
+	for len(rest) > 0 {
+		if len(rest) < 2 || rest[0] < 2 || int(rest[0]) > len(rest) {
+			return ConfigDescriptor{}, UsbErrorBadDescriptor
+		}
+		desc := rest[:rest[0]]
+		rest = rest[rest[0]:]
+
+		switch DescriptorType(desc[1]) {
+		case DT_INTERFACE:
+			iface, err := parseRawInterfaceDescriptor(desc)
+			if err != nil {
+				return ConfigDescriptor{}, err
+			}
+			cur_iface = -1
+			for i, alts := range cfg.Interfaces {
+				if alts[0].BInterfaceNumber == iface.BInterfaceNumber {
+					cur_iface = i
+				}
+			}
+			if cur_iface < 0 {
+				cfg.Interfaces = append(cfg.Interfaces, nil)
+				cur_iface = len(cfg.Interfaces) - 1
+			}
+			cfg.Interfaces[cur_iface] = append(cfg.Interfaces[cur_iface], iface)
+			cur_alt = len(cfg.Interfaces[cur_iface]) - 1
+			cur_ep = -1
+		case DT_ENDPOINT:
+			if cur_iface < 0 {
+				return ConfigDescriptor{}, UsbErrorBadDescriptor
+			}
+			ep, err := parseRawEndpointDescriptor(desc)
+			if err != nil {
+				return ConfigDescriptor{}, err
+			}
+			alt := &cfg.Interfaces[cur_iface][cur_alt]
+			alt.Endpoints = append(alt.Endpoints, ep)
+			cur_ep = len(alt.Endpoints) - 1
+		default:
+			switch {
+			case cur_ep >= 0:
+				ep := &cfg.Interfaces[cur_iface][cur_alt].Endpoints[cur_ep]
+				ep.Extra = append(ep.Extra, desc...)
+			case cur_iface >= 0:
+				alt := &cfg.Interfaces[cur_iface][cur_alt]
+				alt.Extra = append(alt.Extra, desc...)
+			default:
+				cfg.Extra = append(cfg.Extra, desc...)
+			}
+		}
+	}
+	cfg.Functions = findFunctions(&cfg)
+	return cfg, nil
+}
+
+// Encode the descriptor as a device would send it. A descriptor with
+// BDescriptorType DT_DEVICE_QUALIFIER comes out as a qualifier.
+func (d DeviceDescriptor) Bytes() []byte {
+	if d.BDescriptorType == DT_DEVICE_QUALIFIER {
+		buf := []byte{10, byte(DT_DEVICE_QUALIFIER), 0, 0,
+			byte(d.BDeviceClass), d.BDeviceSubClass, d.BDeviceProtocol,
+			d.BMaxPacketSize0, d.BNumConfigurations, 0}
+		putLe16(buf[2:], d.BcdUSB)
+		return buf
+	}
+	buf := make([]byte, 18)
+	buf[0] = 18
+	buf[1] = byte(DT_DEVICE)
+	putLe16(buf[2:], d.BcdUSB)
+	buf[4] = byte(d.BDeviceClass)
+	buf[5] = d.BDeviceSubClass
+	buf[6] = d.BDeviceProtocol
+	buf[7] = d.BMaxPacketSize0
+	putLe16(buf[8:], d.IdVendor)
+	putLe16(buf[10:], d.IdProduct)
+	putLe16(buf[12:], d.BcdDevice)
+	buf[14] = d.IManufacturer
+	buf[15] = d.IProduct
+	buf[16] = d.ISerialNumber
+	buf[17] = d.BNumConfigurations
+	return buf
+}
+
+// Encode an Interface Association Descriptor
+func (f Function) Bytes() []byte {
+	return []byte{8, byte(DT_INTERFACE_ASSOCIATION), f.BFirstInterface, f.BInterfaceCount,
+		byte(f.BFunctionClass), f.BFunctionSubClass, f.BFunctionProtocol, f.IFunction}
+}
+
+// Encode the descriptor with everything under it, as a device would
+// send it. wTotalLength, bNumInterfaces and bNumEndpoints are
+// counted rather than taken from the fields. Extras are written
+// after whatever they belong to, which puts the IADs a parsed
+// descriptor had back where they were; if there are none in the
+// extras, Functions are written before their first interface.
+func (cfg ConfigDescriptor) Bytes() []byte {
+	dtype := DT_CONFIG
+	if cfg.BDescriptorType == DT_OTHER_SPEED_CONFIG {
+		dtype = DT_OTHER_SPEED_CONFIG
+	}
+	buf := []byte{9, byte(dtype), 0, 0, byte(len(cfg.Interfaces)),
+		byte(cfg.BConfigurationValue), cfg.IConfiguration, cfg.BmAttributes, cfg.MaxPower}
+	buf = append(buf, cfg.Extra...)
+
+	write_iads := len(findFunctions(&cfg)) == 0
+	for _, alts := range cfg.Interfaces {
+		for _, alt := range alts {
+			if write_iads && alt.BAlternateSetting == 0 {
+				for _, f := range cfg.Functions {
+					if f.BFirstInterface == alt.BInterfaceNumber {
+						buf = append(buf, f.Bytes()...)
+					}
+				}
+			}
+			buf = append(buf, 9, byte(DT_INTERFACE), alt.BInterfaceNumber, alt.BAlternateSetting,
+				byte(len(alt.Endpoints)), byte(alt.BInterfaceClass), alt.BInterfaceSubClass,
+				alt.BInterfaceProtocol, alt.IInterface)
+			buf = append(buf, alt.Extra...)
+			for _, ep := range alt.Endpoints {
+				buf = append(buf, ep.bytes()...)
+				buf = append(buf, ep.Extra...)
+			}
+		}
+	}
+	putLe16(buf[2:], uint16(len(buf)))
+	return buf
+}
+
+// Audio class endpoints (BLength 9) keep their two extra bytes
+func (ep EndpointDescriptor) bytes() []byte {
+	buf := []byte{7, byte(DT_ENDPOINT), ep.BEndpointAddress, ep.BmAttributes, 0, 0, ep.BInterval}
+	putLe16(buf[4:], ep.WMaxPacketSize)
+	if ep.BLength >= 9 {
+		buf[0] = 9
+		buf = append(buf, ep.BRefresh, ep.BSynchAddress)
+	}
+	return buf
+}
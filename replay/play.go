@@ -0,0 +1,286 @@
+package replay
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.thequux.com/usb"
+)
+
+// Where the code under test did something other than what was
+// recorded
+type Divergence struct {
+	Device   int
+	Expected *TransferRecord // nil if nothing more was recorded
+	Got      TransferRecord
+	Message  string
+}
+
+func (d Divergence) String() string {
+	return fmt.Sprintf("device %d endpoint 0x%02x: %s", d.Device, d.Got.Endpoint, d.Message)
+}
+
+// A usb.Backend that stands in for the devices of a recording.
+// Transfers are matched against the recording in order, endpoint by
+// endpoint, and answered with the recorded data and status.
+// Everything else (configurations, interfaces, halts) is accepted
+// without question.
+type Player struct {
+	// Fail transfers that don't match with UsbErrorIO, rather than
+	// answering them with the recorded response anyway
+	Strict bool
+	// Take as long over each transfer as the recorded one did
+	RealTime bool
+
+	rec *Recording
+
+	lock        sync.Mutex
+	queues      map[[2]int][]*TransferRecord // by device ID and endpoint
+	divergences []Divergence
+}
+
+func NewPlayer(rec *Recording) *Player {
+	p := &Player{rec: rec, queues: make(map[[2]int][]*TransferRecord)}
+	for i := range rec.Transfers {
+		t := &rec.Transfers[i]
+		key := [2]int{t.Device, int(t.Endpoint)}
+		p.queues[key] = append(p.queues[key], t)
+	}
+	return p
+}
+
+// What has diverged so far
+func (p *Player) Divergences() []Divergence {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return append([]Divergence(nil), p.divergences...)
+}
+
+// The recorded transfers that haven't been replayed yet
+func (p *Player) Remaining() []*TransferRecord {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	var ret []*TransferRecord
+	for i := range p.rec.Transfers {
+		t := &p.rec.Transfers[i]
+		for _, q := range p.queues[[2]int{t.Device, int(t.Endpoint)}] {
+			if q == t {
+				ret = append(ret, t)
+			}
+		}
+	}
+	return ret
+}
+
+// Return an error describing every divergence and every recorded
+// transfer that never happened, or nil if the replay went exactly
+// as recorded.
+func (p *Player) Finish() error {
+	var msgs []string
+	for _, d := range p.Divergences() {
+		msgs = append(msgs, d.String())
+	}
+	if n := len(p.Remaining()); n > 0 {
+		msgs = append(msgs, fmt.Sprintf("%d recorded transfers not replayed", n))
+	}
+	if msgs == nil {
+		return nil
+	}
+	return fmt.Errorf("replay: %s", strings.Join(msgs, "; "))
+}
+
+func (p *Player) GetDeviceList() ([]usb.BackendDevice, *usb.UsbError) {
+	ret := make([]usb.BackendDevice, len(p.rec.Devices))
+	for i := range p.rec.Devices {
+		ret[i] = &playDevice{&p.rec.Devices[i], p}
+	}
+	return ret, nil
+}
+
+func (p *Player) SetDebug(level int) {}
+
+func (p *Player) Close() {}
+
+// Compare a transfer with the next one recorded on its endpoint,
+// taking that one off the queue
+func (p *Player) match(got TransferRecord) (*TransferRecord, bool) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	key := [2]int{got.Device, int(got.Endpoint)}
+	queue := p.queues[key]
+	if len(queue) == 0 {
+		p.divergences = append(p.divergences, Divergence{got.Device, nil, got, "transfer beyond the end of the recording"})
+		return nil, false
+	}
+	want := queue[0]
+	p.queues[key] = queue[1:]
+
+	var msg string
+	switch {
+	case got.Type != want.Type:
+		msg = fmt.Sprintf("transfer type %d, recorded %d", got.Type, want.Type)
+	case got.In != want.In:
+		msg = "direction differs from the recording"
+	case got.Setup != nil && want.Setup != nil && *got.Setup != *want.Setup:
+		msg = fmt.Sprintf("setup %+v, recorded %+v", *got.Setup, *want.Setup)
+	case !got.In && !bytes.Equal(got.Data, want.Data):
+		msg = fmt.Sprintf("sent %x, recorded %x", []byte(got.Data), []byte(want.Data))
+	}
+	if msg != "" {
+		p.divergences = append(p.divergences, Divergence{got.Device, want, got, msg})
+		return want, false
+	}
+	return want, true
+}
+
+type playDevice struct {
+	rec *DeviceRecord
+	p   *Player
+}
+
+func (d *playDevice) GetBusNumber() int {
+	return d.rec.Bus
+}
+
+func (d *playDevice) GetAddress() int {
+	return d.rec.Address
+}
+
+func (d *playDevice) GetSpeed() usb.Speed {
+	return d.rec.Speed
+}
+
+func (d *playDevice) GetDeviceDescriptor() (usb.DeviceDescriptor, *usb.UsbError) {
+	return usb.ParseDeviceDescriptor(d.rec.Descriptor)
+}
+
+func (d *playDevice) GetConfigDescriptor(config_index int) (usb.ConfigDescriptor, *usb.UsbError) {
+	if config_index < 0 || config_index >= len(d.rec.Configs) {
+		return usb.ConfigDescriptor{}, usb.UsbErrorNotFound
+	}
+	return usb.ParseConfigDescriptor(d.rec.Configs[config_index])
+}
+
+func (d *playDevice) GetActiveConfigDescriptor() (usb.ConfigDescriptor, *usb.UsbError) {
+	for _, raw := range d.rec.Configs {
+		cfg, err := usb.ParseConfigDescriptor(raw)
+		if err == nil && cfg.BConfigurationValue == d.rec.Configuration {
+			return cfg, nil
+		}
+	}
+	return usb.ConfigDescriptor{}, usb.UsbErrorNotFound
+}
+
+func (d *playDevice) Open() (usb.BackendHandle, *usb.UsbError) {
+	return &playHandle{d: d, config: d.rec.Configuration, pending: make(map[*usb.Transfer]chan struct{})}, nil
+}
+
+type playHandle struct {
+	d       *playDevice
+	lock    sync.Mutex
+	config  int
+	pending map[*usb.Transfer]chan struct{} // closed to cancel
+}
+
+func (h *playHandle) Close() {}
+
+func (h *playHandle) GetConfiguration() (int, *usb.UsbError) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return h.config, nil
+}
+
+func (h *playHandle) SetConfiguration(config int) *usb.UsbError {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.config = config
+	return nil
+}
+
+func (h *playHandle) ClaimInterface(iface_no int) *usb.UsbError              { return nil }
+func (h *playHandle) ReleaseInterface(iface_no int) *usb.UsbError            { return nil }
+func (h *playHandle) SetInterfaceAltSetting(iface_no, alt int) *usb.UsbError { return nil }
+func (h *playHandle) KernelDriverActive(iface_no int) (bool, *usb.UsbError)  { return false, nil }
+func (h *playHandle) AttachKernelDriver(iface_no int) *usb.UsbError          { return nil }
+func (h *playHandle) DetachKernelDriver(iface_no int) *usb.UsbError          { return nil }
+func (h *playHandle) ClearHalt(endpoint byte) *usb.UsbError                  { return nil }
+func (h *playHandle) Reset() *usb.UsbError                                   { return nil }
+
+func (h *playHandle) SubmitTransfer(t *usb.Transfer) *usb.UsbError {
+	got := TransferRecord{
+		Device:   h.d.rec.ID,
+		Type:     t.Type,
+		Endpoint: t.Endpoint,
+		In:       t.In(),
+		Length:   len(t.Buffer),
+	}
+	if t.Type == usb.TRANSFER_TYPE_CONTROL {
+		setup := t.Setup
+		got.Setup = &setup
+	}
+	if !got.In {
+		got.Data = append(Hex(nil), t.Buffer...)
+	}
+	want, ok := h.d.p.match(got)
+	cancel := make(chan struct{})
+	h.lock.Lock()
+	h.pending[t] = cancel
+	h.lock.Unlock()
+	go h.play(t, want, ok || (want != nil && !h.d.p.Strict), cancel)
+	return nil
+}
+
+func (h *playHandle) CancelTransfer(t *usb.Transfer) *usb.UsbError {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	cancel, ok := h.pending[t]
+	if !ok {
+		return usb.UsbErrorNotFound
+	}
+	delete(h.pending, t)
+	close(cancel)
+	return nil
+}
+
+// Answer a transfer with the recorded response, or fail it
+func (h *playHandle) play(t *usb.Transfer, want *TransferRecord, answer bool, cancel chan struct{}) {
+	if answer && h.d.p.RealTime && want.Duration > 0 {
+		select {
+		case <-time.After(want.Duration):
+		case <-cancel:
+			t.Complete(0, usb.UsbErrorCancelled)
+			return
+		}
+	}
+	h.lock.Lock()
+	_, live := h.pending[t]
+	delete(h.pending, t)
+	h.lock.Unlock()
+	switch {
+	case !live:
+		t.Complete(0, usb.UsbErrorCancelled)
+		return
+	case !answer:
+		t.Complete(0, usb.UsbErrorIO)
+		return
+	}
+
+	actual, status := want.Actual, decodeStatus(want.Status)
+	if t.In() {
+		if t.Type == usb.TRANSFER_TYPE_ISOCHRONOUS || len(want.Data) <= len(t.Buffer) {
+			copy(t.Buffer, want.Data)
+		} else {
+			actual, status = copy(t.Buffer, want.Data), usb.UsbErrorOverflow
+		}
+	}
+	for i := range t.IsoPackets {
+		if i < len(want.IsoPackets) {
+			t.IsoPackets[i].Actual = want.IsoPackets[i].Actual
+			t.IsoPackets[i].Status = decodeStatus(want.IsoPackets[i].Status)
+		}
+	}
+	t.Complete(actual, status)
+}
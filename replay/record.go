@@ -0,0 +1,220 @@
+package replay
+
+import (
+	"encoding/json"
+	"io"
+	"log/slog"
+	"sync"
+	"time"
+
+	"gopkg.thequux.com/usb"
+)
+
+// A usb.Backend that passes everything on to another backend and
+// records each device opened and each transfer made through it.
+type Recorder struct {
+	inner usb.Backend
+	start time.Time
+
+	lock    sync.Mutex
+	enc     *json.Encoder
+	err     error
+	devices map[[2]int]int // bus and address to ID
+}
+
+// Record what is done through b to w. Each record is written as soon
+// as it is complete.
+func NewRecorder(b usb.Backend, w io.Writer) *Recorder {
+	return &Recorder{
+		inner:   b,
+		start:   time.Now(),
+		enc:     json.NewEncoder(w),
+		devices: make(map[[2]int]int),
+	}
+}
+
+// The first error writing the recording, if any
+func (r *Recorder) Err() error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.err
+}
+
+func (r *Recorder) write(l line) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.err == nil {
+		r.err = r.enc.Encode(l)
+	}
+}
+
+func (r *Recorder) GetDeviceList() ([]usb.BackendDevice, *usb.UsbError) {
+	devs, err := r.inner.GetDeviceList()
+	if err != nil {
+		return nil, err
+	}
+	ret := make([]usb.BackendDevice, len(devs))
+	for i, dev := range devs {
+		ret[i] = &recDevice{dev, r}
+	}
+	return ret, nil
+}
+
+func (r *Recorder) SetDebug(level int) {
+	r.inner.SetDebug(level)
+}
+
+func (r *Recorder) SetLogger(l *slog.Logger) {
+	if inner, ok := r.inner.(usb.LoggingBackend); ok {
+		inner.SetLogger(l)
+	}
+}
+
+func (r *Recorder) SetOption(option, value int) *usb.UsbError {
+	if inner, ok := r.inner.(usb.OptionSetter); ok {
+		return inner.SetOption(option, value)
+	}
+	if option == usb.OPTION_LOG_LEVEL {
+		r.inner.SetDebug(value)
+		return nil
+	}
+	return usb.UsbErrorNotSupported
+}
+
+func (r *Recorder) HasCapability(capability int) bool {
+	if inner, ok := r.inner.(usb.CapabilityReporter); ok {
+		return inner.HasCapability(capability)
+	}
+	return capability == usb.CAP_HAS_CAPABILITY
+}
+
+func (r *Recorder) Close() {
+	r.inner.Close()
+}
+
+// Give the device an ID, writing its record the first time
+func (r *Recorder) deviceID(dev usb.BackendDevice, h usb.BackendHandle) int {
+	key := [2]int{dev.GetBusNumber(), dev.GetAddress()}
+	r.lock.Lock()
+	id, ok := r.devices[key]
+	if !ok {
+		id = len(r.devices)
+		r.devices[key] = id
+	}
+	r.lock.Unlock()
+	if ok {
+		return id
+	}
+
+	rec := &DeviceRecord{ID: id, Bus: key[0], Address: key[1], Speed: dev.GetSpeed()}
+	rec.Configuration, _ = h.GetConfiguration()
+	desc, _ := dev.GetDeviceDescriptor()
+	rec.Descriptor = desc.Bytes()
+	for i := 0; i < int(desc.BNumConfigurations); i++ {
+		if cfg, err := dev.GetConfigDescriptor(i); err == nil {
+			rec.Configs = append(rec.Configs, cfg.Bytes())
+		}
+	}
+	r.write(line{Device: rec})
+	return id
+}
+
+type recDevice struct {
+	usb.BackendDevice
+	r *Recorder
+}
+
+func (d *recDevice) Open() (usb.BackendHandle, *usb.UsbError) {
+	h, err := d.BackendDevice.Open()
+	if err != nil {
+		return nil, err
+	}
+	return &recHandle{
+		BackendHandle: h,
+		r:             d.r,
+		id:            d.r.deviceID(d.BackendDevice, h),
+		shadows:       make(map[*usb.Transfer]*usb.Transfer),
+	}, nil
+}
+
+// Everything but transfers goes straight through
+type recHandle struct {
+	usb.BackendHandle
+	r  *Recorder
+	id int
+
+	lock    sync.Mutex
+	shadows map[*usb.Transfer]*usb.Transfer
+}
+
+// Transfers go through as a copy, so that the recorder sees them
+// complete before the caller does
+func (h *recHandle) SubmitTransfer(t *usb.Transfer) *usb.UsbError {
+	shadow := &usb.Transfer{
+		Type:       t.Type,
+		Endpoint:   t.Endpoint,
+		Setup:      t.Setup,
+		Buffer:     t.Buffer,
+		IsoPackets: append([]usb.IsoPacket(nil), t.IsoPackets...),
+		Timeout:    t.Timeout,
+	}
+	rec := &TransferRecord{
+		Device:   h.id,
+		Type:     t.Type,
+		Endpoint: t.Endpoint,
+		In:       t.In(),
+		Length:   len(t.Buffer),
+		Start:    time.Since(h.r.start),
+	}
+	if t.Type == usb.TRANSFER_TYPE_CONTROL {
+		setup := t.Setup
+		rec.Setup = &setup
+	}
+	if !rec.In {
+		rec.Data = append(Hex(nil), t.Buffer...)
+	}
+
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if err := usb.SubmitTo(h.BackendHandle, shadow); err != nil {
+		return err
+	}
+	h.shadows[t] = shadow
+	go h.wait(t, shadow, rec)
+	return nil
+}
+
+func (h *recHandle) wait(t, shadow *usb.Transfer, rec *TransferRecord) {
+	shadow.Wait()
+	h.lock.Lock()
+	delete(h.shadows, t)
+	h.lock.Unlock()
+
+	rec.Duration = time.Since(h.r.start) - rec.Start
+	rec.Actual = shadow.Actual
+	rec.Status = encodeStatus(shadow.Status)
+	copy(t.IsoPackets, shadow.IsoPackets)
+	for _, p := range shadow.IsoPackets {
+		rec.IsoPackets = append(rec.IsoPackets, IsoRecord{p.Length, p.Actual, encodeStatus(p.Status)})
+	}
+	if rec.In {
+		switch {
+		case t.Type == usb.TRANSFER_TYPE_ISOCHRONOUS:
+			rec.Data = append(Hex(nil), t.Buffer...)
+		case shadow.Actual <= len(t.Buffer):
+			rec.Data = append(Hex(nil), t.Buffer[:shadow.Actual]...)
+		}
+	}
+	h.r.write(line{Transfer: rec})
+	t.Complete(shadow.Actual, shadow.Status)
+}
+
+func (h *recHandle) CancelTransfer(t *usb.Transfer) *usb.UsbError {
+	h.lock.Lock()
+	shadow, ok := h.shadows[t]
+	h.lock.Unlock()
+	if !ok {
+		return usb.UsbErrorNotFound
+	}
+	return shadow.Cancel()
+}
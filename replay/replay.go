@@ -0,0 +1,170 @@
+// Recording the transfers made to a real device, and playing them
+// back in place of the device. A session with a prototype board can
+// be recorded once:
+//
+//	f, _ := os.Create("session.jsonl")
+//	b, _ := usb.NewLibusbBackend()
+//	rec := replay.NewRecorder(b, f)
+//	ctx := usb.NewContext(rec)
+//	... use ctx as normal, then ctx.Close()
+//
+// and then serves as a regression test without the board:
+//
+//	recording, _ := replay.Load(f)
+//	player := replay.NewPlayer(recording)
+//	ctx := usb.NewContext(player)
+//	... run the same code against ctx
+//	if err := player.Finish(); err != nil {
+//		t.Fatal(err)
+//	}
+//
+// A recording is a file of JSON objects, one per line, each holding
+// either a "device" or a "transfer", in the order they happened.
+package replay
+
+import (
+	"bufio"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"time"
+
+	"gopkg.thequux.com/usb"
+)
+
+var ErrMalformed = errors.New("replay: malformed recording")
+
+// Bytes that appear in JSON as a hex string, for the sake of anyone
+// reading or diffing a recording
+type Hex []byte
+
+func (h Hex) MarshalJSON() ([]byte, error) {
+	return json.Marshal(hex.EncodeToString(h))
+}
+
+func (h *Hex) UnmarshalJSON(buf []byte) error {
+	var s string
+	if err := json.Unmarshal(buf, &s); err != nil {
+		return err
+	}
+	b, err := hex.DecodeString(s)
+	*h = b
+	return err
+}
+
+// A device that was opened during the recording
+type DeviceRecord struct {
+	ID            int       `json:"id"`
+	Bus           int       `json:"bus"`
+	Address       int       `json:"address"`
+	Speed         usb.Speed `json:"speed"`
+	Configuration int       `json:"configuration"` // bConfigurationValue when opened
+	Descriptor    Hex       `json:"descriptor"`
+	Configs       []Hex     `json:"configs"`
+}
+
+type IsoRecord struct {
+	Length int    `json:"length"`
+	Actual int    `json:"actual"`
+	Status string `json:"status,omitempty"`
+}
+
+// A transfer as it was made and as it ended
+type TransferRecord struct {
+	Device   int              `json:"device"`
+	Type     int              `json:"type"`
+	Endpoint byte             `json:"endpoint"`
+	Setup    *usb.SetupPacket `json:"setup,omitempty"`
+	In       bool             `json:"in"`
+	Length   int              `json:"length"` // of the buffer
+	// What was sent, or what came back
+	Data       Hex         `json:"data"`
+	IsoPackets []IsoRecord `json:"iso,omitempty"`
+	Actual     int         `json:"actual"`
+	Status     string      `json:"status,omitempty"` // UsbError text; empty for success
+
+	Start    time.Duration `json:"start"` // since the recording began
+	Duration time.Duration `json:"duration"`
+}
+
+// One line of a recording file
+type line struct {
+	Device   *DeviceRecord   `json:"device,omitempty"`
+	Transfer *TransferRecord `json:"transfer,omitempty"`
+}
+
+type Recording struct {
+	Devices   []DeviceRecord
+	Transfers []TransferRecord
+}
+
+// Read a recording
+func Load(r io.Reader) (*Recording, error) {
+	rec := &Recording{}
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 1<<24)
+	for scanner.Scan() {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var l line
+		if err := json.Unmarshal(scanner.Bytes(), &l); err != nil {
+			return nil, err
+		}
+		switch {
+		case l.Device != nil:
+			rec.Devices = append(rec.Devices, *l.Device)
+		case l.Transfer != nil:
+			rec.Transfers = append(rec.Transfers, *l.Transfer)
+		default:
+			return nil, ErrMalformed
+		}
+	}
+	return rec, scanner.Err()
+}
+
+// Write a recording out in the same format a Recorder does
+func (rec *Recording) Save(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	for i := range rec.Devices {
+		if err := enc.Encode(line{Device: &rec.Devices[i]}); err != nil {
+			return err
+		}
+	}
+	for i := range rec.Transfers {
+		if err := enc.Encode(line{Transfer: &rec.Transfers[i]}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Every error a status can name
+var usbErrors = map[string]*usb.UsbError{
+	usb.UsbErrorBadDescriptor.Text: usb.UsbErrorBadDescriptor,
+	usb.UsbErrorCancelled.Text:     usb.UsbErrorCancelled,
+}
+
+func init() {
+	for _, err := range usb.UsbErrorMap {
+		usbErrors[err.Text] = err
+	}
+}
+
+func encodeStatus(err *usb.UsbError) string {
+	if err == nil {
+		return ""
+	}
+	return err.Text
+}
+
+func decodeStatus(s string) *usb.UsbError {
+	if s == "" {
+		return nil
+	}
+	if err, ok := usbErrors[s]; ok {
+		return err
+	}
+	return usb.UsbErrorMisc
+}
@@ -0,0 +1,85 @@
+package replay
+
+import (
+	"bytes"
+	"os"
+	"testing"
+
+	"gopkg.thequux.com/usb"
+	"gopkg.thequux.com/usb/usbtest"
+)
+
+// Open the device through ctx, read its product string, write msg and
+// read the answer. The echo device answers in upper case; the one
+// recorded in testdata/pong.jsonl, "widget", answers "pong".
+func session(t *testing.T, ctx *usb.Context, msg string) string {
+	h, err := usbtest.OpenEcho(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	product, err := h.GetProduct()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := h.Out.Write([]byte(msg)); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 512)
+	n, rerr := h.In.Read(buf)
+	if rerr != nil {
+		t.Fatal(rerr)
+	}
+	return product + " " + string(buf[:n])
+}
+
+func TestRecordAndPlay(t *testing.T) {
+	var file bytes.Buffer
+	rec := NewRecorder(usbtest.NewBackend(usbtest.NewEchoDevice()), &file)
+	if got := session(t, usb.NewContext(rec), "ping"); got != "Echo PING" {
+		t.Fatalf("recording: got %q", got)
+	}
+	if err := rec.Err(); err != nil {
+		t.Fatal(err)
+	}
+	recording, err := Load(&file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := NewPlayer(recording)
+	if got := session(t, usb.NewContext(p), "ping"); got != "Echo PING" {
+		t.Fatalf("playing: got %q", got)
+	}
+	if err := p.Finish(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPlaySaved(t *testing.T) {
+	f, err := os.Open("testdata/pong.jsonl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	recording, err := Load(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := NewPlayer(recording)
+	if got := session(t, usb.NewContext(p), "ping"); got != "widget pong" {
+		t.Fatalf("got %q", got)
+	}
+	if err := p.Finish(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Writing something else diverges, but is still answered
+	p = NewPlayer(recording)
+	if got := session(t, usb.NewContext(p), "pang"); got != "widget pong" {
+		t.Fatalf("diverging: got %q", got)
+	}
+	if p.Finish() == nil || len(p.Divergences()) != 1 || p.Divergences()[0].Got.Endpoint != 0x02 {
+		t.Fatalf("divergences: %v", p.Divergences())
+	}
+
+}
@@ -0,0 +1,139 @@
+package usb
+
+import (
+	"sync"
+	"time"
+)
+
+// The upper bounds of the buckets of EndpointStats.Latency
+var LatencyBuckets = []time.Duration{
+	100 * time.Microsecond,
+	250 * time.Microsecond,
+	500 * time.Microsecond,
+	1 * time.Millisecond,
+	2500 * time.Microsecond,
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	25 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	250 * time.Millisecond,
+	500 * time.Millisecond,
+	1 * time.Second,
+	2500 * time.Millisecond,
+	5 * time.Second,
+	10 * time.Second,
+}
+
+// What has gone through an endpoint since its device was opened,
+// counting every transfer made through the DeviceHandle, whether with
+// an EndpointHandle or not
+type EndpointStats struct {
+	// Transfers that ended, however they did, including those the
+	// backend refused
+	Transfers int64
+	// Bytes actually moved
+	Bytes int64
+	// Transfers that ended with each error, cancellations and
+	// timeouts included
+	Errors map[*UsbError]int64
+
+	// Latency[i] counts the transfers that took at most
+	// LatencyBuckets[i], and more than LatencyBuckets[i-1]; the last
+	// element, those that took longer than any bucket. Refused
+	// transfers aren't counted here.
+	Latency []int64
+	// The time all of those took together
+	TotalLatency time.Duration
+}
+
+func (s *EndpointStats) record(actual int, took time.Duration, err *UsbError, accepted bool) {
+	s.Transfers++
+	s.Bytes += int64(actual)
+	if err != nil {
+		if s.Errors == nil {
+			s.Errors = make(map[*UsbError]int64)
+		}
+		s.Errors[err]++
+	}
+	if !accepted {
+		return
+	}
+	if s.Latency == nil {
+		s.Latency = make([]int64, len(LatencyBuckets)+1)
+	}
+	i := 0
+	for i < len(LatencyBuckets) && took > LatencyBuckets[i] {
+		i++
+	}
+	s.Latency[i]++
+	s.TotalLatency += took
+}
+
+// A copy that can be read while s is still being updated
+func (s *EndpointStats) clone() EndpointStats {
+	ret := *s
+	ret.Errors = make(map[*UsbError]int64, len(s.Errors))
+	for err, n := range s.Errors {
+		ret.Errors[err] = n
+	}
+	ret.Latency = make([]int64, len(LatencyBuckets)+1)
+	copy(ret.Latency, s.Latency)
+	return ret
+}
+
+// The statistics of each endpoint of a handle, by address
+type statsTable struct {
+	lock      sync.Mutex
+	endpoints map[byte]*EndpointStats
+}
+
+func (st *statsTable) record(endpoint byte, actual int, took time.Duration, err *UsbError, accepted bool) {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+	if st.endpoints == nil {
+		st.endpoints = make(map[byte]*EndpointStats)
+	}
+	s, ok := st.endpoints[endpoint]
+	if !ok {
+		s = &EndpointStats{}
+		st.endpoints[endpoint] = s
+	}
+	s.record(actual, took, err, accepted)
+}
+
+func (st *statsTable) get(endpoint byte) EndpointStats {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+	if s, ok := st.endpoints[endpoint]; ok {
+		return s.clone()
+	}
+	return (&EndpointStats{}).clone()
+}
+
+func (st *statsTable) all() map[byte]EndpointStats {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+	ret := make(map[byte]EndpointStats, len(st.endpoints))
+	for endpoint, s := range st.endpoints {
+		ret[endpoint] = s.clone()
+	}
+	return ret
+}
+
+// The statistics of the endpoint with the given address, including
+// the direction bit; 0 for the default control endpoint
+func (h *DeviceHandle) GetEndpointStats(endpoint byte) EndpointStats {
+	return h.stats.get(endpoint)
+}
+
+// The statistics of every endpoint that has been used, by address
+func (h *DeviceHandle) GetAllEndpointStats() map[byte]EndpointStats {
+	return h.stats.all()
+}
+
+// The statistics of this endpoint, shared with every other handle to
+// the same endpoint of the same DeviceHandle
+func (ep *EndpointHandle) GetStats() EndpointStats {
+	return ep.handle.GetEndpointStats(ep.ep)
+}
@@ -0,0 +1,200 @@
+package usb
+
+import "unicode/utf16"
+
+// Strings are cached per handle, keyed by index and language
+type stringKey struct {
+	index  byte
+	langid uint16
+}
+
+// Strings are read with the largest request a descriptor can answer,
+// which is what the kernel does too; some devices misbehave when
+// asked for less than the whole string.
+const maxStringLength = 255
+
+// Check a string descriptor's header and return its UTF-16 payload.
+// A trailing odd byte is dropped rather than rejected.
+func parseStringDescriptor(buf []byte) ([]uint16, *UsbError) {
+	if len(buf) < 2 || buf[0] < 2 || DescriptorType(buf[1]) != DT_STRING {
+		return nil, UsbErrorBadDescriptor
+	}
+	if int(buf[0]) < len(buf) {
+		buf = buf[:buf[0]]
+	}
+	ret := make([]uint16, (len(buf)-2)/2)
+	for i := range ret {
+		ret[i] = le16(buf[2+2*i:])
+	}
+	return ret, nil
+}
+
+// Return the languages the device has strings in. The list is read
+// from string descriptor 0 once and cached.
+func (h *DeviceHandle) GetLangIds() ([]uint16, *UsbError) {
+	h.string_lock.Lock()
+	defer h.string_lock.Unlock()
+	return h.getLangIds()
+}
+
+func (h *DeviceHandle) getLangIds() ([]uint16, *UsbError) {
+	if h.langids != nil {
+		return h.langids, nil
+	}
+	buf, err := h.GetRawDescriptor(DT_STRING, 0, 0, maxStringLength)
+	if err != nil {
+		return nil, err
+	}
+	langs, err := parseStringDescriptor(buf)
+	if err != nil {
+		return nil, err
+	}
+	h.langids = langs
+	return langs, nil
+}
+
+// Read a string descriptor in the given language. Results are cached
+// for the lifetime of the handle; see FlushStringCache. Index 0 is
+// the language table, not a string, so it is rejected.
+func (h *DeviceHandle) GetStringDescriptor(index byte, langid uint16) (string, *UsbError) {
+	if index == 0 {
+		return "", UsbErrorInvalidParam
+	}
+	h.string_lock.Lock()
+	defer h.string_lock.Unlock()
+
+	key := stringKey{index, langid}
+	if s, ok := h.strings[key]; ok {
+		return s, nil
+	}
+	buf, err := h.GetRawDescriptor(DT_STRING, index, langid, maxStringLength)
+	if err != nil {
+		return "", err
+	}
+	units, err := parseStringDescriptor(buf)
+	if err != nil {
+		return "", err
+	}
+	s := string(utf16.Decode(units))
+	h.strings[key] = s
+	return s, nil
+}
+
+// Choose the language GetDefaultStringDescriptor uses, overriding
+// the automatic choice.
+func (h *DeviceHandle) SetDefaultLangId(langid uint16) {
+	h.string_lock.Lock()
+	h.default_langid = langid
+	h.string_lock.Unlock()
+}
+
+// Return the language GetDefaultStringDescriptor uses: the one set
+// with SetDefaultLangId, otherwise US English if the device has it,
+// otherwise the first language the device lists.
+func (h *DeviceHandle) GetDefaultLangId() (uint16, *UsbError) {
+	h.string_lock.Lock()
+	defer h.string_lock.Unlock()
+	if h.default_langid != 0 {
+		return h.default_langid, nil
+	}
+	if h.auto_langid != 0 {
+		return h.auto_langid, nil
+	}
+	langs, err := h.getLangIds()
+	if err != nil {
+		return 0, err
+	}
+	if len(langs) == 0 {
+		return 0, UsbErrorNotSupported
+	}
+	h.auto_langid = langs[0]
+	for _, l := range langs {
+		if l == LANGID_ENGLISH_US {
+			h.auto_langid = l
+		}
+	}
+	return h.auto_langid, nil
+}
+
+func (h *DeviceHandle) GetDefaultStringDescriptor(index byte) (string, *UsbError) {
+	langid, err := h.GetDefaultLangId()
+	if err != nil {
+		return "", err
+	}
+	return h.GetStringDescriptor(index, langid)
+}
+
+// Read a string in every language the device offers, keyed by LANGID.
+// Languages that fail individually are left out; an error is only
+// returned if none could be read.
+func (h *DeviceHandle) GetStringDescriptorAll(index byte) (map[uint16]string, *UsbError) {
+	langs, err := h.GetLangIds()
+	if err != nil {
+		return nil, err
+	}
+	ret := make(map[uint16]string, len(langs))
+	for _, l := range langs {
+		s, serr := h.GetStringDescriptor(index, l)
+		if serr != nil {
+			err = serr
+			continue
+		}
+		ret[l] = s
+	}
+	if len(ret) == 0 && err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+// Forget every cached string, the language table and the language
+// chosen from it, e.g. after the device has been reset into a
+// different firmware. A language set with SetDefaultLangId stays.
+func (h *DeviceHandle) FlushStringCache() {
+	h.string_lock.Lock()
+	h.langids = nil
+	h.auto_langid = 0
+	h.strings = make(map[stringKey]string)
+	h.string_lock.Unlock()
+}
+
+// Read a string by index in the default language. Index 0 means the
+// device has no such string, which gives an empty string and no error.
+func (h *DeviceHandle) getOptionalString(index byte) (string, *UsbError) {
+	if index == 0 {
+		return "", nil
+	}
+	return h.GetDefaultStringDescriptor(index)
+}
+
+func (h *DeviceHandle) getDeviceString(pick func(*DeviceDescriptor) byte) (string, *UsbError) {
+	desc, err := h.GetDevice().GetDeviceDescriptor()
+	if err != nil {
+		return "", err
+	}
+	return h.getOptionalString(pick(&desc))
+}
+
+func (h *DeviceHandle) GetManufacturer() (string, *UsbError) {
+	return h.getDeviceString(func(d *DeviceDescriptor) byte { return d.IManufacturer })
+}
+
+func (h *DeviceHandle) GetProduct() (string, *UsbError) {
+	return h.getDeviceString(func(d *DeviceDescriptor) byte { return d.IProduct })
+}
+
+func (h *DeviceHandle) GetSerialNumber() (string, *UsbError) {
+	return h.getDeviceString(func(d *DeviceDescriptor) byte { return d.ISerialNumber })
+}
+
+func (h *DeviceHandle) GetConfigurationString(cfg *ConfigDescriptor) (string, *UsbError) {
+	return h.getOptionalString(cfg.IConfiguration)
+}
+
+func (h *DeviceHandle) GetInterfaceString(iface *InterfaceDescriptor) (string, *UsbError) {
+	return h.getOptionalString(iface.IInterface)
+}
+
+func (h *DeviceHandle) GetFunctionString(f *Function) (string, *UsbError) {
+	return h.getOptionalString(f.IFunction)
+}
@@ -0,0 +1,247 @@
+package usb
+
+// Enumeration through sysfs, for backends that don't have libusb to
+// do it for them, and for inventory without opening anything.
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Where Linux lists USB devices
+const SYSFS_ROOT = "/sys/bus/usb/devices"
+
+// A device as sysfs describes it. Everything here is read once, when
+// the device is listed, from attributes that any user may read, so
+// neither libusb nor access to the device node is needed.
+type SysfsDevice struct {
+	// The device's directory, and its name there: usbN for the root
+	// hub of bus N, or like 1-1.2 for the device on port 2 of the hub
+	// on port 1 of bus 1
+	Path, Name string
+
+	Bus, Address int
+	Speed        Speed
+	// The ports from the root hub down to the device; empty for root
+	// hubs
+	PortPath []int
+
+	// The strings the kernel read from the device when it was
+	// enumerated; empty where the device has none
+	Manufacturer, Product, Serial string
+
+	// The driver bound to the device itself (usually "usb"), and those
+	// bound to the interfaces of the active configuration, by
+	// bInterfaceNumber. Interfaces without a driver are left out.
+	Driver  string
+	Drivers map[byte]string
+
+	Power SysfsPower
+
+	// The device descriptor followed by every configuration, in bus
+	// byte order, as they would be read from the device
+	Descriptors []byte
+}
+
+// The runtime power management state of a device
+type SysfsPower struct {
+	// "auto" if the device may be suspended when idle, "on" if not
+	Control string
+	// "active", "suspended", or one of the states in between
+	RuntimeStatus string
+	// "enabled" or "disabled"; empty for devices that can't wake the
+	// system
+	Wakeup string
+	// How long the device has to be idle before it is suspended;
+	// negative for never
+	AutosuspendDelay time.Duration
+}
+
+func sysfsReadAttr(dir, name string) (string, error) {
+	buf, err := ioutil.ReadFile(filepath.Join(dir, name))
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(buf)), nil
+}
+
+func sysfsReadInt(dir, name string, base int) (int, error) {
+	s, err := sysfsReadAttr(dir, name)
+	if err != nil {
+		return 0, err
+	}
+	v, err := strconv.ParseInt(s, base, 32)
+	return int(v), err
+}
+
+// The speed attribute is in Mbit/s
+var sysfsSpeeds = map[string]Speed{
+	"1.5":   SPEED_LOW,
+	"12":    SPEED_FULL,
+	"480":   SPEED_HIGH,
+	"5000":  SPEED_SUPER,
+	"10000": SPEED_SUPER_PLUS,
+	"20000": SPEED_SUPER_PLUS,
+}
+
+// The last element of a symlink, which for a driver link is the
+// driver's name
+func sysfsLinkName(path string) string {
+	target, err := os.Readlink(path)
+	if err != nil {
+		return ""
+	}
+	return filepath.Base(target)
+}
+
+func readSysfsDevice(dir string) (*SysfsDevice, error) {
+	dev := &SysfsDevice{Path: dir, Name: filepath.Base(dir)}
+	var err error
+	if dev.Bus, err = sysfsReadInt(dir, "busnum", 10); err != nil {
+		return nil, err
+	}
+	if dev.Address, err = sysfsReadInt(dir, "devnum", 10); err != nil {
+		return nil, err
+	}
+	if dev.Descriptors, err = ioutil.ReadFile(filepath.Join(dir, "descriptors")); err != nil {
+		return nil, err
+	}
+	if s, err := sysfsReadAttr(dir, "speed"); err == nil {
+		dev.Speed = sysfsSpeeds[s]
+	}
+
+	// devpath is the ports joined with dots, or 0 for a root hub
+	if s, err := sysfsReadAttr(dir, "devpath"); err == nil && s != "0" {
+		for _, port := range strings.Split(s, ".") {
+			if n, err := strconv.Atoi(port); err == nil {
+				dev.PortPath = append(dev.PortPath, n)
+			}
+		}
+	}
+
+	dev.Manufacturer, _ = sysfsReadAttr(dir, "manufacturer")
+	dev.Product, _ = sysfsReadAttr(dir, "product")
+	dev.Serial, _ = sysfsReadAttr(dir, "serial")
+
+	dev.Driver = sysfsLinkName(filepath.Join(dir, "driver"))
+	dev.Drivers = make(map[byte]string)
+	// Interfaces of the active configuration are subdirectories named
+	// like 1-1.2:1.0; a root hub's are named for port 0 of its bus,
+	// like 1-0:1.0, rather than for usbN
+	prefix := dev.Name
+	if strings.HasPrefix(prefix, "usb") {
+		prefix = strconv.Itoa(dev.Bus) + "-0"
+	}
+	ifaces, _ := filepath.Glob(filepath.Join(dir, prefix+":*"))
+	for _, iface := range ifaces {
+		number, err := sysfsReadInt(iface, "bInterfaceNumber", 16)
+		if err != nil {
+			continue
+		}
+		if driver := sysfsLinkName(filepath.Join(iface, "driver")); driver != "" {
+			dev.Drivers[byte(number)] = driver
+		}
+	}
+
+	power := filepath.Join(dir, "power")
+	dev.Power.Control, _ = sysfsReadAttr(power, "control")
+	dev.Power.RuntimeStatus, _ = sysfsReadAttr(power, "runtime_status")
+	dev.Power.Wakeup, _ = sysfsReadAttr(power, "wakeup")
+	dev.Power.AutosuspendDelay = -1
+	if ms, err := sysfsReadInt(power, "autosuspend_delay_ms", 10); err == nil && ms >= 0 {
+		dev.Power.AutosuspendDelay = time.Duration(ms) * time.Millisecond
+	}
+	return dev, nil
+}
+
+// List the devices under root, which is normally SYSFS_ROOT but may be
+// a copy of it, skipping interfaces (named like 1-1.2:1.0) and
+// anything that can't be read.
+func ListSysfsDevices(root string) ([]*SysfsDevice, *UsbError) {
+	entries, err := ioutil.ReadDir(root)
+	if err != nil {
+		switch {
+		case os.IsNotExist(err):
+			return nil, UsbErrorNotFound
+		case os.IsPermission(err):
+			return nil, UsbErrorAccess
+		}
+		return nil, UsbErrorIO
+	}
+	var ret []*SysfsDevice
+	for _, e := range entries {
+		if strings.Contains(e.Name(), ":") {
+			continue
+		}
+		if dev, err := readSysfsDevice(filepath.Join(root, e.Name())); err == nil {
+			ret = append(ret, dev)
+		}
+	}
+	return ret, nil
+}
+
+// The descriptors attribute is in bus byte order, the same as on the
+// wire, with the configurations one after the other.
+func (dev *SysfsDevice) GetDeviceDescriptor() (DeviceDescriptor, *UsbError) {
+	return ParseDeviceDescriptor(dev.Descriptors)
+}
+
+func (dev *SysfsDevice) rawConfigs() [][]byte {
+	var ret [][]byte
+	if len(dev.Descriptors) < 1 || int(dev.Descriptors[0]) > len(dev.Descriptors) {
+		return nil
+	}
+	rest := dev.Descriptors[dev.Descriptors[0]:]
+	for len(rest) >= 4 {
+		total := int(le16(rest[2:]))
+		if total < 4 || total > len(rest) {
+			break
+		}
+		ret = append(ret, rest[:total])
+		rest = rest[total:]
+	}
+	return ret
+}
+
+func (dev *SysfsDevice) GetConfigDescriptor(config_index int) (ConfigDescriptor, *UsbError) {
+	configs := dev.rawConfigs()
+	if config_index < 0 || config_index >= len(configs) {
+		return ConfigDescriptor{}, UsbErrorNotFound
+	}
+	return ParseConfigDescriptor(configs[config_index])
+}
+
+// Return the current bConfigurationValue, 0 if unconfigured. Unlike
+// the rest, this is read afresh each time.
+func (dev *SysfsDevice) GetConfiguration() (int, *UsbError) {
+	s, err := sysfsReadAttr(dev.Path, "bConfigurationValue")
+	if err != nil {
+		return 0, UsbErrorNoDevice
+	}
+	if s == "" {
+		return 0, nil
+	}
+	v, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, UsbErrorIO
+	}
+	return v, nil
+}
+
+func (dev *SysfsDevice) GetActiveConfigDescriptor() (ConfigDescriptor, *UsbError) {
+	value, err := dev.GetConfiguration()
+	if err != nil {
+		return ConfigDescriptor{}, err
+	}
+	for _, raw := range dev.rawConfigs() {
+		cfg, err := ParseConfigDescriptor(raw)
+		if err == nil && cfg.BConfigurationValue == value {
+			return cfg, nil
+		}
+	}
+	return ConfigDescriptor{}, UsbErrorNotFound
+}
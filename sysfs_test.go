@@ -0,0 +1,112 @@
+package usb
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+// testdata/sysfs is a copy of a small /sys/bus/usb/devices: the root
+// hub of bus 1, a hub on its port 1, and an MSP430 launchpad on port 2
+// of that hub with cdc_acm bound to its first interface. Like the real
+// thing it also lists that interface, and something that isn't a
+// device at all.
+func TestListSysfsDevices(t *testing.T) {
+	devs, err := ListSysfsDevices("testdata/sysfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	byName := make(map[string]*SysfsDevice)
+	for _, dev := range devs {
+		byName[dev.Name] = dev
+	}
+	if len(devs) != 3 || byName["usb1"] == nil || byName["1-1"] == nil || byName["1-1.2"] == nil {
+		names := []string{}
+		for _, dev := range devs {
+			names = append(names, dev.Name)
+		}
+		t.Fatalf("listed %v, want usb1, 1-1 and 1-1.2", names)
+	}
+
+	tests := []struct {
+		name         string
+		bus, address int
+		speed        Speed
+		port_path    []int
+		product      string
+		drivers      map[byte]string
+		vendor, pid  uint16
+		control      string
+		autosuspend  time.Duration
+	}{
+		{"usb1", 1, 1, SPEED_HIGH, nil, "EHCI Host Controller",
+			map[byte]string{0: "hub"}, 0x1d6b, 0x0002, "auto", 0},
+		{"1-1", 1, 2, SPEED_HIGH, []int{1}, "USB2.0 Hub",
+			map[byte]string{0: "hub"}, 0x8087, 0x0024, "auto", 2 * time.Second},
+		{"1-1.2", 1, 5, SPEED_FULL, []int{1, 2}, "MSP430",
+			map[byte]string{0: "cdc_acm"}, 0x2047, 0x0200, "on", -1},
+	}
+	for _, test := range tests {
+		dev := byName[test.name]
+		if dev.Bus != test.bus || dev.Address != test.address {
+			t.Errorf("%s: at %d:%d, want %d:%d", test.name, dev.Bus, dev.Address, test.bus, test.address)
+		}
+		if dev.Speed != test.speed {
+			t.Errorf("%s: speed %v, want %v", test.name, dev.Speed, test.speed)
+		}
+		if !reflect.DeepEqual(dev.PortPath, test.port_path) {
+			t.Errorf("%s: port path %v, want %v", test.name, dev.PortPath, test.port_path)
+		}
+		if dev.Product != test.product {
+			t.Errorf("%s: product %q, want %q", test.name, dev.Product, test.product)
+		}
+		if dev.Driver != "usb" {
+			t.Errorf("%s: driver %q, want usb", test.name, dev.Driver)
+		}
+		if !reflect.DeepEqual(dev.Drivers, test.drivers) {
+			t.Errorf("%s: interface drivers %v, want %v", test.name, dev.Drivers, test.drivers)
+		}
+		if dev.Power.Control != test.control || dev.Power.AutosuspendDelay != test.autosuspend {
+			t.Errorf("%s: power %+v, want control %q and autosuspend %v",
+				test.name, dev.Power, test.control, test.autosuspend)
+		}
+
+		desc, err := dev.GetDeviceDescriptor()
+		if err != nil {
+			t.Errorf("%s: device descriptor: %v", test.name, err)
+		} else if desc.IdVendor != test.vendor || desc.IdProduct != test.pid {
+			t.Errorf("%s: is %04x:%04x, want %04x:%04x",
+				test.name, desc.IdVendor, desc.IdProduct, test.vendor, test.pid)
+		}
+		config, err := dev.GetActiveConfigDescriptor()
+		if err != nil {
+			t.Errorf("%s: active configuration: %v", test.name, err)
+		} else if config.BConfigurationValue != 1 {
+			t.Errorf("%s: active configuration %d, want 1", test.name, config.BConfigurationValue)
+		}
+	}
+
+	dev := byName["1-1.2"]
+	if dev.Manufacturer != "Texas Instruments" || dev.Serial != "ABC123" {
+		t.Errorf("1-1.2: strings %q %q", dev.Manufacturer, dev.Serial)
+	}
+	if dev.Power.Wakeup != "" {
+		t.Errorf("1-1.2: wakeup %q for a device that can't wake the system", dev.Power.Wakeup)
+	}
+	config, err := dev.GetConfigDescriptor(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(config.Interfaces) != 2 || len(config.Interfaces[1][0].Endpoints) != 2 {
+		t.Errorf("1-1.2: configuration %+v", config)
+	}
+	if _, err := dev.GetConfigDescriptor(1); err != UsbErrorNotFound {
+		t.Errorf("1-1.2: second configuration: %v, want %v", err, UsbErrorNotFound)
+	}
+}
+
+func TestListSysfsDevicesMissing(t *testing.T) {
+	if _, err := ListSysfsDevices("testdata/nonexistent"); err != UsbErrorNotFound {
+		t.Errorf("got %v, want %v", err, UsbErrorNotFound)
+	}
+}
@@ -0,0 +1,104 @@
+package usb
+
+import (
+	"sync"
+	"time"
+)
+
+// A Tracer sees every transfer made through a DeviceHandle: once as
+// it is submitted, and again when it completes or its submission
+// fails. Completions are reported from whichever goroutine the
+// backend completes transfers on, but before anyone waiting on the
+// transfer is woken, so the buffer still holds what was transferred.
+type Tracer interface {
+	TraceSubmit(h *DeviceHandle, t *Transfer)
+	TraceComplete(h *DeviceHandle, t *Transfer)
+	// The backend refused the transfer; it will not complete
+	TraceError(h *DeviceHandle, t *Transfer, err *UsbError)
+}
+
+type tracerSlot struct {
+	lock   sync.Mutex
+	tracer Tracer
+}
+
+func (s *tracerSlot) get() Tracer {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.tracer
+}
+
+func (s *tracerSlot) set(t Tracer) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.tracer = t
+}
+
+// Trace the transfers of every handle from this context that has no
+// tracer of its own. nil stops tracing.
+func (ctx *Context) SetTracer(t Tracer) {
+	ctx.tracer.set(t)
+}
+
+// Trace the transfers made through this handle with t rather than
+// with the context's tracer. nil goes back to the context's.
+func (h *DeviceHandle) SetTracer(t Tracer) {
+	h.tracer.set(t)
+}
+
+func (h *DeviceHandle) getTracer() Tracer {
+	if t := h.tracer.get(); t != nil {
+		return t
+	}
+	return h.ctx.tracer.get()
+}
+
+// A Hook is told about every transfer made through a DeviceHandle, as
+// a Tracer is, but can also turn transfers away, and is told how long
+// each one took. AfterTransfer is called as TraceComplete is, before
+// anyone waiting on the transfer is woken.
+type Hook interface {
+	// Before the transfer is submitted. Returning an error refuses it:
+	// Submit returns the error, and AfterTransfer isn't called.
+	BeforeTransfer(h *DeviceHandle, t *Transfer) *UsbError
+	// Once the transfer has ended, however it did, with the time since
+	// it was submitted and its status. If the backend refused it, err
+	// is the backend's error and took is 0.
+	AfterTransfer(h *DeviceHandle, t *Transfer, took time.Duration, err *UsbError)
+}
+
+type hookSlot struct {
+	lock sync.Mutex
+	hook Hook
+}
+
+func (s *hookSlot) get() Hook {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.hook
+}
+
+func (s *hookSlot) set(hook Hook) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.hook = hook
+}
+
+// Hook the transfers of every handle from this context that has no
+// hook of its own. nil removes the hook.
+func (ctx *Context) SetHook(hook Hook) {
+	ctx.hook.set(hook)
+}
+
+// Hook the transfers made through this handle with hook rather than
+// with the context's. nil goes back to the context's.
+func (h *DeviceHandle) SetHook(hook Hook) {
+	h.hook.set(hook)
+}
+
+func (h *DeviceHandle) getHook() Hook {
+	if hook := h.hook.get(); hook != nil {
+		return hook
+	}
+	return h.ctx.hook.get()
+}
@@ -0,0 +1,210 @@
+package usb
+
+import "time"
+
+// The setup packet of a control transfer. WLength is filled in from
+// the length of the transfer's Buffer when it is submitted.
+type SetupPacket struct {
+	BmRequestType byte
+	BRequest      byte
+	WValue        uint16
+	WIndex        uint16
+	WLength       uint16
+}
+
+// One packet of an isochronous transfer
+type IsoPacket struct {
+	Length int // bytes of the transfer's Buffer that belong to this packet
+	Actual int
+	Status *UsbError
+}
+
+// A Transfer is a single request to an endpoint. It is started with
+// DeviceHandle.Submit and finishes in the background; ControlTransfer
+// and the Read and Write methods of EndpointHandle are built on it.
+type Transfer struct {
+	Type     int  // TRANSFER_TYPE_*
+	Endpoint byte // address with the direction bit; ignored for control
+	Setup    SetupPacket
+
+	// The data to send or the space to receive into. For control
+	// transfers this is just the data stage. For isochronous
+	// transfers the packets follow each other, in the lengths given
+	// by IsoPackets.
+	Buffer     []byte
+	IsoPackets []IsoPacket
+	// If set, Buffer must be part of this, and is set to all of it if
+	// nil; the backend may then use it without copying (see Buffer)
+	Mem *Buffer
+
+	Timeout time.Duration // 0 waits forever
+
+	// Set when the transfer completes. For isochronous transfers,
+	// Actual is the sum over the packets.
+	Actual int
+	Status *UsbError
+
+	backend BackendHandle
+	done    chan struct{}
+	tracer  Tracer
+	hook    Hook
+	traced  *DeviceHandle // nil if submitted with SubmitTo
+	started time.Time
+}
+
+// Reports whether data moves from the device to the host
+func (t *Transfer) In() bool {
+	if t.Type == TRANSFER_TYPE_CONTROL {
+		return t.Setup.BmRequestType&DIR_MASK == DIR_IN
+	}
+	return t.Endpoint&DIR_MASK == DIR_IN
+}
+
+// Record the outcome of the transfer and wake anyone waiting on it.
+// Only backends call this.
+func (t *Transfer) Complete(actual int, status *UsbError) {
+	t.Actual, t.Status = actual, status
+	if t.tracer != nil {
+		t.tracer.TraceComplete(t.traced, t)
+	}
+	if t.traced != nil {
+		t.traced.ended(t, time.Since(t.started), status, true)
+	}
+	close(t.done)
+}
+
+// A channel that is closed when the transfer completes
+func (t *Transfer) Done() <-chan struct{} {
+	return t.done
+}
+
+// Wait for the transfer to complete and return its status
+func (t *Transfer) Wait() *UsbError {
+	if t.done == nil {
+		return UsbErrorInvalidParam
+	}
+	<-t.done
+	return t.Status
+}
+
+// Ask for the transfer to be cancelled. Wait still has to be called
+// to find out how it ended.
+func (t *Transfer) Cancel() *UsbError {
+	if t.backend == nil {
+		return UsbErrorInvalidParam
+	}
+	return t.backend.CancelTransfer(t)
+}
+
+// Start a transfer on this device. A Transfer can be submitted again
+// once it has completed, but not before.
+func (h *DeviceHandle) Submit(t *Transfer) *UsbError {
+	if h.handle == nil {
+		return UsbErrorNoDevice
+	}
+	if err := t.prepare(); err != nil {
+		return err
+	}
+	t.hook = h.getHook()
+	if t.hook != nil {
+		if err := t.hook.BeforeTransfer(h, t); err != nil {
+			return err
+		}
+	}
+	t.tracer, t.traced = h.getTracer(), h
+	if t.tracer != nil {
+		t.tracer.TraceSubmit(h, t)
+	}
+	if t.Mem != nil {
+		h.bufferInUse(t, true)
+	}
+	t.started = time.Now()
+	if err := t.submit(h.handle); err != nil {
+		if t.tracer != nil {
+			t.tracer.TraceError(h, t, err)
+		}
+		h.ended(t, 0, err, false)
+		return err
+	}
+	return nil
+}
+
+// Start a transfer straight on a backend handle, as Submit does on a
+// DeviceHandle but without tracing. This is for backends that wrap
+// another backend and pass transfers on to it.
+func SubmitTo(h BackendHandle, t *Transfer) *UsbError {
+	if err := t.prepare(); err != nil {
+		return err
+	}
+	t.tracer, t.hook, t.traced = nil, nil, nil
+	return t.submit(h)
+}
+
+// Check the transfer and fill in what follows from the rest of it
+func (t *Transfer) prepare() *UsbError {
+	if t.Mem != nil {
+		if t.Buffer == nil {
+			t.Buffer = t.Mem.Bytes()
+		}
+		if !t.Mem.contains(t.Buffer) {
+			return UsbErrorInvalidParam
+		}
+	}
+	switch t.Type {
+	case TRANSFER_TYPE_CONTROL:
+		if len(t.Buffer) > 0xffff {
+			return UsbErrorInvalidParam
+		}
+		t.Endpoint = 0
+		t.Setup.WLength = uint16(len(t.Buffer))
+	case TRANSFER_TYPE_ISOCHRONOUS:
+		total := 0
+		for i := range t.IsoPackets {
+			total += t.IsoPackets[i].Length
+			t.IsoPackets[i].Actual, t.IsoPackets[i].Status = 0, nil
+		}
+		if total > len(t.Buffer) {
+			return UsbErrorInvalidParam
+		}
+	}
+	t.Actual, t.Status = 0, nil
+	return nil
+}
+
+func (t *Transfer) submit(h BackendHandle) *UsbError {
+	t.backend = h
+	t.done = make(chan struct{})
+	if err := h.SubmitTransfer(t); err != nil {
+		t.done = nil
+		return err
+	}
+	return nil
+}
+
+// Count a transfer that has ended, or that the backend refused, and
+// tell the hook and the log
+func (h *DeviceHandle) ended(t *Transfer, took time.Duration, err *UsbError, accepted bool) {
+	actual := 0
+	if accepted {
+		actual = t.Actual
+	}
+	if t.Mem != nil {
+		h.bufferInUse(t, false)
+	}
+	h.stats.record(t.Endpoint, actual, took, err, accepted)
+	if t.hook != nil {
+		t.hook.AfterTransfer(h, t, took, err)
+	}
+	if err != nil {
+		h.logTransfer(t, err)
+	}
+}
+
+// Submit a transfer and wait for it
+func (h *DeviceHandle) do(t *Transfer) (int, *UsbError) {
+	if err := h.Submit(t); err != nil {
+		return 0, err
+	}
+	err := t.Wait()
+	return t.Actual, err
+}
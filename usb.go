@@ -1,13 +1,8 @@
 package usb
 
-// #cgo CFLAGS: -I/usr/include/libusb-1.0
-// #cgo LDFLAGS: -lusb-1.0
-// #include <libusb.h>
-// #include <stdio.h>
-import "C"
-import "reflect"
-import "unsafe"
 import "fmt"
+import "log/slog"
+import "sync"
 
 type UsbError struct{
 	Text string
@@ -15,8 +10,13 @@ type UsbError struct{
 
 /////////////////// Basic types
 type Context struct {
+	init_lock sync.Mutex // guards initialized, closed and backend changing
 	initialized bool
-	ctx *C.struct_libusb_context
+	closed bool
+	backend Backend
+	tracer tracerSlot // see trace.go
+	hook hookSlot
+	logger loggerSlot // see log.go
 }
 
 var DefaultContext *Context
@@ -36,6 +36,12 @@ var (
 	UsbErrorNoMem = &UsbError{"ENOMEM"}
 	UsbErrorNotSupported = &UsbError{"ENOTSUP"}
 	UsbErrorMisc = &UsbError{"EIEIO"} // Old McDonald had a flash drive...
+
+	// Not a libusb error; returned when a descriptor read from the
+	// device doesn't parse.
+	UsbErrorBadDescriptor = &UsbError{"EBADDESC"}
+	// Nor this; the status of a transfer that was cancelled.
+	UsbErrorCancelled = &UsbError{"ECANCELED"}
 )
 
 const (
@@ -43,6 +49,7 @@ const (
 	DEBUG_ERROR
 	DEBUG_WARN
 	DEBUG_INFO
+	DEBUG_DEBUG
 )
 
 var UsbErrorMap = map[int]*UsbError{
@@ -62,177 +69,285 @@ var UsbErrorMap = map[int]*UsbError{
 	-99: UsbErrorMisc,
 }
 
-func decodeUsbError(errno C.int) (int,*UsbError) {
-	if errno >= 0 {
-		return int(errno), nil
-	}
-	err, ok := UsbErrorMap[int(errno)]
-	if !ok {
-		err = UsbErrorMisc
-	} 
-	return int(errno), err
-}
-
-func returnUsbError(errno C.int) *UsbError {
-	_, err := decodeUsbError(errno)
-	return err
-}
-
 func (err *UsbError) Error() string {
 	return fmt.Sprintf("%#v", err)
 }
 
 //////////////////////// Basic lifecycle support...
 
-// Automatically called when necessary
+// Make a context that reaches devices through the given backend.
+// A zero Context uses the default backend, libusb.
+func NewContext(b Backend) *Context {
+	return &Context{initialized: true, backend: b}
+}
+
+// Automatically called when necessary. Only a zero Context starts a
+// backend of its own; once closed, a context stays closed.
 func (ctx *Context) doinit() *UsbError {
+	ctx.init_lock.Lock()
+	defer ctx.init_lock.Unlock()
+	if ctx.closed {
+		return UsbErrorNoDevice
+	}
 	if !ctx.initialized {
-		_, err := decodeUsbError(C.libusb_init(&ctx.ctx))
-		if err == nil {
-			ctx.initialized = true
+		b, err := newDefaultBackend()
+		if err != nil {
+			return err
+		}
+		ctx.backend = b
+		ctx.initialized = true
+		if l := ctx.logger.get(); l != nil {
+			ctx.applyLogger(l)
 		}
-		return err
 	}
 	return nil
 }
 
-// Can be called to shut down. Probably not required
-func (ctx *Context) destroy() {
+// Shut the backend down. Devices must be closed first. Everything
+// done with the context afterwards fails with UsbErrorNoDevice.
+func (ctx *Context) Close() {
+	ctx.init_lock.Lock()
+	defer ctx.init_lock.Unlock()
+	ctx.closed = true
 	if ctx.initialized {
 		ctx.initialized = false
-		C.libusb_exit(ctx.ctx)
-		ctx.ctx = nil
+		ctx.backend.Close()
+		ctx.backend = nil
 	}
 }
 
 func (ctx *Context) SetDebug(level int) {
-	ctx.doinit()
-	C.libusb_set_debug(ctx.ctx, C.int(level))
+	if ctx.doinit() == nil {
+		ctx.backend.SetDebug(level)
+	}
 }
 
 
 func init() {
-	_, err := decodeUsbError(C.libusb_init(nil))
-	if err != nil {
-		panic(err)
-	}
-	DefaultContext = &Context{initialized: true}
+	// Set up on first use, so that merely importing the package
+	// works without libusb
+	DefaultContext = new(Context)
 }
 //////////////////////// DEVICE SUPPORT
 // memory management
 type Device struct {
 	ctx *Context
-	device *C.struct_libusb_device
+	dev BackendDevice
 }
 
 type DeviceHandle struct {
 	ctx *Context
-	handle *C.struct_libusb_device_handle
-	default_langid uint16
+	dev *Device
+	handle BackendHandle
 	interfaces map[byte]*Interface
+	tracer tracerSlot
+	hook hookSlot
+	stats statsTable // see stats.go
+	buffer_lock sync.Mutex // see buffer.go
+	buffers map[*Buffer]bool
+	buffer_transfers map[*Transfer]bool
+
+	// String descriptor cache; see string.go
+	string_lock sync.Mutex
+	default_langid uint16 // set with SetDefaultLangId
+	auto_langid uint16 // chosen from langids
+	langids []uint16
+	strings map[stringKey]string
+}
+
+func newDeviceHandle(dev *Device, handle BackendHandle) *DeviceHandle {
+	return &DeviceHandle{
+		ctx: dev.ctx,
+		dev: dev,
+		handle: handle,
+		interfaces: make(map[byte]*Interface, 0),
+		strings: make(map[stringKey]string),
+		buffers: make(map[*Buffer]bool),
+		buffer_transfers: make(map[*Transfer]bool),
+	}
 }
 
-func (ctx *Context) wrapDevice(dev *C.struct_libusb_device) *Device {
-	C.libusb_ref_device(dev)
-	return &Device{ctx, dev}
-}
-func (dev *Device) destroy() {
-	C.libusb_unref_device(dev.device)
-	dev.device = nil
-	dev.ctx = nil
-}
-
-func (handle *DeviceHandle) destroy() {
+// Close the device. Endpoints and interfaces of the handle can't be
+// used afterwards. Transfers still using its Buffers are cancelled and
+// waited for first.
+func (handle *DeviceHandle) Close() {
 	if handle.handle != nil {
-		C.libusb_close(handle.handle)
+		handle.cancelBufferTransfers()
+		handle.freeBuffers()
+		handle.handle.Close()
 		handle.handle = nil
 	}
-	handle.ctx = nil
 }
 
 func (ctx *Context) GetDeviceList() (dev []*Device, err *UsbError) {
-	var (
-		baseptr **C.struct_libusb_device
-		devlist []*C.struct_libusb_device
-	)
-	count, err := decodeUsbError(C.int(C.libusb_get_device_list(ctx.ctx, &baseptr)))
+	if err = ctx.doinit(); err != nil {
+		return nil, err
+	}
+	devlist, err := ctx.backend.GetDeviceList()
 	if err != nil {
-		dev = nil
-		return
+		return nil, err
 	}
-
-	hdr := &reflect.SliceHeader{Data: uintptr(unsafe.Pointer(baseptr)), Len: count, Cap: count}
-	devlist = *(*[]*C.struct_libusb_device)(unsafe.Pointer(&hdr))
-	dev = make([]*Device, count)
-	for i := 0; i < count; i++ {
-		dev[i] = ctx.wrapDevice(devlist[i])
+	dev = make([]*Device, len(devlist))
+	for i := range devlist {
+		dev[i] = &Device{ctx, devlist[i]}
 	}
-	devlist = nil
-	C.libusb_free_device_list(baseptr, 1)
 	return dev, nil
 }
 
 func (dev *Device) GetDeviceAddress() (bus,addr int) {
-	bus = int(C.libusb_get_bus_number(dev.device))
-	addr = int(C.libusb_get_device_address(dev.device))
-	return
+	return dev.dev.GetBusNumber(), dev.dev.GetAddress()
 }
 	
+type Speed int
+
+// Matches enum libusb_speed, which is why the order matters
+const (
+	SPEED_UNKNOWN Speed = iota
+	SPEED_LOW
+	SPEED_FULL
+	SPEED_HIGH
+	SPEED_SUPER
+	SPEED_SUPER_PLUS
+)
+
+var speedNames = []string{"unknown", "low", "full", "high", "super", "super+"}
+
+func (s Speed) String() string {
+	if s < 0 || int(s) >= len(speedNames) {
+		return speedNames[SPEED_UNKNOWN]
+	}
+	return speedNames[s]
+}
+
+// Return the speed the device is operating at
+func (dev *Device) GetSpeed() Speed {
+	return dev.dev.GetSpeed()
+}
+
+// Find an endpoint in any alternate setting of the active configuration
+func (dev *Device) findEndpoint(endpoint int) (EndpointDescriptor, *UsbError) {
+	cfg, err := dev.GetActiveConfigDescriptor()
+	if err != nil {
+		return EndpointDescriptor{}, err
+	}
+	for _, alts := range cfg.Interfaces {
+		for _, alt := range alts {
+			for _, ep := range alt.Endpoints {
+				if int(ep.BEndpointAddress) == endpoint {
+					return ep, nil
+				}
+			}
+		}
+	}
+	return EndpointDescriptor{}, UsbErrorNotFound
+}
+
+// Return wMaxPacketSize of an endpoint in the active configuration,
+// as it appears in the descriptor
 func (dev *Device) GetMaxPacketSize(endpoint int) (int,*UsbError) {
-	sz, err := decodeUsbError(C.libusb_get_max_packet_size(dev.device, C.uchar(endpoint)))
-	return sz, err
+	ep, err := dev.findEndpoint(endpoint)
+	if err != nil {
+		return 0, err
+	}
+	return int(ep.WMaxPacketSize), nil
 }
 
+// Return how many bytes a periodic endpoint moves per service
+// interval: wMaxPacketSize times the high-bandwidth multiplier, or
+// at SuperSpeed, wBytesPerInterval from the endpoint companion.
 func (dev *Device) GetMaxIsoPacketSize(endpoint int) (sz int, err *UsbError) {
-	sz, err = decodeUsbError(C.libusb_get_max_iso_packet_size(dev.device, C.uchar(endpoint)))
-	return
+	ep, err := dev.findEndpoint(endpoint)
+	if err != nil {
+		return 0, err
+	}
+	ttype := ep.BmAttributes & TRANSFER_TYPE_MASK
+	periodic := ttype == TRANSFER_TYPE_ISOCHRONOUS || ttype == TRANSFER_TYPE_INTERRUPT
+	if periodic && dev.GetSpeed() >= SPEED_SUPER {
+		sz = -1
+		walkDescriptors(ep.Extra, func(dtype DescriptorType, desc []byte) {
+			if dtype == DT_SS_ENDPOINT_COMPANION && len(desc) >= 6 {
+				sz = int(le16(desc[4:]))
+			}
+		})
+		if sz >= 0 {
+			return sz, nil
+		}
+	}
+	sz = int(ep.WMaxPacketSize & 0x7ff)
+	if periodic {
+		sz *= 1 + int(ep.WMaxPacketSize>>11&3)
+	}
+	return sz, nil
 }
-	
 
 func (dev *Device) Open() (handle *DeviceHandle, err *UsbError) {
-	handle = &DeviceHandle{dev.ctx, nil, 0, make(map[byte]*Interface, 0)}
-	_, err = decodeUsbError(C.libusb_open(dev.device, &handle.handle))
+	h, err := dev.dev.Open()
 	if err != nil {
-		handle = nil
+		dev.ctx.log(slog.LevelWarn, "open failed", dev.logAttrs(), slog.String("error", err.Text))
+		return nil, err
 	}
-	return
+	dev.ctx.log(slog.LevelDebug, "opened", dev.logAttrs())
+	return newDeviceHandle(dev, h), nil
 }
 
 // Open a device by vendor/product id. If more than one device
 // matches, return the first.
 func (ctx *Context) Open(vendor, product int) (*DeviceHandle,*UsbError) {
-	handle := &DeviceHandle{ctx, nil, 0, make(map[byte]*Interface, 0)}
-	dev := C.libusb_open_device_with_vid_pid(ctx.ctx, C.uint16_t(vendor), C.uint16_t(product))
+	devs, err := ctx.GetDeviceList()
+	if err != nil {
+		return nil, err
+	}
+	for _, dev := range devs {
+		desc, err := dev.GetDeviceDescriptor()
+		if err != nil || int(desc.IdVendor) != vendor || int(desc.IdProduct) != product {
+			continue
+		}
+		return dev.Open()
+	}
+	return nil, UsbErrorNotFound
+}
 
-	if dev == nil {
-		return nil, UsbErrorMisc
+// Open a device from a file descriptor for its device node that was
+// opened elsewhere, such as by a privileged helper or by Android's
+// UsbManager. The descriptor stays the caller's, to close once the
+// handle has been. This works even with device discovery turned off
+// (see LibusbOptions), but only on backends that are FDOpeners.
+func (ctx *Context) OpenFromFD(fd uintptr) (*DeviceHandle, *UsbError) {
+	if err := ctx.doinit(); err != nil {
+		return nil, err
 	}
-	handle.handle = dev
-	return handle, nil
+	b, ok := ctx.backend.(FDOpener)
+	if !ok {
+		return nil, UsbErrorNotSupported
+	}
+	dev, h, err := b.OpenFD(fd)
+	if err != nil {
+		ctx.log(slog.LevelWarn, "open failed", slog.Uint64("fd", uint64(fd)), slog.String("error", err.Text))
+		return nil, err
+	}
+	device := &Device{ctx, dev}
+	ctx.log(slog.LevelDebug, "opened", device.logAttrs(), slog.Uint64("fd", uint64(fd)))
+	return newDeviceHandle(device, h), nil
 }
 
 // Return a *Device for the given handle.
 func (h *DeviceHandle) GetDevice() *Device {
-	return h.ctx.wrapDevice(C.libusb_get_device(h.handle))
+	return h.dev
 }
 
 // Return the active configuration
 func (h *DeviceHandle) GetConfiguration() (int, *UsbError) {
-	var res C.int
-	if err := returnUsbError(C.libusb_get_configuration(h.handle, &res)); err != nil {
-		return 0, err
-	}
-	return int(res), nil
+	return h.handle.GetConfiguration()
 }
 
 // Set the active configuration
 func (h *DeviceHandle) SetConfiguration(config int) *UsbError {
-	return returnUsbError(C.libusb_set_configuration(h.handle, C.int(config)))
+	return h.handle.SetConfiguration(config)
 }
 
 type Interface struct {
 	handle *DeviceHandle
-	num C.int
+	num int
 	claimed int
 }
 
@@ -241,16 +356,19 @@ func (h *DeviceHandle) GetInterface(iface_no byte) *Interface {
 	if iface, ok := h.interfaces[iface_no]; ok {
 		return iface
 	}
-	iface := &Interface{handle: h, num: C.int(iface_no)}
+	iface := &Interface{handle: h, num: int(iface_no)}
 	h.interfaces[iface_no] = iface
 	return iface
 }
 
 // Claim this interface. Fails if the interface is already claimed by another process.
 func (i *Interface) Claim() *UsbError {
-	if err := returnUsbError(C.libusb_claim_interface(i.handle.handle, i.num)); err != nil {
+	dev := i.handle.dev
+	if err := i.handle.handle.ClaimInterface(i.num); err != nil {
+		dev.ctx.log(slog.LevelWarn, "claim failed", dev.logAttrs(), slog.Int("interface", i.num), slog.String("error", err.Text))
 		return err
 	}
+	dev.ctx.log(slog.LevelDebug, "claimed", dev.logAttrs(), slog.Int("interface", i.num))
 	i.claimed++
 	return nil
 }
@@ -258,37 +376,62 @@ func (i *Interface) Claim() *UsbError {
 func (i *Interface) Release() *UsbError {
 	i.claimed--
 	if i.claimed <= 0 {
-		return returnUsbError(C.libusb_release_interface(i.handle.handle, i.num))
+		return i.handle.handle.ReleaseInterface(i.num)
 	}
 	return nil
 }
 
+// Claim every interface of a function. Either all of them end up
+// claimed or, on error, the claims this call made are released again;
+// interfaces that were claimed before stay claimed.
+func (h *DeviceHandle) ClaimFunction(f Function) *UsbError {
+	claimed := make([]*Interface, 0, f.BInterfaceCount)
+	for n := 0; n < int(f.BInterfaceCount); n++ {
+		iface := h.GetInterface(f.BFirstInterface + byte(n))
+		if err := iface.Claim(); err != nil {
+			for i := len(claimed) - 1; i >= 0; i-- {
+				claimed[i].Release()
+			}
+			return err
+		}
+		claimed = append(claimed, iface)
+	}
+	return nil
+}
+
+// Release every interface of a function. Returns the first error seen.
+func (h *DeviceHandle) ReleaseFunction(f Function) *UsbError {
+	var first *UsbError
+	for n := 0; n < int(f.BInterfaceCount); n++ {
+		if err := h.GetInterface(f.BFirstInterface + byte(n)).Release(); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
 func (i *Interface) SetAlternate(alt int)  *UsbError {
-	return returnUsbError(C.libusb_set_interface_alt_setting(i.handle.handle, i.num, C.int(alt)))
+	return i.handle.handle.SetInterfaceAltSetting(i.num, alt)
 }
 
 func (i *Interface) IsKernelDriverActive() (bool, *UsbError) {
-	v, err := decodeUsbError(C.libusb_kernel_driver_active(i.handle.handle, i.num))
-	if err != nil {
-		return false, err
-	}
-	return (v == 1), nil
+	return i.handle.handle.KernelDriverActive(i.num)
 }
 
 func (i *Interface) AttachKernelDriver() *UsbError {
-	return returnUsbError(C.libusb_attach_kernel_driver(i.handle.handle, i.num))
+	return i.handle.handle.AttachKernelDriver(i.num)
 }
 
 func (i *Interface) DetachKernelDriver() *UsbError {
-	return returnUsbError(C.libusb_detach_kernel_driver(i.handle.handle, i.num))
+	return i.handle.handle.DetachKernelDriver(i.num)
 }
 
 func (h *DeviceHandle) ClearHalt(endpoint int) *UsbError {
-	return returnUsbError(C.libusb_clear_halt(h.handle, C.uchar(endpoint)))
+	return h.handle.ClearHalt(byte(endpoint))
 }
 
 func (h *DeviceHandle) Reset() *UsbError {
-	return returnUsbError(C.libusb_reset_device(h.handle))
+	return h.handle.Reset()
 }
 
 
@@ -301,11 +444,16 @@ func (i *DeviceHandle) OpenEndpoint(ep EndpointDescriptor) (res *EndpointHandle,
 	handle: i,
 	readable: ep.BEndpointAddress & DIR_MASK == DIR_IN, // if not, it's an output
 	ep: ep.BEndpointAddress,
+	descriptor: &ep,
 	}
 
 	switch ep.BmAttributes & TRANSFER_TYPE_MASK {
 	case TRANSFER_TYPE_INTERRUPT:
 		res.transfer = interruptTransfer
+	case TRANSFER_TYPE_BULK:
+		res.transfer = bulkTransfer
+	case TRANSFER_TYPE_ISOCHRONOUS:
+		res.transfer = isoTransfer
 	default:
 		panic("Unsupported transfer type")
 	}
@@ -313,6 +461,5 @@ func (i *DeviceHandle) OpenEndpoint(ep EndpointDescriptor) (res *EndpointHandle,
 }
 
 func (ep *EndpointHandle) ClearHalt() *UsbError {
-	err := returnUsbError(C.libusb_clear_halt(ep.handle.handle, C.uchar(ep.ep)))
-	return err
+	return ep.handle.handle.ClearHalt(ep.ep)
 }
@@ -0,0 +1,732 @@
+//go:build linux
+
+package usb
+
+// A backend that talks to usbfs directly, with no cgo. Devices are
+// found through sysfs and opened at /dev/bus/usb/BBB/DDD; transfers
+// are URBs, reaped by a goroutine per open device.
+
+import (
+	"fmt"
+	"runtime"
+	"sync"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+const usbfsDevRoot = "/dev/bus/usb"
+
+// Mirrors of the structures in linux/usbdevice_fs.h
+type (
+	usbfsCtrlTransfer struct {
+		BRequestType byte
+		BRequest     byte
+		WValue       uint16
+		WIndex       uint16
+		WLength      uint16
+		Timeout      uint32 // in milliseconds
+		Data         uintptr
+	}
+
+	usbfsSetInterface struct {
+		Interface  uint32
+		AltSetting uint32
+	}
+
+	usbfsGetDriver struct {
+		Interface uint32
+		Driver    [256]byte
+	}
+
+	usbfsIoctl struct {
+		Ifno      int32
+		IoctlCode int32
+		Data      uintptr
+	}
+
+	usbfsUrb struct {
+		Type            byte
+		Endpoint        byte
+		Status          int32
+		Flags           uint32
+		Buffer          uintptr
+		BufferLength    int32
+		ActualLength    int32
+		StartFrame      int32
+		NumberOfPackets int32
+		ErrorCount      int32
+		Signr           uint32
+		Usercontext     uintptr
+		// followed by NumberOfPackets usbfsIsoPacket
+	}
+
+	usbfsIsoPacket struct {
+		Length       uint32
+		ActualLength uint32
+		Status       uint32
+	}
+)
+
+// URB types, which aren't numbered like TRANSFER_TYPE_*
+var usbfsUrbTypes = map[int]byte{
+	TRANSFER_TYPE_ISOCHRONOUS: 0,
+	TRANSFER_TYPE_INTERRUPT:   1,
+	TRANSFER_TYPE_CONTROL:     2,
+	TRANSFER_TYPE_BULK:        3,
+}
+
+const usbfsUrbIsoASAP = 0x02
+
+// ioctl numbers as _IOC builds them on most architectures (not
+// alpha, mips, powerpc or sparc). Several depend on the size of a
+// pointer, so they are worked out rather than written down.
+const (
+	iocNone  = 0
+	iocWrite = 1
+	iocRead  = 2
+)
+
+func usbfsIoc(dir, nr, size uintptr) uintptr {
+	return dir<<30 | size<<16 | 'U'<<8 | nr
+}
+
+var (
+	usbdevfsControl          = usbfsIoc(iocRead|iocWrite, 0, unsafe.Sizeof(usbfsCtrlTransfer{}))
+	usbdevfsSetInterface     = usbfsIoc(iocRead, 4, unsafe.Sizeof(usbfsSetInterface{}))
+	usbdevfsSetConfiguration = usbfsIoc(iocRead, 5, 4)
+	usbdevfsGetDriver        = usbfsIoc(iocWrite, 8, unsafe.Sizeof(usbfsGetDriver{}))
+	usbdevfsSubmitUrb        = usbfsIoc(iocRead, 10, unsafe.Sizeof(usbfsUrb{}))
+	usbdevfsDiscardUrb       = usbfsIoc(iocNone, 11, 0)
+	usbdevfsReapUrb          = usbfsIoc(iocWrite, 12, unsafe.Sizeof(uintptr(0)))
+	usbdevfsReapUrbNDelay    = usbfsIoc(iocWrite, 13, unsafe.Sizeof(uintptr(0)))
+	usbdevfsClaimInterface   = usbfsIoc(iocRead, 15, 4)
+	usbdevfsReleaseInterface = usbfsIoc(iocRead, 16, 4)
+	usbdevfsIoctl            = usbfsIoc(iocRead|iocWrite, 18, unsafe.Sizeof(usbfsIoctl{}))
+	usbdevfsReset            = usbfsIoc(iocNone, 20, 0)
+	usbdevfsClearHalt        = usbfsIoc(iocRead, 21, 4)
+	usbdevfsDisconnect       = usbfsIoc(iocNone, 22, 0)
+	usbdevfsConnect          = usbfsIoc(iocNone, 23, 0)
+	usbdevfsGetSpeed         = usbfsIoc(iocNone, 31, 0)
+)
+
+func usbfsDoIoctl(fd int, req uintptr, arg unsafe.Pointer) (int, syscall.Errno) {
+	for {
+		r, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), req, uintptr(arg))
+		if errno != syscall.EINTR {
+			return int(r), errno
+		}
+	}
+}
+
+var usbfsErrnoMap = map[syscall.Errno]*UsbError{
+	syscall.EACCES:    UsbErrorAccess,
+	syscall.EPERM:     UsbErrorAccess,
+	syscall.ENOENT:    UsbErrorNotFound,
+	syscall.ENODATA:   UsbErrorNotFound,
+	syscall.ENODEV:    UsbErrorNoDevice,
+	syscall.ESHUTDOWN: UsbErrorNoDevice,
+	syscall.EBUSY:     UsbErrorBusy,
+	syscall.EINVAL:    UsbErrorInvalidParam,
+	syscall.EPIPE:     UsbErrorPipe,
+	syscall.ETIMEDOUT: UsbErrorTimeout,
+	syscall.EOVERFLOW: UsbErrorOverflow,
+	syscall.ENOMEM:    UsbErrorNoMem,
+	syscall.EINTR:     UsbErrorInterrupted,
+	syscall.ENOTTY:    UsbErrorNotSupported,
+	syscall.ENOSYS:    UsbErrorNotSupported,
+}
+
+func usbfsError(errno syscall.Errno) *UsbError {
+	if errno == 0 {
+		return nil
+	}
+	if err, ok := usbfsErrnoMap[errno]; ok {
+		return err
+	}
+	return UsbErrorIO
+}
+
+func usbfsIoctlError(fd int, req uintptr, arg unsafe.Pointer) *UsbError {
+	_, errno := usbfsDoIoctl(fd, req, arg)
+	return usbfsError(errno)
+}
+
+//////////////////////// The backend
+
+type usbfsBackend struct {
+	sysfs string
+}
+
+// Make a backend that uses usbfs directly
+func NewUsbfsBackend() (Backend, *UsbError) {
+	return &usbfsBackend{sysfs: SYSFS_ROOT}, nil
+}
+
+// usbfs has no debug output to turn on
+func (b *usbfsBackend) SetDebug(level int) {}
+
+// usbfs can detach drivers itself, but has no hotplug events or HID
+// access of its own
+func (b *usbfsBackend) HasCapability(capability int) bool {
+	return capability == CAP_HAS_CAPABILITY || capability == CAP_SUPPORTS_DETACH_KERNEL_DRIVER
+}
+
+func (b *usbfsBackend) Close() {}
+
+// usbfs device nodes are character devices of this major number,
+// with bus and address in the minor
+const usbfsMajor = 189
+
+// Take over a device node opened elsewhere. The device is described
+// from sysfs if it can be read there, otherwise from the node itself.
+func (b *usbfsBackend) OpenFD(fd uintptr) (BackendDevice, BackendHandle, *UsbError) {
+	var st syscall.Stat_t
+	if err := syscall.Fstat(int(fd), &st); err != nil {
+		return nil, nil, usbfsError(err.(syscall.Errno))
+	}
+	// As the kernel's new_encode_dev packs them
+	rdev := uint64(st.Rdev)
+	major := int(rdev>>8&0xfff | rdev>>32&^0xfff)
+	minor := int(rdev&0xff | rdev>>12&^0xff)
+	if st.Mode&syscall.S_IFMT != syscall.S_IFCHR || major != usbfsMajor {
+		return nil, nil, UsbErrorInvalidParam
+	}
+	bus, addr := minor/128+1, minor%128+1
+
+	// The handle gets a descriptor of its own, so that the caller's
+	// stays the caller's
+	r, _, errno := syscall.Syscall(syscall.SYS_FCNTL, fd, syscall.F_DUPFD_CLOEXEC, 0)
+	if errno != 0 {
+		return nil, nil, usbfsError(errno)
+	}
+	nfd := int(r)
+
+	var sysfs *SysfsDevice
+	devs, _ := ListSysfsDevices(b.sysfs)
+	for _, dev := range devs {
+		if dev.Bus == bus && dev.Address == addr {
+			sysfs = dev
+			break
+		}
+	}
+	if sysfs == nil {
+		sysfs = &SysfsDevice{Bus: bus, Address: addr}
+		// Reading the node gives the same descriptors as sysfs
+		buf := make([]byte, 4096)
+		for {
+			n, err := syscall.Pread(nfd, buf, int64(len(sysfs.Descriptors)))
+			if err != nil {
+				syscall.Close(nfd)
+				return nil, nil, usbfsError(err.(syscall.Errno))
+			}
+			if n <= 0 {
+				break
+			}
+			sysfs.Descriptors = append(sysfs.Descriptors, buf[:n]...)
+		}
+		if speed, errno := usbfsDoIoctl(nfd, usbdevfsGetSpeed, nil); errno == 0 {
+			sysfs.Speed = usbfsSpeeds[speed]
+		}
+	}
+
+	d := &usbfsDevice{sysfs: sysfs}
+	h, err := newUsbfsHandle(d, nfd)
+	if err != nil {
+		return nil, nil, err
+	}
+	d.opened = h
+	return d, h, nil
+}
+
+// The kernel's enum usb_device_speed; wireless USB counts as high
+// speed
+var usbfsSpeeds = map[int]Speed{
+	1: SPEED_LOW,
+	2: SPEED_FULL,
+	3: SPEED_HIGH,
+	4: SPEED_HIGH,
+	5: SPEED_SUPER,
+	6: SPEED_SUPER_PLUS,
+}
+
+func (b *usbfsBackend) GetDeviceList() ([]BackendDevice, *UsbError) {
+	devs, err := ListSysfsDevices(b.sysfs)
+	if err != nil {
+		return nil, err
+	}
+	ret := make([]BackendDevice, len(devs))
+	for i, dev := range devs {
+		ret[i] = &usbfsDevice{sysfs: dev}
+	}
+	return ret, nil
+}
+
+//////////////////////// Devices
+
+type usbfsDevice struct {
+	sysfs *SysfsDevice
+	// The handle a device taken over by OpenFD came with, which has to
+	// be asked what sysfs can't say
+	opened *usbfsHandle
+}
+
+func (d *usbfsDevice) GetBusNumber() int {
+	return d.sysfs.Bus
+}
+
+func (d *usbfsDevice) GetAddress() int {
+	return d.sysfs.Address
+}
+
+func (d *usbfsDevice) GetSpeed() Speed {
+	return d.sysfs.Speed
+}
+
+func (d *usbfsDevice) GetDeviceDescriptor() (DeviceDescriptor, *UsbError) {
+	return d.sysfs.GetDeviceDescriptor()
+}
+
+func (d *usbfsDevice) GetConfigDescriptor(config_index int) (ConfigDescriptor, *UsbError) {
+	return d.sysfs.GetConfigDescriptor(config_index)
+}
+
+func (d *usbfsDevice) GetActiveConfigDescriptor() (ConfigDescriptor, *UsbError) {
+	cfg, err := d.sysfs.GetActiveConfigDescriptor()
+	if err != UsbErrorNoDevice || d.opened == nil {
+		return cfg, err
+	}
+	value, err := d.opened.GetConfiguration()
+	if err != nil {
+		return ConfigDescriptor{}, err
+	}
+	for i := 0; ; i++ {
+		cfg, err := d.sysfs.GetConfigDescriptor(i)
+		if err != nil {
+			return ConfigDescriptor{}, UsbErrorNotFound
+		}
+		if cfg.BConfigurationValue == value {
+			return cfg, nil
+		}
+	}
+}
+
+func (d *usbfsDevice) Open() (BackendHandle, *UsbError) {
+	path := fmt.Sprintf("%s/%03d/%03d", usbfsDevRoot, d.sysfs.Bus, d.sysfs.Address)
+	fd, err := syscall.Open(path, syscall.O_RDWR|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		if err == syscall.ENOENT {
+			return nil, UsbErrorNoDevice
+		}
+		return nil, usbfsError(err.(syscall.Errno))
+	}
+	return newUsbfsHandle(d, fd)
+}
+
+//////////////////////// Handles
+
+type usbfsHandle struct {
+	dev  *usbfsDevice
+	fd   int
+	wake [2]int // a pipe that stops the reaper
+	done chan struct{}
+
+	lock       sync.Mutex
+	closed     bool // no more URBs may be submitted or discarded
+	pending    map[*usbfsUrb]*usbfsTransfer
+	byTransfer map[*Transfer]*usbfsTransfer
+}
+
+func newUsbfsHandle(dev *usbfsDevice, fd int) (*usbfsHandle, *UsbError) {
+	h := &usbfsHandle{
+		dev:        dev,
+		fd:         fd,
+		done:       make(chan struct{}),
+		pending:    make(map[*usbfsUrb]*usbfsTransfer),
+		byTransfer: make(map[*Transfer]*usbfsTransfer),
+	}
+	if err := syscall.Pipe2(h.wake[:], syscall.O_CLOEXEC); err != nil {
+		syscall.Close(fd)
+		return nil, UsbErrorNoMem
+	}
+	go h.reap()
+	return h, nil
+}
+
+// Transfers still in flight are discarded, and end as cancelled.
+// Everything that uses the fd is over before it is closed: the reaper
+// has stopped, and the timers are stopped and can't find a URB to
+// discard.
+func (h *usbfsHandle) Close() {
+	syscall.Write(h.wake[1], []byte{0})
+	<-h.done
+	syscall.Close(h.wake[0])
+	syscall.Close(h.wake[1])
+
+	h.lock.Lock()
+	h.closed = true
+	for _, ut := range h.pending {
+		if ut.timer != nil {
+			ut.timer.Stop()
+		}
+		usbfsDoIoctl(h.fd, usbdevfsDiscardUrb, unsafe.Pointer(ut.urb))
+	}
+	h.lock.Unlock()
+	// Reap the discarded URBs here, now that the reaper has stopped;
+	// if the device has gone, whatever is left fails with it
+	for h.hasPending() {
+		var urb *usbfsUrb
+		if _, errno := usbfsDoIoctl(h.fd, usbdevfsReapUrb, unsafe.Pointer(&urb)); errno != 0 {
+			break
+		}
+		if ut := h.take(urb); ut != nil {
+			ut.complete()
+		}
+	}
+	h.failPending(UsbErrorNoDevice)
+	syscall.Close(h.fd)
+}
+
+func (h *usbfsHandle) GetConfiguration() (int, *UsbError) {
+	if v, err := h.dev.sysfs.GetConfiguration(); err == nil {
+		return v, nil
+	}
+	// Ask the device. Data is only a uintptr, which the stack moving
+	// wouldn't update, so the byte it points at lives on the heap.
+	buf := make([]byte, 1)
+	ctrl := usbfsCtrlTransfer{
+		BRequestType: DIR_IN | REQUEST_TYPE_STANDARD | RECIPIENT_DEVICE,
+		BRequest:     REQUEST_GET_CONFIGURATION,
+		WLength:      1,
+		Timeout:      uint32(descriptorTimeout / time.Millisecond),
+		Data:         uintptr(unsafe.Pointer(&buf[0])),
+	}
+	n, errno := usbfsDoIoctl(h.fd, usbdevfsControl, unsafe.Pointer(&ctrl))
+	runtime.KeepAlive(buf)
+	if errno != 0 {
+		return 0, usbfsError(errno)
+	}
+	if n != 1 {
+		return 0, UsbErrorIO
+	}
+	return int(buf[0]), nil
+}
+
+func (h *usbfsHandle) SetConfiguration(config int) *UsbError {
+	v := int32(config)
+	return usbfsIoctlError(h.fd, usbdevfsSetConfiguration, unsafe.Pointer(&v))
+}
+
+func (h *usbfsHandle) ClaimInterface(iface_no int) *UsbError {
+	v := uint32(iface_no)
+	return usbfsIoctlError(h.fd, usbdevfsClaimInterface, unsafe.Pointer(&v))
+}
+
+func (h *usbfsHandle) ReleaseInterface(iface_no int) *UsbError {
+	v := uint32(iface_no)
+	return usbfsIoctlError(h.fd, usbdevfsReleaseInterface, unsafe.Pointer(&v))
+}
+
+func (h *usbfsHandle) SetInterfaceAltSetting(iface_no, alt int) *UsbError {
+	si := usbfsSetInterface{uint32(iface_no), uint32(alt)}
+	return usbfsIoctlError(h.fd, usbdevfsSetInterface, unsafe.Pointer(&si))
+}
+
+// Return the kernel driver bound to an interface, "" if none
+func (h *usbfsHandle) driver(iface_no int) (string, *UsbError) {
+	gd := usbfsGetDriver{Interface: uint32(iface_no)}
+	_, errno := usbfsDoIoctl(h.fd, usbdevfsGetDriver, unsafe.Pointer(&gd))
+	if errno == syscall.ENODATA {
+		return "", nil
+	}
+	if errno != 0 {
+		return "", usbfsError(errno)
+	}
+	n := 0
+	for n < len(gd.Driver) && gd.Driver[n] != 0 {
+		n++
+	}
+	return string(gd.Driver[:n]), nil
+}
+
+// Having claimed the interface through usbfs (ours or someone
+// else's) doesn't count as a kernel driver
+func (h *usbfsHandle) KernelDriverActive(iface_no int) (bool, *UsbError) {
+	name, err := h.driver(iface_no)
+	if err != nil {
+		return false, err
+	}
+	return name != "" && name != "usbfs", nil
+}
+
+func (h *usbfsHandle) AttachKernelDriver(iface_no int) *UsbError {
+	cmd := usbfsIoctl{Ifno: int32(iface_no), IoctlCode: int32(usbdevfsConnect)}
+	return usbfsIoctlError(h.fd, usbdevfsIoctl, unsafe.Pointer(&cmd))
+}
+
+func (h *usbfsHandle) DetachKernelDriver(iface_no int) *UsbError {
+	if active, err := h.KernelDriverActive(iface_no); err != nil {
+		return err
+	} else if !active {
+		return UsbErrorNotFound
+	}
+	cmd := usbfsIoctl{Ifno: int32(iface_no), IoctlCode: int32(usbdevfsDisconnect)}
+	return usbfsIoctlError(h.fd, usbdevfsIoctl, unsafe.Pointer(&cmd))
+}
+
+func (h *usbfsHandle) ClearHalt(endpoint byte) *UsbError {
+	v := uint32(endpoint)
+	return usbfsIoctlError(h.fd, usbdevfsClearHalt, unsafe.Pointer(&v))
+}
+
+func (h *usbfsHandle) Reset() *UsbError {
+	return usbfsIoctlError(h.fd, usbdevfsReset, nil)
+}
+
+//////////////////////// Transfers
+
+// A URB in flight. The kernel holds on to the URB and its buffer
+// until it is reaped, so both are allocated here and kept reachable
+// through the pending map; data is copied in and out.
+type usbfsTransfer struct {
+	t         *Transfer
+	mem       []uint64 // backs urb and the iso packets after it
+	urb       *usbfsUrb
+	buf       []byte
+	shared    bool // buf is the transfer's own Buffer, not a copy
+	timer     *time.Timer
+	timed_out bool
+}
+
+func (ut *usbfsTransfer) isoPacket(i int) *usbfsIsoPacket {
+	return (*usbfsIsoPacket)(unsafe.Pointer(uintptr(unsafe.Pointer(ut.urb)) +
+		unsafe.Sizeof(usbfsUrb{}) + uintptr(i)*unsafe.Sizeof(usbfsIsoPacket{})))
+}
+
+func (h *usbfsHandle) SubmitTransfer(t *Transfer) *UsbError {
+	urb_type, ok := usbfsUrbTypes[t.Type]
+	if !ok {
+		return UsbErrorInvalidParam
+	}
+	size := unsafe.Sizeof(usbfsUrb{}) + uintptr(len(t.IsoPackets))*unsafe.Sizeof(usbfsIsoPacket{})
+	ut := &usbfsTransfer{t: t, mem: make([]uint64, (size+7)/8)}
+	ut.urb = (*usbfsUrb)(unsafe.Pointer(&ut.mem[0]))
+
+	offset := 0
+	if t.Type == TRANSFER_TYPE_CONTROL {
+		offset = 8
+	}
+	if t.inPlace(h) {
+		// Mapped by AllocBuffer, so the kernel can use it as it is
+		ut.buf, ut.shared = t.Buffer, true
+	} else {
+		ut.buf = make([]byte, offset+len(t.Buffer))
+		if t.Type == TRANSFER_TYPE_CONTROL {
+			ut.buf[0] = t.Setup.BmRequestType
+			ut.buf[1] = t.Setup.BRequest
+			putLe16(ut.buf[2:], t.Setup.WValue)
+			putLe16(ut.buf[4:], t.Setup.WIndex)
+			putLe16(ut.buf[6:], t.Setup.WLength)
+		}
+		if !t.In() {
+			copy(ut.buf[offset:], t.Buffer)
+		}
+	}
+
+	ut.urb.Type = urb_type
+	ut.urb.Endpoint = t.Endpoint
+	ut.urb.BufferLength = int32(len(ut.buf))
+	if len(ut.buf) > 0 {
+		ut.urb.Buffer = uintptr(unsafe.Pointer(&ut.buf[0]))
+	}
+	if t.Type == TRANSFER_TYPE_ISOCHRONOUS {
+		ut.urb.Flags = usbfsUrbIsoASAP
+		ut.urb.NumberOfPackets = int32(len(t.IsoPackets))
+		for i, p := range t.IsoPackets {
+			ut.isoPacket(i).Length = uint32(p.Length)
+		}
+	}
+
+	// Hold the lock so that the reaper can't see the URB before it's
+	// in the pending map
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if h.closed {
+		return UsbErrorNoDevice
+	}
+	if _, errno := usbfsDoIoctl(h.fd, usbdevfsSubmitUrb, unsafe.Pointer(ut.urb)); errno != 0 {
+		return usbfsError(errno)
+	}
+	h.pending[ut.urb] = ut
+	h.byTransfer[t] = ut
+	// usbfs has no timeouts of its own
+	if t.Timeout > 0 {
+		ut.timer = time.AfterFunc(t.Timeout, func() {
+			h.lock.Lock()
+			defer h.lock.Unlock()
+			if !h.closed && h.byTransfer[t] == ut {
+				ut.timed_out = true
+				usbfsDoIoctl(h.fd, usbdevfsDiscardUrb, unsafe.Pointer(ut.urb))
+			}
+		})
+	}
+	return nil
+}
+
+// Map memory from the device node, which the kernel moves data to and
+// from directly (Linux 4.6 and later), or anonymous memory if it can't
+// be mapped
+func (h *usbfsHandle) AllocBuffer(size int) ([]byte, func(), *UsbError) {
+	// Nothing can be mapped with no length
+	length := size
+	if length == 0 {
+		length = 1
+	}
+	prot := syscall.PROT_READ | syscall.PROT_WRITE
+	mem, err := syscall.Mmap(h.fd, 0, length, prot, syscall.MAP_SHARED)
+	if err != nil {
+		mem, err = syscall.Mmap(-1, 0, length, prot, syscall.MAP_PRIVATE|syscall.MAP_ANON)
+	}
+	if err != nil {
+		return nil, nil, UsbErrorNoMem
+	}
+	return mem[:size], func() { syscall.Munmap(mem) }, nil
+}
+
+func (h *usbfsHandle) CancelTransfer(t *Transfer) *UsbError {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	ut, ok := h.byTransfer[t]
+	if !ok || h.closed {
+		return UsbErrorNotFound
+	}
+	return usbfsIoctlError(h.fd, usbdevfsDiscardUrb, unsafe.Pointer(ut.urb))
+}
+
+// Translate the status of a URB, a negative errno
+func usbfsUrbStatus(status int32) *UsbError {
+	switch syscall.Errno(-status) {
+	case 0, syscall.EREMOTEIO:
+		return nil
+	case syscall.ENOENT, syscall.ECONNRESET:
+		return UsbErrorCancelled
+	case syscall.EPIPE:
+		return UsbErrorPipe
+	case syscall.EOVERFLOW:
+		return UsbErrorOverflow
+	case syscall.ENODEV, syscall.ESHUTDOWN:
+		return UsbErrorNoDevice
+	case syscall.ETIMEDOUT:
+		return UsbErrorTimeout
+	}
+	return UsbErrorIO
+}
+
+func (ut *usbfsTransfer) complete() {
+	t := ut.t
+	if ut.timer != nil {
+		ut.timer.Stop()
+	}
+	status := usbfsUrbStatus(ut.urb.Status)
+	if status == UsbErrorCancelled && ut.timed_out {
+		status = UsbErrorTimeout
+	}
+	actual := int(ut.urb.ActualLength)
+	buf := ut.buf
+	switch t.Type {
+	case TRANSFER_TYPE_CONTROL:
+		buf = buf[8 : 8+actual]
+	case TRANSFER_TYPE_ISOCHRONOUS:
+		// Each packet's data stays at its own offset, so copy it all
+		actual = 0
+		for i := range t.IsoPackets {
+			p := ut.isoPacket(i)
+			t.IsoPackets[i].Actual = int(p.ActualLength)
+			t.IsoPackets[i].Status = usbfsUrbStatus(int32(p.Status))
+			actual += int(p.ActualLength)
+		}
+	default:
+		buf = buf[:actual]
+	}
+	if t.In() && !ut.shared {
+		copy(t.Buffer, buf)
+	}
+	t.Complete(actual, status)
+}
+
+// Remove a URB from the pending maps, returning its transfer
+func (h *usbfsHandle) take(urb *usbfsUrb) *usbfsTransfer {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	ut, ok := h.pending[urb]
+	if !ok {
+		return nil
+	}
+	delete(h.pending, urb)
+	delete(h.byTransfer, ut.t)
+	return ut
+}
+
+func (h *usbfsHandle) hasPending() bool {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return len(h.pending) > 0
+}
+
+// Complete everything still pending with the given status
+func (h *usbfsHandle) failPending(status *UsbError) {
+	h.lock.Lock()
+	pending := h.pending
+	h.pending = make(map[*usbfsUrb]*usbfsTransfer)
+	h.byTransfer = make(map[*Transfer]*usbfsTransfer)
+	h.lock.Unlock()
+	for _, ut := range pending {
+		if ut.timer != nil {
+			ut.timer.Stop()
+		}
+		ut.t.Complete(0, status)
+	}
+}
+
+type pollFd struct {
+	fd      int32
+	events  int16
+	revents int16
+}
+
+const (
+	pollIn  = 0x1
+	pollOut = 0x4
+	pollErr = 0x8
+	pollHup = 0x10
+)
+
+// usbfs reports POLLOUT when there is a URB to reap, and POLLERR
+// once the device has gone away.
+func (h *usbfsHandle) reap() {
+	defer close(h.done)
+	for {
+		fds := [2]pollFd{{fd: int32(h.fd), events: pollOut}, {fd: int32(h.wake[0]), events: pollIn}}
+		_, _, errno := syscall.Syscall6(syscall.SYS_PPOLL, uintptr(unsafe.Pointer(&fds[0])), 2, 0, 0, 0, 0)
+		if errno == syscall.EINTR {
+			continue
+		}
+		if errno != 0 || fds[1].revents != 0 {
+			return
+		}
+		for {
+			var urb *usbfsUrb
+			_, errno := usbfsDoIoctl(h.fd, usbdevfsReapUrbNDelay, unsafe.Pointer(&urb))
+			if errno != 0 {
+				break
+			}
+			if ut := h.take(urb); ut != nil {
+				ut.complete()
+			}
+		}
+		if fds[0].revents&(pollErr|pollHup) != 0 {
+			h.failPending(UsbErrorNoDevice)
+			return
+		}
+	}
+}
@@ -0,0 +1,8 @@
+//go:build !cgo && linux
+
+package usb
+
+// Without cgo, Linux can still use usbfs
+func newDefaultBackend() (Backend, *UsbError) {
+	return NewUsbfsBackend()
+}
@@ -0,0 +1,830 @@
+package usbip
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"gopkg.thequux.com/usb"
+	"gopkg.thequux.com/usb/usbmon"
+)
+
+// How long the requests the client makes itself may take
+const controlTimeout = 5 * time.Second
+
+// Dial a server, on PORT unless addr has a port of its own
+func dial(addr string) (net.Conn, error) {
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(addr, strconv.Itoa(PORT))
+	}
+	return net.Dial("tcp", addr)
+}
+
+// List the devices a server exports
+func ListDevices(addr string) ([]*ExportedDevice, error) {
+	conn, err := dial(addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	return ListDevicesConn(conn)
+}
+
+// As ListDevices, over a connection that is already open. The server
+// closes it afterwards.
+func ListDevicesConn(conn net.Conn) ([]*ExportedDevice, error) {
+	if _, err := conn.Write(OpHeader{VERSION, OP_REQ_DEVLIST, ST_OK}.Append(nil)); err != nil {
+		return nil, err
+	}
+	rep, err := ReadOpHeader(conn)
+	if err != nil {
+		return nil, err
+	}
+	if rep.Version != VERSION || rep.Code != OP_REP_DEVLIST {
+		return nil, ErrProtocol
+	}
+	if rep.Status != ST_OK {
+		return nil, ErrRefused
+	}
+	var count [4]byte
+	if _, err := io.ReadFull(conn, count[:]); err != nil {
+		return nil, err
+	}
+	var ret []*ExportedDevice
+	for i := uint32(0); i < be.Uint32(count[:]); i++ {
+		d, err := ReadExportedDevice(conn, true)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, d)
+	}
+	return ret, nil
+}
+
+// A usb.Backend whose devices are attached from USB/IP servers. Each
+// device keeps a connection of its own, and stays attached until it is
+// detached, the server drops it or the backend is closed.
+type Backend struct {
+	lock    sync.Mutex
+	devices []*Device
+}
+
+func NewBackend() *Backend {
+	return &Backend{}
+}
+
+// Import the device with the given bus ID from a server
+func (b *Backend) Attach(addr, busid string) (*Device, error) {
+	conn, err := dial(addr)
+	if err != nil {
+		return nil, err
+	}
+	d, err := b.AttachConn(conn, busid)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return d, nil
+}
+
+// As Attach, over a connection that is already open. The device owns
+// the connection from then on.
+func (b *Backend) AttachConn(conn net.Conn, busid string) (*Device, error) {
+	req := OpHeader{VERSION, OP_REQ_IMPORT, ST_OK}.Append(nil)
+	var id [32]byte
+	copy(id[:len(id)-1], busid)
+	if _, err := conn.Write(append(req, id[:]...)); err != nil {
+		return nil, err
+	}
+	rep, err := ReadOpHeader(conn)
+	if err != nil {
+		return nil, err
+	}
+	if rep.Version != VERSION || rep.Code != OP_REP_IMPORT {
+		return nil, ErrProtocol
+	}
+	switch rep.Status {
+	case ST_OK:
+	case ST_NA, ST_NODEV:
+		return nil, ErrNoDevice
+	case ST_DEV_BUSY:
+		return nil, ErrBusy
+	default:
+		return nil, ErrRefused
+	}
+	exported, err := ReadExportedDevice(conn, false)
+	if err != nil {
+		return nil, err
+	}
+
+	d := &Device{
+		Exported: exported,
+		conn:     conn,
+		devid:    uint32(exported.Bus)<<16 | uint32(exported.Device),
+		gone:     make(chan struct{}),
+		pending:  make(map[uint32]*urb),
+		unlinks:  make(map[uint32]uint32),
+		config:   int(exported.BConfigurationValue),
+		claimed:  make(map[byte]*handle),
+		alts:     make(map[byte]byte),
+	}
+	go d.receive(bufio.NewReader(conn))
+	if err := d.readDescriptors(); err != nil {
+		d.shutdown(err)
+		return nil, err
+	}
+
+	b.lock.Lock()
+	b.devices = append(b.devices, d)
+	b.lock.Unlock()
+	return d, nil
+}
+
+// Give a device back to its server
+func (b *Backend) Detach(d *Device) {
+	b.lock.Lock()
+	for i, dev := range b.devices {
+		if dev == d {
+			b.devices = append(b.devices[:i], b.devices[i+1:]...)
+			break
+		}
+	}
+	b.lock.Unlock()
+	d.shutdown(nil)
+}
+
+// The attached devices that are still there
+func (b *Backend) GetDeviceList() ([]usb.BackendDevice, *usb.UsbError) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	var ret []usb.BackendDevice
+	for _, d := range b.devices {
+		if !d.Detached() {
+			ret = append(ret, &backendDevice{d})
+		}
+	}
+	return ret, nil
+}
+
+func (b *Backend) SetDebug(level int) {}
+
+// Detach every device
+func (b *Backend) Close() {
+	b.lock.Lock()
+	devices := b.devices
+	b.devices = nil
+	b.lock.Unlock()
+	for _, d := range devices {
+		d.shutdown(nil)
+	}
+}
+
+//////////////////////// Devices
+
+// A device imported from a server. It keeps the bus and device
+// numbers it has there.
+type Device struct {
+	// As the server described it when it was imported
+	Exported *ExportedDevice
+
+	conn  net.Conn
+	devid uint32
+
+	wlock sync.Mutex // held while writing to conn
+
+	lock    sync.Mutex
+	gone    chan struct{}
+	err     error
+	seqnum  uint32
+	pending map[uint32]*urb   // by seqnum
+	unlinks map[uint32]uint32 // the seqnum of each unlink's URB, by the unlink's own
+
+	device  []byte // raw descriptors, read on import
+	configs [][]byte
+	parsed  []usb.ConfigDescriptor
+
+	config  int
+	claimed map[byte]*handle
+	alts    map[byte]byte
+}
+
+// A submitted transfer
+type urb struct {
+	t      *usb.Transfer
+	timer  *time.Timer
+	reason *usb.UsbError // why it was unlinked, if it was
+}
+
+// Reports whether the device has been detached, by either end
+func (d *Device) Detached() bool {
+	select {
+	case <-d.gone:
+		return true
+	default:
+		return false
+	}
+}
+
+// Why the connection to the server ended: nil if the device was
+// detached here or is still attached
+func (d *Device) Err() error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return d.err
+}
+
+// Drop the connection and fail whatever is still in flight
+func (d *Device) shutdown(err error) {
+	d.lock.Lock()
+	select {
+	case <-d.gone:
+		d.lock.Unlock()
+		return
+	default:
+	}
+	close(d.gone)
+	d.err = err
+	pending := d.pending
+	d.pending = make(map[uint32]*urb)
+	d.lock.Unlock()
+
+	d.conn.Close()
+	for _, u := range pending {
+		if u.timer != nil {
+			u.timer.Stop()
+		}
+		u.t.Complete(0, usb.UsbErrorNoDevice)
+	}
+}
+
+func (d *Device) send(buf []byte) *usb.UsbError {
+	d.wlock.Lock()
+	defer d.wlock.Unlock()
+	if d.Detached() {
+		return usb.UsbErrorNoDevice
+	}
+	if _, err := d.conn.Write(buf); err != nil {
+		go d.shutdown(err)
+		return usb.UsbErrorIO
+	}
+	return nil
+}
+
+// Read the device's descriptors through the connection, as the host
+// it is attached to would
+func (d *Device) readDescriptors() error {
+	h := &handle{d: d}
+	get := func(dtype usb.DescriptorType, index, length int) ([]byte, *usb.UsbError) {
+		buf := make([]byte, length)
+		n, err := h.control(usb.SetupPacket{
+			BmRequestType: usb.DIR_IN | usb.REQUEST_TYPE_STANDARD | usb.RECIPIENT_DEVICE,
+			BRequest:      usb.REQUEST_GET_DESCRIPTOR,
+			WValue:        uint16(dtype)<<8 | uint16(index),
+		}, buf)
+		return buf[:n], err
+	}
+
+	raw, err := get(usb.DT_DEVICE, 0, 18)
+	if err != nil {
+		return err
+	}
+	desc, err := usb.ParseDeviceDescriptor(raw)
+	if err != nil {
+		return err
+	}
+	d.device = raw
+	for i := 0; i < int(desc.BNumConfigurations); i++ {
+		head, err := get(usb.DT_CONFIG, i, 9)
+		if err != nil {
+			return err
+		}
+		if len(head) < 4 {
+			return usb.UsbErrorBadDescriptor
+		}
+		raw, err := get(usb.DT_CONFIG, i, int(head[2])|int(head[3])<<8)
+		if err != nil {
+			return err
+		}
+		cfg, err := usb.ParseConfigDescriptor(raw)
+		if err != nil {
+			return err
+		}
+		d.configs = append(d.configs, raw)
+		d.parsed = append(d.parsed, cfg)
+	}
+	return nil
+}
+
+// Find a configuration by its bConfigurationValue
+func (d *Device) findConfig(value int) (int, bool) {
+	for i, cfg := range d.parsed {
+		if cfg.BConfigurationValue == value {
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+// The interval to submit a periodic transfer with, in the kernel's
+// units: frames for interrupt endpoints below high speed, otherwise
+// (micro)frames from the exponent in bInterval. Call with the lock
+// held.
+func (d *Device) interval(endpoint byte) int32 {
+	i, ok := d.findConfig(d.config)
+	if !ok {
+		return 1
+	}
+	for _, alts := range d.parsed[i].Interfaces {
+		for _, alt := range alts {
+			if len(alts) > 1 && alt.BAlternateSetting != d.alts[alt.BInterfaceNumber] {
+				continue
+			}
+			for _, ep := range alt.Endpoints {
+				if ep.BEndpointAddress != endpoint {
+					continue
+				}
+				b := int32(ep.BInterval)
+				if b < 1 {
+					b = 1
+				}
+				if d.Exported.Speed < usb.SPEED_HIGH && ep.BmAttributes&usb.TRANSFER_TYPE_MASK == usb.TRANSFER_TYPE_INTERRUPT {
+					return b
+				}
+				if b > 16 {
+					b = 16
+				}
+				return 1 << uint(b-1)
+			}
+		}
+	}
+	return 1
+}
+
+// Take the replies to submissions off the connection until it ends
+func (d *Device) receive(r *bufio.Reader) {
+	for {
+		cmd, err := ReadCommand(r)
+		if err == nil {
+			switch cmd := cmd.(type) {
+			case *RetSubmit:
+				err = d.retSubmit(r, cmd)
+			case *RetUnlink:
+				d.retUnlink(cmd)
+			default:
+				err = ErrProtocol
+			}
+		}
+		if err != nil {
+			select {
+			case <-d.gone:
+				// Detached here, so the connection was closed
+				// under us
+				err = nil
+			default:
+			}
+			d.shutdown(err)
+			return
+		}
+	}
+}
+
+func (d *Device) retSubmit(r *bufio.Reader, ret *RetSubmit) error {
+	d.lock.Lock()
+	u, ok := d.pending[ret.Seqnum]
+	delete(d.pending, ret.Seqnum)
+	d.lock.Unlock()
+	if !ok {
+		// What follows can't be told without the submission
+		return ErrProtocol
+	}
+	if u.timer != nil {
+		u.timer.Stop()
+	}
+	t := u.t
+	iso := t.Type == usb.TRANSFER_TYPE_ISOCHRONOUS
+
+	actual := int(ret.ActualLength)
+	if actual < 0 || actual > len(t.Buffer) {
+		t.Complete(0, usb.UsbErrorIO)
+		return ErrProtocol
+	}
+	var data []byte
+	if t.In() {
+		data = t.Buffer[:actual]
+		if iso {
+			data = make([]byte, actual)
+		}
+		if _, err := io.ReadFull(r, data); err != nil {
+			t.Complete(0, usb.UsbErrorIO)
+			return err
+		}
+	}
+	if iso && ret.NumberOfPackets > 0 {
+		descs, err := ReadIsoDescriptors(r, int(ret.NumberOfPackets))
+		if err != nil || len(descs) != len(t.IsoPackets) {
+			t.Complete(0, usb.UsbErrorIO)
+			return ErrProtocol
+		}
+		offset := 0
+		for i := range t.IsoPackets {
+			pkt := &t.IsoPackets[i]
+			pkt.Actual = int(descs[i].ActualLength)
+			pkt.Status = usbmon.ErrorOf(int(descs[i].Status))
+			if t.In() {
+				// Put each packet back in its own slot
+				if pkt.Actual > pkt.Length || pkt.Actual > len(data) {
+					t.Complete(0, usb.UsbErrorIO)
+					return ErrProtocol
+				}
+				copy(t.Buffer[offset:], data[:pkt.Actual])
+				data = data[pkt.Actual:]
+			}
+			offset += pkt.Length
+		}
+	}
+
+	status := usbmon.ErrorOf(int(ret.Status))
+	if u.reason != nil && status == usb.UsbErrorCancelled {
+		status = u.reason
+	}
+	t.Complete(actual, status)
+	return nil
+}
+
+func (d *Device) retUnlink(ret *RetUnlink) {
+	d.lock.Lock()
+	seqnum, ok := d.unlinks[ret.Seqnum]
+	delete(d.unlinks, ret.Seqnum)
+	var u *urb
+	if ok && ret.Status != 0 {
+		// Cancelled, so there will be no RET_SUBMIT
+		u = d.pending[seqnum]
+		delete(d.pending, seqnum)
+	}
+	d.lock.Unlock()
+	if u != nil {
+		if u.timer != nil {
+			u.timer.Stop()
+		}
+		u.t.Complete(0, u.reason)
+	}
+}
+
+// Ask the server to cancel a URB, which then ends with reason
+func (d *Device) unlink(seqnum uint32, reason *usb.UsbError) *usb.UsbError {
+	d.lock.Lock()
+	u, ok := d.pending[seqnum]
+	if !ok || u.reason != nil {
+		d.lock.Unlock()
+		return nil
+	}
+	u.reason = reason
+	d.seqnum++
+	cmd := &CmdUnlink{
+		Header:       Header{Command: CMD_UNLINK, Seqnum: d.seqnum, DevID: d.devid},
+		UnlinkSeqnum: seqnum,
+	}
+	d.unlinks[cmd.Seqnum] = seqnum
+	d.lock.Unlock()
+	return d.send(cmd.Append(nil))
+}
+
+// The Device seen through the usb.BackendDevice interface, so that
+// its methods don't clutter Device
+type backendDevice struct {
+	d *Device
+}
+
+func (bd *backendDevice) GetBusNumber() int {
+	return bd.d.Exported.Bus
+}
+
+func (bd *backendDevice) GetAddress() int {
+	return bd.d.Exported.Device
+}
+
+func (bd *backendDevice) GetSpeed() usb.Speed {
+	return bd.d.Exported.Speed
+}
+
+func (bd *backendDevice) GetDeviceDescriptor() (usb.DeviceDescriptor, *usb.UsbError) {
+	return usb.ParseDeviceDescriptor(bd.d.device)
+}
+
+func (bd *backendDevice) GetConfigDescriptor(config_index int) (usb.ConfigDescriptor, *usb.UsbError) {
+	if config_index < 0 || config_index >= len(bd.d.configs) {
+		return usb.ConfigDescriptor{}, usb.UsbErrorNotFound
+	}
+	return usb.ParseConfigDescriptor(bd.d.configs[config_index])
+}
+
+func (bd *backendDevice) GetActiveConfigDescriptor() (usb.ConfigDescriptor, *usb.UsbError) {
+	bd.d.lock.Lock()
+	i, ok := bd.d.findConfig(bd.d.config)
+	bd.d.lock.Unlock()
+	if !ok {
+		return usb.ConfigDescriptor{}, usb.UsbErrorNotFound
+	}
+	return usb.ParseConfigDescriptor(bd.d.configs[i])
+}
+
+func (bd *backendDevice) Open() (usb.BackendHandle, *usb.UsbError) {
+	if bd.d.Detached() {
+		return nil, usb.UsbErrorNoDevice
+	}
+	return &handle{d: bd.d}, nil
+}
+
+//////////////////////// Handles
+
+// An open imported device. The server has the whole device, so claims
+// are only kept track of here, and no kernel drivers are in the way.
+type handle struct {
+	d      *Device
+	lock   sync.Mutex
+	closed bool
+}
+
+// Check that the handle can still be used
+func (h *handle) check() *usb.UsbError {
+	h.lock.Lock()
+	closed := h.closed
+	h.lock.Unlock()
+	if closed || h.d.Detached() {
+		return usb.UsbErrorNoDevice
+	}
+	return nil
+}
+
+func (h *handle) Close() {
+	h.lock.Lock()
+	h.closed = true
+	h.lock.Unlock()
+	h.d.lock.Lock()
+	for iface, owner := range h.d.claimed {
+		if owner == h {
+			delete(h.d.claimed, iface)
+		}
+	}
+	h.d.lock.Unlock()
+}
+
+// Make a control request and wait for it
+func (h *handle) control(setup usb.SetupPacket, data []byte) (int, *usb.UsbError) {
+	t := &usb.Transfer{
+		Type:    usb.TRANSFER_TYPE_CONTROL,
+		Setup:   setup,
+		Buffer:  data,
+		Timeout: controlTimeout,
+	}
+	if err := usb.SubmitTo(h, t); err != nil {
+		return 0, err
+	}
+	err := t.Wait()
+	return t.Actual, err
+}
+
+func (h *handle) GetConfiguration() (int, *usb.UsbError) {
+	if err := h.check(); err != nil {
+		return 0, err
+	}
+	h.d.lock.Lock()
+	defer h.d.lock.Unlock()
+	return h.d.config, nil
+}
+
+func (h *handle) SetConfiguration(config int) *usb.UsbError {
+	if err := h.check(); err != nil {
+		return err
+	}
+	d := h.d
+	if config < 0 {
+		config = 0
+	}
+	d.lock.Lock()
+	_, ok := d.findConfig(config)
+	busy := len(d.claimed) > 0
+	d.lock.Unlock()
+	if !ok && config != 0 {
+		return usb.UsbErrorNotFound
+	}
+	if busy {
+		return usb.UsbErrorBusy
+	}
+	_, err := h.control(usb.SetupPacket{
+		BmRequestType: usb.DIR_OUT | usb.REQUEST_TYPE_STANDARD | usb.RECIPIENT_DEVICE,
+		BRequest:      usb.REQUEST_SET_CONFIGURATION,
+		WValue:        uint16(config),
+	}, nil)
+	if err != nil {
+		return err
+	}
+	d.lock.Lock()
+	d.config = config
+	d.alts = make(map[byte]byte)
+	d.lock.Unlock()
+	return nil
+}
+
+func (h *handle) ClaimInterface(iface_no int) *usb.UsbError {
+	if err := h.check(); err != nil {
+		return err
+	}
+	d := h.d
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	i, ok := d.findConfig(d.config)
+	if !ok || !hasInterface(d.parsed[i], byte(iface_no)) {
+		return usb.UsbErrorNotFound
+	}
+	if owner, ok := d.claimed[byte(iface_no)]; ok && owner != h {
+		return usb.UsbErrorBusy
+	}
+	d.claimed[byte(iface_no)] = h
+	return nil
+}
+
+func hasInterface(cfg usb.ConfigDescriptor, iface_no byte) bool {
+	for _, alts := range cfg.Interfaces {
+		if len(alts) > 0 && alts[0].BInterfaceNumber == iface_no {
+			return true
+		}
+	}
+	return false
+}
+
+func (h *handle) ReleaseInterface(iface_no int) *usb.UsbError {
+	if err := h.check(); err != nil {
+		return err
+	}
+	d := h.d
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if d.claimed[byte(iface_no)] != h {
+		return usb.UsbErrorNotFound
+	}
+	delete(d.claimed, byte(iface_no))
+	return nil
+}
+
+func (h *handle) SetInterfaceAltSetting(iface_no, alt int) *usb.UsbError {
+	if err := h.check(); err != nil {
+		return err
+	}
+	d := h.d
+	d.lock.Lock()
+	claimed := d.claimed[byte(iface_no)] == h
+	d.lock.Unlock()
+	if !claimed {
+		return usb.UsbErrorNotFound
+	}
+	_, err := h.control(usb.SetupPacket{
+		BmRequestType: usb.DIR_OUT | usb.REQUEST_TYPE_STANDARD | usb.RECIPIENT_INTERFACE,
+		BRequest:      usb.REQUEST_SET_INTERFACE,
+		WValue:        uint16(alt),
+		WIndex:        uint16(iface_no),
+	}, nil)
+	if err != nil {
+		return err
+	}
+	d.lock.Lock()
+	d.alts[byte(iface_no)] = byte(alt)
+	d.lock.Unlock()
+	return nil
+}
+
+// Drivers on the server are the server's business
+func (h *handle) KernelDriverActive(iface_no int) (bool, *usb.UsbError) {
+	if err := h.check(); err != nil {
+		return false, err
+	}
+	return false, nil
+}
+
+func (h *handle) AttachKernelDriver(iface_no int) *usb.UsbError {
+	return usb.UsbErrorNotSupported
+}
+
+func (h *handle) DetachKernelDriver(iface_no int) *usb.UsbError {
+	if err := h.check(); err != nil {
+		return err
+	}
+	return usb.UsbErrorNotFound
+}
+
+func (h *handle) ClearHalt(endpoint byte) *usb.UsbError {
+	if err := h.check(); err != nil {
+		return err
+	}
+	_, err := h.control(usb.SetupPacket{
+		BmRequestType: usb.DIR_OUT | usb.REQUEST_TYPE_STANDARD | usb.RECIPIENT_ENDPOINT,
+		BRequest:      usb.REQUEST_CLEAR_FEATURE,
+		WValue:        0, // ENDPOINT_HALT
+		WIndex:        uint16(endpoint),
+	}, nil)
+	return err
+}
+
+// Linux's server resets the device when it sees the hub request to
+// reset a port, whichever port it names
+func (h *handle) Reset() *usb.UsbError {
+	if err := h.check(); err != nil {
+		return err
+	}
+	_, err := h.control(usb.SetupPacket{
+		BmRequestType: usb.DIR_OUT | usb.REQUEST_TYPE_CLASS | usb.RECIPIENT_OTHER,
+		BRequest:      usb.REQUEST_SET_FEATURE,
+		WValue:        4, // PORT_RESET
+	}, nil)
+	return err
+}
+
+//////////////////////// Transfers
+
+func (h *handle) SubmitTransfer(t *usb.Transfer) *usb.UsbError {
+	if err := h.check(); err != nil {
+		return err
+	}
+	d := h.d
+	cmd := &CmdSubmit{
+		Header: Header{
+			Command:  CMD_SUBMIT,
+			DevID:    d.devid,
+			Endpoint: uint32(t.Endpoint &^ usb.DIR_MASK),
+		},
+		TransferBufferLength: int32(len(t.Buffer)),
+	}
+	if t.In() {
+		cmd.Direction = DIR_IN
+		cmd.TransferFlags |= URB_DIR_IN
+	}
+	var descs []IsoPacketDescriptor
+	switch t.Type {
+	case usb.TRANSFER_TYPE_CONTROL:
+		cmd.Setup = t.Setup
+	case usb.TRANSFER_TYPE_ISOCHRONOUS:
+		cmd.TransferFlags |= URB_ISO_ASAP
+		cmd.NumberOfPackets = int32(len(t.IsoPackets))
+		offset := 0
+		for _, pkt := range t.IsoPackets {
+			descs = append(descs, IsoPacketDescriptor{Offset: uint32(offset), Length: uint32(pkt.Length)})
+			offset += pkt.Length
+		}
+	}
+
+	u := &urb{t: t}
+	d.lock.Lock()
+	if t.Type == usb.TRANSFER_TYPE_INTERRUPT || t.Type == usb.TRANSFER_TYPE_ISOCHRONOUS {
+		cmd.Interval = d.interval(t.Endpoint)
+	}
+	d.seqnum++
+	cmd.Seqnum = d.seqnum
+	d.pending[cmd.Seqnum] = u
+	if t.Timeout > 0 {
+		seqnum := cmd.Seqnum
+		u.timer = time.AfterFunc(t.Timeout, func() { d.unlink(seqnum, usb.UsbErrorTimeout) })
+	}
+	d.lock.Unlock()
+
+	buf := cmd.Append(nil)
+	if !t.In() {
+		buf = append(buf, t.Buffer...)
+	}
+	buf = AppendIsoDescriptors(buf, descs)
+	if err := d.send(buf); err != nil {
+		d.lock.Lock()
+		_, ok := d.pending[cmd.Seqnum]
+		delete(d.pending, cmd.Seqnum)
+		d.lock.Unlock()
+		if !ok {
+			// Failed along with the connection, so it has been
+			// completed already
+			return nil
+		}
+		if u.timer != nil {
+			u.timer.Stop()
+		}
+		return err
+	}
+	return nil
+}
+
+func (h *handle) CancelTransfer(t *usb.Transfer) *usb.UsbError {
+	d := h.d
+	d.lock.Lock()
+	seqnum, found := uint32(0), false
+	for s, u := range d.pending {
+		if u.t == t {
+			seqnum, found = s, true
+			break
+		}
+	}
+	d.lock.Unlock()
+	if !found {
+		return usb.UsbErrorNotFound
+	}
+	return d.unlink(seqnum, usb.UsbErrorCancelled)
+}
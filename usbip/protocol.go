@@ -0,0 +1,423 @@
+// USB/IP, the protocol Linux's usbip tools use to share USB devices
+// over TCP, without the kernel's vhci-hcd on the importing side. A
+// Backend attaches devices exported by a usbipd server and makes them
+// usable through the usual Context, DeviceHandle and EndpointHandle:
+//
+//	devs, _ := usbip.ListDevices("lab-rack:3240")
+//	b := usbip.NewBackend()
+//	_, err := b.Attach("lab-rack:3240", devs[0].BusID)
+//	ctx := usb.NewContext(b)
+//
+// A Server does the reverse, exporting devices found through gousb to
+// any USB/IP client. The messages of the protocol are exported here as
+// well, for tests that stand in for either end.
+package usbip
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+
+	"gopkg.thequux.com/usb"
+)
+
+var (
+	ErrProtocol = errors.New("usbip: protocol error")
+	ErrNoDevice = errors.New("usbip: no such device exported")
+	ErrBusy     = errors.New("usbip: device already in use")
+	ErrRefused  = errors.New("usbip: import refused")
+)
+
+// The port usbipd listens on
+const PORT = 3240
+
+// The protocol version, which both ends have to agree on
+const VERSION = 0x0111
+
+// Operations, which are exchanged before a device is imported
+const (
+	OP_REQ_DEVLIST = 0x8005
+	OP_REP_DEVLIST = 0x0005
+	OP_REQ_IMPORT  = 0x8003
+	OP_REP_IMPORT  = 0x0003
+)
+
+// Operation statuses
+const (
+	ST_OK       = 0
+	ST_NA       = 1 // not available
+	ST_DEV_BUSY = 2
+	ST_DEV_ERR  = 3
+	ST_NODEV    = 4
+	ST_ERROR    = 5
+)
+
+// Commands, which carry URBs once a device has been imported
+const (
+	CMD_SUBMIT = 1
+	CMD_UNLINK = 2
+	RET_SUBMIT = 3
+	RET_UNLINK = 4
+)
+
+// The direction of a command
+const (
+	DIR_OUT = 0
+	DIR_IN  = 1
+)
+
+// The URB transfer flags that matter over USB/IP
+const (
+	URB_SHORT_NOT_OK = 0x0001
+	URB_ISO_ASAP     = 0x0002
+	URB_ZERO_PACKET  = 0x0040
+	URB_DIR_IN       = 0x0200
+)
+
+// Every command is this long, before its data and isochronous
+// descriptors
+const COMMAND_LEN = 48
+
+// The length of an exported device on the wire, without its interfaces
+const DEVICE_LEN = 312
+
+const ISO_DESCRIPTOR_LEN = 16
+
+// Linux takes no more isochronous packets than this in one URB
+const MAX_ISO_PACKETS = 1024
+
+// Everything is in network byte order but the setup packet, which is
+// as on the bus
+var be = binary.BigEndian
+
+// The header of an operation
+type OpHeader struct {
+	Version uint16
+	Code    uint16
+	Status  uint32
+}
+
+func (op OpHeader) Append(buf []byte) []byte {
+	buf = be.AppendUint16(buf, op.Version)
+	buf = be.AppendUint16(buf, op.Code)
+	return be.AppendUint32(buf, op.Status)
+}
+
+func ReadOpHeader(r io.Reader) (OpHeader, error) {
+	var buf [8]byte
+	if _, err := io.ReadFull(r, buf[:]); err != nil {
+		return OpHeader{}, err
+	}
+	return OpHeader{
+		Version: be.Uint16(buf[0:]),
+		Code:    be.Uint16(buf[2:]),
+		Status:  be.Uint32(buf[4:]),
+	}, nil
+}
+
+// A device as a server lists it
+type ExportedDevice struct {
+	Path   string // in the server's sysfs
+	BusID  string // what to import it by, e.g. 1-1.2
+	Bus    int
+	Device int
+	Speed  usb.Speed
+
+	IdVendor, IdProduct uint16
+	BcdDevice           uint16
+	BDeviceClass        usb.ClassCode
+	BDeviceSubClass     byte
+	BDeviceProtocol     byte
+	BConfigurationValue byte
+	BNumConfigurations  byte
+	BNumInterfaces      byte
+
+	// Only in device lists, not import replies
+	Interfaces []ExportedInterface
+}
+
+// An interface of the active configuration of an exported device
+type ExportedInterface struct {
+	BInterfaceClass    usb.ClassCode
+	BInterfaceSubClass byte
+	BInterfaceProtocol byte
+}
+
+// The kernel's enum usb_device_speed, by usb.Speed; wireless USB,
+// which is 4, counts as high speed
+var wireSpeeds = map[usb.Speed]uint32{
+	usb.SPEED_UNKNOWN:    0,
+	usb.SPEED_LOW:        1,
+	usb.SPEED_FULL:       2,
+	usb.SPEED_HIGH:       3,
+	usb.SPEED_SUPER:      5,
+	usb.SPEED_SUPER_PLUS: 6,
+}
+
+func speedFromWire(v uint32) usb.Speed {
+	if v == 4 {
+		return usb.SPEED_HIGH
+	}
+	for speed, w := range wireSpeeds {
+		if w == v {
+			return speed
+		}
+	}
+	return usb.SPEED_UNKNOWN
+}
+
+// Append the device, and its interfaces if withInterfaces is set, as
+// in a device list
+func (d *ExportedDevice) Append(buf []byte, withInterfaces bool) []byte {
+	var path [256]byte
+	var busid [32]byte
+	copy(path[:len(path)-1], d.Path)
+	copy(busid[:len(busid)-1], d.BusID)
+	buf = append(buf, path[:]...)
+	buf = append(buf, busid[:]...)
+	buf = be.AppendUint32(buf, uint32(d.Bus))
+	buf = be.AppendUint32(buf, uint32(d.Device))
+	buf = be.AppendUint32(buf, wireSpeeds[d.Speed])
+	buf = be.AppendUint16(buf, d.IdVendor)
+	buf = be.AppendUint16(buf, d.IdProduct)
+	buf = be.AppendUint16(buf, d.BcdDevice)
+	buf = append(buf, byte(d.BDeviceClass), d.BDeviceSubClass, d.BDeviceProtocol,
+		d.BConfigurationValue, d.BNumConfigurations, d.BNumInterfaces)
+	if withInterfaces {
+		for _, iface := range d.Interfaces {
+			buf = append(buf, byte(iface.BInterfaceClass), iface.BInterfaceSubClass, iface.BInterfaceProtocol, 0)
+		}
+	}
+	return buf
+}
+
+// Read a device, and its BNumInterfaces interfaces if withInterfaces
+// is set
+func ReadExportedDevice(r io.Reader, withInterfaces bool) (*ExportedDevice, error) {
+	buf := make([]byte, DEVICE_LEN)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, err
+	}
+	cstring := func(b []byte) string {
+		if i := bytes.IndexByte(b, 0); i >= 0 {
+			b = b[:i]
+		}
+		return string(b)
+	}
+	d := &ExportedDevice{
+		Path:                cstring(buf[0:256]),
+		BusID:               cstring(buf[256:288]),
+		Bus:                 int(be.Uint32(buf[288:])),
+		Device:              int(be.Uint32(buf[292:])),
+		Speed:               speedFromWire(be.Uint32(buf[296:])),
+		IdVendor:            be.Uint16(buf[300:]),
+		IdProduct:           be.Uint16(buf[302:]),
+		BcdDevice:           be.Uint16(buf[304:]),
+		BDeviceClass:        usb.ClassCode(buf[306]),
+		BDeviceSubClass:     buf[307],
+		BDeviceProtocol:     buf[308],
+		BConfigurationValue: buf[309],
+		BNumConfigurations:  buf[310],
+		BNumInterfaces:      buf[311],
+	}
+	if withInterfaces {
+		ifaces := make([]byte, 4*int(d.BNumInterfaces))
+		if _, err := io.ReadFull(r, ifaces); err != nil {
+			return nil, err
+		}
+		for i := 0; i < len(ifaces); i += 4 {
+			d.Interfaces = append(d.Interfaces, ExportedInterface{
+				BInterfaceClass:    usb.ClassCode(ifaces[i]),
+				BInterfaceSubClass: ifaces[i+1],
+				BInterfaceProtocol: ifaces[i+2],
+			})
+		}
+	}
+	return d, nil
+}
+
+// What every command starts with. DevID is the bus number in the top
+// 16 bits and the device number in the bottom; Endpoint is the number
+// alone, with the direction in Direction. Replies from Linux leave
+// all but Command and Seqnum 0.
+type Header struct {
+	Command   uint32
+	Seqnum    uint32
+	DevID     uint32
+	Direction uint32
+	Endpoint  uint32
+}
+
+func (h *Header) append(buf []byte) []byte {
+	buf = be.AppendUint32(buf, h.Command)
+	buf = be.AppendUint32(buf, h.Seqnum)
+	buf = be.AppendUint32(buf, h.DevID)
+	buf = be.AppendUint32(buf, h.Direction)
+	return be.AppendUint32(buf, h.Endpoint)
+}
+
+// Submit a URB. OUT data follows, TransferBufferLength bytes of it,
+// then NumberOfPackets isochronous descriptors.
+type CmdSubmit struct {
+	Header
+	TransferFlags        uint32
+	TransferBufferLength int32
+	StartFrame           int32
+	NumberOfPackets      int32 // 0, or -1 from some clients, if not isochronous
+	Interval             int32
+	Setup                usb.SetupPacket
+}
+
+func (c *CmdSubmit) Append(buf []byte) []byte {
+	buf = c.Header.append(buf)
+	buf = be.AppendUint32(buf, c.TransferFlags)
+	buf = be.AppendUint32(buf, uint32(c.TransferBufferLength))
+	buf = be.AppendUint32(buf, uint32(c.StartFrame))
+	buf = be.AppendUint32(buf, uint32(c.NumberOfPackets))
+	buf = be.AppendUint32(buf, uint32(c.Interval))
+	buf = append(buf, c.Setup.BmRequestType, c.Setup.BRequest)
+	buf = binary.LittleEndian.AppendUint16(buf, c.Setup.WValue)
+	buf = binary.LittleEndian.AppendUint16(buf, c.Setup.WIndex)
+	return binary.LittleEndian.AppendUint16(buf, c.Setup.WLength)
+}
+
+// The outcome of a URB. IN data follows, ActualLength bytes of it,
+// then NumberOfPackets isochronous descriptors. For isochronous IN
+// transfers the data of the packets is packed together, without the
+// gaps the descriptors' offsets leave.
+type RetSubmit struct {
+	Header
+	Status          int32 // negative errno
+	ActualLength    int32
+	StartFrame      int32
+	NumberOfPackets int32
+	ErrorCount      int32
+}
+
+func (c *RetSubmit) Append(buf []byte) []byte {
+	buf = c.Header.append(buf)
+	buf = be.AppendUint32(buf, uint32(c.Status))
+	buf = be.AppendUint32(buf, uint32(c.ActualLength))
+	buf = be.AppendUint32(buf, uint32(c.StartFrame))
+	buf = be.AppendUint32(buf, uint32(c.NumberOfPackets))
+	buf = be.AppendUint32(buf, uint32(c.ErrorCount))
+	return append(buf, make([]byte, 8)...)
+}
+
+// Ask for the URB submitted as UnlinkSeqnum to be cancelled. If it
+// is, it gets no RET_SUBMIT.
+type CmdUnlink struct {
+	Header
+	UnlinkSeqnum uint32
+}
+
+func (c *CmdUnlink) Append(buf []byte) []byte {
+	buf = c.Header.append(buf)
+	buf = be.AppendUint32(buf, c.UnlinkSeqnum)
+	return append(buf, make([]byte, 24)...)
+}
+
+// The outcome of an unlink: -ECONNRESET if the URB was cancelled, 0
+// if it had already completed
+type RetUnlink struct {
+	Header
+	Status int32
+}
+
+func (c *RetUnlink) Append(buf []byte) []byte {
+	buf = c.Header.append(buf)
+	buf = be.AppendUint32(buf, uint32(c.Status))
+	return append(buf, make([]byte, 24)...)
+}
+
+// Read one command, without what follows it: a *CmdSubmit,
+// *RetSubmit, *CmdUnlink or *RetUnlink
+func ReadCommand(r io.Reader) (interface{}, error) {
+	buf := make([]byte, COMMAND_LEN)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, err
+	}
+	h := Header{
+		Command:   be.Uint32(buf[0:]),
+		Seqnum:    be.Uint32(buf[4:]),
+		DevID:     be.Uint32(buf[8:]),
+		Direction: be.Uint32(buf[12:]),
+		Endpoint:  be.Uint32(buf[16:]),
+	}
+	i32 := func(off int) int32 { return int32(be.Uint32(buf[off:])) }
+	switch h.Command {
+	case CMD_SUBMIT:
+		return &CmdSubmit{
+			Header:               h,
+			TransferFlags:        be.Uint32(buf[20:]),
+			TransferBufferLength: i32(24),
+			StartFrame:           i32(28),
+			NumberOfPackets:      i32(32),
+			Interval:             i32(36),
+			Setup: usb.SetupPacket{
+				BmRequestType: buf[40],
+				BRequest:      buf[41],
+				WValue:        binary.LittleEndian.Uint16(buf[42:]),
+				WIndex:        binary.LittleEndian.Uint16(buf[44:]),
+				WLength:       binary.LittleEndian.Uint16(buf[46:]),
+			},
+		}, nil
+	case RET_SUBMIT:
+		return &RetSubmit{
+			Header:          h,
+			Status:          i32(20),
+			ActualLength:    i32(24),
+			StartFrame:      i32(28),
+			NumberOfPackets: i32(32),
+			ErrorCount:      i32(36),
+		}, nil
+	case CMD_UNLINK:
+		return &CmdUnlink{Header: h, UnlinkSeqnum: be.Uint32(buf[20:])}, nil
+	case RET_UNLINK:
+		return &RetUnlink{Header: h, Status: i32(20)}, nil
+	}
+	return nil, ErrProtocol
+}
+
+// One packet of an isochronous URB
+type IsoPacketDescriptor struct {
+	Offset       uint32 // into the transfer buffer
+	Length       uint32
+	ActualLength uint32
+	Status       int32
+}
+
+func AppendIsoDescriptors(buf []byte, descs []IsoPacketDescriptor) []byte {
+	for _, d := range descs {
+		buf = be.AppendUint32(buf, d.Offset)
+		buf = be.AppendUint32(buf, d.Length)
+		buf = be.AppendUint32(buf, d.ActualLength)
+		buf = be.AppendUint32(buf, uint32(d.Status))
+	}
+	return buf
+}
+
+func ReadIsoDescriptors(r io.Reader, n int) ([]IsoPacketDescriptor, error) {
+	if n <= 0 {
+		return nil, nil
+	}
+	if n > MAX_ISO_PACKETS {
+		return nil, ErrProtocol
+	}
+	buf := make([]byte, n*ISO_DESCRIPTOR_LEN)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, err
+	}
+	descs := make([]IsoPacketDescriptor, n)
+	for i := range descs {
+		b := buf[i*ISO_DESCRIPTOR_LEN:]
+		descs[i] = IsoPacketDescriptor{
+			Offset:       be.Uint32(b[0:]),
+			Length:       be.Uint32(b[4:]),
+			ActualLength: be.Uint32(b[8:]),
+			Status:       int32(be.Uint32(b[12:])),
+		}
+	}
+	return descs, nil
+}
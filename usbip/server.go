@@ -0,0 +1,667 @@
+package usbip
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"gopkg.thequux.com/usb"
+	"gopkg.thequux.com/usb/usbmon"
+)
+
+// The most a client may ask to move in one URB
+const maxTransfer = 1 << 24
+
+// A USB/IP server that exports devices found through gousb, so that
+// Linux's usbip attach, or a Backend here, can use them over the
+// network:
+//
+//	s := usbip.NewServer()
+//	s.Export("1-1", dev)
+//	l, _ := net.Listen("tcp", ":3240")
+//	s.Serve(l)
+//
+// A device is opened when a client imports it, and its kernel drivers
+// are detached for as long as the client has it. If the device goes
+// away, the client is disconnected and the device is no longer
+// exported.
+type Server struct {
+	// How often an imported device is checked for, so that one
+	// unplugged while nothing is in flight is noticed too; a second
+	// unless changed before serving
+	PollInterval time.Duration
+
+	lock      sync.Mutex
+	exports   map[string]*export // by bus ID
+	listeners []net.Listener
+	conns     map[net.Conn]bool
+	closed    bool
+}
+
+type export struct {
+	busid string
+	dev   *usb.Device
+	inUse bool
+}
+
+func NewServer() *Server {
+	return &Server{
+		PollInterval: time.Second,
+		exports:      make(map[string]*export),
+		conns:        make(map[net.Conn]bool),
+	}
+}
+
+// Offer a device to clients under the given bus ID, which is any name
+// of up to 31 bytes
+func (s *Server) Export(busid string, dev *usb.Device) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.exports[busid] = &export{busid: busid, dev: dev}
+}
+
+// Stop offering a device. A client that has it already keeps it.
+func (s *Server) Unexport(busid string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	delete(s.exports, busid)
+}
+
+// Accept clients until the listener fails or the server is closed
+func (s *Server) Serve(l net.Listener) error {
+	s.lock.Lock()
+	if s.closed {
+		s.lock.Unlock()
+		return net.ErrClosed
+	}
+	s.listeners = append(s.listeners, l)
+	s.lock.Unlock()
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go s.ServeConn(conn)
+	}
+}
+
+// Close the listeners and disconnect every client
+func (s *Server) Close() {
+	s.lock.Lock()
+	s.closed = true
+	listeners, conns := s.listeners, s.conns
+	s.listeners, s.conns = nil, make(map[net.Conn]bool)
+	s.lock.Unlock()
+	for _, l := range listeners {
+		l.Close()
+	}
+	for conn := range conns {
+		conn.Close()
+	}
+}
+
+// Answer one request on a connection; an import keeps it until the
+// client lets the device go. The connection is closed afterwards.
+func (s *Server) ServeConn(conn net.Conn) {
+	defer conn.Close()
+	s.lock.Lock()
+	if s.closed {
+		s.lock.Unlock()
+		return
+	}
+	s.conns[conn] = true
+	s.lock.Unlock()
+	defer func() {
+		s.lock.Lock()
+		delete(s.conns, conn)
+		s.lock.Unlock()
+	}()
+
+	op, err := ReadOpHeader(conn)
+	if err != nil || op.Version != VERSION {
+		return
+	}
+	switch op.Code {
+	case OP_REQ_DEVLIST:
+		s.devlist(conn)
+	case OP_REQ_IMPORT:
+		var id [32]byte
+		if _, err := io.ReadFull(conn, id[:]); err != nil {
+			return
+		}
+		busid := string(id[:])
+		for i, c := range id {
+			if c == 0 {
+				busid = string(id[:i])
+				break
+			}
+		}
+		if ss := s.attach(conn, busid); ss != nil {
+			ss.run()
+		}
+	}
+}
+
+func (s *Server) devlist(conn net.Conn) {
+	s.lock.Lock()
+	var devs []*ExportedDevice
+	for _, e := range s.exports {
+		if e.inUse {
+			continue
+		}
+		if d, err := describe(e.busid, e.dev); err == nil {
+			devs = append(devs, d)
+		}
+	}
+	s.lock.Unlock()
+
+	buf := OpHeader{VERSION, OP_REP_DEVLIST, ST_OK}.Append(nil)
+	buf = be.AppendUint32(buf, uint32(len(devs)))
+	for _, d := range devs {
+		buf = d.Append(buf, true)
+	}
+	conn.Write(buf)
+}
+
+// A device as it is listed
+func describe(busid string, dev *usb.Device) (*ExportedDevice, *usb.UsbError) {
+	desc, err := dev.GetDeviceDescriptor()
+	if err != nil {
+		return nil, err
+	}
+	bus, addr := dev.GetDeviceAddress()
+	d := &ExportedDevice{
+		Path:               busid,
+		BusID:              busid,
+		Bus:                bus,
+		Device:             addr,
+		Speed:              dev.GetSpeed(),
+		IdVendor:           desc.IdVendor,
+		IdProduct:          desc.IdProduct,
+		BcdDevice:          desc.BcdDevice,
+		BDeviceClass:       desc.BDeviceClass,
+		BDeviceSubClass:    desc.BDeviceSubClass,
+		BDeviceProtocol:    desc.BDeviceProtocol,
+		BNumConfigurations: desc.BNumConfigurations,
+	}
+	if cfg, err := dev.GetActiveConfigDescriptor(); err == nil {
+		d.BConfigurationValue = byte(cfg.BConfigurationValue)
+		d.BNumInterfaces = byte(len(cfg.Interfaces))
+		for _, alts := range cfg.Interfaces {
+			if len(alts) == 0 {
+				continue
+			}
+			d.Interfaces = append(d.Interfaces, ExportedInterface{
+				BInterfaceClass:    alts[0].BInterfaceClass,
+				BInterfaceSubClass: alts[0].BInterfaceSubClass,
+				BInterfaceProtocol: alts[0].BInterfaceProtocol,
+			})
+		}
+	}
+	return d, nil
+}
+
+// Open an exported device for a client and answer the import
+func (s *Server) attach(conn net.Conn, busid string) *session {
+	reply := func(status uint32, d *ExportedDevice) {
+		buf := OpHeader{VERSION, OP_REP_IMPORT, status}.Append(nil)
+		if d != nil {
+			buf = d.Append(buf, false)
+		}
+		conn.Write(buf)
+	}
+
+	s.lock.Lock()
+	e, ok := s.exports[busid]
+	switch {
+	case !ok:
+		s.lock.Unlock()
+		reply(ST_NODEV, nil)
+		return nil
+	case e.inUse:
+		s.lock.Unlock()
+		reply(ST_DEV_BUSY, nil)
+		return nil
+	}
+	e.inUse = true
+	s.lock.Unlock()
+
+	h, err := e.dev.Open()
+	if err != nil {
+		s.release(e, err)
+		reply(ST_DEV_ERR, nil)
+		return nil
+	}
+	ss := &session{
+		s:       s,
+		e:       e,
+		conn:    conn,
+		h:       h,
+		pending: make(map[uint32]*serverUrb),
+	}
+	ss.claim()
+	d, err := describe(busid, e.dev)
+	if err != nil {
+		ss.cleanup()
+		reply(ST_DEV_ERR, nil)
+		return nil
+	}
+	reply(ST_OK, d)
+	return ss
+}
+
+// Give a device back once a client is done with it, dropping it if it
+// went away
+func (s *Server) release(e *export, err *usb.UsbError) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	e.inUse = false
+	if err == usb.UsbErrorNoDevice && s.exports[e.busid] == e {
+		delete(s.exports, e.busid)
+	}
+}
+
+//////////////////////// Sessions
+
+// A client's use of an imported device
+type session struct {
+	s    *Server
+	e    *export
+	conn net.Conn
+	h    *usb.DeviceHandle
+
+	wlock sync.Mutex // held while writing to conn
+	rlock sync.Mutex // held while carrying out requests here
+
+	lock     sync.Mutex
+	pending  map[uint32]*serverUrb // by seqnum
+	wg       sync.WaitGroup
+	cfg      usb.ConfigDescriptor
+	alts     map[byte]byte
+	claimed  []byte
+	detached []byte // interfaces whose kernel drivers have to be put back
+	gone     bool   // the device went away
+}
+
+// A URB being carried out
+type serverUrb struct {
+	t            *usb.Transfer // nil for requests carried out here
+	descs        []IsoPacketDescriptor
+	unlinked     bool
+	unlinkSeqnum uint32
+}
+
+// Take the interfaces of the active configuration from the kernel and
+// claim them, so that any endpoint can be used. Interfaces that can't
+// be claimed are left alone; transfers to them fail.
+func (ss *session) claim() {
+	cfg, err := ss.h.GetDevice().GetActiveConfigDescriptor()
+	ss.lock.Lock()
+	defer ss.lock.Unlock()
+	ss.cfg = cfg
+	ss.alts = make(map[byte]byte)
+	if err != nil {
+		return
+	}
+	for _, alts := range cfg.Interfaces {
+		if len(alts) == 0 {
+			continue
+		}
+		iface := ss.h.GetInterface(alts[0].BInterfaceNumber)
+		if active, _ := iface.IsKernelDriverActive(); active {
+			if iface.DetachKernelDriver() == nil {
+				ss.detached = append(ss.detached, alts[0].BInterfaceNumber)
+			}
+		}
+		if iface.Claim() == nil {
+			ss.claimed = append(ss.claimed, alts[0].BInterfaceNumber)
+		}
+	}
+}
+
+// Release the claimed interfaces, and put back kernel drivers if all
+// is done
+func (ss *session) unclaim(reattach bool) {
+	ss.lock.Lock()
+	defer ss.lock.Unlock()
+	for _, n := range ss.claimed {
+		ss.h.GetInterface(n).Release()
+	}
+	ss.claimed = nil
+	if reattach {
+		for _, n := range ss.detached {
+			ss.h.GetInterface(n).AttachKernelDriver()
+		}
+		ss.detached = nil
+	}
+}
+
+func (ss *session) send(buf []byte) {
+	ss.wlock.Lock()
+	defer ss.wlock.Unlock()
+	ss.conn.Write(buf)
+}
+
+// Carry out URBs until the client goes away or the device does
+func (ss *session) run() {
+	stop, watched := make(chan struct{}), make(chan struct{})
+	go ss.watch(stop, watched)
+	r := bufio.NewReader(ss.conn)
+	for {
+		cmd, err := ReadCommand(r)
+		if err != nil {
+			break
+		}
+		switch cmd := cmd.(type) {
+		case *CmdSubmit:
+			err = ss.submit(r, cmd)
+		case *CmdUnlink:
+			ss.unlink(cmd)
+		default:
+			err = ErrProtocol
+		}
+		if err != nil {
+			break
+		}
+	}
+	close(stop)
+	<-watched
+	ss.cleanup()
+}
+
+// Check for the device now and then, and disconnect the client if it
+// has gone. A transfer failing notices that too, but only if there is
+// one.
+func (ss *session) watch(stop <-chan struct{}, watched chan<- struct{}) {
+	defer close(watched)
+	ticker := time.NewTicker(ss.s.PollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		if _, err := ss.h.GetConfiguration(); err == usb.UsbErrorNoDevice {
+			ss.lock.Lock()
+			ss.gone = true
+			ss.lock.Unlock()
+			ss.conn.Close()
+			return
+		}
+	}
+}
+
+// Cancel what is left, wait for it, and give the device back
+func (ss *session) cleanup() {
+	ss.conn.Close()
+	ss.lock.Lock()
+	var cancel []*usb.Transfer
+	for _, u := range ss.pending {
+		if u.t != nil {
+			cancel = append(cancel, u.t)
+		}
+	}
+	ss.lock.Unlock()
+	for _, t := range cancel {
+		t.Cancel()
+	}
+	ss.wg.Wait()
+
+	ss.lock.Lock()
+	gone := ss.gone
+	ss.lock.Unlock()
+	var err *usb.UsbError
+	if gone {
+		err = usb.UsbErrorNoDevice
+	} else {
+		ss.unclaim(true)
+	}
+	ss.h.Close()
+	ss.s.release(ss.e, err)
+}
+
+// The type of the endpoint with the given address in the current
+// setting of the active configuration
+func (ss *session) endpointType(endpoint byte) (int, bool) {
+	ss.lock.Lock()
+	defer ss.lock.Unlock()
+	for _, alts := range ss.cfg.Interfaces {
+		for _, alt := range alts {
+			if alt.BAlternateSetting != ss.alts[alt.BInterfaceNumber] {
+				continue
+			}
+			for _, ep := range alt.Endpoints {
+				if ep.BEndpointAddress == endpoint {
+					return int(ep.BmAttributes & usb.TRANSFER_TYPE_MASK), true
+				}
+			}
+		}
+	}
+	return 0, false
+}
+
+func (ss *session) submit(r *bufio.Reader, cmd *CmdSubmit) error {
+	length := int(cmd.TransferBufferLength)
+	if length < 0 || length > maxTransfer {
+		return ErrProtocol
+	}
+	in := cmd.Direction == DIR_IN
+	var out []byte
+	if !in {
+		out = make([]byte, length)
+		if _, err := io.ReadFull(r, out); err != nil {
+			return err
+		}
+	}
+
+	t := &usb.Transfer{Endpoint: byte(cmd.Endpoint & 0x0f)}
+	if in {
+		t.Endpoint |= usb.DIR_IN
+	}
+	var descs []IsoPacketDescriptor
+	if cmd.Endpoint == 0 {
+		t.Type = usb.TRANSFER_TYPE_CONTROL
+		t.Setup = cmd.Setup
+	} else {
+		ttype, ok := ss.endpointType(t.Endpoint)
+		if !ok {
+			ss.reply(cmd, nil, 0, -usbmon.EPIPE, nil)
+			return nil
+		}
+		t.Type = ttype
+	}
+	if t.Type == usb.TRANSFER_TYPE_ISOCHRONOUS {
+		var err error
+		if descs, err = ReadIsoDescriptors(r, int(cmd.NumberOfPackets)); err != nil {
+			return err
+		}
+		for _, d := range descs {
+			if int(d.Offset)+int(d.Length) > length {
+				return ErrProtocol
+			}
+			t.IsoPackets = append(t.IsoPackets, usb.IsoPacket{Length: int(d.Length)})
+			if !in {
+				// Packets follow each other without gaps here
+				t.Buffer = append(t.Buffer, out[d.Offset:d.Offset+d.Length]...)
+			}
+		}
+		if in {
+			t.Buffer = make([]byte, length)
+		}
+	} else if in {
+		t.Buffer = make([]byte, length)
+	} else {
+		t.Buffer = out
+	}
+
+	u := &serverUrb{descs: descs}
+	ss.lock.Lock()
+	ss.pending[cmd.Seqnum] = u
+	ss.wg.Add(1)
+	ss.lock.Unlock()
+
+	if t.Type == usb.TRANSFER_TYPE_CONTROL && ss.handledHere(cmd.Setup) {
+		go func() {
+			err := ss.request(cmd.Setup)
+			ss.finish(cmd, u, t, err)
+		}()
+		return nil
+	}
+
+	ss.lock.Lock()
+	u.t = t
+	ss.lock.Unlock()
+	if err := ss.h.Submit(t); err != nil {
+		ss.lock.Lock()
+		u.t = nil
+		ss.lock.Unlock()
+		ss.finish(cmd, u, t, err)
+		return nil
+	}
+	go func() {
+		t.Wait()
+		ss.finish(cmd, u, t, t.Status)
+	}()
+	return nil
+}
+
+// The requests that change the state of the device under the
+// backend, which has to hear of them. Linux's server picks out the
+// same ones.
+func (ss *session) handledHere(s usb.SetupPacket) bool {
+	std := s.BmRequestType&usb.REQUEST_TYPE_MASK == usb.REQUEST_TYPE_STANDARD
+	switch {
+	case std && s.BmRequestType&usb.RECIPIENT_MASK == usb.RECIPIENT_DEVICE && s.BRequest == usb.REQUEST_SET_CONFIGURATION:
+	case std && s.BmRequestType&usb.RECIPIENT_MASK == usb.RECIPIENT_INTERFACE && s.BRequest == usb.REQUEST_SET_INTERFACE:
+	case std && s.BmRequestType&usb.RECIPIENT_MASK == usb.RECIPIENT_ENDPOINT && s.BRequest == usb.REQUEST_CLEAR_FEATURE && s.WValue == 0:
+	case s.BmRequestType == usb.DIR_OUT|usb.REQUEST_TYPE_CLASS|usb.RECIPIENT_OTHER && s.BRequest == usb.REQUEST_SET_FEATURE && s.WValue == 4:
+		// A port reset
+	default:
+		return false
+	}
+	return true
+}
+
+func (ss *session) request(s usb.SetupPacket) *usb.UsbError {
+	ss.rlock.Lock()
+	defer ss.rlock.Unlock()
+	switch s.BRequest {
+	case usb.REQUEST_SET_CONFIGURATION:
+		ss.unclaim(false)
+		err := ss.h.SetConfiguration(int(s.WValue & 0xff))
+		ss.claim()
+		return err
+	case usb.REQUEST_SET_INTERFACE:
+		iface := byte(s.WIndex)
+		if err := ss.h.GetInterface(iface).SetAlternate(int(s.WValue)); err != nil {
+			return err
+		}
+		ss.lock.Lock()
+		ss.alts[iface] = byte(s.WValue)
+		ss.lock.Unlock()
+		return nil
+	case usb.REQUEST_CLEAR_FEATURE:
+		return ss.h.ClearHalt(int(s.WIndex & 0xff))
+	}
+	err := ss.h.Reset()
+	ss.lock.Lock()
+	ss.alts = make(map[byte]byte)
+	ss.lock.Unlock()
+	return err
+}
+
+// Answer a URB once it is done. An unlinked URB that was cancelled
+// gets only the answer to the unlink; one that finished anyway gets
+// both.
+func (ss *session) finish(cmd *CmdSubmit, u *serverUrb, t *usb.Transfer, err *usb.UsbError) {
+	defer ss.wg.Done()
+	ss.lock.Lock()
+	delete(ss.pending, cmd.Seqnum)
+	unlinked := u.unlinked
+	if err == usb.UsbErrorNoDevice {
+		ss.gone = true
+	}
+	ss.lock.Unlock()
+
+	if err == usb.UsbErrorNoDevice {
+		// The device went away; so does the client
+		ss.conn.Close()
+		return
+	}
+	if unlinked && err == usb.UsbErrorCancelled {
+		ss.send((&RetUnlink{Header: Header{Command: RET_UNLINK, Seqnum: u.unlinkSeqnum}, Status: -usbmon.ECONNRESET}).Append(nil))
+		return
+	}
+
+	status := usbmon.StatusOf(err)
+	if err == nil && cmd.TransferFlags&URB_SHORT_NOT_OK != 0 && t.In() && t.Actual < len(t.Buffer) {
+		status = -usbmon.EREMOTEIO
+	}
+	var data []byte
+	var descs []IsoPacketDescriptor
+	if t.Type == usb.TRANSFER_TYPE_ISOCHRONOUS {
+		// IN data goes back packed, without the gaps between packets;
+		// the client spreads it back out to the offsets it gave
+		offset := 0
+		for i, pkt := range t.IsoPackets {
+			if t.In() {
+				data = append(data, t.Buffer[offset:offset+pkt.Actual]...)
+			}
+			descs = append(descs, IsoPacketDescriptor{
+				Offset:       u.descs[i].Offset,
+				Length:       uint32(pkt.Length),
+				ActualLength: uint32(pkt.Actual),
+				Status:       int32(usbmon.StatusOf(pkt.Status)),
+			})
+			offset += pkt.Length
+		}
+	} else if t.In() {
+		data = t.Buffer[:t.Actual]
+	}
+	ss.reply(cmd, data, t.Actual, status, descs)
+	if unlinked {
+		ss.send((&RetUnlink{Header: Header{Command: RET_UNLINK, Seqnum: u.unlinkSeqnum}}).Append(nil))
+	}
+}
+
+func (ss *session) reply(cmd *CmdSubmit, data []byte, actual, status int, descs []IsoPacketDescriptor) {
+	ret := &RetSubmit{
+		Header:       Header{Command: RET_SUBMIT, Seqnum: cmd.Seqnum},
+		Status:       int32(status),
+		ActualLength: int32(actual),
+	}
+	if descs != nil {
+		ret.NumberOfPackets = int32(len(descs))
+		for _, d := range descs {
+			if d.Status != 0 {
+				ret.ErrorCount++
+			}
+		}
+	}
+	buf := ret.Append(nil)
+	buf = append(buf, data...)
+	ss.send(AppendIsoDescriptors(buf, descs))
+}
+
+func (ss *session) unlink(cmd *CmdUnlink) {
+	ss.lock.Lock()
+	u, ok := ss.pending[cmd.UnlinkSeqnum]
+	var t *usb.Transfer
+	if ok {
+		u.unlinked = true
+		u.unlinkSeqnum = cmd.Seqnum
+		t = u.t
+	}
+	ss.lock.Unlock()
+	if !ok {
+		// Done already
+		ss.send((&RetUnlink{Header: Header{Command: RET_UNLINK, Seqnum: cmd.Seqnum}}).Append(nil))
+		return
+	}
+	if t != nil {
+		t.Cancel()
+	}
+}
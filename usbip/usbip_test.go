@@ -0,0 +1,235 @@
+package usbip_test
+
+import (
+	"bytes"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"gopkg.thequux.com/usb"
+	"gopkg.thequux.com/usb/usbip"
+	"gopkg.thequux.com/usb/usbtest"
+)
+
+// The usbtest echo device exported by a Server on a loopback port,
+// with a second vendor request, 0x02 OUT, that sets a value
+type echo struct {
+	dev  *usbtest.Device
+	addr string
+
+	lock  sync.Mutex
+	value []byte
+}
+
+func serve(t *testing.T) *echo {
+	e := &echo{dev: usbtest.NewEchoDevice()}
+	control := e.dev.Control
+	e.dev.Control = func(req *usbtest.Request) ([]byte, *usb.UsbError) {
+		if req.Setup.BmRequestType == usb.DIR_OUT|usb.REQUEST_TYPE_VENDOR && req.Setup.BRequest == 0x02 {
+			e.lock.Lock()
+			e.value = append([]byte(nil), req.Data...)
+			e.lock.Unlock()
+			return nil, nil
+		}
+		return control(req)
+	}
+	devs, err := usbtest.NewContext(e.dev).GetDeviceList()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := usbip.NewServer()
+	s.PollInterval = 10 * time.Millisecond
+	s.Export("1-2", devs[0])
+	l, lerr := net.Listen("tcp", "127.0.0.1:0")
+	if lerr != nil {
+		t.Fatal(lerr)
+	}
+	go s.Serve(l)
+	t.Cleanup(s.Close)
+	e.addr = l.Addr().String()
+	return e
+}
+
+// Import the device and open it through a context on the client side
+func (e *echo) attach(t *testing.T) *usbtest.EchoHandle {
+	b := usbip.NewBackend()
+	t.Cleanup(b.Close)
+	if _, err := b.Attach(e.addr, "1-2"); err != nil {
+		t.Fatal(err)
+	}
+	h, err := usbtest.OpenEcho(usb.NewContext(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(h.Close)
+	return h
+}
+
+func TestDevlist(t *testing.T) {
+	e := serve(t)
+	devs, err := usbip.ListDevices(e.addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(devs) != 1 {
+		t.Fatalf("listed %d devices, want 1", len(devs))
+	}
+	dev := devs[0]
+	if dev.BusID != "1-2" || dev.IdVendor != usbtest.ECHO_VENDOR || dev.IdProduct != usbtest.ECHO_PRODUCT || dev.Speed != usb.SPEED_HIGH {
+		t.Errorf("listed %+v", dev)
+	}
+	if dev.BConfigurationValue != 1 || dev.BNumInterfaces != 1 ||
+		len(dev.Interfaces) != 1 || dev.Interfaces[0].BInterfaceClass != usb.CLASS_VENDOR {
+		t.Errorf("listed configuration %d with interfaces %+v", dev.BConfigurationValue, dev.Interfaces)
+	}
+}
+
+func TestImport(t *testing.T) {
+	e := serve(t)
+	b := usbip.NewBackend()
+	defer b.Close()
+	if _, err := b.Attach(e.addr, "9-9"); err != usbip.ErrNoDevice {
+		t.Errorf("importing an unknown bus ID: %v, want %v", err, usbip.ErrNoDevice)
+	}
+	d, err := b.Attach(e.addr, "1-2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.Exported.IdVendor != usbtest.ECHO_VENDOR || d.Exported.Interfaces != nil {
+		t.Errorf("imported %+v", d.Exported)
+	}
+	if _, err := b.Attach(e.addr, "1-2"); err != usbip.ErrBusy {
+		t.Errorf("importing twice: %v, want %v", err, usbip.ErrBusy)
+	}
+
+	devs, uerr := usb.NewContext(b).GetDeviceList()
+	if uerr != nil || len(devs) != 1 {
+		t.Fatal(devs, uerr)
+	}
+	desc, uerr := devs[0].GetDeviceDescriptor()
+	if uerr != nil || desc.IdVendor != usbtest.ECHO_VENDOR || desc.IdProduct != usbtest.ECHO_PRODUCT {
+		t.Errorf("descriptor %+v, %v", desc, uerr)
+	}
+	cfg, uerr := devs[0].GetActiveConfigDescriptor()
+	if uerr != nil || len(cfg.Interfaces) != 1 || len(cfg.Interfaces[0][0].Endpoints) != 2 {
+		t.Errorf("configuration %+v, %v", cfg, uerr)
+	}
+
+	// Once let go, it can be imported again
+	b.Detach(d)
+	for i := 0; i < 100; i++ {
+		if d, err = b.Attach(e.addr, "1-2"); err != usbip.ErrBusy {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if err != nil {
+		t.Errorf("importing after detaching: %v", err)
+	}
+}
+
+func TestControl(t *testing.T) {
+	e := serve(t)
+	h := e.attach(t)
+
+	version := make([]byte, 2)
+	n, err := h.ControlTransfer(usb.DIR_IN|usb.REQUEST_TYPE_VENDOR, 0x01, 0, 0, version, time.Second)
+	if err != nil || n != 2 || version[0] != 1 || version[1] != 4 {
+		t.Errorf("version %v, %v", version[:n], err)
+	}
+	if _, err := h.ControlTransfer(usb.DIR_OUT|usb.REQUEST_TYPE_VENDOR, 0x02, 0, 0, []byte{0xaa, 0x55}, time.Second); err != nil {
+		t.Error(err)
+	}
+	e.lock.Lock()
+	if !bytes.Equal(e.value, []byte{0xaa, 0x55}) {
+		t.Errorf("device was sent %x, want aa55", e.value)
+	}
+	e.lock.Unlock()
+	if _, err := h.ControlTransfer(usb.DIR_IN|usb.REQUEST_TYPE_VENDOR, 0x03, 0, 0, version, time.Second); err != usb.UsbErrorPipe {
+		t.Errorf("unknown request: %v, want %v", err, usb.UsbErrorPipe)
+	}
+}
+
+func TestBulk(t *testing.T) {
+	e := serve(t)
+	h := e.attach(t)
+	if n, err := h.Out.Write([]byte("hello")); n != 5 || err != nil {
+		t.Fatalf("wrote %d, %v", n, err)
+	}
+	buf := make([]byte, 512)
+	if n, err := h.In.Read(buf); n != 5 || err != nil || string(buf[:n]) != "HELLO" {
+		t.Errorf("read %q, %v", buf[:n], err)
+	}
+}
+
+// Transfers that time out or are cancelled are unlinked on the server
+func TestUnlink(t *testing.T) {
+	e := serve(t)
+	h := e.attach(t)
+	buf := make([]byte, 512)
+	e.dev.SetNAK(0x81, usbtest.NAKForever)
+
+	tr := &usb.Transfer{Type: usb.TRANSFER_TYPE_BULK, Endpoint: 0x81, Buffer: buf, Timeout: 50 * time.Millisecond}
+	if err := h.Submit(tr); err != nil {
+		t.Fatal(err)
+	}
+	if err := tr.Wait(); err != usb.UsbErrorTimeout {
+		t.Errorf("timed out with %v, want %v", err, usb.UsbErrorTimeout)
+	}
+
+	tr = &usb.Transfer{Type: usb.TRANSFER_TYPE_BULK, Endpoint: 0x81, Buffer: buf}
+	if err := h.Submit(tr); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(10 * time.Millisecond)
+	if err := tr.Cancel(); err != nil {
+		t.Error(err)
+	}
+	if err := tr.Wait(); err != usb.UsbErrorCancelled {
+		t.Errorf("cancelled with %v, want %v", err, usb.UsbErrorCancelled)
+	}
+
+	// Neither left anything behind to take the next transfer's data
+	e.dev.SetNAK(0x81, 0)
+	if _, err := h.Out.Write([]byte("again")); err != nil {
+		t.Fatal(err)
+	}
+	n, err := h.In.Read(buf)
+	if err != nil || string(buf[:n]) != "AGAIN" {
+		t.Errorf("read %q, %v after unlinking", buf[:n], err)
+	}
+}
+
+// A device unplugged while its client isn't using it is noticed all
+// the same: the client is disconnected and the export dropped
+func TestUnplugIdle(t *testing.T) {
+	e := serve(t)
+	b := usbip.NewBackend()
+	defer b.Close()
+	d, err := b.Attach(e.addr, "1-2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.dev.Disconnect()
+	for i := 0; i < 100 && !d.Detached(); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !d.Detached() {
+		t.Fatal("client still attached a second after unplugging")
+	}
+	var devs []*usbip.ExportedDevice
+	for i := 0; i < 100; i++ {
+		if devs, err = usbip.ListDevices(e.addr); err != nil || len(devs) == 0 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err != nil || len(devs) != 0 {
+		t.Fatalf("listed %d devices after unplugging, with %v", len(devs), err)
+	}
+	if _, err := b.Attach(e.addr, "1-2"); err != usbip.ErrNoDevice {
+		t.Errorf("importing after unplugging: %v, want %v", err, usbip.ErrNoDevice)
+	}
+}
@@ -0,0 +1,194 @@
+package usbmon
+
+import (
+	"encoding/binary"
+	"io"
+	"time"
+
+	"gopkg.thequux.com/usb"
+)
+
+// Binary events start with a struct usbmon_packet in one of two sizes
+const (
+	// What read() on /dev/usbmonN gives, and pcap's LINKTYPE_USB_LINUX
+	HEADER_LEN = 48
+	// What the mmap interface gives, and LINKTYPE_USB_LINUX_MMAPPED;
+	// it adds the interval, start frame, URB flags and the number of
+	// isochronous descriptors captured
+	HEADER_LEN_MMAPPED = 64
+)
+
+// The length of each isochronous descriptor, which come between the
+// header and the data
+const ISO_DESCRIPTOR_LEN = 16
+
+// The kernel captures no more descriptors than this
+const ISO_DESCRIPTOR_MAX = 128
+
+// The binary format numbers transfer types its own way
+var binaryTypes = [4]int{
+	usb.TRANSFER_TYPE_ISOCHRONOUS,
+	usb.TRANSFER_TYPE_INTERRUPT,
+	usb.TRANSFER_TYPE_CONTROL,
+	usb.TRANSFER_TYPE_BULK,
+}
+
+// Reads binary events one after another, as they come from reading
+// /dev/usbmonN
+type BinaryReader struct {
+	// HEADER_LEN unless set otherwise
+	HeaderLen int
+	// The byte order of the host that made the capture; little endian
+	// unless set otherwise
+	Order binary.ByteOrder
+
+	r io.Reader
+}
+
+func NewBinaryReader(r io.Reader) *BinaryReader {
+	return &BinaryReader{HeaderLen: HEADER_LEN, Order: binary.LittleEndian, r: r}
+}
+
+// The next event, or io.EOF at the end
+func (r *BinaryReader) Next() (*Event, error) {
+	buf := make([]byte, r.HeaderLen)
+	if _, err := io.ReadFull(r.r, buf); err != nil {
+		return nil, err
+	}
+	len_cap := r.Order.Uint32(buf[36:])
+	buf = append(buf, make([]byte, len_cap)...)
+	if _, err := io.ReadFull(r.r, buf[r.HeaderLen:]); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return ParseBinary(buf, r.HeaderLen, r.Order)
+}
+
+// Parse a binary event: a header of hdrlen bytes (HEADER_LEN or
+// HEADER_LEN_MMAPPED) followed by what was captured. The capture may
+// have been cut short, as pcap's snap length does.
+func ParseBinary(buf []byte, hdrlen int, order binary.ByteOrder) (*Event, error) {
+	if (hdrlen != HEADER_LEN && hdrlen != HEADER_LEN_MMAPPED) || len(buf) < hdrlen {
+		return nil, ErrMalformed
+	}
+	ev := &Event{
+		ID:           order.Uint64(buf[0:]),
+		Type:         buf[8],
+		TransferType: binaryTypes[buf[9]&3],
+		Endpoint:     buf[10],
+		Device:       int(buf[11]),
+		Bus:          int(order.Uint16(buf[12:])),
+		SetupFlag:    buf[14],
+		DataFlag:     buf[15],
+		Timestamp: time.Duration(order.Uint64(buf[16:]))*time.Second +
+			time.Duration(int32(order.Uint32(buf[24:])))*time.Microsecond,
+		Status: int(int32(order.Uint32(buf[28:]))),
+		Length: int(order.Uint32(buf[32:])),
+	}
+	switch ev.Type {
+	case EVENT_SUBMIT, EVENT_COMPLETE, EVENT_ERROR:
+	default:
+		return nil, ErrMalformed
+	}
+	data := buf[hdrlen:]
+	if len_cap := int(order.Uint32(buf[36:])); len(data) > len_cap {
+		data = data[:len_cap]
+	}
+
+	ndesc := 0
+	switch {
+	case ev.TransferType == usb.TRANSFER_TYPE_CONTROL && ev.SetupFlag == 0:
+		// The setup packet is in wire order, whatever the host's
+		s := buf[40:48]
+		ev.Setup = &usb.SetupPacket{
+			BmRequestType: s[0],
+			BRequest:      s[1],
+			WValue:        binary.LittleEndian.Uint16(s[2:]),
+			WIndex:        binary.LittleEndian.Uint16(s[4:]),
+			WLength:       binary.LittleEndian.Uint16(s[6:]),
+		}
+	case ev.TransferType == usb.TRANSFER_TYPE_ISOCHRONOUS:
+		ev.ErrorCount = int(int32(order.Uint32(buf[40:])))
+		ev.NumIsoPackets = int(int32(order.Uint32(buf[44:])))
+		ndesc = ev.NumIsoPackets
+		if ndesc > ISO_DESCRIPTOR_MAX {
+			ndesc = ISO_DESCRIPTOR_MAX
+		}
+	}
+	if hdrlen == HEADER_LEN_MMAPPED {
+		ev.Interval = int(int32(order.Uint32(buf[48:])))
+		ev.StartFrame = int(int32(order.Uint32(buf[52:])))
+		ev.Flags = order.Uint32(buf[56:])
+		ndesc = int(order.Uint32(buf[60:]))
+	}
+	if ndesc < 0 {
+		ndesc = 0
+	}
+
+	// The isochronous descriptors are counted in the captured length
+	for i := 0; i < ndesc && len(data) >= ISO_DESCRIPTOR_LEN; i++ {
+		ev.IsoDescriptors = append(ev.IsoDescriptors, IsoDescriptor{
+			Status: int(int32(order.Uint32(data[0:]))),
+			Offset: int(order.Uint32(data[4:])),
+			Length: int(order.Uint32(data[8:])),
+		})
+		data = data[ISO_DESCRIPTOR_LEN:]
+	}
+	if ev.DataFlag == 0 {
+		ev.Data = append([]byte(nil), data...)
+	}
+	return ev, nil
+}
+
+// Append the event in binary form: a header of hdrlen bytes
+// (HEADER_LEN or HEADER_LEN_MMAPPED), the isochronous descriptors and
+// the data. ParseBinary reads it back.
+func (e *Event) AppendBinary(buf []byte, hdrlen int, order binary.ByteOrder) []byte {
+	hdr := make([]byte, hdrlen)
+	order.PutUint64(hdr[0:], e.ID)
+	hdr[8] = e.Type
+	for i, ttype := range binaryTypes {
+		if ttype == e.TransferType {
+			hdr[9] = byte(i)
+		}
+	}
+	hdr[10] = e.Endpoint
+	hdr[11] = byte(e.Device)
+	order.PutUint16(hdr[12:], uint16(e.Bus))
+	hdr[14] = e.SetupFlag
+	hdr[15] = e.DataFlag
+	order.PutUint64(hdr[16:], uint64(e.Timestamp/time.Second))
+	order.PutUint32(hdr[24:], uint32(e.Timestamp%time.Second/time.Microsecond))
+	order.PutUint32(hdr[28:], uint32(int32(e.Status)))
+	order.PutUint32(hdr[32:], uint32(e.Length))
+	order.PutUint32(hdr[36:], uint32(len(e.IsoDescriptors)*ISO_DESCRIPTOR_LEN+len(e.Data)))
+	switch {
+	case e.Setup != nil:
+		s := hdr[40:48]
+		s[0], s[1] = e.Setup.BmRequestType, e.Setup.BRequest
+		binary.LittleEndian.PutUint16(s[2:], e.Setup.WValue)
+		binary.LittleEndian.PutUint16(s[4:], e.Setup.WIndex)
+		binary.LittleEndian.PutUint16(s[6:], e.Setup.WLength)
+	case e.TransferType == usb.TRANSFER_TYPE_ISOCHRONOUS:
+		order.PutUint32(hdr[40:], uint32(int32(e.ErrorCount)))
+		order.PutUint32(hdr[44:], uint32(int32(e.NumIsoPackets)))
+	}
+	if hdrlen == HEADER_LEN_MMAPPED {
+		order.PutUint32(hdr[48:], uint32(int32(e.Interval)))
+		order.PutUint32(hdr[52:], uint32(int32(e.StartFrame)))
+		order.PutUint32(hdr[56:], e.Flags)
+		order.PutUint32(hdr[60:], uint32(len(e.IsoDescriptors)))
+	}
+	buf = append(buf, hdr...)
+
+	for _, d := range e.IsoDescriptors {
+		var desc [ISO_DESCRIPTOR_LEN]byte
+		order.PutUint32(desc[0:], uint32(int32(d.Status)))
+		order.PutUint32(desc[4:], uint32(d.Offset))
+		order.PutUint32(desc[8:], uint32(d.Length))
+		buf = append(buf, desc[:]...)
+	}
+	return append(buf, e.Data...)
+}
@@ -0,0 +1,120 @@
+package usbmon
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// The captures of the session in testdata/session.txt, with each
+// header size
+var binaryCaptures = []struct {
+	file   string
+	hdrlen int
+}{
+	{"testdata/session.bin", HEADER_LEN},
+	{"testdata/session.mmap.bin", HEADER_LEN_MMAPPED},
+}
+
+func readBinary(t *testing.T, file string, hdrlen int) ([]*Event, []byte) {
+	capture, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := NewBinaryReader(bytes.NewReader(capture))
+	r.HeaderLen = hdrlen
+	var events []*Event
+	for {
+		ev, err := r.Next()
+		if err == io.EOF {
+			return events, capture
+		}
+		if err != nil {
+			t.Fatalf("%s: event %d: %v", file, len(events), err)
+		}
+		events = append(events, ev)
+	}
+}
+
+func TestParseBinary(t *testing.T) {
+	text := readText(t)
+	for _, c := range binaryCaptures {
+		events, _ := readBinary(t, c.file, c.hdrlen)
+		if len(events) != len(text) {
+			t.Fatalf("%s: %d events, want %d", c.file, len(events), len(text))
+		}
+		for i, ev := range events {
+			// Binary captures have wall clock times, and only the
+			// longer header has the interval and start frame
+			want := *text[i]
+			want.Timestamp = 1700000000*time.Second + text[i].Timestamp
+			if c.hdrlen == HEADER_LEN {
+				want.Interval, want.StartFrame = 0, 0
+			}
+			got := *ev
+			got.Flags = 0
+			if !reflect.DeepEqual(&got, &want) {
+				t.Errorf("%s: event %d:\n got %+v\nwant %+v", c.file, i, &got, &want)
+			}
+		}
+		if bulk_in := events[9]; c.hdrlen == HEADER_LEN_MMAPPED && bulk_in.Flags != 1 {
+			t.Errorf("%s: URB flags %#x, want URB_SHORT_NOT_OK", c.file, bulk_in.Flags)
+		}
+	}
+}
+
+func TestParseBinaryMalformed(t *testing.T) {
+	events, capture := readBinary(t, "testdata/session.bin", HEADER_LEN)
+	if _, err := ParseBinary(capture[:HEADER_LEN-1], HEADER_LEN, binary.LittleEndian); err != ErrMalformed {
+		t.Errorf("short header: %v", err)
+	}
+	if _, err := ParseBinary(capture, 40, binary.LittleEndian); err != ErrMalformed {
+		t.Errorf("header length 40: %v", err)
+	}
+	bad := events[0].AppendBinary(nil, HEADER_LEN, binary.LittleEndian)
+	bad[8] = 'X'
+	if _, err := ParseBinary(bad, HEADER_LEN, binary.LittleEndian); err != ErrMalformed {
+		t.Errorf("event type X: %v", err)
+	}
+
+	// A capture cut short by the snap length still parses
+	ev, err := ParseBinary(capture[HEADER_LEN:2*HEADER_LEN+10], HEADER_LEN, binary.LittleEndian)
+	if err != nil || ev.Length != 18 || len(ev.Data) != 10 {
+		t.Errorf("cut short: %+v, %v", ev, err)
+	}
+
+	r := NewBinaryReader(bytes.NewReader(capture[:HEADER_LEN+10]))
+	r.Next()
+	if _, err := r.Next(); err != io.ErrUnexpectedEOF {
+		t.Errorf("truncated file: %v", err)
+	}
+}
+
+// AppendBinary writes each event back as it was captured, and in the
+// other byte order as something ParseBinary reads back the same
+func TestAppendBinary(t *testing.T) {
+	for _, c := range binaryCaptures {
+		events, capture := readBinary(t, c.file, c.hdrlen)
+		var buf []byte
+		for _, ev := range events {
+			buf = ev.AppendBinary(buf, c.hdrlen, binary.LittleEndian)
+		}
+		if !bytes.Equal(buf, capture) {
+			t.Errorf("%s: written back differently", c.file)
+		}
+
+		for i, ev := range events {
+			back, err := ParseBinary(ev.AppendBinary(nil, c.hdrlen, binary.BigEndian), c.hdrlen, binary.BigEndian)
+			if err != nil {
+				t.Fatalf("%s: event %d: %v", c.file, i, err)
+			}
+			if !reflect.DeepEqual(back, ev) {
+				t.Errorf("%s: event %d, big endian:\n got %+v\nwant %+v", c.file, i, back, ev)
+			}
+		}
+	}
+}
@@ -0,0 +1,187 @@
+package usbmon
+
+import (
+	"fmt"
+
+	"gopkg.thequux.com/usb"
+)
+
+// Standard requests that chapter 9 adds for SuperSpeed
+const (
+	REQUEST_SET_SEL         = 0x30
+	REQUEST_SET_ISOCH_DELAY = 0x31
+)
+
+var standardRequests = map[byte]string{
+	usb.REQUEST_GET_STATUS:        "GET_STATUS",
+	usb.REQUEST_CLEAR_FEATURE:     "CLEAR_FEATURE",
+	usb.REQUEST_SET_FEATURE:       "SET_FEATURE",
+	usb.REQUEST_SET_ADDRESS:       "SET_ADDRESS",
+	usb.REQUEST_GET_DESCRIPTOR:    "GET_DESCRIPTOR",
+	usb.REQUEST_SET_DESCRIPTOR:    "SET_DESCRIPTOR",
+	usb.REQUEST_GET_CONFIGURATION: "GET_CONFIGURATION",
+	usb.REQUEST_SET_CONFIGURATION: "SET_CONFIGURATION",
+	usb.REQUEST_GET_INTERFACE:     "GET_INTERFACE",
+	usb.REQUEST_SET_INTERFACE:     "SET_INTERFACE",
+	usb.REQUEST_SYNCH_FRAME:       "SYNCH_FRAME",
+	REQUEST_SET_SEL:               "SET_SEL",
+	REQUEST_SET_ISOCH_DELAY:       "SET_ISOCH_DELAY",
+}
+
+var descriptorTypes = map[usb.DescriptorType]string{
+	usb.DT_DEVICE:                "DEVICE",
+	usb.DT_CONFIG:                "CONFIG",
+	usb.DT_STRING:                "STRING",
+	usb.DT_INTERFACE:             "INTERFACE",
+	usb.DT_ENDPOINT:              "ENDPOINT",
+	usb.DT_DEVICE_QUALIFIER:      "DEVICE_QUALIFIER",
+	usb.DT_OTHER_SPEED_CONFIG:    "OTHER_SPEED_CONFIG",
+	usb.DT_INTERFACE_POWER:       "INTERFACE_POWER",
+	usb.DT_INTERFACE_ASSOCIATION: "INTERFACE_ASSOCIATION",
+	usb.DT_BOS:                   "BOS",
+	usb.DT_DEVICE_CAPABILITY:     "DEVICE_CAPABILITY",
+	usb.DT_HID:                   "HID",
+	usb.DT_HID_REPORT:            "HID_REPORT",
+	usb.DT_HID_PHYSICAL:          "HID_PHYSICAL",
+	usb.DT_HUB:                   "HUB",
+	usb.DT_SS_HUB:                "SS_HUB",
+}
+
+// Feature selectors, by recipient
+var features = map[byte]map[uint16]string{
+	usb.RECIPIENT_DEVICE:    {1: "DEVICE_REMOTE_WAKEUP", 2: "TEST_MODE", 48: "U1_ENABLE", 49: "U2_ENABLE", 50: "LTM_ENABLE"},
+	usb.RECIPIENT_INTERFACE: {0: "FUNCTION_SUSPEND"},
+	usb.RECIPIENT_ENDPOINT:  {0: "ENDPOINT_HALT"},
+}
+
+// Requests of the classes that have them, where they can be told
+// apart by the request code alone
+var classRequests = map[usb.ClassCode]map[byte]string{
+	usb.CLASS_AUDIO: {
+		0x01: "SET_CUR", 0x02: "SET_MIN", 0x03: "SET_MAX", 0x04: "SET_RES",
+		0x81: "GET_CUR", 0x82: "GET_MIN", 0x83: "GET_MAX", 0x84: "GET_RES",
+	},
+	usb.CLASS_COMM: {
+		0x00: "SEND_ENCAPSULATED_COMMAND", 0x01: "GET_ENCAPSULATED_RESPONSE",
+		0x20: "SET_LINE_CODING", 0x21: "GET_LINE_CODING",
+		0x22: "SET_CONTROL_LINE_STATE", 0x23: "SEND_BREAK",
+	},
+	usb.CLASS_HID: {
+		0x01: "GET_REPORT", 0x02: "GET_IDLE", 0x03: "GET_PROTOCOL",
+		0x09: "SET_REPORT", 0x0a: "SET_IDLE", 0x0b: "SET_PROTOCOL",
+	},
+	usb.CLASS_PRINTER: {
+		0x00: "GET_DEVICE_ID", 0x01: "GET_PORT_STATUS", 0x02: "SOFT_RESET",
+	},
+	usb.CLASS_MASS_STORAGE: {
+		0xfe: "GET_MAX_LUN", 0xff: "BULK_ONLY_MASS_STORAGE_RESET",
+	},
+	usb.CLASS_HUB: {
+		0x00: "GET_STATUS", 0x01: "CLEAR_FEATURE", 0x03: "SET_FEATURE",
+		0x06: "GET_DESCRIPTOR", 0x07: "SET_DESCRIPTOR",
+		0x08: "CLEAR_TT_BUFFER", 0x09: "RESET_TT", 0x0a: "GET_TT_STATE",
+		0x0b: "STOP_TT", 0x0c: "SET_HUB_DEPTH", 0x0d: "GET_PORT_ERR_COUNT",
+	},
+}
+
+var recipients = [4]string{"device", "interface", "endpoint", "other"}
+
+// A setup packet in words, e.g.
+//
+//	GET_DESCRIPTOR(STRING 2, langid 0x0409) length 255
+//	HID SET_IDLE to interface 0, wValue 0x0000 wIndex 0x0000
+//	vendor request 0x20 to device, wValue 0x0001 wIndex 0x0000 length 64
+//
+// class is the class of whatever the request is addressed to, if it
+// is known; class requests are only named for the classes that this
+// package knows and only when class is given.
+func DescribeSetup(s usb.SetupPacket, class usb.ClassCode) string {
+	recipient := "reserved recipient"
+	if r := s.BmRequestType & usb.RECIPIENT_MASK; r < 4 {
+		recipient = recipients[r]
+	}
+	suffix := ""
+	if s.WLength > 0 {
+		suffix = fmt.Sprintf(" length %d", s.WLength)
+	}
+
+	switch s.BmRequestType & usb.REQUEST_TYPE_MASK {
+	case usb.REQUEST_TYPE_STANDARD:
+		if name, ok := standardRequests[s.BRequest]; ok {
+			return name + describeStandard(s, recipient) + suffix
+		}
+		return fmt.Sprintf("standard request 0x%02x to %s, wValue 0x%04x wIndex 0x%04x%s",
+			s.BRequest, recipient, s.WValue, s.WIndex, suffix)
+	case usb.REQUEST_TYPE_CLASS:
+		if name, ok := classRequests[class][s.BRequest]; ok {
+			return fmt.Sprintf("%s %s to %s, wValue 0x%04x wIndex 0x%04x%s",
+				classNames[class], name, recipient, s.WValue, s.WIndex, suffix)
+		}
+		return fmt.Sprintf("class request 0x%02x to %s, wValue 0x%04x wIndex 0x%04x%s",
+			s.BRequest, recipient, s.WValue, s.WIndex, suffix)
+	case usb.REQUEST_TYPE_VENDOR:
+		return fmt.Sprintf("vendor request 0x%02x to %s, wValue 0x%04x wIndex 0x%04x%s",
+			s.BRequest, recipient, s.WValue, s.WIndex, suffix)
+	}
+	return fmt.Sprintf("reserved request type, request 0x%02x to %s, wValue 0x%04x wIndex 0x%04x%s",
+		s.BRequest, recipient, s.WValue, s.WIndex, suffix)
+}
+
+// The arguments of a standard request
+func describeStandard(s usb.SetupPacket, recipient string) string {
+	to := recipient
+	switch s.BmRequestType & usb.RECIPIENT_MASK {
+	case usb.RECIPIENT_INTERFACE:
+		to = fmt.Sprintf("interface %d", s.WIndex&0xff)
+	case usb.RECIPIENT_ENDPOINT:
+		to = fmt.Sprintf("endpoint 0x%02x", s.WIndex&0xff)
+	}
+
+	switch s.BRequest {
+	case usb.REQUEST_GET_STATUS:
+		return "(" + to + ")"
+	case usb.REQUEST_CLEAR_FEATURE, usb.REQUEST_SET_FEATURE:
+		feature, ok := features[s.BmRequestType&usb.RECIPIENT_MASK][s.WValue]
+		if !ok {
+			feature = fmt.Sprintf("feature %d", s.WValue)
+		}
+		return fmt.Sprintf("(%s, %s)", to, feature)
+	case usb.REQUEST_SET_ADDRESS:
+		return fmt.Sprintf("(%d)", s.WValue)
+	case usb.REQUEST_GET_DESCRIPTOR, usb.REQUEST_SET_DESCRIPTOR:
+		dtype := usb.DescriptorType(s.WValue >> 8)
+		name, ok := descriptorTypes[dtype]
+		if !ok {
+			name = fmt.Sprintf("type 0x%02x", int(dtype))
+		}
+		switch {
+		case dtype == usb.DT_STRING && s.WValue&0xff != 0:
+			return fmt.Sprintf("(%s %d, langid 0x%04x)", name, s.WValue&0xff, s.WIndex)
+		case s.WIndex != 0:
+			return fmt.Sprintf("(%s %d, wIndex 0x%04x)", name, s.WValue&0xff, s.WIndex)
+		}
+		return fmt.Sprintf("(%s %d)", name, s.WValue&0xff)
+	case usb.REQUEST_GET_CONFIGURATION:
+		return "()"
+	case usb.REQUEST_SET_CONFIGURATION:
+		return fmt.Sprintf("(%d)", s.WValue&0xff)
+	case usb.REQUEST_GET_INTERFACE:
+		return fmt.Sprintf("(%d)", s.WIndex&0xff)
+	case usb.REQUEST_SET_INTERFACE:
+		return fmt.Sprintf("(%d, alt %d)", s.WIndex&0xff, s.WValue)
+	case usb.REQUEST_SYNCH_FRAME:
+		return "(" + to + ")"
+	case REQUEST_SET_ISOCH_DELAY:
+		return fmt.Sprintf("(%d ns)", s.WValue)
+	}
+	return ""
+}
+
+var classNames = map[usb.ClassCode]string{
+	usb.CLASS_AUDIO:        "audio",
+	usb.CLASS_COMM:         "CDC",
+	usb.CLASS_HID:          "HID",
+	usb.CLASS_PRINTER:      "printer",
+	usb.CLASS_MASS_STORAGE: "mass storage",
+	usb.CLASS_HUB:          "hub",
+}
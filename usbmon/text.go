@@ -0,0 +1,258 @@
+package usbmon
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.thequux.com/usb"
+)
+
+// The letters of the address word
+var textTypes = map[byte]int{
+	'C': usb.TRANSFER_TYPE_CONTROL,
+	'Z': usb.TRANSFER_TYPE_ISOCHRONOUS,
+	'B': usb.TRANSFER_TYPE_BULK,
+	'I': usb.TRANSFER_TYPE_INTERRUPT,
+}
+
+var textTypeLetters = [4]byte{'C', 'Z', 'B', 'I'}
+
+// Reads the text "u" format, one event per line
+type TextReader struct {
+	scanner *bufio.Scanner
+	line    int
+}
+
+func NewTextReader(r io.Reader) *TextReader {
+	return &TextReader{scanner: bufio.NewScanner(r)}
+}
+
+// The next event, or io.EOF at the end. Blank lines are skipped.
+func (r *TextReader) Next() (*Event, error) {
+	for r.scanner.Scan() {
+		r.line++
+		if strings.TrimSpace(r.scanner.Text()) == "" {
+			continue
+		}
+		return ParseText(r.scanner.Text())
+	}
+	if err := r.scanner.Err(); err != nil {
+		return nil, err
+	}
+	return nil, io.EOF
+}
+
+// The number of the line last read, for error messages
+func (r *TextReader) Line() int {
+	return r.line
+}
+
+// Parse one line of the text "u" format
+func ParseText(line string) (*Event, error) {
+	f := strings.Fields(line)
+	if len(f) < 5 || len(f[2]) != 1 {
+		return nil, ErrMalformed
+	}
+	ev := &Event{Type: f[2][0]}
+	id, err1 := strconv.ParseUint(f[0], 16, 64)
+	ts, err2 := strconv.ParseUint(f[1], 10, 32)
+	if err1 != nil || err2 != nil {
+		return nil, ErrMalformed
+	}
+	ev.ID = id
+	ev.Timestamp = time.Duration(ts) * time.Microsecond
+	switch ev.Type {
+	case EVENT_SUBMIT, EVENT_COMPLETE, EVENT_ERROR:
+	default:
+		return nil, ErrMalformed
+	}
+	if !parseTextAddress(ev, f[3]) {
+		return nil, ErrMalformed
+	}
+	f = f[4:]
+
+	// A setup packet, or the status and its companions
+	if word := f[0]; word[0] != '-' && (word[0] < '0' || word[0] > '9') {
+		if len(word) != 1 || len(f) < 6 {
+			return nil, ErrMalformed
+		}
+		ev.Status = -EINPROGRESS
+		if word[0] == 's' {
+			var vals [5]uint64
+			for i := range vals {
+				v, err := strconv.ParseUint(f[1+i], 16, 16)
+				if err != nil {
+					return nil, ErrMalformed
+				}
+				vals[i] = v
+			}
+			ev.Setup = &usb.SetupPacket{
+				BmRequestType: byte(vals[0]),
+				BRequest:      byte(vals[1]),
+				WValue:        uint16(vals[2]),
+				WIndex:        uint16(vals[3]),
+				WLength:       uint16(vals[4]),
+			}
+		} else {
+			ev.SetupFlag = word[0]
+		}
+		f = f[6:]
+	} else {
+		ev.SetupFlag = '-'
+		fields := []*int{&ev.Status, &ev.Interval, &ev.StartFrame, &ev.ErrorCount}
+		parts := strings.Split(word, ":")
+		if len(parts) > len(fields) {
+			return nil, ErrMalformed
+		}
+		for i, part := range parts {
+			v, err := strconv.Atoi(part)
+			if err != nil {
+				return nil, ErrMalformed
+			}
+			*fields[i] = v
+		}
+		f = f[1:]
+	}
+
+	// The isochronous packet count, and the first few packets
+	if ev.TransferType == usb.TRANSFER_TYPE_ISOCHRONOUS && ev.Type != EVENT_ERROR && len(f) > 0 {
+		n, err := strconv.Atoi(f[0])
+		if err != nil {
+			return nil, ErrMalformed
+		}
+		ev.NumIsoPackets = n
+		f = f[1:]
+		for len(f) > 0 && strings.Count(f[0], ":") == 2 {
+			var d IsoDescriptor
+			if _, err := fmt.Sscanf(f[0], "%d:%d:%d", &d.Status, &d.Offset, &d.Length); err != nil {
+				return nil, ErrMalformed
+			}
+			ev.IsoDescriptors = append(ev.IsoDescriptors, d)
+			f = f[1:]
+		}
+	}
+
+	if len(f) == 0 {
+		return ev, nil
+	}
+	length, err := strconv.Atoi(f[0])
+	if err != nil {
+		return nil, ErrMalformed
+	}
+	ev.Length = length
+	f = f[1:]
+	if len(f) == 0 {
+		return ev, nil
+	}
+	if len(f[0]) != 1 {
+		return nil, ErrMalformed
+	}
+	if f[0] != "=" {
+		ev.DataFlag = f[0][0]
+		return ev, nil
+	}
+	// Data words are just the bytes in order, split into fours
+	data, err := hex.DecodeString(strings.Join(f[1:], ""))
+	if err != nil {
+		return nil, ErrMalformed
+	}
+	ev.Data = data
+	return ev, nil
+}
+
+// e.g. "Bi:1:003:2"
+func parseTextAddress(ev *Event, word string) bool {
+	parts := strings.Split(word, ":")
+	if len(parts) != 4 || len(parts[0]) != 2 {
+		return false
+	}
+	ttype, ok := textTypes[parts[0][0]]
+	if !ok {
+		return false
+	}
+	ev.TransferType = ttype
+	switch parts[0][1] {
+	case 'i':
+		ev.Endpoint = usb.DIR_IN
+	case 'o':
+	default:
+		return false
+	}
+	bus, err1 := strconv.Atoi(parts[1])
+	dev, err2 := strconv.Atoi(parts[2])
+	ep, err3 := strconv.ParseUint(parts[3], 10, 4)
+	if err1 != nil || err2 != nil || err3 != nil {
+		return false
+	}
+	ev.Bus, ev.Device = bus, dev
+	ev.Endpoint |= byte(ep)
+	return true
+}
+
+// The event as a line of the text "u" format, without the trailing
+// newline. Unlike the kernel, this never cuts short the data or the
+// list of isochronous packets.
+func (e *Event) Text() string {
+	var b strings.Builder
+	// The kernel keeps only 4096 seconds' worth of timestamp in text,
+	// so wall clock times from binary captures have to be cut down
+	us := int64(e.Timestamp / time.Microsecond)
+	if us >= 1<<32 {
+		us = (us/1000000)%4096*1000000 + us%1000000
+	}
+	dir := byte('o')
+	if e.In() {
+		dir = 'i'
+	}
+	fmt.Fprintf(&b, "%x %d %c %c%c:%d:%03d:%d", e.ID, us, e.Type,
+		textTypeLetters[e.TransferType&usb.TRANSFER_TYPE_MASK], dir,
+		e.Bus, e.Device, e.Endpoint&0x0f)
+
+	switch {
+	case e.Setup != nil:
+		s := e.Setup
+		fmt.Fprintf(&b, " s %02x %02x %04x %04x %04x", s.BmRequestType, s.BRequest, s.WValue, s.WIndex, s.WLength)
+	case e.SetupFlag != 0 && e.SetupFlag != '-':
+		fmt.Fprintf(&b, " %c __ __ ____ ____ ____", e.SetupFlag)
+	case e.Type == EVENT_ERROR:
+		fmt.Fprintf(&b, " %d", e.Status)
+	case e.TransferType == usb.TRANSFER_TYPE_ISOCHRONOUS:
+		fmt.Fprintf(&b, " %d:%d:%d", e.Status, e.Interval, e.StartFrame)
+		if e.Type == EVENT_COMPLETE {
+			fmt.Fprintf(&b, ":%d", e.ErrorCount)
+		}
+	case e.TransferType == usb.TRANSFER_TYPE_INTERRUPT:
+		fmt.Fprintf(&b, " %d:%d", e.Status, e.Interval)
+	default:
+		fmt.Fprintf(&b, " %d", e.Status)
+	}
+
+	if e.TransferType == usb.TRANSFER_TYPE_ISOCHRONOUS && e.Type != EVENT_ERROR {
+		fmt.Fprintf(&b, " %d", e.NumIsoPackets)
+		for _, d := range e.IsoDescriptors {
+			fmt.Fprintf(&b, " %d:%d:%d", d.Status, d.Offset, d.Length)
+		}
+	}
+
+	fmt.Fprintf(&b, " %d", e.Length)
+	if e.Length > 0 {
+		if e.DataFlag != 0 {
+			fmt.Fprintf(&b, " %c", e.DataFlag)
+		} else {
+			b.WriteString(" =")
+			for i := 0; i < len(e.Data); i += 4 {
+				end := i + 4
+				if end > len(e.Data) {
+					end = len(e.Data)
+				}
+				fmt.Fprintf(&b, " %x", e.Data[i:end])
+			}
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,103 @@
+package usbmon
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"reflect"
+	"testing"
+
+	"gopkg.thequux.com/usb"
+)
+
+// The events of testdata/session.txt: enumerating a device, setting
+// its configuration, then bulk, interrupt and isochronous transfers
+func readText(t *testing.T) []*Event {
+	f, err := os.Open("testdata/session.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	r := NewTextReader(f)
+	var events []*Event
+	for {
+		ev, err := r.Next()
+		if err == io.EOF {
+			return events
+		}
+		if err != nil {
+			t.Fatalf("line %d: %v", r.Line(), err)
+		}
+		events = append(events, ev)
+	}
+}
+
+func TestParseText(t *testing.T) {
+	events := readText(t)
+	if len(events) != 15 {
+		t.Fatalf("%d events, want 15", len(events))
+	}
+
+	want := &Event{
+		ID: 0xffff888004a3c0c0, Type: EVENT_SUBMIT, TransferType: usb.TRANSFER_TYPE_CONTROL,
+		Endpoint: 0x80, Bus: 1, Device: 5, Timestamp: 1000 * 1000, Status: -EINPROGRESS,
+		Setup:  &usb.SetupPacket{BmRequestType: 0x80, BRequest: usb.REQUEST_GET_DESCRIPTOR, WValue: 0x0100, WLength: 18},
+		Length: 18, DataFlag: '<',
+	}
+	if !reflect.DeepEqual(events[0], want) {
+		t.Errorf("GET_DESCRIPTOR submission:\n got %+v\nwant %+v", events[0], want)
+	}
+	if ev := events[1]; ev.Status != 0 || len(ev.Data) != 18 || ev.Data[8] != 0x47 || ev.SetupFlag != '-' {
+		t.Errorf("GET_DESCRIPTOR completion: %+v", ev)
+	}
+	if ev := events[6]; string(ev.Data) != "hello" || ev.Endpoint != 0x02 {
+		t.Errorf("bulk OUT submission: %+v", ev)
+	}
+	if ev := events[11]; ev.Interval != 8 || ev.Error() != usb.UsbErrorCancelled {
+		t.Errorf("interrupt completion: %+v", ev)
+	}
+	iso := events[13]
+	wantDescs := []IsoDescriptor{{0, 0, 4}, {0, 4, 3}}
+	if iso.NumIsoPackets != 2 || iso.StartFrame != 138 || !reflect.DeepEqual(iso.IsoDescriptors, wantDescs) || len(iso.Data) != 7 {
+		t.Errorf("isochronous completion: %+v", iso)
+	}
+	if ev := events[14]; ev.Type != EVENT_ERROR || ev.Status != -ENODEV {
+		t.Errorf("failed submission: %+v", ev)
+	}
+}
+
+// Each event is written back as the line it was read from
+func TestTextRoundTrip(t *testing.T) {
+	f, err := os.Open("testdata/session.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		ev, err := ParseText(scanner.Text())
+		if err != nil {
+			t.Fatalf("%s: %v", scanner.Text(), err)
+		}
+		if got := ev.Text(); got != scanner.Text() {
+			t.Errorf("\n got %s\nwant %s", got, scanner.Text())
+		}
+	}
+}
+
+func TestParseTextMalformed(t *testing.T) {
+	for _, line := range []string{
+		"",
+		"ffff888004a3c0c0 1000 S",
+		"ffff888004a3c0c0 1000 X Bo:1:005:2 -115 5 <",
+		"ffff888004a3c0c0 1000 S Xo:1:005:2 -115 5 <",
+		"ffff888004a3c0c0 1000 S Bo:1:005 -115 5 <",
+		"ffff888004a3c0c0 1000 S Co:1:005:0 s 00 09 0001",
+		"ffff888004a3c0c0 1000 S Bo:1:005:2 -115 5 = 6865zz",
+		"zzzz 1000 S Bo:1:005:2 -115 5 <",
+	} {
+		if _, err := ParseText(line); err != ErrMalformed {
+			t.Errorf("%q: %v", line, err)
+		}
+	}
+}
@@ -0,0 +1,199 @@
+// Parsing traffic captured with Linux's usbmon, in either of the
+// forms it comes in: the text of /sys/kernel/debug/usb/usbmon/Nu,
+// or the binary events of /dev/usbmonN. Both turn into the same
+// Event, one per URB submission, completion or submission error.
+//
+// Neither needs a live system; saved captures parse just the same:
+//
+//	cat /sys/kernel/debug/usb/usbmon/1u > capture.txt
+//	cat /dev/usbmon1 > capture.bin
+//
+//	r := usbmon.NewTextReader(f) // or usbmon.NewBinaryReader(f)
+//	for {
+//		ev, err := r.Next()
+//		if err != nil {
+//			break
+//		}
+//		fmt.Println(ev.Text())
+//		if ev.Setup != nil {
+//			fmt.Println(usbmon.DescribeSetup(*ev.Setup, 0))
+//		}
+//	}
+package usbmon
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"gopkg.thequux.com/usb"
+)
+
+var ErrMalformed = errors.New("usbmon: malformed event")
+
+// Event types, as the kernel writes them
+const (
+	EVENT_SUBMIT   = 'S'
+	EVENT_COMPLETE = 'C'
+	EVENT_ERROR    = 'E' // submission failed
+)
+
+// Reads events one at a time, returning io.EOF at the end; the text
+// and binary readers here are both EventReaders, as is the pcap reader
+// in usbpcap
+type EventReader interface {
+	Next() (*Event, error)
+}
+
+// One isochronous packet of a URB
+type IsoDescriptor struct {
+	Status int // negative errno, 0 for success
+	Offset int // into the transfer buffer
+	Length int // asked for on submission, actual on completion
+}
+
+// A URB event. The submission and the completion of a URB share an
+// ID, which is the kernel's address for the URB, so it may be reused
+// once the URB has completed.
+type Event struct {
+	ID           uint64
+	Type         byte // EVENT_*
+	TransferType int  // usb.TRANSFER_TYPE_*
+	Endpoint     byte // with the direction bit, for control too
+	Bus          int
+	Device       int
+
+	// Since an arbitrary epoch: the Unix epoch for binary captures,
+	// but only a wrapping microsecond counter for text ones
+	Timestamp time.Duration
+
+	// Negative errno; -EINPROGRESS for submissions
+	Status int
+
+	// Present for control submissions. SetupFlag is 0 when it was
+	// captured and otherwise says why not; it is '-' for events that
+	// have no setup packet at all.
+	Setup     *usb.SetupPacket
+	SetupFlag byte
+
+	// Interrupt and isochronous only
+	Interval int
+	// Isochronous only
+	StartFrame     int
+	ErrorCount     int
+	NumIsoPackets  int             // in the URB
+	IsoDescriptors []IsoDescriptor // as many as were captured
+
+	// Requested on submission, actual on completion
+	Length int
+	// What was captured of the data, which may be less than Length.
+	// DataFlag is 0 when there is data, and otherwise says why there
+	// isn't: '<' for IN submissions, '>' for OUT completions.
+	Data     []byte
+	DataFlag byte
+
+	// The URB's transfer_flags, for binary captures with the
+	// 64-byte header
+	Flags uint32
+}
+
+func (e *Event) In() bool {
+	return e.Endpoint&usb.DIR_MASK == usb.DIR_IN
+}
+
+// The status as the rest of the package would report it. Short
+// reads (-EREMOTEIO) and submissions in progress are not errors.
+func (e *Event) Error() *usb.UsbError {
+	return ErrorOf(e.Status)
+}
+
+// A URB status, a negative errno, as the rest of the package would
+// report it; the reverse of StatusOf
+func ErrorOf(status int) *usb.UsbError {
+	switch status {
+	case 0, -EINPROGRESS, -EREMOTEIO:
+		return nil
+	case -ENOENT, -ECONNRESET:
+		return usb.UsbErrorCancelled
+	case -EPIPE:
+		return usb.UsbErrorPipe
+	case -EOVERFLOW:
+		return usb.UsbErrorOverflow
+	case -ENODEV, -ESHUTDOWN:
+		return usb.UsbErrorNoDevice
+	case -ETIMEDOUT:
+		return usb.UsbErrorTimeout
+	}
+	return usb.UsbErrorIO
+}
+
+// The status the kernel would have given a URB that ended with err,
+// as near as can be told
+func StatusOf(err *usb.UsbError) int {
+	switch err {
+	case nil:
+		return 0
+	case usb.UsbErrorCancelled:
+		return -ENOENT
+	case usb.UsbErrorPipe:
+		return -EPIPE
+	case usb.UsbErrorOverflow:
+		return -EOVERFLOW
+	case usb.UsbErrorNoDevice:
+		return -ENODEV
+	case usb.UsbErrorTimeout:
+		return -ETIMEDOUT
+	case usb.UsbErrorIO:
+		return -EPROTO
+	}
+	return -EIO
+}
+
+// The errnos that turn up as URB statuses. These are Linux's numbers
+// whatever the system doing the parsing.
+const (
+	ENOENT      = 2
+	EIO         = 5
+	EXDEV       = 18
+	ENODEV      = 19
+	EPIPE       = 32
+	ENOSR       = 63
+	ECOMM       = 70
+	EPROTO      = 71
+	EOVERFLOW   = 75
+	EILSEQ      = 84
+	EREMOTEIO   = 121
+	ECONNRESET  = 104
+	ESHUTDOWN   = 108
+	ETIMEDOUT   = 110
+	EINPROGRESS = 115
+)
+
+var errnoNames = map[int]string{
+	ENOENT:      "ENOENT",
+	EIO:         "EIO",
+	EXDEV:       "EXDEV",
+	ENODEV:      "ENODEV",
+	EPIPE:       "EPIPE",
+	ENOSR:       "ENOSR",
+	ECOMM:       "ECOMM",
+	EPROTO:      "EPROTO",
+	EOVERFLOW:   "EOVERFLOW",
+	EILSEQ:      "EILSEQ",
+	EREMOTEIO:   "EREMOTEIO",
+	ECONNRESET:  "ECONNRESET",
+	ESHUTDOWN:   "ESHUTDOWN",
+	ETIMEDOUT:   "ETIMEDOUT",
+	EINPROGRESS: "EINPROGRESS",
+}
+
+// A status in words, e.g. "-EPIPE"
+func StatusText(status int) string {
+	if status == 0 {
+		return "0"
+	}
+	if name, ok := errnoNames[-status]; ok {
+		return "-" + name
+	}
+	return fmt.Sprint(status)
+}
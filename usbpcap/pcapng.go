@@ -0,0 +1,159 @@
+// Captures of USB traffic in the formats Wireshark and tcpdump use.
+// A Reader gives the usbmon events of a pcap or pcapng file. A Writer
+// writes pcapng, and is a usb.Tracer, so the transfers a program makes
+// can be captured without root or usbmon:
+//
+//	f, _ := os.Create("trace.pcapng")
+//	w, _ := usbpcap.NewWriter(f)
+//	ctx.SetTracer(w)
+//
+// Packets use LINKTYPE_USB_LINUX_MMAPPED, which is a usbmon binary
+// event, so Wireshark's USB dissectors see just what they would have
+// if the traffic had been captured from the kernel.
+package usbpcap
+
+import (
+	"encoding/binary"
+	"io"
+	"sync"
+
+	"gopkg.thequux.com/usb"
+	"gopkg.thequux.com/usb/usbmon"
+)
+
+const (
+	LINKTYPE_USB_LINUX         = 189
+	LINKTYPE_USB_LINUX_MMAPPED = 220
+)
+
+// pcapng block types
+const (
+	blockSectionHeader        = 0x0A0D0D0A
+	blockInterfaceDescription = 0x00000001
+	blockEnhancedPacket       = 0x00000006
+
+	byteOrderMagic = 0x1A2B3C4D
+)
+
+// pcapng option codes
+const (
+	optEndOfOpt  = 0
+	optIfName    = 2
+	optShbUserAp = 4
+	optIfTsresol = 9
+)
+
+var le = binary.LittleEndian
+
+// Writes pcapng with a single interface of LINKTYPE_USB_LINUX_MMAPPED
+type Writer struct {
+	lock sync.Mutex
+	w    io.Writer
+	err  error
+
+	// Tracing state; see trace.go
+	next      uint64
+	ids       map[*usb.Transfer]uint64
+	intervals map[intervalKey]int
+}
+
+// Start a capture on w, writing the section and interface headers
+// straight away
+func NewWriter(w io.Writer) (*Writer, error) {
+	pw := &Writer{
+		w:         w,
+		ids:       make(map[*usb.Transfer]uint64),
+		intervals: make(map[intervalKey]int),
+	}
+
+	var shb []byte
+	shb = le.AppendUint32(shb, byteOrderMagic)
+	shb = le.AppendUint16(shb, 1) // version 1.0
+	shb = le.AppendUint16(shb, 0)
+	shb = le.AppendUint64(shb, 0xffffffffffffffff) // section length unknown
+	shb = appendOption(shb, optShbUserAp, []byte("gousb"))
+	shb = appendOption(shb, optEndOfOpt, nil)
+	pw.writeBlock(blockSectionHeader, shb)
+
+	var idb []byte
+	idb = le.AppendUint16(idb, LINKTYPE_USB_LINUX_MMAPPED)
+	idb = le.AppendUint16(idb, 0)
+	idb = le.AppendUint32(idb, 0) // no snap length
+	idb = appendOption(idb, optIfName, []byte("gousb"))
+	idb = appendOption(idb, optIfTsresol, []byte{6}) // microseconds, as usbmon has
+	idb = appendOption(idb, optEndOfOpt, nil)
+	pw.writeBlock(blockInterfaceDescription, idb)
+
+	if pw.err != nil {
+		return nil, pw.err
+	}
+	return pw, nil
+}
+
+// The first error writing the capture, if any. Once there has been
+// one, nothing more is written.
+func (pw *Writer) Err() error {
+	pw.lock.Lock()
+	defer pw.lock.Unlock()
+	return pw.err
+}
+
+// Write a usbmon event as a packet, stamped with its own timestamp,
+// which is taken to be since the Unix epoch
+func (pw *Writer) WriteEvent(ev *usbmon.Event) error {
+	pw.lock.Lock()
+	defer pw.lock.Unlock()
+	pw.writeEvent(ev)
+	return pw.err
+}
+
+// Call with the lock held
+func (pw *Writer) writeEvent(ev *usbmon.Event) {
+	pkt := ev.AppendBinary(nil, usbmon.HEADER_LEN_MMAPPED, le)
+	// The original length is what would have been captured had
+	// there been no limit; for isochronous IN completions the kernel
+	// captures the whole buffer, which is ev.Data already.
+	orig := len(pkt)
+	if missing := ev.Length - len(ev.Data); missing > 0 && ev.DataFlag == 0 {
+		orig += missing
+	}
+
+	ts := uint64(ev.Timestamp.Microseconds())
+	var epb []byte
+	epb = le.AppendUint32(epb, 0) // interface
+	epb = le.AppendUint32(epb, uint32(ts>>32))
+	epb = le.AppendUint32(epb, uint32(ts))
+	epb = le.AppendUint32(epb, uint32(len(pkt)))
+	epb = le.AppendUint32(epb, uint32(orig))
+	epb = append(epb, pad(pkt)...)
+	pw.writeBlock(blockEnhancedPacket, epb)
+}
+
+// Write a block around its body, which must be padded already. Call
+// with the lock held, or before anyone else has the Writer.
+func (pw *Writer) writeBlock(btype uint32, body []byte) {
+	if pw.err != nil {
+		return
+	}
+	total := uint32(12 + len(body))
+	var buf []byte
+	buf = le.AppendUint32(buf, btype)
+	buf = le.AppendUint32(buf, total)
+	buf = append(buf, body...)
+	buf = le.AppendUint32(buf, total)
+	_, pw.err = pw.w.Write(buf)
+}
+
+func appendOption(buf []byte, code uint16, value []byte) []byte {
+	buf = le.AppendUint16(buf, code)
+	buf = le.AppendUint16(buf, uint16(len(value)))
+	return append(buf, pad(value)...)
+}
+
+// Pad to a multiple of 4 bytes
+func pad(buf []byte) []byte {
+	if n := len(buf) % 4; n != 0 {
+		return append(buf[:len(buf):len(buf)], make([]byte, 4-n)...)
+	}
+	return buf
+}
@@ -0,0 +1,197 @@
+package usbpcap
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+
+	"gopkg.thequux.com/usb/usbmon"
+)
+
+var (
+	ErrNotCapture = errors.New("usbpcap: not a pcap or pcapng file")
+	ErrMalformed  = errors.New("usbpcap: malformed capture")
+)
+
+// pcap file magic, in the order it was written
+const (
+	pcapMagic     = 0xa1b2c3d4
+	pcapMagicNsec = 0xa1b23c4d
+)
+
+// The most a packet can hold: usbmon's header, its isochronous
+// descriptors and the 256 KiB of data Wireshark captures at most. A
+// block can be bigger by its own fields and options. Lengths past these
+// are taken for corruption rather than allocated.
+const (
+	maxPacket = usbmon.HEADER_LEN_MMAPPED + usbmon.ISO_DESCRIPTOR_MAX*usbmon.ISO_DESCRIPTOR_LEN + 256<<10
+	maxBlock  = maxPacket + 64<<10
+)
+
+const (
+	blockPacket       = 0x00000002 // obsolete, but still read
+	blockSimplePacket = 0x00000003
+)
+
+// Reads the USB packets of a pcap or pcapng file, such as Wireshark or
+// tcpdump saves from a usbmon interface, as usbmon events. Packets of
+// other link types are skipped.
+type Reader struct {
+	r  *bufio.Reader
+	ng bool
+
+	// The byte order of the file, and of the usbmon headers in it
+	order binary.ByteOrder
+	// pcap: the link type of the whole file; pcapng: of each
+	// interface of the current section
+	linktype   int
+	interfaces []int
+}
+
+// Start reading a capture, telling pcap from pcapng by the first few
+// bytes
+func NewReader(r io.Reader) (*Reader, error) {
+	pr := &Reader{r: bufio.NewReader(r)}
+	head, err := pr.r.Peek(4)
+	if err != nil {
+		return nil, ErrNotCapture
+	}
+	if binary.LittleEndian.Uint32(head) == blockSectionHeader {
+		pr.ng = true
+		return pr, nil
+	}
+
+	hdr := make([]byte, 24)
+	if _, err := io.ReadFull(pr.r, hdr); err != nil {
+		return nil, ErrNotCapture
+	}
+	for _, order := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+		switch order.Uint32(hdr) {
+		case pcapMagic, pcapMagicNsec:
+			pr.order = order
+		}
+	}
+	if pr.order == nil {
+		return nil, ErrNotCapture
+	}
+	pr.linktype = int(pr.order.Uint32(hdr[20:]) & 0xffff)
+	return pr, nil
+}
+
+// The next USB event, or io.EOF at the end
+func (pr *Reader) Next() (*usbmon.Event, error) {
+	for {
+		linktype, data, err := pr.next()
+		if err != nil {
+			return nil, err
+		}
+		switch linktype {
+		case LINKTYPE_USB_LINUX:
+			return usbmon.ParseBinary(data, usbmon.HEADER_LEN, pr.order)
+		case LINKTYPE_USB_LINUX_MMAPPED:
+			return usbmon.ParseBinary(data, usbmon.HEADER_LEN_MMAPPED, pr.order)
+		}
+	}
+}
+
+// The next packet of any link type
+func (pr *Reader) next() (int, []byte, error) {
+	if !pr.ng {
+		hdr := make([]byte, 16)
+		if _, err := io.ReadFull(pr.r, hdr); err != nil {
+			return 0, nil, readError(err, false)
+		}
+		incl_len := pr.order.Uint32(hdr[8:])
+		if incl_len > maxPacket {
+			return 0, nil, ErrMalformed
+		}
+		data := make([]byte, incl_len)
+		if _, err := io.ReadFull(pr.r, data); err != nil {
+			return 0, nil, readError(err, true)
+		}
+		return pr.linktype, data, nil
+	}
+
+	for {
+		btype, body, err := pr.block()
+		if err != nil {
+			return 0, nil, err
+		}
+		switch btype {
+		case blockInterfaceDescription:
+			if len(body) < 8 {
+				return 0, nil, ErrMalformed
+			}
+			pr.interfaces = append(pr.interfaces, int(pr.order.Uint16(body)))
+		case blockEnhancedPacket, blockPacket:
+			if len(body) < 20 {
+				return 0, nil, ErrMalformed
+			}
+			var iface int
+			if btype == blockEnhancedPacket {
+				iface = int(pr.order.Uint32(body))
+			} else {
+				iface = int(pr.order.Uint16(body))
+			}
+			caplen := int(pr.order.Uint32(body[12:]))
+			if iface >= len(pr.interfaces) || caplen > len(body)-20 {
+				return 0, nil, ErrMalformed
+			}
+			return pr.interfaces[iface], body[20 : 20+caplen], nil
+		case blockSimplePacket:
+			if len(body) < 4 || len(pr.interfaces) == 0 {
+				return 0, nil, ErrMalformed
+			}
+			data := body[4:]
+			if orig := int(pr.order.Uint32(body)); orig < len(data) {
+				data = data[:orig]
+			}
+			return pr.interfaces[0], data, nil
+		}
+	}
+}
+
+// Read a pcapng block. A section header starts a new section, with its
+// own byte order and interfaces.
+func (pr *Reader) block() (uint32, []byte, error) {
+	hdr := make([]byte, 8)
+	if _, err := io.ReadFull(pr.r, hdr); err != nil {
+		return 0, nil, readError(err, false)
+	}
+	if binary.LittleEndian.Uint32(hdr) == blockSectionHeader {
+		magic, err := pr.r.Peek(4)
+		if err != nil {
+			return 0, nil, readError(err, true)
+		}
+		switch {
+		case binary.LittleEndian.Uint32(magic) == byteOrderMagic:
+			pr.order = binary.LittleEndian
+		case binary.BigEndian.Uint32(magic) == byteOrderMagic:
+			pr.order = binary.BigEndian
+		default:
+			return 0, nil, ErrMalformed
+		}
+		pr.interfaces = nil
+	}
+	if pr.order == nil {
+		return 0, nil, ErrMalformed
+	}
+	total := pr.order.Uint32(hdr[4:])
+	if total < 12 || total%4 != 0 || total > maxBlock {
+		return 0, nil, ErrMalformed
+	}
+	body := make([]byte, total-8)
+	if _, err := io.ReadFull(pr.r, body); err != nil {
+		return 0, nil, readError(err, true)
+	}
+	return pr.order.Uint32(hdr), body[:len(body)-4], nil
+}
+
+// Only running out of file between records is a clean end
+func readError(err error, midway bool) error {
+	if err == io.ErrUnexpectedEOF || (midway && err == io.EOF) {
+		return ErrMalformed
+	}
+	return err
+}
@@ -0,0 +1,67 @@
+package usbpcap_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"runtime"
+	"testing"
+
+	"gopkg.thequux.com/usb/usbpcap"
+)
+
+// Lengths far past what any USB packet needs are reported rather than
+// allocated
+func TestReaderLengths(t *testing.T) {
+	le := binary.LittleEndian
+	pcap := func(incl_len uint32) []byte {
+		hdr := le.AppendUint32(nil, 0xa1b2c3d4)
+		hdr = le.AppendUint16(hdr, 2)
+		hdr = le.AppendUint16(hdr, 4)
+		hdr = append(hdr, make([]byte, 8)...)
+		hdr = le.AppendUint32(hdr, 0) // snap length
+		hdr = le.AppendUint32(hdr, usbpcap.LINKTYPE_USB_LINUX_MMAPPED)
+		rec := make([]byte, 8)
+		rec = le.AppendUint32(rec, incl_len)
+		return le.AppendUint32(append(hdr, rec...), incl_len)
+	}
+	pcapng := func(block_type, total uint32) []byte {
+		// A section and interface as the Writer starts them
+		var buf bytes.Buffer
+		if _, err := usbpcap.NewWriter(&buf); err != nil {
+			t.Fatal(err)
+		}
+		block := le.AppendUint32(buf.Bytes(), block_type)
+		block = le.AppendUint32(block, total)
+		// Byte order magic, in case it's a section header
+		block = le.AppendUint32(block, 0x1a2b3c4d)
+		return append(block, make([]byte, 64)...)
+	}
+
+	tests := []struct {
+		name string
+		file []byte
+	}{
+		{"pcap", pcap(0xffffffff)},
+		{"pcap, 1 GiB", pcap(1 << 30)},
+		{"pcapng packet", pcapng(0x00000006, 0xfffffffc)},
+		{"pcapng packet, 1 GiB", pcapng(0x00000006, 1<<30)},
+		{"pcapng unknown block", pcapng(0x00000bad, 1<<30)},
+		{"pcapng section", pcapng(0x0a0d0d0a, 1<<30)},
+	}
+	for _, test := range tests {
+		r, err := usbpcap.NewReader(bytes.NewReader(test.file))
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		var before, after runtime.MemStats
+		runtime.ReadMemStats(&before)
+		if _, err := r.Next(); err != usbpcap.ErrMalformed {
+			t.Errorf("%s: %v, want %v", test.name, err, usbpcap.ErrMalformed)
+		}
+		runtime.ReadMemStats(&after)
+		if n := after.TotalAlloc - before.TotalAlloc; n > 1<<20 {
+			t.Errorf("%s: allocated %d bytes", test.name, n)
+		}
+	}
+}
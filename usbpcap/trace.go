@@ -0,0 +1,153 @@
+package usbpcap
+
+import (
+	"time"
+
+	"gopkg.thequux.com/usb"
+	"gopkg.thequux.com/usb/usbmon"
+)
+
+// URB transfer_flags that the kernel would have set
+const (
+	urbIsoASAP = 0x0002
+	urbDirIn   = 0x0200
+)
+
+type intervalKey struct {
+	h        *usb.DeviceHandle
+	endpoint byte
+}
+
+func (pw *Writer) TraceSubmit(h *usb.DeviceHandle, t *usb.Transfer) {
+	pw.lock.Lock()
+	defer pw.lock.Unlock()
+	pw.next++
+	pw.ids[t] = pw.next
+	ev := pw.event(h, t, usbmon.EVENT_SUBMIT)
+	ev.Status = -usbmon.EINPROGRESS
+	ev.Length = len(t.Buffer)
+	if t.Type == usb.TRANSFER_TYPE_CONTROL {
+		ev.SetupFlag = 0
+		setup := t.Setup
+		ev.Setup = &setup
+	}
+	if t.In() {
+		ev.DataFlag = '<'
+	} else {
+		ev.Data = append([]byte(nil), t.Buffer...)
+	}
+	offset := 0
+	for _, p := range t.IsoPackets {
+		ev.IsoDescriptors = append(ev.IsoDescriptors, usbmon.IsoDescriptor{Offset: offset, Length: p.Length})
+		offset += p.Length
+	}
+	if t.Type == usb.TRANSFER_TYPE_ISOCHRONOUS && !t.In() {
+		ev.Data = ev.Data[:offset]
+	}
+	pw.writeEvent(ev)
+}
+
+func (pw *Writer) TraceComplete(h *usb.DeviceHandle, t *usb.Transfer) {
+	pw.lock.Lock()
+	defer pw.lock.Unlock()
+	ev := pw.event(h, t, usbmon.EVENT_COMPLETE)
+	delete(pw.ids, t)
+	ev.Status = usbmon.StatusOf(t.Status)
+	ev.Length = t.Actual
+	offset := 0
+	for _, p := range t.IsoPackets {
+		status := usbmon.StatusOf(p.Status)
+		if status != 0 {
+			ev.ErrorCount++
+		}
+		ev.IsoDescriptors = append(ev.IsoDescriptors, usbmon.IsoDescriptor{Status: status, Offset: offset, Length: p.Actual})
+		offset += p.Length
+	}
+	switch {
+	case !t.In():
+		ev.DataFlag = '>'
+	case t.Type == usb.TRANSFER_TYPE_ISOCHRONOUS:
+		// The packets are where they landed, gaps and all
+		ev.Data = append([]byte(nil), t.Buffer[:offset]...)
+	case t.Actual <= len(t.Buffer):
+		ev.Data = append([]byte(nil), t.Buffer[:t.Actual]...)
+	default:
+		ev.Data = append([]byte(nil), t.Buffer...)
+	}
+	pw.writeEvent(ev)
+}
+
+func (pw *Writer) TraceError(h *usb.DeviceHandle, t *usb.Transfer, err *usb.UsbError) {
+	pw.lock.Lock()
+	defer pw.lock.Unlock()
+	ev := pw.event(h, t, usbmon.EVENT_ERROR)
+	delete(pw.ids, t)
+	ev.Status = usbmon.StatusOf(err)
+	ev.DataFlag = '>'
+	if t.In() {
+		ev.DataFlag = '<'
+	}
+	pw.writeEvent(ev)
+}
+
+// The parts of an event that are the same for submission and
+// completion. Call with the lock held.
+func (pw *Writer) event(h *usb.DeviceHandle, t *usb.Transfer, etype byte) *usbmon.Event {
+	bus, addr := h.GetDevice().GetDeviceAddress()
+	ev := &usbmon.Event{
+		ID:           pw.ids[t],
+		Type:         etype,
+		TransferType: t.Type,
+		Endpoint:     t.Endpoint,
+		Bus:          bus,
+		Device:       addr,
+		Timestamp:    time.Duration(time.Now().UnixNano()),
+		SetupFlag:    '-',
+	}
+	if t.In() {
+		ev.Endpoint |= usb.DIR_IN
+		ev.Flags |= urbDirIn
+	}
+	switch t.Type {
+	case usb.TRANSFER_TYPE_ISOCHRONOUS:
+		ev.Flags |= urbIsoASAP
+		ev.NumIsoPackets = len(t.IsoPackets)
+		ev.Interval = pw.interval(h, t.Endpoint)
+	case usb.TRANSFER_TYPE_INTERRUPT:
+		ev.Interval = pw.interval(h, t.Endpoint)
+	}
+	return ev
+}
+
+// The interval of a periodic endpoint as the kernel has it in the
+// URB: in frames for full and low speed interrupt endpoints, and
+// otherwise in (micro)frames from the exponent in bInterval. Call
+// with the lock held.
+func (pw *Writer) interval(h *usb.DeviceHandle, endpoint byte) int {
+	key := intervalKey{h, endpoint}
+	if interval, ok := pw.intervals[key]; ok {
+		return interval
+	}
+	dev := h.GetDevice()
+	cfg, err := dev.GetActiveConfigDescriptor()
+	if err != nil {
+		return 0
+	}
+	interval := 0
+	for _, alts := range cfg.Interfaces {
+		for _, alt := range alts {
+			for _, ep := range alt.Endpoints {
+				if ep.BEndpointAddress != endpoint || interval != 0 {
+					continue
+				}
+				interval = int(ep.BInterval)
+				exponent := dev.GetSpeed() >= usb.SPEED_HIGH || ep.BmAttributes&usb.TRANSFER_TYPE_MASK == usb.TRANSFER_TYPE_ISOCHRONOUS
+				if exponent && interval >= 1 && interval <= 16 {
+					interval = 1 << (interval - 1)
+				}
+			}
+		}
+	}
+	pw.intervals[key] = interval
+	return interval
+}
@@ -0,0 +1,284 @@
+package usbpcap_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"testing"
+	"time"
+
+	"gopkg.thequux.com/usb"
+	"gopkg.thequux.com/usb/usbmon"
+	"gopkg.thequux.com/usb/usbpcap"
+	"gopkg.thequux.com/usb/usbtest"
+)
+
+// A device at 3:9 with a vendor control request, a bulk OUT endpoint
+// that stalls on "stall", a bulk IN endpoint and an isochronous IN one
+func tracedDevice() *usbtest.Device {
+	return &usbtest.Device{
+		Bus:        3,
+		Address:    9,
+		Speed:      usb.SPEED_HIGH,
+		Descriptor: usb.DeviceDescriptor{BcdUSB: 0x0200, BMaxPacketSize0: 64, IdVendor: 0x2047, IdProduct: 0x0200},
+		Configs: []usb.ConfigDescriptor{{
+			BConfigurationValue: 1,
+			Interfaces: [][]usb.InterfaceDescriptor{{{
+				Endpoints: []usb.EndpointDescriptor{
+					{BEndpointAddress: 0x01, BmAttributes: usb.TRANSFER_TYPE_BULK, WMaxPacketSize: 512},
+					{BEndpointAddress: 0x81, BmAttributes: usb.TRANSFER_TYPE_BULK, WMaxPacketSize: 512},
+					{BEndpointAddress: 0x83, BmAttributes: usb.TRANSFER_TYPE_ISOCHRONOUS, WMaxPacketSize: 8, BInterval: 4},
+				},
+			}}},
+		}},
+		Control: func(req *usbtest.Request) ([]byte, *usb.UsbError) {
+			if req.Setup.BmRequestType == usb.DIR_IN|usb.REQUEST_TYPE_VENDOR && req.Setup.BRequest == 0x01 {
+				return []byte{1, 4}, nil
+			}
+			return nil, usb.UsbErrorPipe
+		},
+		Endpoints: map[byte]usbtest.Handler{
+			0x01: func(req *usbtest.Request) ([]byte, *usb.UsbError) {
+				if string(req.Data) == "stall" {
+					return nil, usb.UsbErrorPipe
+				}
+				return nil, nil
+			},
+			0x81: func(req *usbtest.Request) ([]byte, *usb.UsbError) {
+				return []byte("pong"), nil
+			},
+			0x83: func(req *usbtest.Request) ([]byte, *usb.UsbError) {
+				return []byte("abcdefghijklmnopqrst"), nil
+			},
+		},
+	}
+}
+
+// Make transfers of every kind, traced: a control read, a bulk write
+// and one that stalls, a bulk read, an isochronous read of three
+// packets, and a write refused because the device has gone
+func traceTransfers(t *testing.T, w *usbpcap.Writer) {
+	dev := tracedDevice()
+	ctx := usbtest.NewContext(dev)
+	h, err := ctx.Open(0x2047, 0x0200)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	if err := h.GetInterface(0).Claim(); err != nil {
+		t.Fatal(err)
+	}
+	ctx.SetTracer(w)
+
+	transfers := []*usb.Transfer{
+		{Type: usb.TRANSFER_TYPE_CONTROL, Buffer: make([]byte, 2), Setup: usb.SetupPacket{
+			BmRequestType: usb.DIR_IN | usb.REQUEST_TYPE_VENDOR, BRequest: 0x01, WValue: 0x1234, WIndex: 2}},
+		{Type: usb.TRANSFER_TYPE_BULK, Endpoint: 0x01, Buffer: []byte("ping")},
+		{Type: usb.TRANSFER_TYPE_BULK, Endpoint: 0x01, Buffer: []byte("stall")},
+		{Type: usb.TRANSFER_TYPE_BULK, Endpoint: 0x81, Buffer: make([]byte, 64)},
+		{Type: usb.TRANSFER_TYPE_ISOCHRONOUS, Endpoint: 0x83, Buffer: make([]byte, 24),
+			IsoPackets: []usb.IsoPacket{{Length: 8}, {Length: 8}, {Length: 8}}},
+	}
+	for _, tr := range transfers {
+		if err := h.Submit(tr); err != nil {
+			t.Fatal(err)
+		}
+		tr.Wait()
+	}
+	dev.Disconnect()
+	tr := &usb.Transfer{Type: usb.TRANSFER_TYPE_BULK, Endpoint: 0x01, Buffer: []byte("gone")}
+	if err := h.Submit(tr); err != usb.UsbErrorNoDevice {
+		t.Fatalf("submitted to an unplugged device: %v", err)
+	}
+}
+
+// The blocks of a little-endian pcapng file, by type and body
+type block struct {
+	btype uint32
+	body  []byte
+}
+
+func readBlocks(t *testing.T, data []byte) []block {
+	var blocks []block
+	for len(data) > 0 {
+		if len(data) < 12 {
+			t.Fatalf("%d bytes left over", len(data))
+		}
+		total := binary.LittleEndian.Uint32(data[4:])
+		if total < 12 || total%4 != 0 || int(total) > len(data) ||
+			binary.LittleEndian.Uint32(data[total-4:]) != total {
+			t.Fatalf("bad block length %d", total)
+		}
+		blocks = append(blocks, block{binary.LittleEndian.Uint32(data), data[8 : total-4]})
+		data = data[total:]
+	}
+	return blocks
+}
+
+func TestTrace(t *testing.T) {
+	var capture bytes.Buffer
+	w, err := usbpcap.NewWriter(&capture)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	traceTransfers(t, w)
+	end := time.Now()
+	if err := w.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The interface says microseconds, and each packet is stamped
+	// with its event's time
+	var stamps []int64
+	for _, b := range readBlocks(t, capture.Bytes()) {
+		switch b.btype {
+		case 0x00000001:
+			if linktype := binary.LittleEndian.Uint16(b.body); linktype != usbpcap.LINKTYPE_USB_LINUX_MMAPPED {
+				t.Errorf("link type %d", linktype)
+			}
+			tsresol := -1
+			for opts := b.body[8:]; len(opts) >= 4; {
+				code, length := binary.LittleEndian.Uint16(opts), int(binary.LittleEndian.Uint16(opts[2:]))
+				if code == 9 && length == 1 {
+					tsresol = int(opts[4])
+				}
+				opts = opts[4+(length+3)&^3:]
+			}
+			if tsresol != 6 {
+				t.Errorf("if_tsresol %d, want 6", tsresol)
+			}
+		case 0x00000006:
+			ts := int64(binary.LittleEndian.Uint32(b.body[4:]))<<32 | int64(binary.LittleEndian.Uint32(b.body[8:]))
+			stamps = append(stamps, ts)
+		}
+	}
+
+	r, err := usbpcap.NewReader(bytes.NewReader(capture.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var events []*usbmon.Event
+	for {
+		ev, err := r.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		events = append(events, ev)
+	}
+	// Five transfers submitted and completed, and one submitted and
+	// refused
+	if len(events) != 12 || len(stamps) != len(events) {
+		t.Fatalf("%d events in %d packets, want 12", len(events), len(stamps))
+	}
+
+	submitted := make(map[uint64]*usbmon.Event)
+	for i, ev := range events {
+		if ev.Bus != 3 || ev.Device != 9 {
+			t.Errorf("event %d from %d:%d, want 3:9", i, ev.Bus, ev.Device)
+		}
+		if ev.Timestamp.Microseconds() != stamps[i] {
+			t.Errorf("event %d at %dµs in a packet stamped %dµs", i, ev.Timestamp.Microseconds(), stamps[i])
+		}
+		if ev.Timestamp < time.Duration(start.UnixNano()).Truncate(time.Microsecond) ||
+			ev.Timestamp > time.Duration(end.UnixNano()) {
+			t.Errorf("event %d at %v, outside the test", i, ev.Timestamp)
+		}
+		if ev.Type == usbmon.EVENT_SUBMIT {
+			if submitted[ev.ID] != nil || ev.ID == 0 {
+				t.Errorf("event %d: ID %d used twice", i, ev.ID)
+			}
+			submitted[ev.ID] = ev
+			if ev.Status != -usbmon.EINPROGRESS {
+				t.Errorf("submission %d with status %d", i, ev.Status)
+			}
+			continue
+		}
+		s := submitted[ev.ID]
+		if s == nil {
+			t.Errorf("event %d: %c with no submission", i, ev.Type)
+			continue
+		}
+		delete(submitted, ev.ID)
+		if s.Endpoint != ev.Endpoint || s.TransferType != ev.TransferType || s.Flags != ev.Flags {
+			t.Errorf("event %d: %c %02x type %d flags %x for S %02x type %d flags %x", i,
+				ev.Type, ev.Endpoint, ev.TransferType, ev.Flags, s.Endpoint, s.TransferType, s.Flags)
+		}
+	}
+	if len(submitted) != 0 {
+		t.Errorf("%d submissions never ended", len(submitted))
+	}
+
+	// The control read, with its setup packet
+	s, c := events[0], events[1]
+	want := usb.SetupPacket{BmRequestType: usb.DIR_IN | usb.REQUEST_TYPE_VENDOR, BRequest: 0x01, WValue: 0x1234, WIndex: 2, WLength: 2}
+	if s.Endpoint != 0x80 || s.SetupFlag != 0 || s.Setup == nil || *s.Setup != want {
+		t.Errorf("control submission to %02x with setup %c %+v", s.Endpoint, s.SetupFlag, s.Setup)
+	}
+	if s.Length != 2 || s.DataFlag != '<' {
+		t.Errorf("control submission of %d, flag %c", s.Length, s.DataFlag)
+	}
+	if c.Status != 0 || c.Length != 2 || !bytes.Equal(c.Data, []byte{1, 4}) {
+		t.Errorf("control completion %d with %x, status %d", c.Length, c.Data, c.Status)
+	}
+
+	// The bulk write, and the one that stalled
+	s, c = events[2], events[3]
+	if s.Endpoint != 0x01 || s.Flags&0x200 != 0 || string(s.Data) != "ping" {
+		t.Errorf("bulk OUT submission to %02x, flags %x, with %q", s.Endpoint, s.Flags, s.Data)
+	}
+	if c.Status != 0 || c.Length != 4 || c.DataFlag != '>' {
+		t.Errorf("bulk OUT completion of %d, flag %c, status %d", c.Length, c.DataFlag, c.Status)
+	}
+	if c = events[5]; c.Status != -usbmon.EPIPE || c.Length != 0 {
+		t.Errorf("stalled bulk OUT completion of %d, status %d", c.Length, c.Status)
+	}
+
+	// The bulk read
+	s, c = events[6], events[7]
+	if s.Endpoint != 0x81 || s.Flags&0x200 == 0 || s.Length != 64 || s.DataFlag != '<' {
+		t.Errorf("bulk IN submission to %02x, flags %x, of %d, flag %c", s.Endpoint, s.Flags, s.Length, s.DataFlag)
+	}
+	if c.Length != 4 || string(c.Data) != "pong" {
+		t.Errorf("bulk IN completion of %d with %q", c.Length, c.Data)
+	}
+
+	// The isochronous read: each packet at its own offset, the last
+	// one short
+	s, c = events[8], events[9]
+	if s.Endpoint != 0x83 || s.TransferType != usb.TRANSFER_TYPE_ISOCHRONOUS || s.NumIsoPackets != 3 || s.Interval != 8 {
+		t.Errorf("isochronous submission to %02x of %d packets every %d", s.Endpoint, s.NumIsoPackets, s.Interval)
+	}
+	wantIso := []usbmon.IsoDescriptor{{Offset: 0, Length: 8}, {Offset: 8, Length: 8}, {Offset: 16, Length: 8}}
+	if !isoEqual(s.IsoDescriptors, wantIso) {
+		t.Errorf("isochronous submission descriptors %+v", s.IsoDescriptors)
+	}
+	wantIso[2].Length = 4
+	if !isoEqual(c.IsoDescriptors, wantIso) || c.NumIsoPackets != 3 || c.ErrorCount != 0 {
+		t.Errorf("isochronous completion descriptors %+v, %d errors", c.IsoDescriptors, c.ErrorCount)
+	}
+	if c.Length != 20 || string(c.Data[:20]) != "abcdefghijklmnopqrst" {
+		t.Errorf("isochronous completion of %d with %q", c.Length, c.Data)
+	}
+
+	// The write refused
+	s, e := events[10], events[11]
+	if e.Type != usbmon.EVENT_ERROR || e.ID != s.ID || e.Status != -usbmon.ENODEV {
+		t.Errorf("refused write ended with %c, status %d", e.Type, e.Status)
+	}
+}
+
+func isoEqual(a, b []usbmon.IsoDescriptor) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,405 @@
+package usbtest
+
+import (
+	"sync"
+	"time"
+
+	"gopkg.thequux.com/usb"
+)
+
+// A usb.Backend whose devices are all virtual
+type Backend struct {
+	lock    sync.Mutex
+	devices []*Device
+}
+
+func NewBackend(devices ...*Device) *Backend {
+	b := &Backend{}
+	for _, d := range devices {
+		b.Add(d)
+	}
+	return b
+}
+
+// A context with just the given devices attached
+func NewContext(devices ...*Device) *usb.Context {
+	return usb.NewContext(NewBackend(devices...))
+}
+
+// Plug in another device. Devices without an address get the next
+// free one on bus 1.
+func (b *Backend) Add(d *Device) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if d.Bus == 0 {
+		d.Bus = 1
+	}
+	if d.Address == 0 {
+		d.Address = len(b.devices) + 1
+	}
+	d.lock.Lock()
+	d.start()
+	d.lock.Unlock()
+	b.devices = append(b.devices, d)
+}
+
+func (b *Backend) GetDeviceList() ([]usb.BackendDevice, *usb.UsbError) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	var ret []usb.BackendDevice
+	for _, d := range b.devices {
+		if !d.Disconnected() {
+			ret = append(ret, &backendDevice{d})
+		}
+	}
+	return ret, nil
+}
+
+func (b *Backend) SetDebug(level int) {}
+
+// Simulated devices' drivers can be detached, as Device.KernelDrivers says
+func (b *Backend) HasCapability(capability int) bool {
+	return capability == usb.CAP_HAS_CAPABILITY || capability == usb.CAP_SUPPORTS_DETACH_KERNEL_DRIVER
+}
+
+func (b *Backend) Close() {}
+
+// The Device seen through the usb.BackendDevice interface, so that
+// its methods don't clutter Device
+type backendDevice struct {
+	d *Device
+}
+
+func (bd *backendDevice) GetBusNumber() int {
+	return bd.d.Bus
+}
+
+func (bd *backendDevice) GetAddress() int {
+	return bd.d.Address
+}
+
+func (bd *backendDevice) GetSpeed() usb.Speed {
+	return bd.d.Speed
+}
+
+func (bd *backendDevice) GetDeviceDescriptor() (usb.DeviceDescriptor, *usb.UsbError) {
+	return bd.d.deviceDescriptor(), nil
+}
+
+// Round trip through the wire format, so that what the code under
+// test sees is what a real device would have given it
+func (bd *backendDevice) GetConfigDescriptor(config_index int) (usb.ConfigDescriptor, *usb.UsbError) {
+	if config_index < 0 || config_index >= len(bd.d.Configs) {
+		return usb.ConfigDescriptor{}, usb.UsbErrorNotFound
+	}
+	return usb.ParseConfigDescriptor(bd.d.Configs[config_index].Bytes())
+}
+
+func (bd *backendDevice) GetActiveConfigDescriptor() (usb.ConfigDescriptor, *usb.UsbError) {
+	bd.d.lock.Lock()
+	cfg, ok := bd.d.findConfig(bd.d.config)
+	bd.d.lock.Unlock()
+	if !ok {
+		return usb.ConfigDescriptor{}, usb.UsbErrorNotFound
+	}
+	return usb.ParseConfigDescriptor(cfg.Bytes())
+}
+
+func (bd *backendDevice) Open() (usb.BackendHandle, *usb.UsbError) {
+	if bd.d.Disconnected() {
+		return nil, usb.UsbErrorNoDevice
+	}
+	return &handle{d: bd.d, pending: make(map[*usb.Transfer]*pending)}, nil
+}
+
+// An open virtual device
+type handle struct {
+	d       *Device
+	lock    sync.Mutex
+	closed  bool
+	pending map[*usb.Transfer]*pending
+}
+
+// Check that the handle can still be used
+func (h *handle) check() *usb.UsbError {
+	h.lock.Lock()
+	closed := h.closed
+	h.lock.Unlock()
+	if closed || h.d.Disconnected() {
+		return usb.UsbErrorNoDevice
+	}
+	return nil
+}
+
+func (h *handle) Close() {
+	h.lock.Lock()
+	h.closed = true
+	h.lock.Unlock()
+	h.d.lock.Lock()
+	for iface, owner := range h.d.claimed {
+		if owner == h {
+			delete(h.d.claimed, iface)
+		}
+	}
+	h.d.lock.Unlock()
+}
+
+func (h *handle) GetConfiguration() (int, *usb.UsbError) {
+	if err := h.check(); err != nil {
+		return 0, err
+	}
+	return h.d.Configuration(), nil
+}
+
+func (h *handle) SetConfiguration(config int) *usb.UsbError {
+	if err := h.check(); err != nil {
+		return err
+	}
+	d := h.d
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if config < 0 {
+		config = 0
+	}
+	if _, ok := d.findConfig(config); !ok && config != 0 {
+		return usb.UsbErrorNotFound
+	}
+	if len(d.claimed) > 0 {
+		return usb.UsbErrorBusy
+	}
+	d.config = config
+	d.alts = make(map[byte]byte)
+	d.halted = make(map[byte]bool)
+	return nil
+}
+
+func (h *handle) ClaimInterface(iface_no int) *usb.UsbError {
+	if err := h.check(); err != nil {
+		return err
+	}
+	d := h.d
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if _, ok := d.findAlt(byte(iface_no), 0); !ok {
+		return usb.UsbErrorNotFound
+	}
+	if owner, ok := d.claimed[byte(iface_no)]; (ok && owner != h) || d.drivers[byte(iface_no)] {
+		return usb.UsbErrorBusy
+	}
+	d.claimed[byte(iface_no)] = h
+	return nil
+}
+
+func (h *handle) ReleaseInterface(iface_no int) *usb.UsbError {
+	if err := h.check(); err != nil {
+		return err
+	}
+	d := h.d
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if d.claimed[byte(iface_no)] != h {
+		return usb.UsbErrorNotFound
+	}
+	delete(d.claimed, byte(iface_no))
+	return nil
+}
+
+func (h *handle) SetInterfaceAltSetting(iface_no, alt int) *usb.UsbError {
+	if err := h.check(); err != nil {
+		return err
+	}
+	d := h.d
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if d.claimed[byte(iface_no)] != h {
+		return usb.UsbErrorNotFound
+	}
+	if _, ok := d.findAlt(byte(iface_no), byte(alt)); !ok {
+		return usb.UsbErrorNotFound
+	}
+	d.alts[byte(iface_no)] = byte(alt)
+	return nil
+}
+
+func (h *handle) KernelDriverActive(iface_no int) (bool, *usb.UsbError) {
+	if err := h.check(); err != nil {
+		return false, err
+	}
+	h.d.lock.Lock()
+	defer h.d.lock.Unlock()
+	return h.d.drivers[byte(iface_no)], nil
+}
+
+func (h *handle) AttachKernelDriver(iface_no int) *usb.UsbError {
+	if err := h.check(); err != nil {
+		return err
+	}
+	h.d.lock.Lock()
+	defer h.d.lock.Unlock()
+	if _, ok := h.d.claimed[byte(iface_no)]; ok {
+		return usb.UsbErrorBusy
+	}
+	h.d.drivers[byte(iface_no)] = true
+	return nil
+}
+
+func (h *handle) DetachKernelDriver(iface_no int) *usb.UsbError {
+	if err := h.check(); err != nil {
+		return err
+	}
+	h.d.lock.Lock()
+	defer h.d.lock.Unlock()
+	if !h.d.drivers[byte(iface_no)] {
+		return usb.UsbErrorNotFound
+	}
+	delete(h.d.drivers, byte(iface_no))
+	return nil
+}
+
+func (h *handle) ClearHalt(endpoint byte) *usb.UsbError {
+	if err := h.check(); err != nil {
+		return err
+	}
+	h.d.lock.Lock()
+	defer h.d.lock.Unlock()
+	delete(h.d.halted, endpoint)
+	return nil
+}
+
+// A reset puts the device back in its first configuration
+func (h *handle) Reset() *usb.UsbError {
+	if err := h.check(); err != nil {
+		return err
+	}
+	d := h.d
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.config = 0
+	if len(d.Configs) > 0 {
+		d.config = d.Configs[0].BConfigurationValue
+	}
+	d.alts = make(map[byte]byte)
+	d.halted = make(map[byte]bool)
+	return nil
+}
+
+//////////////////////// Transfers
+
+type pending struct {
+	t      *usb.Transfer
+	cancel chan struct{}
+	once   sync.Once
+}
+
+func (h *handle) SubmitTransfer(t *usb.Transfer) *usb.UsbError {
+	if err := h.check(); err != nil {
+		return err
+	}
+	p := &pending{t: t, cancel: make(chan struct{})}
+	h.lock.Lock()
+	h.pending[t] = p
+	h.lock.Unlock()
+	go h.run(p)
+	return nil
+}
+
+func (h *handle) CancelTransfer(t *usb.Transfer) *usb.UsbError {
+	h.lock.Lock()
+	p, ok := h.pending[t]
+	h.lock.Unlock()
+	if !ok {
+		return usb.UsbErrorNotFound
+	}
+	p.once.Do(func() { close(p.cancel) })
+	return nil
+}
+
+func (h *handle) finish(p *pending, actual int, status *usb.UsbError) {
+	h.lock.Lock()
+	delete(h.pending, p.t)
+	h.lock.Unlock()
+	p.t.Complete(actual, status)
+}
+
+// Carry out a transfer: NAK for as long as asked to, then let the
+// device handle it
+func (h *handle) run(p *pending) {
+	t := p.t
+	d := h.d
+	var timeout <-chan time.Time
+	if t.Timeout > 0 {
+		timer := time.NewTimer(t.Timeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	d.lock.Lock()
+	delay := d.naks[t.Endpoint]
+	gone := d.gone
+	d.lock.Unlock()
+
+	var nak <-chan time.Time
+	if delay > 0 {
+		timer := time.NewTimer(delay)
+		defer timer.Stop()
+		nak = timer.C
+	}
+	if delay != 0 {
+		select {
+		case <-nak:
+		case <-timeout:
+			h.finish(p, 0, usb.UsbErrorTimeout)
+			return
+		case <-p.cancel:
+			h.finish(p, 0, usb.UsbErrorCancelled)
+			return
+		case <-gone:
+			h.finish(p, 0, usb.UsbErrorNoDevice)
+			return
+		}
+	}
+	if err := h.check(); err != nil {
+		h.finish(p, 0, err)
+		return
+	}
+
+	req := &Request{Endpoint: t.Endpoint, Setup: t.Setup}
+	if t.In() {
+		req.Length = len(t.Buffer)
+	} else {
+		req.Data = append([]byte(nil), t.Buffer...)
+	}
+	resp, err := d.handle(h, req)
+	if err != nil {
+		h.finish(p, 0, err)
+		return
+	}
+	if !t.In() {
+		for i := range t.IsoPackets {
+			t.IsoPackets[i].Actual = t.IsoPackets[i].Length
+		}
+		h.finish(p, len(t.Buffer), nil)
+		return
+	}
+
+	switch {
+	case t.Type == usb.TRANSFER_TYPE_CONTROL && len(resp) > len(t.Buffer):
+		resp = resp[:len(t.Buffer)]
+	case len(resp) > len(t.Buffer):
+		h.finish(p, copy(t.Buffer, resp), usb.UsbErrorOverflow)
+		return
+	}
+	if t.Type == usb.TRANSFER_TYPE_ISOCHRONOUS {
+		// Fill the packets in order, each from the start of its slot
+		offset, actual := 0, 0
+		for i := range t.IsoPackets {
+			pkt := &t.IsoPackets[i]
+			pkt.Actual = copy(t.Buffer[offset:offset+pkt.Length], resp)
+			resp = resp[pkt.Actual:]
+			offset += pkt.Length
+			actual += pkt.Actual
+		}
+		h.finish(p, actual, nil)
+		return
+	}
+	h.finish(p, copy(t.Buffer, resp), nil)
+}
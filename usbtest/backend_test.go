@@ -0,0 +1,140 @@
+package usbtest_test
+
+import (
+	"testing"
+	"time"
+
+	"gopkg.thequux.com/usb"
+	"gopkg.thequux.com/usb/usbtest"
+)
+
+func openEcho(t *testing.T, dev *usbtest.Device) (*usb.Context, *usbtest.EchoHandle) {
+	ctx := usbtest.NewContext(dev)
+	h, err := usbtest.OpenEcho(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(h.Close)
+	return ctx, h
+}
+
+func TestHalt(t *testing.T) {
+	dev := usbtest.NewEchoDevice()
+	_, h := openEcho(t, dev)
+	dev.Halt(0x81)
+	buf := make([]byte, 512)
+	if _, err := h.In.Read(buf); err != usb.UsbErrorPipe {
+		t.Fatalf("read from halted endpoint: %v", err)
+	}
+	if err := h.In.ClearHalt(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := h.In.Read(buf); err != nil {
+		t.Fatalf("read after clearing halt: %v", err)
+	}
+}
+
+func TestTimeoutAndCancel(t *testing.T) {
+	dev := usbtest.NewEchoDevice()
+	_, h := openEcho(t, dev)
+	dev.SetNAK(0x81, usbtest.NAKForever)
+	h.In.SetTimeout(20 * time.Millisecond)
+	if _, err := h.In.Read(make([]byte, 512)); err != usb.UsbErrorTimeout {
+		t.Fatalf("read from NAKing endpoint: %v", err)
+	}
+
+	tr := &usb.Transfer{Type: usb.TRANSFER_TYPE_BULK, Endpoint: 0x81, Buffer: make([]byte, 512)}
+	if err := h.Submit(tr); err != nil {
+		t.Fatal(err)
+	}
+	tr.Cancel()
+	if err := tr.Wait(); err != usb.UsbErrorCancelled {
+		t.Fatalf("cancelled transfer: %v", err)
+	}
+}
+
+func TestDisconnect(t *testing.T) {
+	dev := usbtest.NewEchoDevice()
+	ctx, h := openEcho(t, dev)
+	dev.SetNAK(0x81, usbtest.NAKForever)
+	tr := &usb.Transfer{Type: usb.TRANSFER_TYPE_BULK, Endpoint: 0x81, Buffer: make([]byte, 512)}
+	if err := h.Submit(tr); err != nil {
+		t.Fatal(err)
+	}
+	dev.Disconnect()
+	if err := tr.Wait(); err != usb.UsbErrorNoDevice {
+		t.Fatalf("transfer in flight when unplugged: %v", err)
+	}
+	if devs, _ := ctx.GetDeviceList(); len(devs) != 0 {
+		t.Fatalf("%d devices listed after unplugging", len(devs))
+	}
+	if _, err := h.GetConfiguration(); err != usb.UsbErrorNoDevice {
+		t.Fatalf("unplugged device: %v", err)
+	}
+}
+
+// A closed context stays closed, rather than starting libusb in place
+// of the backend it was made with
+func TestClosedContext(t *testing.T) {
+	ctx := usbtest.NewContext(usbtest.NewEchoDevice())
+	ctx.Close()
+	if devs, err := ctx.GetDeviceList(); err != usb.UsbErrorNoDevice {
+		t.Fatalf("listed %d devices after closing, with %v", len(devs), err)
+	}
+	if _, err := ctx.Open(usbtest.ECHO_VENDOR, usbtest.ECHO_PRODUCT); err == nil {
+		t.Fatal("opened a device after closing")
+	}
+}
+
+// Flushing the string cache chooses the language again, but keeps one
+// that was set
+func TestDefaultLangId(t *testing.T) {
+	dev := usbtest.NewEchoDevice()
+	dev.LangIds = []uint16{0x0407, usb.LANGID_ENGLISH_US}
+	_, h := openEcho(t, dev)
+	if l, err := h.GetDefaultLangId(); err != nil || l != usb.LANGID_ENGLISH_US {
+		t.Fatalf("default language 0x%04x, %v", l, err)
+	}
+
+	dev.LangIds = []uint16{0x0407}
+	h.FlushStringCache()
+	if l, err := h.GetDefaultLangId(); err != nil || l != 0x0407 {
+		t.Fatalf("after flushing, default language 0x%04x, %v", l, err)
+	}
+
+	h.SetDefaultLangId(0x040c)
+	dev.LangIds = []uint16{usb.LANGID_ENGLISH_US}
+	h.FlushStringCache()
+	if l, err := h.GetDefaultLangId(); err != nil || l != 0x040c {
+		t.Fatalf("after setting and flushing, default language 0x%04x, %v", l, err)
+	}
+}
+
+// A function that can't be claimed whole leaves the interfaces as they
+// were
+func TestClaimFunctionRollback(t *testing.T) {
+	dev := usbtest.NewEchoDevice()
+	cfg := &dev.Configs[0]
+	for n := byte(1); n <= 2; n++ {
+		cfg.Interfaces = append(cfg.Interfaces, []usb.InterfaceDescriptor{{BInterfaceNumber: n, BInterfaceClass: usb.CLASS_VENDOR}})
+	}
+	dev.KernelDrivers = map[byte]bool{2: true}
+	h, err := usbtest.NewContext(dev).Open(usbtest.ECHO_VENDOR, usbtest.ECHO_PRODUCT)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	if err := h.GetInterface(0).Claim(); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.ClaimFunction(usb.Function{BFirstInterface: 0, BInterfaceCount: 3}); err != usb.UsbErrorBusy {
+		t.Fatalf("claimed a function with a bound interface: %v", err)
+	}
+	// Only claimed interfaces can have their alternate setting chosen
+	if err := h.GetInterface(0).SetAlternate(0); err != nil {
+		t.Errorf("interface 0 was released: %v", err)
+	}
+	if err := h.GetInterface(1).SetAlternate(0); err != usb.UsbErrorNotFound {
+		t.Errorf("interface 1 is still claimed: %v", err)
+	}
+}
@@ -0,0 +1,254 @@
+package usbtest
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"sync"
+
+	"gopkg.thequux.com/usb"
+	"gopkg.thequux.com/usb/usbmon"
+)
+
+var ErrNotInCapture = errors.New("usbtest: device not found in capture")
+
+// How closely requests to a Recorded device have to follow the
+// capture
+type Strictness int
+
+const (
+	// Each request must be the next one captured on its endpoint,
+	// with the same setup packet and the same data sent
+	MATCH_STRICT Strictness = iota
+	// A request is answered by the first unused capture it matches,
+	// in setup packet (but for wLength) and data sent, in any order
+	MATCH_UNORDERED
+	// As MATCH_UNORDERED, but without comparing the data sent, and
+	// once the captures a request matches are used up, the last of
+	// them answers it again. This suits devices that are polled.
+	MATCH_LOOSE
+)
+
+// One captured request and the device's reply
+type exchange struct {
+	setup  usb.SetupPacket
+	sent   []byte
+	length int // of what was sent, which may be more than was captured
+	reply  []byte
+	status *usb.UsbError
+	used   bool
+}
+
+// A device that stands in for one seen in a capture, such as a
+// Wireshark capture of usbmon read with usbpcap.Reader:
+//
+//	r, _ := usbpcap.NewReader(f)
+//	rec, err := usbtest.FromCapture(r, 0x2047, 0x0200)
+//	ctx := usbtest.NewContext(rec.Device)
+//
+// Its descriptors are those the host read while enumerating it.
+// Other requests, on the control endpoint and on the rest, are
+// answered with the reply captured for the matching request; requests
+// that match nothing stall and are kept for Unmatched. A text capture
+// only holds the first 32 bytes of each transfer, so binary ones are
+// better.
+type Recorded struct {
+	*Device
+	Strictness Strictness
+
+	lock      sync.Mutex
+	exchanges map[byte][]*exchange // by endpoint address, 0 for control
+	unmatched []Request
+}
+
+// Build a device from the first one in the capture with the given
+// vendor and product IDs. The capture has to include its device
+// descriptor being read.
+func FromCapture(r usbmon.EventReader, vendor, product uint16) (*Recorded, error) {
+	var events []*usbmon.Event
+	for {
+		ev, err := r.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, ev)
+	}
+
+	// Pair each submission with its completion
+	type urb struct{ submit, complete *usbmon.Event }
+	var urbs []*urb
+	pending := make(map[uint64]*urb)
+	for _, ev := range events {
+		switch ev.Type {
+		case usbmon.EVENT_SUBMIT:
+			u := &urb{submit: ev}
+			pending[ev.ID] = u
+			urbs = append(urbs, u)
+		case usbmon.EVENT_COMPLETE:
+			if u, ok := pending[ev.ID]; ok {
+				u.complete = ev
+				delete(pending, ev.ID)
+			}
+		}
+	}
+
+	// Find the device by its device descriptor. It is read first at
+	// address 0, so the address it ends up with has to be read too.
+	bus, addr := -1, -1
+	for _, u := range urbs {
+		s := u.submit.Setup
+		if u.complete == nil || s == nil || s.BmRequestType != usb.DIR_IN|usb.REQUEST_TYPE_STANDARD|usb.RECIPIENT_DEVICE ||
+			s.BRequest != usb.REQUEST_GET_DESCRIPTOR || usb.DescriptorType(s.WValue>>8) != usb.DT_DEVICE {
+			continue
+		}
+		data := u.complete.Data
+		if u.submit.Device != 0 && len(data) >= 12 &&
+			uint16(data[8])|uint16(data[9])<<8 == vendor && uint16(data[10])|uint16(data[11])<<8 == product {
+			bus, addr = u.submit.Bus, u.submit.Device
+			break
+		}
+	}
+	if addr < 0 {
+		return nil, ErrNotInCapture
+	}
+
+	rec := &Recorded{
+		Device:    &Device{Bus: bus, Address: addr, Descriptors: make(map[uint16][]byte)},
+		exchanges: make(map[byte][]*exchange),
+	}
+	rec.Device.Control = rec.handle
+	rec.Device.Endpoints = make(map[byte]Handler)
+	for _, u := range urbs {
+		if u.complete == nil || u.submit.Bus != bus || u.submit.Device != addr {
+			continue
+		}
+		rec.add(u.submit, u.complete)
+	}
+
+	raw, ok := rec.Device.Descriptors[uint16(usb.DT_DEVICE)<<8]
+	if !ok {
+		return nil, ErrNotInCapture
+	}
+	desc, err := usb.ParseDeviceDescriptor(raw)
+	if err != nil {
+		return nil, err
+	}
+	rec.Device.Descriptor = desc
+	for i := 0; i < int(desc.BNumConfigurations); i++ {
+		raw, ok := rec.Device.Descriptors[uint16(usb.DT_CONFIG)<<8|uint16(i)]
+		if !ok {
+			break
+		}
+		cfg, err := usb.ParseConfigDescriptor(raw)
+		if err != nil {
+			return nil, err
+		}
+		rec.Device.Configs = append(rec.Device.Configs, cfg)
+	}
+	return rec, nil
+}
+
+// Take in one transfer of the device
+func (rec *Recorded) add(submit, complete *usbmon.Event) {
+	endpoint := submit.Endpoint
+	x := &exchange{status: complete.Error()}
+	if submit.TransferType == usb.TRANSFER_TYPE_CONTROL {
+		if submit.Setup == nil {
+			return
+		}
+		endpoint = 0
+		x.setup = *submit.Setup
+	}
+	if submit.Endpoint&usb.DIR_MASK == usb.DIR_IN {
+		x.reply = complete.Data
+		if submit.TransferType == usb.TRANSFER_TYPE_ISOCHRONOUS {
+			// Close up the gaps between packets
+			x.reply = nil
+			for _, d := range complete.IsoDescriptors {
+				if d.Offset+d.Length <= len(complete.Data) {
+					x.reply = append(x.reply, complete.Data[d.Offset:d.Offset+d.Length]...)
+				}
+			}
+		}
+	} else {
+		x.sent = submit.Data
+		x.length = submit.Length
+	}
+
+	s := x.setup
+	if endpoint == 0 && s.BmRequestType&usb.REQUEST_TYPE_MASK == usb.REQUEST_TYPE_STANDARD && answersItself(s) {
+		// Keep the descriptors, longest read wins; the rest of these
+		// the Device answers itself
+		if s.BRequest == usb.REQUEST_GET_DESCRIPTOR && x.status == nil {
+			key := s.WValue
+			if len(x.reply) > len(rec.Device.Descriptors[key]) {
+				rec.Device.Descriptors[key] = x.reply
+			}
+		}
+		return
+	}
+	if endpoint != 0 {
+		rec.Device.Endpoints[endpoint] = rec.handle
+	}
+	rec.exchanges[endpoint] = append(rec.exchanges[endpoint], x)
+}
+
+// The requests that matched nothing in the capture, in order
+func (rec *Recorded) Unmatched() []Request {
+	rec.lock.Lock()
+	defer rec.lock.Unlock()
+	return append([]Request(nil), rec.unmatched...)
+}
+
+func (rec *Recorded) handle(req *Request) ([]byte, *usb.UsbError) {
+	rec.lock.Lock()
+	defer rec.lock.Unlock()
+	if x := rec.match(req); x != nil {
+		x.used = true
+		return x.reply, x.status
+	}
+	rec.unmatched = append(rec.unmatched, *req)
+	return nil, usb.UsbErrorPipe
+}
+
+// Find the capture that answers a request; call with the lock held
+func (rec *Recorded) match(req *Request) *exchange {
+	var last *exchange
+	for _, x := range rec.exchanges[req.Endpoint] {
+		if rec.Strictness == MATCH_STRICT {
+			if x.used {
+				continue
+			}
+			if x.setup == req.Setup && sameData(x, req.Data) {
+				return x
+			}
+			return nil
+		}
+
+		s := x.setup
+		s.WLength = req.Setup.WLength
+		if s != req.Setup || (rec.Strictness != MATCH_LOOSE && !sameData(x, req.Data)) {
+			continue
+		}
+		if !x.used {
+			return x
+		}
+		last = x
+	}
+	if rec.Strictness == MATCH_LOOSE {
+		return last
+	}
+	return nil
+}
+
+// Compare what was sent with what was captured of it, which may have
+// been cut short
+func sameData(x *exchange, data []byte) bool {
+	if len(data) != x.length {
+		return false
+	}
+	return bytes.HasPrefix(data, x.sent)
+}
@@ -0,0 +1,119 @@
+package usbtest_test
+
+import (
+	"os"
+	"strings"
+	"testing"
+
+	"gopkg.thequux.com/usb"
+	"gopkg.thequux.com/usb/usbpcap"
+	"gopkg.thequux.com/usb/usbtest"
+)
+
+// testdata/echo.pcap holds the root hub's device descriptor being
+// read, then an echo device much like NewEchoDevice's, but with its
+// OUT endpoint at 0x02, being enumerated at address 0 and then 7, and
+// a driver asking it for its version and echoing "hello" and "again"
+func fromCapture(t *testing.T, vendor, product uint16) (*usbtest.Recorded, error) {
+	f, err := os.Open("testdata/echo.pcap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	r, err := usbpcap.NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return usbtest.FromCapture(r, vendor, product)
+}
+
+// Echo msg, as the captured driver did
+func echo(t *testing.T, rec *usbtest.Recorded, msg string) (string, *usb.UsbError) {
+	h, err := usbtest.OpenEcho(usbtest.NewContext(rec.Device))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	if _, err := h.Out.Write([]byte(msg)); err != nil {
+		return "", err.(*usb.UsbError)
+	}
+	buf := make([]byte, 512)
+	n, rerr := h.In.Read(buf)
+	if rerr != nil {
+		return "", rerr.(*usb.UsbError)
+	}
+	return string(buf[:n]), nil
+}
+
+func TestFromCapture(t *testing.T) {
+	rec, err := fromCapture(t, usbtest.ECHO_VENDOR, usbtest.ECHO_PRODUCT)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec.Bus != 1 || rec.Address != 7 {
+		t.Errorf("found at %d:%d, want 1:7", rec.Bus, rec.Address)
+	}
+	h, uerr := usbtest.NewContext(rec.Device).Open(usbtest.ECHO_VENDOR, usbtest.ECHO_PRODUCT)
+	if uerr != nil {
+		t.Fatal(uerr)
+	}
+	if product, err := h.GetProduct(); product != "Echo" || err != nil {
+		t.Errorf("product %q, %v", product, err)
+	}
+	version := make([]byte, 2)
+	if n, err := h.ControlTransfer(usb.DIR_IN|usb.REQUEST_TYPE_VENDOR, 0x01, 0, 0, version, 0); n != 2 || version[0] != 1 || version[1] != 4 || err != nil {
+		t.Errorf("version %v, %v", version[:n], err)
+	}
+	cfg, _ := h.GetDevice().GetActiveConfigDescriptor()
+	if eps := cfg.Interfaces[0][0].Endpoints; len(eps) != 2 || eps[0].BEndpointAddress != 0x81 || eps[1].BEndpointAddress != 0x02 {
+		t.Errorf("endpoints %+v", eps)
+	}
+	h.Close()
+
+	for _, msg := range []string{"hello", "again"} {
+		if got, err := echo(t, rec, msg); got != strings.ToUpper(msg) || err != nil {
+			t.Errorf("echo %q: got %q, %v", msg, got, err)
+		}
+	}
+	if n := len(rec.Unmatched()); n != 0 {
+		t.Errorf("%d requests unmatched", n)
+	}
+
+	// Everything captured is used up
+	if _, err := echo(t, rec, "hello"); err != usb.UsbErrorPipe {
+		t.Errorf("echo beyond the capture: %v", err)
+	}
+}
+
+func TestFromCaptureStrictness(t *testing.T) {
+	// Strictly, requests have to come in the order captured
+	rec, _ := fromCapture(t, usbtest.ECHO_VENDOR, usbtest.ECHO_PRODUCT)
+	if _, err := echo(t, rec, "again"); err != usb.UsbErrorPipe {
+		t.Errorf("strict, out of order: %v", err)
+	}
+	if u := rec.Unmatched(); len(u) != 1 || string(u[0].Data) != "again" {
+		t.Errorf("strict, unmatched: %+v", u)
+	}
+
+	rec, _ = fromCapture(t, usbtest.ECHO_VENDOR, usbtest.ECHO_PRODUCT)
+	rec.Strictness = usbtest.MATCH_UNORDERED
+	if got, err := echo(t, rec, "again"); err != nil || got != "HELLO" {
+		// Replies on each endpoint still come in the order captured
+		t.Errorf("unordered: got %q, %v", got, err)
+	}
+
+	// Loosely, the last reply is given again once they run out
+	rec, _ = fromCapture(t, usbtest.ECHO_VENDOR, usbtest.ECHO_PRODUCT)
+	rec.Strictness = usbtest.MATCH_LOOSE
+	for i, want := range []string{"HELLO", "AGAIN", "AGAIN"} {
+		if got, err := echo(t, rec, "anything"); err != nil || got != want {
+			t.Errorf("loose, %d: got %q, %v", i, got, err)
+		}
+	}
+}
+
+func TestFromCaptureNotFound(t *testing.T) {
+	if _, err := fromCapture(t, 0xdead, 0xbeef); err != usbtest.ErrNotInCapture {
+		t.Errorf("absent device: %v", err)
+	}
+}
@@ -0,0 +1,378 @@
+// Virtual devices, defined in Go, for testing drivers without
+// hardware. A Device answers the standard requests itself from its
+// descriptors and strings, and hands everything else to handler
+// functions. A Backend full of them plugs into usb.NewContext, so the
+// code under test uses the normal GetDeviceList, Open and
+// OpenEndpoint:
+//
+//	dev := &usbtest.Device{
+//		Descriptor: usb.DeviceDescriptor{IdVendor: 0x2047, IdProduct: 0x0200},
+//		Configs:    []usb.ConfigDescriptor{cfg},
+//		Endpoints: map[byte]usbtest.Handler{
+//			0x81: func(req *usbtest.Request) ([]byte, *usb.UsbError) {
+//				return []byte{0x90}, nil
+//			},
+//		},
+//	}
+//	ctx := usbtest.NewContext(dev)
+//	h, err := ctx.Open(0x2047, 0x0200)
+//
+// Stalls, timeouts, slow endpoints and unplugging can be simulated
+// with Halt, SetNAK and Disconnect. NewEchoDevice is a ready-made
+// device for tests that just need something to talk to.
+package usbtest
+
+import (
+	"sync"
+	"time"
+	"unicode/utf16"
+
+	"gopkg.thequux.com/usb"
+)
+
+// A request to the device as a handler sees it
+type Request struct {
+	Endpoint byte            // address with the direction bit; 0 for control
+	Setup    usb.SetupPacket // control requests only
+	Data     []byte          // what the host sent, for OUT requests
+	Length   int             // how much the host will take, for IN requests
+}
+
+// Handles a request. For IN requests, return the data to send; a
+// control reply is cut to wLength, while a longer reply on any other
+// endpoint overflows the host's buffer. Returning an error fails the
+// request with it; usb.UsbErrorPipe stalls, and on anything but the
+// control endpoint also halts the endpoint until the halt is
+// cleared.
+type Handler func(req *Request) ([]byte, *usb.UsbError)
+
+// Adapt a HandleControl method, like those in msos and webusb, to a
+// Handler. Requests it doesn't answer stall.
+func ControlHandler(f func(bmRequestType, bRequest byte, wValue, wIndex, wLength uint16) ([]byte, bool)) Handler {
+	return func(req *Request) ([]byte, *usb.UsbError) {
+		s := req.Setup
+		if resp, ok := f(s.BmRequestType, s.BRequest, s.WValue, s.WIndex, s.WLength); ok {
+			return resp, nil
+		}
+		return nil, usb.UsbErrorPipe
+	}
+}
+
+// Wait forever; see SetNAK
+const NAKForever time.Duration = -1
+
+// A virtual device. Fill in the exported fields before handing it to
+// a Backend and leave them alone afterwards.
+type Device struct {
+	Bus, Address int
+	Speed        usb.Speed
+
+	// BLength, BDescriptorType and, if zero, BNumConfigurations are
+	// filled in. Configurations are encoded with usb.ConfigDescriptor.Bytes.
+	Descriptor usb.DeviceDescriptor
+	Configs    []usb.ConfigDescriptor
+
+	// String descriptors by index, in every language of LangIds.
+	// LangIds defaults to US English.
+	Strings map[byte]string
+	LangIds []uint16
+
+	// Any other descriptors to answer GET_DESCRIPTOR with, such as
+	// the BOS, by type<<8 | index. These take precedence over the
+	// ones built from the fields above.
+	Descriptors map[uint16][]byte
+
+	// Handles the control requests the device doesn't answer itself:
+	// every class and vendor request, and standard requests other
+	// than those for descriptors, configuration, alternate settings,
+	// status and halts. Nil stalls them all.
+	Control Handler
+	// Handlers for the other endpoints, by address. Endpoints without
+	// one stall.
+	Endpoints map[byte]Handler
+
+	// Interfaces that start out with a kernel driver bound
+	KernelDrivers map[byte]bool
+
+	lock       sync.Mutex
+	started    bool
+	config     int
+	alts       map[byte]byte
+	claimed    map[byte]*handle
+	halted     map[byte]bool
+	naks       map[byte]time.Duration
+	drivers    map[byte]bool
+	gone       chan struct{}
+	disconnect bool
+}
+
+// Set up the simulation state; called with the lock held
+func (d *Device) start() {
+	if d.started {
+		return
+	}
+	d.started = true
+	if len(d.Configs) > 0 {
+		d.config = d.Configs[0].BConfigurationValue
+	}
+	d.alts = make(map[byte]byte)
+	d.claimed = make(map[byte]*handle)
+	d.halted = make(map[byte]bool)
+	d.naks = make(map[byte]time.Duration)
+	d.drivers = make(map[byte]bool)
+	for iface, bound := range d.KernelDrivers {
+		d.drivers[iface] = bound
+	}
+	d.gone = make(chan struct{})
+}
+
+// Halt an endpoint, so that transfers on it stall until the halt is
+// cleared. Halting endpoint 0 stalls just the next control request.
+func (d *Device) Halt(endpoint byte) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.start()
+	d.halted[endpoint] = true
+}
+
+// Reports whether an endpoint is halted
+func (d *Device) Halted(endpoint byte) bool {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.start()
+	return d.halted[endpoint]
+}
+
+// Make an endpoint NAK for the given time before each transfer is
+// handled, so that transfers with a shorter timeout time out. With
+// NAKForever, transfers only end by timing out or being cancelled;
+// 0 turns NAKing off.
+func (d *Device) SetNAK(endpoint byte, delay time.Duration) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.start()
+	if delay == 0 {
+		delete(d.naks, endpoint)
+	} else {
+		d.naks[endpoint] = delay
+	}
+}
+
+// Unplug the device. It disappears from the device list, transfers
+// in flight end with usb.UsbErrorNoDevice and so does everything
+// done with its handles from then on.
+func (d *Device) Disconnect() {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.start()
+	if !d.disconnect {
+		d.disconnect = true
+		close(d.gone)
+	}
+}
+
+// Reports whether Disconnect was called
+func (d *Device) Disconnected() bool {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return d.disconnect
+}
+
+// The currently selected bConfigurationValue, 0 when unconfigured
+func (d *Device) Configuration() int {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.start()
+	return d.config
+}
+
+// The currently selected alternate setting of an interface
+func (d *Device) AltSetting(iface_no byte) byte {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.start()
+	return d.alts[iface_no]
+}
+
+func (d *Device) deviceDescriptor() usb.DeviceDescriptor {
+	desc := d.Descriptor
+	desc.BLength = 18
+	desc.BDescriptorType = usb.DT_DEVICE
+	if desc.BNumConfigurations == 0 {
+		desc.BNumConfigurations = byte(len(d.Configs))
+	}
+	return desc
+}
+
+func (d *Device) langIds() []uint16 {
+	if len(d.LangIds) == 0 {
+		return []uint16{usb.LANGID_ENGLISH_US}
+	}
+	return d.LangIds
+}
+
+// Find the configuration with the given value; called with the lock
+// held
+func (d *Device) findConfig(value int) (usb.ConfigDescriptor, bool) {
+	for _, cfg := range d.Configs {
+		if cfg.BConfigurationValue == value {
+			return cfg, true
+		}
+	}
+	return usb.ConfigDescriptor{}, false
+}
+
+// Find an alternate setting in the active configuration; called with
+// the lock held
+func (d *Device) findAlt(iface_no, alt byte) (usb.InterfaceDescriptor, bool) {
+	cfg, ok := d.findConfig(d.config)
+	if !ok {
+		return usb.InterfaceDescriptor{}, false
+	}
+	for _, alts := range cfg.Interfaces {
+		for _, desc := range alts {
+			if desc.BInterfaceNumber == iface_no && desc.BAlternateSetting == alt {
+				return desc, true
+			}
+		}
+	}
+	return usb.InterfaceDescriptor{}, false
+}
+
+// Answer GET_DESCRIPTOR from the device's descriptors
+func (d *Device) getDescriptor(dtype usb.DescriptorType, index byte) ([]byte, bool) {
+	if desc, ok := d.Descriptors[uint16(dtype)<<8|uint16(index)]; ok {
+		return desc, true
+	}
+	switch dtype {
+	case usb.DT_DEVICE:
+		return d.deviceDescriptor().Bytes(), index == 0
+	case usb.DT_CONFIG:
+		if int(index) < len(d.Configs) {
+			return d.Configs[index].Bytes(), true
+		}
+	case usb.DT_STRING:
+		if index == 0 {
+			buf := []byte{0, byte(usb.DT_STRING)}
+			for _, langid := range d.langIds() {
+				buf = append(buf, byte(langid), byte(langid>>8))
+			}
+			buf[0] = byte(len(buf))
+			return buf, true
+		}
+		if s, ok := d.Strings[index]; ok {
+			return encodeString(s), true
+		}
+	}
+	return nil, false
+}
+
+// Encode a string descriptor, cutting it short at the 255 byte limit
+func encodeString(s string) []byte {
+	buf := []byte{0, byte(usb.DT_STRING)}
+	for _, c := range utf16.Encode([]rune(s)) {
+		if len(buf)+2 > 255 {
+			break
+		}
+		buf = append(buf, byte(c), byte(c>>8))
+	}
+	buf[0] = byte(len(buf))
+	return buf
+}
+
+const featureEndpointHalt = 0
+
+// Answer one of the standard requests that answersItself picks out
+func (d *Device) standardRequest(h *handle, req *Request) ([]byte, *usb.UsbError) {
+	s := req.Setup
+	recipient := s.BmRequestType & usb.RECIPIENT_MASK
+	in := s.BmRequestType&usb.DIR_MASK == usb.DIR_IN
+	switch {
+	case s.BRequest == usb.REQUEST_GET_DESCRIPTOR && in && recipient == usb.RECIPIENT_DEVICE:
+		d.lock.Lock()
+		defer d.lock.Unlock()
+		if desc, found := d.getDescriptor(usb.DescriptorType(s.WValue>>8), byte(s.WValue)); found {
+			return desc, nil
+		}
+		return nil, usb.UsbErrorPipe
+	case s.BRequest == usb.REQUEST_GET_CONFIGURATION && in:
+		return []byte{byte(d.Configuration())}, nil
+	case s.BRequest == usb.REQUEST_SET_CONFIGURATION && !in:
+		return nil, h.SetConfiguration(int(s.WValue))
+	case s.BRequest == usb.REQUEST_GET_INTERFACE && in:
+		return []byte{d.AltSetting(byte(s.WIndex))}, nil
+	case s.BRequest == usb.REQUEST_SET_INTERFACE && !in:
+		d.lock.Lock()
+		defer d.lock.Unlock()
+		if _, found := d.findAlt(byte(s.WIndex), byte(s.WValue)); !found {
+			return nil, usb.UsbErrorPipe
+		}
+		d.alts[byte(s.WIndex)] = byte(s.WValue)
+		return nil, nil
+	case s.BRequest == usb.REQUEST_GET_STATUS && in:
+		if recipient == usb.RECIPIENT_ENDPOINT && d.Halted(byte(s.WIndex)) {
+			return []byte{1, 0}, nil
+		}
+		return []byte{0, 0}, nil
+	case s.BRequest == usb.REQUEST_CLEAR_FEATURE && recipient == usb.RECIPIENT_ENDPOINT &&
+		s.WValue == featureEndpointHalt:
+		return nil, h.ClearHalt(byte(s.WIndex))
+	case s.BRequest == usb.REQUEST_SET_FEATURE && recipient == usb.RECIPIENT_ENDPOINT &&
+		s.WValue == featureEndpointHalt:
+		d.Halt(byte(s.WIndex))
+		return nil, nil
+	}
+	return nil, usb.UsbErrorPipe
+}
+
+// Reports whether a standard request is one that standardRequest
+// answers, rather than passing on to the Control handler
+func answersItself(s usb.SetupPacket) bool {
+	recipient := s.BmRequestType & usb.RECIPIENT_MASK
+	in := s.BmRequestType&usb.DIR_MASK == usb.DIR_IN
+	switch s.BRequest {
+	case usb.REQUEST_GET_DESCRIPTOR:
+		return in && recipient == usb.RECIPIENT_DEVICE
+	case usb.REQUEST_GET_CONFIGURATION, usb.REQUEST_GET_INTERFACE, usb.REQUEST_GET_STATUS:
+		return in
+	case usb.REQUEST_SET_CONFIGURATION, usb.REQUEST_SET_INTERFACE:
+		return !in
+	case usb.REQUEST_CLEAR_FEATURE, usb.REQUEST_SET_FEATURE:
+		return recipient == usb.RECIPIENT_ENDPOINT && s.WValue == featureEndpointHalt
+	}
+	return false
+}
+
+// Work out the reply to a request
+func (d *Device) handle(h *handle, req *Request) ([]byte, *usb.UsbError) {
+	d.lock.Lock()
+	halted := d.halted[req.Endpoint]
+	if req.Endpoint == 0 {
+		// A protocol stall only lasts for one request
+		delete(d.halted, 0)
+	}
+	d.lock.Unlock()
+	if halted {
+		return nil, usb.UsbErrorPipe
+	}
+
+	if req.Endpoint == 0 {
+		if req.Setup.BmRequestType&usb.REQUEST_TYPE_MASK == usb.REQUEST_TYPE_STANDARD && answersItself(req.Setup) {
+			return d.standardRequest(h, req)
+		}
+		if d.Control == nil {
+			return nil, usb.UsbErrorPipe
+		}
+		return d.Control(req)
+	}
+
+	handler, ok := d.Endpoints[req.Endpoint]
+	if !ok {
+		return nil, usb.UsbErrorPipe
+	}
+	resp, err := handler(req)
+	if err == usb.UsbErrorPipe {
+		d.Halt(req.Endpoint)
+	}
+	return resp, err
+}
@@ -0,0 +1,114 @@
+package usbtest
+
+import (
+	"bytes"
+	"sync"
+
+	"gopkg.thequux.com/usb"
+)
+
+// The IDs NewEchoDevice answers to
+const (
+	ECHO_VENDOR  = 0x2047
+	ECHO_PRODUCT = 0x0200
+)
+
+// A high-speed device, "Echo", with a vendor request, 0x01 IN, that
+// reports version 1.4, and a pair of bulk endpoints, 0x01 OUT and 0x81
+// IN, that echo what is written back in upper case. Tests that need
+// more can change its handlers before using it.
+func NewEchoDevice() *Device {
+	var (
+		lock    sync.Mutex
+		written []byte
+	)
+	return &Device{
+		Speed:      usb.SPEED_HIGH,
+		Descriptor: usb.DeviceDescriptor{BcdUSB: 0x0200, BMaxPacketSize0: 64, IdVendor: ECHO_VENDOR, IdProduct: ECHO_PRODUCT, IProduct: 1},
+		Configs: []usb.ConfigDescriptor{{
+			BConfigurationValue: 1,
+			BmAttributes:        0x80,
+			MaxPower:            50,
+			Interfaces: [][]usb.InterfaceDescriptor{{{
+				BInterfaceClass: usb.CLASS_VENDOR,
+				Endpoints: []usb.EndpointDescriptor{
+					{BEndpointAddress: 0x01, BmAttributes: usb.TRANSFER_TYPE_BULK, WMaxPacketSize: 512},
+					{BEndpointAddress: 0x81, BmAttributes: usb.TRANSFER_TYPE_BULK, WMaxPacketSize: 512},
+				},
+			}}},
+		}},
+		Strings: map[byte]string{1: "Echo"},
+		Control: func(req *Request) ([]byte, *usb.UsbError) {
+			if req.Setup.BmRequestType == usb.DIR_IN|usb.REQUEST_TYPE_VENDOR && req.Setup.BRequest == 0x01 {
+				return []byte{1, 4}, nil
+			}
+			return nil, usb.UsbErrorPipe
+		},
+		Endpoints: map[byte]Handler{
+			0x01: func(req *Request) ([]byte, *usb.UsbError) {
+				lock.Lock()
+				written = bytes.ToUpper(req.Data)
+				lock.Unlock()
+				return nil, nil
+			},
+			0x81: func(req *Request) ([]byte, *usb.UsbError) {
+				lock.Lock()
+				defer lock.Unlock()
+				return written, nil
+			},
+		},
+	}
+}
+
+// An echo device as a driver sees it, with interface 0 claimed and its
+// bulk endpoints open
+type EchoHandle struct {
+	*usb.DeviceHandle
+	Out, In *usb.EndpointHandle
+}
+
+// Open the echo device on ctx, or anything else at its IDs with a bulk
+// OUT and a bulk IN endpoint on interface 0, such as a recording of it
+func OpenEcho(ctx *usb.Context) (*EchoHandle, *usb.UsbError) {
+	h, err := ctx.Open(ECHO_VENDOR, ECHO_PRODUCT)
+	if err != nil {
+		return nil, err
+	}
+	e := &EchoHandle{DeviceHandle: h}
+	if err := e.open(); err != nil {
+		h.Close()
+		return nil, err
+	}
+	return e, nil
+}
+
+func (e *EchoHandle) open() *usb.UsbError {
+	cfg, err := e.GetDevice().GetActiveConfigDescriptor()
+	if err != nil {
+		return err
+	}
+	if len(cfg.Interfaces) == 0 {
+		return usb.UsbErrorNotFound
+	}
+	if err := e.GetInterface(0).Claim(); err != nil {
+		return err
+	}
+	for _, ep := range cfg.Interfaces[0][0].Endpoints {
+		if ep.BmAttributes&usb.TRANSFER_TYPE_MASK != usb.TRANSFER_TYPE_BULK {
+			continue
+		}
+		handle, err := e.OpenEndpoint(ep)
+		if err != nil {
+			return err
+		}
+		if ep.BEndpointAddress&usb.DIR_MASK == usb.DIR_IN {
+			e.In = handle
+		} else {
+			e.Out = handle
+		}
+	}
+	if e.Out == nil || e.In == nil {
+		return usb.UsbErrorNotFound
+	}
+	return nil
+}
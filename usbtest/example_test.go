@@ -0,0 +1,45 @@
+package usbtest_test
+
+import (
+	"fmt"
+
+	"gopkg.thequux.com/usb"
+	"gopkg.thequux.com/usb/usbtest"
+)
+
+// The echo device, as a driver would use it
+func Example() {
+	ctx := usbtest.NewContext(usbtest.NewEchoDevice())
+	h, err := ctx.Open(usbtest.ECHO_VENDOR, usbtest.ECHO_PRODUCT)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	defer h.Close()
+	product, _ := h.GetProduct()
+	fmt.Println("product:", product)
+
+	version := make([]byte, 2)
+	n, err := h.ControlTransfer(usb.DIR_IN|usb.REQUEST_TYPE_VENDOR, 0x01, 0, 0, version, 0)
+	fmt.Println("version:", version[:n], err == nil)
+	// A request the device doesn't know stalls
+	_, err = h.ControlTransfer(usb.DIR_IN|usb.REQUEST_TYPE_VENDOR, 0x02, 0, 0, version, 0)
+	fmt.Println("unknown request:", err == usb.UsbErrorPipe)
+
+	if err := h.GetInterface(0).Claim(); err != nil {
+		fmt.Println(err)
+		return
+	}
+	cfg, _ := h.GetDevice().GetActiveConfigDescriptor()
+	out, _ := h.OpenEndpoint(cfg.Interfaces[0][0].Endpoints[0])
+	in, _ := h.OpenEndpoint(cfg.Interfaces[0][0].Endpoints[1])
+	out.Write([]byte("hello"))
+	buf := make([]byte, 512)
+	n, _ = in.Read(buf)
+	fmt.Printf("echo: %s\n", buf[:n])
+	// Output:
+	// product: Echo
+	// version: [1 4] true
+	// unknown request: true
+	// echo: HELLO
+}
@@ -0,0 +1,169 @@
+// WebUSB: the platform capability that marks a device as usable from
+// a browser, and the URL descriptors it points at.
+package webusb
+
+import (
+	"encoding/binary"
+	"errors"
+	"strings"
+	"time"
+
+	"gopkg.thequux.com/usb"
+)
+
+var (
+	ErrMalformed     = errors.New("webusb: malformed descriptor")
+	ErrNotWebUSB     = errors.New("webusb: device has no WebUSB platform capability")
+	ErrNoLandingPage = errors.New("webusb: device has no landing page")
+	ErrURLTooLong    = errors.New("webusb: URL does not fit in a descriptor")
+)
+
+// {3408B638-09A9-47A0-8BFD-A0768815B665}, in wire order
+var PlatformUUID = [16]byte{
+	0x38, 0xB6, 0x08, 0x34, 0xA9, 0x09, 0xA0, 0x47,
+	0x8B, 0xFD, 0xA0, 0x76, 0x88, 0x15, 0xB6, 0x65,
+}
+
+const (
+	// wIndex of the GET_URL vendor request
+	WEBUSB_REQUEST_GET_URL = 0x02
+
+	// bDescriptorType of a URL descriptor
+	WEBUSB_URL = 0x03
+)
+
+// URL prefixes that bScheme stands for
+const (
+	SCHEME_HTTP  = 0
+	SCHEME_HTTPS = 1
+	SCHEME_NONE  = 255 // the descriptor holds the whole URL
+)
+
+const requestTimeout = time.Second
+
+// The contents of the WebUSB platform capability
+type Capability struct {
+	BcdVersion   uint16
+	VendorCode   byte
+	ILandingPage byte // 0 if there is none
+}
+
+func ParseCapability(data []byte) (Capability, error) {
+	if len(data) < 4 {
+		return Capability{}, ErrMalformed
+	}
+	return Capability{
+		BcdVersion:   binary.LittleEndian.Uint16(data),
+		VendorCode:   data[2],
+		ILandingPage: data[3],
+	}, nil
+}
+
+// Look for the WebUSB platform capability in a BOS
+func FindCapability(bos *usb.BOSDescriptor) (Capability, bool) {
+	data, ok := bos.FindPlatformCapability(PlatformUUID)
+	if !ok {
+		return Capability{}, false
+	}
+	c, err := ParseCapability(data)
+	return c, err == nil
+}
+
+// Build the platform capability for inclusion in a BOS. A zero
+// BcdVersion is written as 1.00.
+func (c Capability) DeviceCapability() usb.DeviceCapability {
+	version := c.BcdVersion
+	if version == 0 {
+		version = 0x0100
+	}
+	data := []byte{byte(version), byte(version >> 8), c.VendorCode, c.ILandingPage}
+	return usb.NewPlatformCapability(PlatformUUID, data)
+}
+
+// Decode a URL descriptor into a complete URL
+func ParseURLDescriptor(buf []byte) (string, error) {
+	if len(buf) < 3 || int(buf[0]) < 3 || int(buf[0]) > len(buf) || buf[1] != WEBUSB_URL {
+		return "", ErrMalformed
+	}
+	url := string(buf[3:buf[0]])
+	switch buf[2] {
+	case SCHEME_HTTP:
+		return "http://" + url, nil
+	case SCHEME_HTTPS:
+		return "https://" + url, nil
+	case SCHEME_NONE:
+		return url, nil
+	}
+	return "", ErrMalformed
+}
+
+// Encode a URL descriptor, using a scheme code when the URL starts
+// with http:// or https://.
+func URLDescriptor(url string) ([]byte, error) {
+	scheme := byte(SCHEME_NONE)
+	if strings.HasPrefix(url, "https://") {
+		scheme, url = SCHEME_HTTPS, url[len("https://"):]
+	} else if strings.HasPrefix(url, "http://") {
+		scheme, url = SCHEME_HTTP, url[len("http://"):]
+	}
+	if 3+len(url) > 0xff {
+		return nil, ErrURLTooLong
+	}
+	buf := []byte{byte(3 + len(url)), WEBUSB_URL, scheme}
+	return append(buf, url...), nil
+}
+
+// Fetch a URL descriptor with the GET_URL request
+func GetURL(h *usb.DeviceHandle, vendor_code, index byte) (string, error) {
+	buf := make([]byte, 0xff)
+	n, err := h.ControlTransfer(usb.DIR_IN|usb.REQUEST_TYPE_VENDOR|usb.RECIPIENT_DEVICE,
+		vendor_code, uint16(index), WEBUSB_REQUEST_GET_URL, buf, requestTimeout)
+	if err != nil {
+		return "", err
+	}
+	return ParseURLDescriptor(buf[:n])
+}
+
+// Read the BOS, find the WebUSB capability and fetch the landing page
+func GetLandingPage(h *usb.DeviceHandle) (string, error) {
+	bos, err := h.GetBOSDescriptor()
+	if err != nil {
+		return "", err
+	}
+	c, ok := FindCapability(&bos)
+	if !ok {
+		return "", ErrNotWebUSB
+	}
+	if c.ILandingPage == 0 {
+		return "", ErrNoLandingPage
+	}
+	return GetURL(h, c.VendorCode, c.ILandingPage)
+}
+
+// The WebUSB side of an emulated device
+type Descriptors struct {
+	Capability
+	URLs map[byte]string // by index; ILandingPage should be one of them
+}
+
+// Answer a GET_URL request, truncated to wLength. ok is false for
+// requests that aren't ours, and for unknown URL indices, which the
+// caller should stall.
+func (d *Descriptors) HandleControl(bmRequestType, bRequest byte, wValue, wIndex, wLength uint16) (resp []byte, ok bool) {
+	if bmRequestType != usb.DIR_IN|usb.REQUEST_TYPE_VENDOR|usb.RECIPIENT_DEVICE ||
+		bRequest != d.VendorCode || wIndex != WEBUSB_REQUEST_GET_URL {
+		return nil, false
+	}
+	url, found := d.URLs[byte(wValue)]
+	if !found {
+		return nil, false
+	}
+	resp, err := URLDescriptor(url)
+	if err != nil {
+		return nil, false
+	}
+	if len(resp) > int(wLength) {
+		resp = resp[:wLength]
+	}
+	return resp, true
+}